@@ -0,0 +1,44 @@
+package fsm
+
+import (
+	"github.com/DNSSEC-Provisioning/music/music"
+	"github.com/miekg/dns"
+)
+
+// signerKSKs returns the KSKs (and CSKs) of all signers of the zone, by keytag.
+func signerKSKs(z *music.Zone) (map[uint16]*dns.DNSKEY, error) {
+	ksks := map[uint16]*dns.DNSKEY{}
+	for _, signer := range z.SGroup.SignerMap {
+		updater := music.GetUpdater(signer.Method)
+		err, rrs := updater.FetchRRset(signer, z.Name, z.Name, dns.TypeDNSKEY)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range rrs {
+			dnskey, ok := a.(*dns.DNSKEY)
+			if !ok {
+				continue
+			}
+			if f := dnskey.Flags & 0x101; f == 257 {
+				ksks[dnskey.KeyTag()] = dnskey
+			}
+		}
+	}
+	return ksks, nil
+}
+
+// signersPublishedDS returns the DS records that the CDS (or CDNSKEY, see
+// music.CdsPolicy) records of all signers of the zone ask the parent for.
+func signersPublishedDS(z *music.Zone, policy music.CdsPolicy) (map[string]*dns.DS, error) {
+	dses := map[string]*dns.DS{}
+	for _, s := range z.SGroup.SignerMap {
+		sdses, err := policy.PublishedDS(z, s)
+		if err != nil {
+			return nil, err
+		}
+		for key, ds := range sdses {
+			dses[key] = ds
+		}
+	}
+	return dses, nil
+}
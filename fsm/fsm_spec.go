@@ -19,6 +19,19 @@ const (
 
 	FsmStateSignersUnknown = "signers-unknown" // Only used in the VERIFY-ZONE-SYNC proc
 
+	// Only used in the MOVE-ZONE proc
+	FsmStateGroupSwitched     = "group-switched"
+	FsmStateOldNsesRemoved    = "old-nses-removed"
+	FsmStateMoveCsyncAdded    = "move-csync-added"
+	FsmStateParentNsMoved     = "parent-ns-moved"
+	FsmStateOldDnskeysRemoved = "old-dnskeys-removed"
+	FsmStateMoveCDSAdded      = "move-cds-added"
+	FsmStateParentDsMoved     = "parent-ds-moved"
+
+	// Only used in the SWAP-SIGNER proc
+	FsmStateSwapCdsAdded       = "swap-cds-added"
+	FsmStateSwapParentDsSynced = "swap-parent-ds-synced"
+	FsmStateNsesSwapped        = "nses-swapped"
 )
 
 var FsmGenericStop = music.FsmTransitionStopFactory(music.FsmStateStop)
@@ -151,6 +164,124 @@ as that would cause the attached zones to have to go unsigned.`,
 		},
 	},
 
+	// PROCESS: SWAP-SIGNER: Replaces one signer in a group with another.
+	// defined in fsm/join*.go, fsm/swap_signer.go and fsm/leave*.go
+
+	music.SignerSwapGroupProcess: music.FSM{
+		Name:         music.SignerSwapGroupProcess,
+		Type:         "single-run",
+		InitialState: FsmStateSignerUnsynced,
+		Desc: `
+SWAP-SIGNER is the process that all zones attached to a signer group
+must execute when one signer in the group is replaced by another. It
+does the work of ADD-SIGNER and REMOVE-SIGNER in a single pass: the
+DNSKEYs of all signers, old and new, are synced and CDS is published
+so that the parent adds the DS of the new signer. Once that DS has
+propagated the NS RRset is changed to that of the new set of signers
+and CSYNC is published so that the parent replaces the NS records.
+Finally the DNSKEYs and DS of the leaving signer are removed. This
+saves one CSYNC cycle, but the parent still does two DS updates.`,
+		States: map[string]music.FSMState{
+			FsmStateSignerUnsynced: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateDnskeysSynced: FsmJoinSyncDnskeys},
+			},
+			FsmStateDnskeysSynced: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateSwapCdsAdded: FsmJoinAddCDS},
+			},
+			FsmStateSwapCdsAdded: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateSwapParentDsSynced: FsmJoinParentDsSynced},
+			},
+			FsmStateSwapParentDsSynced: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateNsesSwapped: FsmSwapSyncNses},
+			},
+			FsmStateNsesSwapped: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateCsyncAdded: FsmJoinAddCsync},
+			},
+			FsmStateCsyncAdded: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateParentNsSynced: FsmSwapParentNsSynced},
+			},
+			FsmStateParentNsSynced: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateOldDnskeysRemoved: FsmLeaveSyncDnskeys},
+			},
+			FsmStateOldDnskeysRemoved: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateCDSAdded: FsmLeaveAddCDS},
+			},
+			FsmStateCDSAdded: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateParentDsSynced: FsmLeaveParentDsSynced},
+			},
+			FsmStateParentDsSynced: music.FSMState{
+				Next: map[string]music.FSMTransition{music.FsmStateStop: music.FsmTransitionStopFactory(FsmStateParentDsSynced)},
+			},
+			music.FsmStateStop: music.FSMState{
+				Next: map[string]music.FSMTransition{music.FsmStateStop: FsmGenericStop},
+			},
+		},
+	},
+
+	// PROCESS: MOVE-ZONE: Moves a single zone from one signer group to another.
+	// defined in fsm/join*.go and fsm/move_zone.go
+
+	music.ZoneMoveProcess: music.FSM{
+		Name:         music.ZoneMoveProcess,
+		Type:         "single-run",
+		InitialState: FsmStateSignerUnsynced,
+		Desc: `
+MOVE-ZONE is the process that a zone executes when it is moved from
+one signer group to another. First the signers of both groups are
+synced as in ADD-SIGNER and the DS and NS RRsets in the parent are
+updated to include the new signers. Then the zone is switched to the
+new group and the NSes and DNSKEYs of the old signers are removed,
+after which the DS and NS RRsets in the parent are updated to only
+contain the new signers.`,
+		States: map[string]music.FSMState{
+			FsmStateSignerUnsynced: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateDnskeysSynced: FsmJoinSyncDnskeys},
+			},
+			FsmStateDnskeysSynced: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateCDSAdded: FsmJoinAddCDS},
+			},
+			FsmStateCDSAdded: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateParentDsSynced: FsmJoinParentDsSynced},
+			},
+			FsmStateParentDsSynced: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateNsesSynced: FsmJoinNsSynced},
+			},
+			FsmStateNsesSynced: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateCsyncAdded: FsmJoinAddCsync},
+			},
+			FsmStateCsyncAdded: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateParentNsSynced: FsmJoinParentNsSynced},
+			},
+			FsmStateParentNsSynced: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateGroupSwitched: FsmMoveSwitchGroup},
+			},
+			FsmStateGroupSwitched: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateOldNsesRemoved: FsmMoveRemoveNses},
+			},
+			FsmStateOldNsesRemoved: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateMoveCsyncAdded: FsmMoveAddCsync},
+			},
+			FsmStateMoveCsyncAdded: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateParentNsMoved: FsmMoveParentNsSynced},
+			},
+			FsmStateParentNsMoved: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateOldDnskeysRemoved: FsmMoveRemoveDnskeys},
+			},
+			FsmStateOldDnskeysRemoved: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateMoveCDSAdded: FsmJoinAddCDS},
+			},
+			FsmStateMoveCDSAdded: music.FSMState{
+				Next: map[string]music.FSMTransition{FsmStateParentDsMoved: FsmMoveParentDsSynced},
+			},
+			FsmStateParentDsMoved: music.FSMState{
+				Next: map[string]music.FSMTransition{music.FsmStateStop: music.FsmTransitionStopFactory(FsmStateParentDsMoved)},
+			},
+			music.FsmStateStop: music.FSMState{
+				Next: map[string]music.FSMTransition{music.FsmStateStop: FsmGenericStop},
+			},
+		},
+	},
+
 	// PROCESS: ZSK-ROLLOVER: This is a real process
 	"zsk-rollover": music.FSM{
 		Name:         "zsk-rollover",
@@ -17,7 +17,7 @@ var FsmJoinAddCDS = music.FSMTransition{
 
 	PreCondition:  JoinAddCdsPreCondition,
 	Action:        JoinAddCdsAction,
-	PostCondition: VerifyCdsPublished,
+	PostCondition: notifyParentAfter(VerifyCdsPublished, dns.TypeCDS),
 }
 
 // JoinAddCdsPreCondition collects DNSKEYS from all signers and verifies that the RRsets match.
@@ -69,12 +69,15 @@ func JoinAddCdsAction(zone *music.Zone) bool {
 		}
 	}
 
-	var cdses, cdnskeys []dns.RR
+	policy, err := zone.CdsPolicyOrStop()
+	if err != nil {
+		return false // stop-reason set in CdsPolicyOrStop()
+	}
+	var ksks []*dns.DNSKEY
 	for _, dnskey := range dnskeyMap {
-		cdses = append(cdses, dnskey.ToDS(dns.SHA256).ToCDS())
-		cdses = append(cdses, dnskey.ToDS(dns.SHA384).ToCDS())
-		cdnskeys = append(cdnskeys, dnskey.ToCDNSKEY())
+		ksks = append(ksks, dnskey)
 	}
+	cdses, cdnskeys := policy.Records(ksks)
 
 	// Publish CDS/CDNSKEY RRsets
 	for _, signer := range zone.SGroup.SignerMap {
@@ -95,7 +98,8 @@ func JoinAddCdsAction(zone *music.Zone) bool {
 	return true
 }
 
-// VerifyCdsPublished verifies that the CDS/CDNSKEY RRs are published and in sync across all signers in the signergroup.
+// VerifyCdsPublished verifies that the CDS/CDNSKEY RRs given by the CDS policy of the zone
+// are published and in sync across all signers in the signergroup.
 func VerifyCdsPublished(zone *music.Zone) bool {
 	log.Printf("Verifying Publication of CDS/CDNSKEY record sets for %s", zone.Name)
 
@@ -104,41 +108,37 @@ func VerifyCdsPublished(zone *music.Zone) bool {
 		return true
 	}
 
-	cdsFromKSK := map[uint16]*dns.CDS{}     // cdsFromKSK: map of CDS RRs created from all KSKs from all signers
-	cdsFromSigners := map[uint16]*dns.CDS{} // cdsFromSigners: map of all CDS RRs found by querying all signers
-
-	cdnskeyFromKSK := map[uint16]*dns.CDNSKEY{}
-	cdnskeyFromSigners := map[uint16]*dns.CDNSKEY{}
-
-	// Fetch DNSKEYS
-	for _, signer := range zone.SGroup.SignerMap {
-		updater := music.GetUpdater(signer.Method)
-		log.Printf("VerifyCdsPublished: %s Using FetchRRset interface\n", zone.Name)
-		err, rrSet := updater.FetchRRset(signer, zone.Name, zone.Name, dns.TypeDNSKEY)
-		if err != nil {
-			log.Printf("Error from updater.FetchRRset: %v\n", err)
-		}
-
-		// Create CDS/CDNSKEY RRsets
-		for _, a := range rrSet {
-			dnskey, ok := a.(*dns.DNSKEY)
-			if !ok {
-				continue
-			}
-
-			if f := dnskey.Flags & 0x101; f == 257 {
-				cdsFromKSK[dnskey.KeyTag()] = dnskey.ToDS(dns.SHA256).ToCDS()
-				cdnskeyFromKSK[dnskey.KeyTag()] = dnskey.ToCDNSKEY()
-			}
-		}
+	ksks, err := signerKSKs(zone)
+	if err != nil {
+		zone.SetStopReason(fmt.Sprintf("Unable to fetch DNSKEY RRset: %v", err))
+		return false
 	}
 	var keyids []uint16
-	for k, _ := range cdsFromKSK {
+	var ksklist []*dns.DNSKEY
+	for k, dnskey := range ksks {
 		keyids = append(keyids, k)
+		ksklist = append(ksklist, dnskey)
 	}
 	log.Printf("Verify Publication of CDS: there are KSKs at the signers with the following keytags: %v\n", keyids)
 
-	// Compare DNSKEYs to published CDS/CDNSKEY RRsets.
+	// cdsFromKSK and cdnskeyFromKSK: the CDS and CDNSKEY RRs that the policy gives for all KSKs from all signers
+	policy, err := zone.CdsPolicyOrStop()
+	if err != nil {
+		return false // stop-reason set in CdsPolicyOrStop()
+	}
+	cdses, cdnskeys := policy.Records(ksklist)
+	cdsFromKSK := map[string]*dns.CDS{}
+	for _, rr := range cdses {
+		cds := rr.(*dns.CDS)
+		cdsFromKSK[music.DSKey(&cds.DS)] = cds
+	}
+	cdnskeyFromKSK := map[uint16]*dns.CDNSKEY{}
+	for _, rr := range cdnskeys {
+		cdnskey := rr.(*dns.CDNSKEY)
+		cdnskeyFromKSK[cdnskey.KeyTag()] = cdnskey
+	}
+
+	// Compare them to the published CDS/CDNSKEY RRsets.
 	for _, signer := range zone.SGroup.SignerMap {
 		updater := music.GetUpdater(signer.Method)
 		err, cdsRRset := updater.FetchRRset(signer, zone.Name, zone.Name, dns.TypeCDS)
@@ -154,41 +154,44 @@ func VerifyCdsPublished(zone *music.Zone) bool {
 			return false
 		}
 
+		cdsFromSigner := map[string]bool{}
 		for _, rr := range cdsRRset {
 			cdsRR, ok := rr.(*dns.CDS)
 			if !ok {
 				continue
 			}
-			cdsFromSigners[cdsRR.KeyTag] = cdsRR
-			if _, exist := cdsFromKSK[cdsRR.KeyTag]; !exist {
-				err, _ = zone.SetStopReason(fmt.Sprintf("CDS RR with keyid=%d published by signer %s should not exist", cdsRR.KeyTag, signer.Name))
+			key := music.DSKey(&cdsRR.DS)
+			cdsFromSigner[key] = true
+			if _, exist := cdsFromKSK[key]; !exist {
+				err, _ = zone.SetStopReason(fmt.Sprintf("CDS RR %s published by signer %s should not exist",
+					key, signer.Name))
 				return false
 			}
 		}
-		for _, cdsRR := range cdsFromKSK {
-			if _, exist := cdsFromSigners[cdsRR.KeyTag]; !exist {
-				err, _ = zone.SetStopReason(fmt.Sprintf("CDS RR with keyid=%d should be published by %s, but is not",
-					cdsRR.KeyTag, signer.Name))
+		for key := range cdsFromKSK {
+			if !cdsFromSigner[key] {
+				err, _ = zone.SetStopReason(fmt.Sprintf("CDS RR %s should be published by %s, but is not",
+					key, signer.Name))
 				return false
 			}
 		}
 
+		cdnskeyFromSigner := map[uint16]bool{}
 		for _, rr := range cdnskeyRRset {
 			cdnskeyRR, ok := rr.(*dns.CDNSKEY)
 			if !ok {
 				continue
 			}
 			keyTag := cdnskeyRR.KeyTag()
-			cdnskeyFromSigners[keyTag] = cdnskeyRR
+			cdnskeyFromSigner[keyTag] = true
 			if _, exist := cdnskeyFromKSK[keyTag]; !exist {
 				err, _ = zone.SetStopReason(fmt.Sprintf("CDNSKEY RR with keyid=%d published by %s should not exist",
 					keyTag, signer.Name))
 				return false
 			}
 		}
-		for _, cdnskeyRR := range cdnskeyFromKSK {
-			keyTag := cdnskeyRR.KeyTag()
-			if _, exist := cdnskeyFromSigners[keyTag]; !exist {
+		for keyTag := range cdnskeyFromKSK {
+			if !cdnskeyFromSigner[keyTag] {
 				err, _ = zone.SetStopReason(fmt.Sprintf("CDNSKEY RR with keyid=%d should be published by %s, but is not",
 					keyTag, signer.Name))
 				return false
@@ -17,7 +17,7 @@ var FsmJoinAddCsync = music.FSMTransition{
 
 	PreCondition:  JoinAddCsyncPreCondition,
 	Action:        JoinAddCsyncAction,
-	PostCondition: VerifyCsyncPublished,
+	PostCondition: notifyParentAfter(VerifyCsyncPublished, dns.TypeCSYNC),
 }
 
 // JoinAddCsyncPreCondition confirms that the NS RRs is in sync across all the signers in the signergroup.
@@ -69,21 +69,12 @@ func JoinWaitDsPreCondition(z *music.Zone) bool {
 		}
 	}
 
-	parentAddress, err := z.GetParentAddressOrStop()
+	parentdses, err := z.ParentRRsetOrStop(dns.TypeDS)
 	if err != nil {
-		return false // stop-reason defined in GetParenAddressOrStop()
+		return false // stop-reason set in ParentRRsetOrStop()
 	}
 
-	m := new(dns.Msg)
-	m.SetQuestion(z.Name, dns.TypeDS)
-	c := new(dns.Client)
-	r, _, err := c.Exchange(m, parentAddress)
-	if err != nil {
-		z.SetStopReason(fmt.Sprintf("Unable to fetch DSes from parent: %s", err))
-		return false
-	}
-
-	for _, a := range r.Answer {
+	for _, a := range parentdses {
 		ds, ok := a.(*dns.DS)
 		if !ok {
 			continue
@@ -22,8 +22,6 @@ var FsmJoinParentDsSynced = music.FSMTransition{
 
 // JoinParentDsSyncedPreCondition compares the DS RRs in the parent zone to the signers CDS RRs.
 func JoinParentDsSyncedPreCondition(z *music.Zone) bool {
-	cdses := make(map[string][]*dns.CDS)
-
 	log.Printf("%s: Verifying that DSes in parent are up to date compared to signers CDSes", z.Name)
 
 	if z.ZoneType == "debug" {
@@ -31,48 +29,24 @@ func JoinParentDsSyncedPreCondition(z *music.Zone) bool {
 		return true
 	}
 
-	for _, s := range z.SGroup.SignerMap {
-		m := new(dns.Msg)
-		m.SetQuestion(z.Name, dns.TypeCDS)
-
-		c := new(dns.Client)
-		r, _, err := c.Exchange(m, s.Address+":"+s.Port) // TODO: add DnsAddress or solve this in a better way
-
-		if err != nil {
-			z.SetStopReason(fmt.Sprintf("Unable to fetch CDSes from %s: %s",
-				s.Name, err))
-			return false
-		}
-
-		cdses[s.Name] = []*dns.CDS{}
-		for _, a := range r.Answer {
-			cds, ok := a.(*dns.CDS)
-			if !ok {
-				continue
-			}
-
-			log.Printf("%s: Signer %s CDS found: %d %d %d %s", z.Name,
-				s.Name, cds.KeyTag, cds.Algorithm, cds.DigestType, cds.Digest)
-			cdses[s.Name] = append(cdses[s.Name], cds)
-		}
+	// the DS records asked for by the CDS (or CDNSKEY) records of the signers
+	policy, err := z.CdsPolicyOrStop()
+	if err != nil {
+		return false // stop-reason set in CdsPolicyOrStop()
 	}
-
-	parentAddress, err := z.GetParentAddressOrStop()
+	cdsmap, err := signersPublishedDS(z, policy)
 	if err != nil {
-		return false // stop-reason set in GetParentAddressOrStop()
+		z.SetStopReason(err.Error())
+		return false
 	}
 
-	m := new(dns.Msg)
-	m.SetQuestion(z.Name, dns.TypeDS)
-	c := new(dns.Client)
-	r, _, err := c.Exchange(m, parentAddress)
+	parentdses, err := z.ParentRRsetOrStop(dns.TypeDS)
 	if err != nil {
-		z.SetStopReason(fmt.Sprintf("Unable to fetch DSes from parent: %s", err))
-		return false
+		return false // stop-reason set in ParentRRsetOrStop()
 	}
 	dses := []*dns.DS{}
 	removedses := make(map[string]*dns.DS)
-	for _, a := range r.Answer {
+	for _, a := range parentdses {
 		ds, ok := a.(*dns.DS)
 		if !ok {
 			continue
@@ -85,16 +59,8 @@ func JoinParentDsSyncedPreCondition(z *music.Zone) bool {
 
 	parent_up_to_date := true
 
-	cdsmap := make(map[string]*dns.CDS)
-	for _, keys := range cdses {
-		for _, key := range keys {
-			cdsmap[fmt.Sprintf("%d %d %d %s", key.KeyTag, key.Algorithm,
-				key.DigestType, key.Digest)] = key
-			delete(removedses, fmt.Sprintf("%d %d %d %s", key.KeyTag, key.Algorithm, key.DigestType, key.Digest))
-		}
-	}
 	for _, ds := range dses {
-		delete(cdsmap, fmt.Sprintf("%d %d %d %s", ds.KeyTag, ds.Algorithm, ds.DigestType, ds.Digest))
+		delete(cdsmap, music.DSKey(ds))
 	}
 	for _, cds := range cdsmap {
 		// log.Printf("%s: Missing DS for CDS: %d %d %d %s", z.Name, cds.KeyTag, cds.Algorithm, cds.DigestType, cds.Digest)
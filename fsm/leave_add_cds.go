@@ -17,7 +17,7 @@ var FsmLeaveAddCDS = music.FSMTransition{
 
 	PreCondition:  LeaveAddCDSPreCondition,
 	Action:        LeaveAddCDSAction,
-	PostCondition: LeaveCDSVerify,
+	PostCondition: notifyParentAfter(LeaveCDSVerify, dns.TypeCDS),
 }
 
 // LeaveAddCDSPreCondition calculate the relevant DNSKEYS for the signergroup and verify that the signers are correct.
@@ -51,7 +51,7 @@ func LeaveAddCDSPreCondition(z *music.Zone) bool {
 	log.Printf("remove %v from SignerMap %v: for %v", leavingSignerName, sg.SignerMap, sg.Name)
 	delete(z.SGroup.SignerMap, leavingSignerName)
 	if _, member := z.SGroup.SignerMap[leavingSignerName]; member {
-		log.Fatalf("Signer %s is still a member of group %s", leavingSignerName, z.SGroup.SignerMap)
+		log.Fatalf("Signer %s is still a member of group %v", leavingSignerName, z.SGroup.SignerMap)
 	}
 
 	log.Printf("%s: Verifying that leaving signer %s DNSKEYs has been removed from all signers",
@@ -113,8 +113,7 @@ func LeaveAddCDSAction(z *music.Zone) bool {
 		return true
 	}
 
-	cdses := []dns.RR{}
-	cdnskeys := []dns.RR{}
+	ksks := map[uint16]*dns.DNSKEY{}
 
 	leavingSignerName := z.FSMSigner // Issue #34: Static leaving signer until metadata is in place
 	if leavingSignerName == "" {
@@ -127,7 +126,7 @@ func LeaveAddCDSAction(z *music.Zone) bool {
 	log.Printf("remove %v from SignerMap %v: for %v", leavingSignerName, z.SGroup.SignerMap, z.SGroup.Name)
 	delete(z.SGroup.SignerMap, leavingSignerName)
 	if _, member := z.SGroup.SignerMap[leavingSignerName]; member {
-		log.Fatalf("Signer %s is still a member of group %s", leavingSignerName, z.SGroup.SignerMap)
+		log.Fatalf("Signer %s is still a member of group %v", leavingSignerName, z.SGroup.SignerMap)
 	}
 
 	for _, s := range z.SGroup.SignerMap {
@@ -151,12 +150,21 @@ func LeaveAddCDSAction(z *music.Zone) bool {
 			}
 
 			if f := dnskey.Flags & 0x101; f == 257 {
-				cdses = append(cdses, dnskey.ToDS(dns.SHA256).ToCDS())
-				cdnskeys = append(cdnskeys, dnskey.ToCDNSKEY())
+				ksks[dnskey.KeyTag()] = dnskey
 			}
 		}
 	}
 
+	policy, err := z.CdsPolicyOrStop()
+	if err != nil {
+		return false // stop-reason set in CdsPolicyOrStop()
+	}
+	var ksklist []*dns.DNSKEY
+	for _, dnskey := range ksks {
+		ksklist = append(ksklist, dnskey)
+	}
+	cdses, cdnskeys := policy.Records(ksklist)
+
 	// Create CDS/CDNSKEY records sets
 	log.Printf("leave_add_cds: %s SignerMap: %v\n", z.Name, z.SGroup.SignerMap)
 	for _, signer := range z.SGroup.SignerMap {
@@ -173,19 +181,13 @@ func LeaveAddCDSAction(z *music.Zone) bool {
 	return true
 }
 
-// LeaveCDSVerify Verifies that the CDS/CDNSKEY RRs are published and in sync on the remaining signers in the signergroup.
+// LeaveCDSVerify Verifies that the CDS/CDNSKEY RRs given by the CDS policy of the zone are
+// published and in sync on the remaining signers in the signergroup.
 func LeaveCDSVerify(zone *music.Zone) bool {
 	if zone.ZoneType == "debug" {
 		log.Printf("LeaveCDSVerify: zone %s (DEBUG) is automatically ok", zone.Name)
 		return true
 	}
-	matches := true
-	rrTypes := []uint16{dns.TypeCDS, dns.TypeCDNSKEY}
-	for _, rrType := range rrTypes {
-		synced := music.SignerRRsetEqual(zone, rrType)
-		if !synced {
-			matches = false
-		}
-	}
-	return matches
+	delete(zone.SGroup.SignerMap, zone.FSMSigner) // the leaving signer does not publish CDS/CDNSKEY
+	return VerifyCdsPublished(zone)
 }
@@ -17,7 +17,7 @@ var FsmLeaveAddCsync = music.FSMTransition{
 
 	PreCondition:  LeaveAddCsyncPreCondition,
 	Action:        LeaveAddCsyncAction,
-	PostCondition: LeaveVerifyCsyncPublished,
+	PostCondition: notifyParentAfter(LeaveVerifyCsyncPublished, dns.TypeCSYNC),
 }
 
 // LeaveAddCsyncPreCondition confirms that the leaving signer NS RRs is not configured on the remaining signers in the signergroup.
@@ -52,7 +52,7 @@ func LeaveAddCsyncPreCondition(z *music.Zone) bool {
 	log.Printf("remove %v from SignerMap %v: for %v", leavingSignerName, sg.SignerMap, sg.Name)
 	delete(z.SGroup.SignerMap, leavingSignerName)
 	if _, member := z.SGroup.SignerMap[leavingSignerName]; member {
-		log.Fatalf("Signer %s is still a member of group %s", leavingSignerName, z.SGroup.SignerMap)
+		log.Fatalf("Signer %s is still a member of group %v", leavingSignerName, z.SGroup.SignerMap)
 	}
 
 	nses := make(map[string]bool)
@@ -157,7 +157,7 @@ func LeaveAddCsyncAction(z *music.Zone) bool {
 	log.Printf("remove %v from SignerMap %v: for %v", leavingSignerName, sg.SignerMap, sg.Name)
 	delete(z.SGroup.SignerMap, leavingSignerName)
 	if _, member := z.SGroup.SignerMap[leavingSignerName]; member {
-		log.Fatalf("Signer %s is still a member of group %s", leavingSignerName, z.SGroup.SignerMap)
+		log.Fatalf("Signer %s is still a member of group %v", leavingSignerName, z.SGroup.SignerMap)
 	}
 
 	ttl := 300
@@ -22,8 +22,6 @@ var FsmLeaveParentDsSynced = music.FSMTransition{
 
 // LeaveParentDsSyncedPreCondition verifies that the DS records on the parent match the CDS RRs on the remaining signers in the signergroup
 func LeaveParentDsSyncedPreCondition(z *music.Zone) bool {
-	cdsmap := make(map[string]*dns.CDS)
-
 	log.Printf("%s: Verifying that DSes in parent are up to date compared to signers CDSes", z.Name)
 
 	if z.ZoneType == "debug" {
@@ -42,51 +40,31 @@ func LeaveParentDsSyncedPreCondition(z *music.Zone) bool {
 	log.Printf("remove %v from SignerMap %v: for %v", leavingSignerName, z.SGroup.SignerMap, z.SGroup.Name)
 	delete(z.SGroup.SignerMap, leavingSignerName)
 	if _, member := z.SGroup.SignerMap[leavingSignerName]; member {
-		log.Fatalf("Signer %s is still a member of group %s", leavingSignerName, z.SGroup.SignerMap)
+		log.Fatalf("Signer %s is still a member of group %v", leavingSignerName, z.SGroup.SignerMap)
 	}
 
-	for _, s := range z.SGroup.SignerMap {
-		m := new(dns.Msg)
-		m.SetQuestion(z.Name, dns.TypeCDS)
-
-		c := new(dns.Client)
-		r, _, err := c.Exchange(m, s.Address+":"+s.Port)
-
-		if err != nil {
-			z.SetStopReason(fmt.Sprintf("Unable to fetch CDSes from %s: %s", s.Name, err))
-			return false
-		}
-
-		for _, a := range r.Answer {
-			cds, ok := a.(*dns.CDS)
-			if !ok {
-				continue
-			}
-
-			cdsmap[fmt.Sprintf("%d %d %d %s", cds.KeyTag, cds.Algorithm, cds.DigestType, cds.Digest)] = cds
-		}
+	// the DS records asked for by the CDS (or CDNSKEY) records of the remaining signers
+	policy, err := z.CdsPolicyOrStop()
+	if err != nil {
+		return false // stop-reason set in CdsPolicyOrStop()
 	}
-
-	parentAddress, err := z.GetParentAddressOrStop()
+	cdsmap, err := signersPublishedDS(z, policy)
 	if err != nil {
-		return false // stop-reason set in GetParentAddressOrStop()
+		z.SetStopReason(err.Error())
+		return false
 	}
 
-	m := new(dns.Msg)
-	m.SetQuestion(z.Name, dns.TypeDS)
-	c := new(dns.Client)
-	r, _, err := c.Exchange(m, parentAddress)
+	parentdses, err := z.ParentRRsetOrStop(dns.TypeDS)
 	if err != nil {
-		z.SetStopReason(fmt.Sprintf("Unable to fetch DSes from parent: %s", err))
-		return false
+		return false // stop-reason set in ParentRRsetOrStop()
 	}
-	for _, a := range r.Answer {
+	for _, a := range parentdses {
 		ds, ok := a.(*dns.DS)
 		if !ok {
 			continue
 		}
 
-		if _, ok := cdsmap[fmt.Sprintf("%d %d %d %s", ds.KeyTag, ds.Algorithm, ds.DigestType, ds.Digest)]; !ok {
+		if _, ok := cdsmap[music.DSKey(ds)]; !ok {
 			z.SetStopReason(fmt.Sprintf("Parent DS found that is not in any signer: %d %d %d %s",
 				ds.KeyTag, ds.Algorithm, ds.DigestType, ds.Digest))
 			return false
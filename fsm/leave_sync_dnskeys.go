@@ -103,21 +103,12 @@ func LeaveSyncDnskeysPreCondition(z *music.Zone) bool {
 		}
 	}
 
-	parentAddress, err := z.GetParentAddressOrStop()
+	parentnses, err := z.ParentRRsetOrStop(dns.TypeNS)
 	if err != nil {
-		return false // stop-reason set in GetParentAddressOrStop()
+		return false // stop-reason set in ParentRRsetOrStop()
 	}
 
-	m = new(dns.Msg)
-	m.SetQuestion(z.Name, dns.TypeNS)
-	c = new(dns.Client)
-	r, _, err = c.Exchange(m, parentAddress)
-	if err != nil {
-		z.SetStopReason(fmt.Sprintf("Unable to fetch NSes from parent: %s", err))
-		return false
-	}
-
-	for _, a := range r.Ns {
+	for _, a := range parentnses {
 		ns, ok := a.(*dns.NS)
 		if !ok {
 			continue
@@ -172,7 +163,7 @@ func LeaveSyncDnskeysAction(z *music.Zone) bool {
 	log.Printf("remove %v from SignerMap %v: for %v", leavingSignerName, sg.SignerMap, sg.Name)
 	delete(z.SGroup.SignerMap, leavingSignerName)
 	if _, member := z.SGroup.SignerMap[leavingSignerName]; member {
-		log.Fatalf("Signer %s is still a member of group %s", leavingSignerName, z.SGroup.SignerMap)
+		log.Fatalf("Signer %s is still a member of group %v", leavingSignerName, z.SGroup.SignerMap)
 	}
 
 	log.Printf("%s: Removing DNSKEYs originating from leaving signer %s", z.Name, leavingSigner.Name)
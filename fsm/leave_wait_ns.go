@@ -108,21 +108,12 @@ func LeaveWaitNsPreCondition(z *music.Zone) bool {
 		}
 	}
 
-	parentAddress, err := z.GetParentAddressOrStop()
+	parentnses, err := z.ParentRRsetOrStop(dns.TypeNS)
 	if err != nil {
-		return false // stop-reason set in GetParentAddressOrStop()
+		return false // stop-reason set in ParentRRsetOrStop()
 	}
 
-	m = new(dns.Msg)
-	m.SetQuestion(z.Name, dns.TypeNS)
-	c = new(dns.Client)
-	r, _, err = c.Exchange(m, parentAddress)
-	if err != nil {
-		z.SetStopReason(fmt.Sprintf("Unable to fetch NSes from parent: %s", err))
-		return false
-	}
-
-	for _, a := range r.Ns {
+	for _, a := range parentnses {
 		ns, ok := a.(*dns.NS)
 		if !ok {
 			continue
@@ -0,0 +1,458 @@
+package fsm
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+	"github.com/miekg/dns"
+)
+
+// The first half of the MOVE-ZONE process reuses the ADD-SIGNER transitions
+// on the union of the old and the new signer group (see music/movezone.go).
+// The transitions below are the second half, where the zone is in the new
+// group and the signers of the old group are removed, much like in
+// REMOVE-SIGNER but with any number of leaving signers.
+
+var FsmMoveSwitchGroup = music.FSMTransition{
+	Description: "Once the parent has the DS and NS records of both signer groups (criteria), move the zone to the new signer group (action)",
+
+	MermaidPreCondDesc:  "None",
+	MermaidActionDesc:   "Move the zone to the new signer group",
+	MermaidPostCondDesc: "None",
+
+	PreCondition:  func(z *music.Zone) bool { return true },
+	Action:        MoveSwitchGroupAction,
+	PostCondition: func(z *music.Zone) bool { return true },
+}
+
+var FsmMoveRemoveNses = music.FSMTransition{
+	Description: "Remove NSes that originated from the signers of the old signer group from the new signers (action)",
+
+	MermaidPreCondDesc:  "None",
+	MermaidActionDesc:   "Remove NS records that belong to the signers of the old group",
+	MermaidPostCondDesc: "Verify that NS records are in sync in the new signers",
+
+	PreCondition:  func(z *music.Zone) bool { return true },
+	Action:        MoveRemoveNsesAction,
+	PostCondition: LeaveSyncNsesPostCondition,
+}
+
+var FsmMoveAddCsync = music.FSMTransition{
+	Description: "Once the old NSes are gone from the new signers (criteria), build CSYNC record and push to all signers (action)",
+
+	MermaidPreCondDesc:  "Verify that the NS records of the old group are gone from the new signers",
+	MermaidActionDesc:   "Create and publish CSYNC record in all signers, old and new",
+	MermaidPostCondDesc: "Verify that the CSYNC record is published in the new signers",
+
+	PreCondition:  MoveAddCsyncPreCondition,
+	Action:        MoveAddCsyncAction,
+	PostCondition: notifyParentAfter(VerifyCsyncPublished, dns.TypeCSYNC),
+}
+
+var FsmMoveParentNsSynced = music.FSMTransition{
+	Description: "Wait for parent to pick up CSYNC and replace the NS records (criteria), then remove CSYNC from all signers (action)",
+
+	MermaidPreCondDesc:  "Wait for the parent NS records to be those of the new signers",
+	MermaidActionDesc:   "Remove CSYNC records from all signers, old and new",
+	MermaidPostCondDesc: "Verify that all CSYNC records have been removed",
+
+	PreCondition:  MoveParentNsSyncedPreCondition,
+	Action:        MoveParentNsSyncedAction,
+	PostCondition: JoinParentNsSyncedPostCondition,
+}
+
+var FsmMoveRemoveDnskeys = music.FSMTransition{
+	Description: "Once the parent NS records have propagated (criteria), remove DNSKEYs that originated from the old signers (action)",
+
+	MermaidPreCondDesc:  "Wait long enough for parent NS records to propagate",
+	MermaidActionDesc:   "Remove DNSKEYs that originated with the signers of the old group",
+	MermaidPostCondDesc: "Verify that DNSKEYs are in sync in the new signers",
+
+	PreCondition:  MoveRemoveDnskeysPreCondition,
+	Action:        MoveRemoveDnskeysAction,
+	PostCondition: LeaveSyncDnskeysVerify,
+}
+
+var FsmMoveParentDsSynced = music.FSMTransition{
+	Description: "Wait for parent to replace the DS records with those of the new signers (criteria), then remove CDS/CDNSKEY from all signers (action)",
+
+	MermaidPreCondDesc:  "Wait for the parent DS records to match the CDS records of the new signers",
+	MermaidActionDesc:   "Remove CDS/CDNSKEY records from all signers",
+	MermaidPostCondDesc: "Verify that all CDS/CDNSKEY records have been removed",
+
+	PreCondition:  MoveParentDsSyncedPreCondition,
+	Action:        JoinParentDsSyncedAction,
+	PostCondition: VerifyCdsRemoved,
+}
+
+// MoveSwitchGroupAction moves the zone to the signer group it is moving to.
+func MoveSwitchGroupAction(z *music.Zone) bool {
+	if err := z.MusicDB.ZoneMoveSwitchGroup(z); err != nil {
+		z.SetStopReason(fmt.Sprintf("Unable to move zone to the new signer group: %v", err))
+		return false
+	}
+	return true
+}
+
+// moveLeavingSigners returns the signers that the zone is moving away from.
+func moveLeavingSigners(z *music.Zone) (map[string]*music.Signer, bool) {
+	leaving, err := z.MusicDB.MoveZoneLeavingSigners(z)
+	if err != nil {
+		z.SetStopReason(fmt.Sprintf("Unable to get the signers of the old signer group: %v", err))
+		return nil, false
+	}
+	return leaving, true
+}
+
+// moveOriginatedFrom returns the NSes or DNSKEYs (table is "zone_nses" or
+// "zone_dnskeys") that originated from the leaving signers.
+func moveOriginatedFrom(z *music.Zone, table, column string, leaving map[string]*music.Signer) (map[string]bool, bool) {
+	sqlq := fmt.Sprintf("SELECT %s FROM %s WHERE zone = ? AND signer = ?", column, table)
+	res := map[string]bool{}
+	for name := range leaving {
+		rows, err := z.MusicDB.Query(sqlq, z.Name, name)
+		if err != nil {
+			log.Printf("%s: mdb.Query(%s) failed: %s", z.Name, sqlq, err)
+			return nil, false
+		}
+		var value string
+		for rows.Next() {
+			if err = rows.Scan(&value); err != nil {
+				log.Printf("%s: Rows.Scan() failed: %s", z.Name, err)
+				rows.Close()
+				return nil, false
+			}
+			res[value] = true
+		}
+		rows.Close()
+	}
+	return res, true
+}
+
+// moveFetchNses returns the NS names served by the signer.
+func moveFetchNses(z *music.Zone, s *music.Signer) (map[string]bool, bool) {
+	m := new(dns.Msg)
+	m.SetQuestion(z.Name, dns.TypeNS)
+	c := new(dns.Client)
+	r, _, err := c.Exchange(m, s.Address+":"+s.Port)
+	if err != nil {
+		z.SetStopReason(fmt.Sprintf("Unable to fetch NSes from %s: %s", s.Name, err))
+		return nil, false
+	}
+
+	nses := map[string]bool{}
+	for _, a := range r.Answer {
+		if ns, ok := a.(*dns.NS); ok {
+			nses[ns.Ns] = true
+		}
+	}
+	return nses, true
+}
+
+// MoveRemoveNsesAction removes the NSes of the old signers from the new signers.
+func MoveRemoveNsesAction(z *music.Zone) bool {
+	if z.ZoneType == "debug" {
+		log.Printf("MoveRemoveNsesAction: zone %s (DEBUG) is automatically ok", z.Name)
+		return true
+	}
+
+	leaving, ok := moveLeavingSigners(z)
+	if !ok {
+		return false
+	}
+	nses, ok := moveOriginatedFrom(z, "zone_nses", "ns", leaving)
+	if !ok {
+		return false
+	}
+
+	var nsToRemove []dns.RR
+	for ns := range nses {
+		rr := new(dns.NS)
+		rr.Hdr = dns.RR_Header{Name: z.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 0}
+		rr.Ns = ns
+		nsToRemove = append(nsToRemove, rr)
+	}
+	log.Printf("%s: NSes to remove: %v", z.Name, nsToRemove)
+	if len(nsToRemove) == 0 {
+		return true
+	}
+
+	for _, signer := range z.SGroup.SignerMap {
+		updater := music.GetUpdater(signer.Method)
+		if err := updater.Update(signer, z.Name, z.Name, nil, &[][]dns.RR{nsToRemove}); err != nil {
+			z.SetStopReason(fmt.Sprintf("Unable to remove NSes from %s: %s", signer.Name, err))
+			return false
+		}
+		log.Printf("%s: Removed NSes from %s successfully", z.Name, signer.Name)
+	}
+	return true
+}
+
+// MoveAddCsyncPreCondition confirms that the NSes of the old signers are gone from the new signers.
+func MoveAddCsyncPreCondition(z *music.Zone) bool {
+	if z.ZoneType == "debug" {
+		log.Printf("MoveAddCsyncPreCondition: zone %s (DEBUG) is automatically ok", z.Name)
+		return true
+	}
+
+	leaving, ok := moveLeavingSigners(z)
+	if !ok {
+		return false
+	}
+	oldnses, ok := moveOriginatedFrom(z, "zone_nses", "ns", leaving)
+	if !ok {
+		return false
+	}
+
+	for _, s := range z.SGroup.SignerMap {
+		nses, ok := moveFetchNses(z, s)
+		if !ok {
+			return false
+		}
+		for ns := range nses {
+			if oldnses[ns] {
+				z.SetStopReason(fmt.Sprintf("NS %s still exists in signer %s", ns, s.Name))
+				return false
+			}
+		}
+	}
+	log.Printf("%s: All NSes of the old signers have been removed", z.Name)
+	return true
+}
+
+// MoveAddCsyncAction publishes a CSYNC record in the new and the old
+// signers, as the parent may ask any of them.
+func MoveAddCsyncAction(z *music.Zone) bool {
+	if z.ZoneType == "debug" {
+		log.Printf("MoveAddCsyncAction: zone %s (DEBUG) is automatically ok", z.Name)
+		return true
+	}
+
+	leaving, ok := moveLeavingSigners(z)
+	if !ok {
+		return false
+	}
+
+	z.CSYNC = new(dns.CSYNC)
+	z.CSYNC.Hdr = dns.RR_Header{Name: z.Name, Rrtype: dns.TypeCSYNC, Class: dns.ClassINET, Ttl: 300, Rdlength: uint16(12)}
+	z.CSYNC.Serial = 1
+	z.CSYNC.Flags = 1
+	z.CSYNC.TypeBitMap = []uint16{dns.TypeA, dns.TypeNS, dns.TypeAAAA}
+
+	for _, signers := range []map[string]*music.Signer{z.SGroup.SignerMap, leaving} {
+		for _, signer := range signers {
+			updater := music.GetUpdater(signer.Method)
+			if err := updater.RemoveRRset(signer, z.Name, z.Name,
+				[][]dns.RR{[]dns.RR{z.CSYNC}}); err != nil {
+				z.SetStopReason(fmt.Sprintf("Unable to remove CSYNC record sets from %s: %s",
+					signer.Name, err))
+				return false
+			}
+			if err := updater.Update(signer, z.Name, z.Name,
+				&[][]dns.RR{[]dns.RR{z.CSYNC}}, nil); err != nil {
+				z.SetStopReason(fmt.Sprintf("Unable to update %s with CSYNC record sets: %s",
+					signer.Name, err))
+				return false
+			}
+			log.Printf("%s: Update %s successfully with CSYNC record sets", z.Name, signer.Name)
+		}
+	}
+	return true
+}
+
+// MoveParentNsSyncedPreCondition verifies that the NS records in the parent
+// are exactly those of the new signers.
+func MoveParentNsSyncedPreCondition(z *music.Zone) bool {
+	if z.ZoneType == "debug" {
+		log.Printf("MoveParentNsSyncedPreCondition: zone %s (DEBUG) is automatically ok", z.Name)
+		return true
+	}
+
+	nsmap := map[string]bool{}
+	for _, s := range z.SGroup.SignerMap {
+		nses, ok := moveFetchNses(z, s)
+		if !ok {
+			return false
+		}
+		for ns := range nses {
+			nsmap[ns] = true
+		}
+	}
+
+	parentnses, err := z.ParentRRsetOrStop(dns.TypeNS)
+	if err != nil {
+		return false // stop-reason set in ParentRRsetOrStop()
+	}
+
+	for _, a := range parentnses {
+		ns, ok := a.(*dns.NS)
+		if !ok {
+			continue
+		}
+		if !nsmap[ns.Ns] {
+			z.SetStopReason(fmt.Sprintf("NS %s still exists in parent", ns.Ns))
+			return false
+		}
+		delete(nsmap, ns.Ns)
+	}
+	if len(nsmap) > 0 {
+		missing_ns := []string{}
+		for ns := range nsmap {
+			missing_ns = append(missing_ns, ns)
+		}
+		z.SetStopReason(fmt.Sprintf("Missing NS in parent: %v", missing_ns))
+		return false
+	}
+
+	log.Printf("%s: Parent NSes are up-to-date", z.Name)
+	return true
+}
+
+// MoveParentNsSyncedAction removes the CSYNC records from the new and the old signers.
+func MoveParentNsSyncedAction(z *music.Zone) bool {
+	if z.ZoneType == "debug" {
+		log.Printf("MoveParentNsSyncedAction: zone %s (DEBUG) is automatically ok", z.Name)
+		return true
+	}
+
+	leaving, ok := moveLeavingSigners(z)
+	if !ok {
+		return false
+	}
+
+	csync := new(dns.CSYNC)
+	csync.Hdr = dns.RR_Header{Name: z.Name, Rrtype: dns.TypeCSYNC, Class: dns.ClassINET, Ttl: 0}
+
+	for _, signers := range []map[string]*music.Signer{z.SGroup.SignerMap, leaving} {
+		for _, signer := range signers {
+			updater := music.GetUpdater(signer.Method)
+			if err := updater.RemoveRRset(signer, z.Name, z.Name,
+				[][]dns.RR{[]dns.RR{csync}}); err != nil {
+				z.SetStopReason(fmt.Sprintf("Unable to remove CSYNC record sets from %s: %s",
+					signer.Name, err))
+				return false
+			}
+			log.Printf("%s: Removed CSYNC record sets from %s successfully", z.Name, signer.Name)
+		}
+	}
+	return true
+}
+
+// MoveRemoveDnskeysPreCondition waits for the new parent NS records to propagate.
+func MoveRemoveDnskeysPreCondition(z *music.Zone) bool {
+	if z.ZoneType == "debug" {
+		log.Printf("MoveRemoveDnskeysPreCondition: zone %s (DEBUG) is automatically ok", z.Name)
+		return true
+	}
+
+	if until, ok := zoneWaitNs[z.Name]; ok {
+		if time.Now().Before(until) {
+			z.SetStopReason(fmt.Sprintf("%s: Waiting until %s (%s)", z.Name, until.String(), time.Until(until).String()))
+			log.Printf("%s: Waiting until %s (%s)", z.Name, until.String(), time.Until(until).String())
+			return false
+		}
+		log.Printf("%s: Waited enough for NS, critera fullfilled", z.Name)
+		delete(zoneWaitNs, z.Name)
+		return true
+	}
+
+	// until := time.Now().Add((time.Duration(ttl*2) * time.Second))
+	// TODO: static wait time to enable faster testing
+	until := time.Now().Add((time.Duration(5) * time.Second))
+
+	zoneWaitNs[z.Name] = until
+	z.SetStopReason(fmt.Sprintf("%s: Waiting until %s (%s)", z.Name, until.String(), time.Until(until).String()))
+	return false
+}
+
+// MoveRemoveDnskeysAction removes the DNSKEYs of the old signers from the new signers.
+func MoveRemoveDnskeysAction(z *music.Zone) bool {
+	if z.ZoneType == "debug" {
+		log.Printf("MoveRemoveDnskeysAction: zone %s (DEBUG) is automatically ok", z.Name)
+		return true
+	}
+
+	leaving, ok := moveLeavingSigners(z)
+	if !ok {
+		return false
+	}
+	dnskeys, ok := moveOriginatedFrom(z, "zone_dnskeys", "dnskey", leaving)
+	if !ok {
+		return false
+	}
+
+	for _, s := range z.SGroup.SignerMap {
+		updater := music.GetUpdater(s.Method)
+		err, rrs := updater.FetchRRset(s, z.Name, z.Name, dns.TypeDNSKEY)
+		if err != nil {
+			z.SetStopReason(fmt.Sprintf("Unable to fetch DNSKEYs from %s: %s", s.Name, err))
+			return false
+		}
+
+		rem := []dns.RR{}
+		for _, a := range rrs {
+			dnskey, ok := a.(*dns.DNSKEY)
+			if !ok {
+				continue
+			}
+			if dnskeys[fmt.Sprintf("%d-%d-%s", dnskey.Protocol, dnskey.Algorithm, dnskey.PublicKey)] {
+				rem = append(rem, dnskey)
+			}
+		}
+
+		if len(rem) > 0 {
+			if err := updater.Update(s, z.Name, z.Name, nil, &[][]dns.RR{rem}); err != nil {
+				z.SetStopReason(fmt.Sprintf("Unable to remove DNSKEYs from %s: %s", s.Name, err))
+				return false
+			}
+			log.Printf("%s: Removed %d DNSKEYs from %s successfully", z.Name, len(rem), s.Name)
+		}
+	}
+	return true
+}
+
+// MoveParentDsSyncedPreCondition verifies that the DS records in the parent
+// are exactly those given by the CDS (or CDNSKEY) records of the new signers.
+func MoveParentDsSyncedPreCondition(z *music.Zone) bool {
+	if z.ZoneType == "debug" {
+		log.Printf("MoveParentDsSyncedPreCondition: zone %s (DEBUG) is automatically ok", z.Name)
+		return true
+	}
+
+	policy, err := z.CdsPolicyOrStop()
+	if err != nil {
+		return false // stop-reason set in CdsPolicyOrStop()
+	}
+	cdsmap, err := signersPublishedDS(z, policy)
+	if err != nil {
+		z.SetStopReason(err.Error())
+		return false
+	}
+
+	parentdses, err := z.ParentRRsetOrStop(dns.TypeDS)
+	if err != nil {
+		return false // stop-reason set in ParentRRsetOrStop()
+	}
+
+	for _, a := range parentdses {
+		ds, ok := a.(*dns.DS)
+		if !ok {
+			continue
+		}
+		key := music.DSKey(ds)
+		if _, ok := cdsmap[key]; !ok {
+			z.SetStopReason(fmt.Sprintf("DS %d of the old signers still exists in parent", ds.KeyTag))
+			return false
+		}
+		delete(cdsmap, key)
+	}
+	for _, cds := range cdsmap {
+		z.SetStopReason(fmt.Sprintf("Missing DS for CDS: %d", cds.KeyTag))
+		return false
+	}
+
+	log.Printf("%s: DS records in parent are up-to-date", z.Name)
+	return true
+}
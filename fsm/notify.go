@@ -0,0 +1,48 @@
+package fsm
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+)
+
+// notifyParentAfter returns a post-condition that, once postcond is true
+// (i.e. the records are published in all signers), tells the parent about
+// each of rrtypes. If the zone has a parent updater (f.e. EPP to the
+// registry) the DS or NS changes are pushed to the parent and a failed push
+// keeps the zone in the current state until it succeeds. Otherwise a
+// generalized NOTIFY is sent; a failed NOTIFY is only logged, the parent
+// will still find the records at its next scan.
+func notifyParentAfter(postcond func(*music.Zone) bool, rrtypes ...uint16) func(*music.Zone) bool {
+	return func(z *music.Zone) bool {
+		if !postcond(z) {
+			return false
+		}
+		if z.ZoneType == "debug" {
+			return true
+		}
+
+		pu, err := z.ParentUpdater()
+		if err != nil {
+			z.SetStopReason(fmt.Sprintf("Unable to update parent: %v", err))
+			return false
+		}
+		for _, rrtype := range rrtypes {
+			if pu != nil {
+				if err := z.PushToParent(pu, rrtype); err != nil {
+					z.SetStopReason(fmt.Sprintf("Unable to push %s to parent: %v",
+						dns.TypeToString[rrtype], err))
+					return false
+				}
+				continue
+			}
+			if err := z.NotifyParent(rrtype); err != nil {
+				log.Printf("%s: Unable to notify parent: %v", z.Name, err)
+			}
+		}
+		return true
+	}
+}
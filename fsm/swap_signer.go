@@ -0,0 +1,154 @@
+package fsm
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+	"github.com/miekg/dns"
+)
+
+// In the SWAP-SIGNER process the signer group contains both the leaving
+// signer (z.FSMSigner) and the new signer until the process is complete.
+// The first steps work on the whole group: once the DNSKEYs are synced
+// across all signers CDS is published and the process waits for the parent
+// DS (and its TTL) to include the new signer's keys. Only then is the NS
+// RRset changed to that of the new set of signers and CSYNC published, so
+// that no resolver is sent to the new signer before it can validate it.
+// The leaving signer's DNSKEYs and DS are then removed with the
+// REMOVE-SIGNER steps. Compared to ADD-SIGNER followed by REMOVE-SIGNER this
+// saves one CSYNC cycle, but the parent still does two DS updates.
+
+var FsmSwapSyncNses = music.FSMTransition{
+	Description: "Wait enough time for parent DS records to propagate (criteria), then sync NS records between all signers, leaving out the NSes of the leaving signer (action)",
+
+	MermaidPreCondDesc:  "Wait for DS to propagate",
+	MermaidActionDesc:   "Sync NS RRsets between all signers without the NSes of the leaving signer",
+	MermaidPostCondDesc: "Verify that NS RRsets are in sync",
+
+	PreCondition:  JoinWaitDsPreCondition,
+	Action:        SwapSyncNsesAction,
+	PostCondition: SwapSyncNsesPostCondition,
+}
+
+var FsmSwapParentNsSynced = music.FSMTransition{
+	Description: "Wait for parent to replace the NS records with those of the new set of signers (criteria), then remove CSYNC from all signers (action)",
+
+	MermaidPreCondDesc:  "Verify that the parent NS RRset is that of the new set of signers",
+	MermaidActionDesc:   "Remove CSYNC RR from all signers",
+	MermaidPostCondDesc: "Verify that CSYNC has been removed from all signers",
+
+	PreCondition:  MoveParentNsSyncedPreCondition,
+	Action:        JoinParentNsSyncedAction,
+	PostCondition: JoinParentNsSyncedPostCondition,
+}
+
+// SwapSyncNsesAction syncs the NS RRsets of all signers (which records the
+// origin of each NS) and then removes the NSes of the leaving signer.
+func SwapSyncNsesAction(z *music.Zone) bool {
+	if z.ZoneType == "debug" {
+		log.Printf("SwapSyncNsesAction: zone %s (DEBUG) is automatically ok", z.Name)
+		return true
+	}
+
+	if !JoinSyncNs(z) {
+		return false
+	}
+
+	leavingSignerName := z.FSMSigner
+	if leavingSignerName == "" {
+		log.Fatalf("Leaving signer name for zone %s unset.", z.Name)
+	}
+
+	// NSes that are also served by a remaining signer stay
+	const sqlq = `
+SELECT ns FROM zone_nses WHERE zone = ? AND signer = ?
+AND ns NOT IN (SELECT ns FROM zone_nses WHERE zone = ? AND signer != ?)`
+	rows, err := z.MusicDB.Query(sqlq, z.Name, leavingSignerName, z.Name, leavingSignerName)
+	if err != nil {
+		log.Printf("%s: mdb.Query(%s) failed: %s", z.Name, sqlq, err)
+		return false
+	}
+	defer rows.Close()
+
+	var nsToRemove []dns.RR
+	var ns string
+	for rows.Next() {
+		if err = rows.Scan(&ns); err != nil {
+			log.Printf("%s: Rows.Scan() failed: %s", z.Name, err)
+			return false
+		}
+		rr := new(dns.NS)
+		rr.Hdr = dns.RR_Header{Name: z.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 0}
+		rr.Ns = ns
+		nsToRemove = append(nsToRemove, rr)
+	}
+	log.Printf("%s: NSes of leaving signer %s to remove: %v", z.Name, leavingSignerName, nsToRemove)
+	if len(nsToRemove) == 0 {
+		return true
+	}
+
+	// also from the leaving signer, so that the parent gets the same NS
+	// RRset whichever signer it asks
+	for _, signer := range z.SGroup.SignerMap {
+		updater := music.GetUpdater(signer.Method)
+		if err := updater.Update(signer, z.Name, z.Name, nil, &[][]dns.RR{nsToRemove}); err != nil {
+			z.SetStopReason(fmt.Sprintf("Unable to remove NSes from %s: %s", signer.Name, err))
+			return false
+		}
+		log.Printf("%s: Removed NSes from %s successfully", z.Name, signer.Name)
+	}
+	return true
+}
+
+// SwapSyncNsesPostCondition confirms that the NS RRsets are in sync across
+// all signers and that no signer serves an NS that is only the leaving signer's.
+func SwapSyncNsesPostCondition(z *music.Zone) bool {
+	if z.ZoneType == "debug" {
+		log.Printf("SwapSyncNsesPostCondition: zone %s (DEBUG) is automatically ok", z.Name)
+		return true
+	}
+
+	if !JoinSyncNSPostCondition(z) {
+		return false
+	}
+
+	leaving := map[string]*music.Signer{}
+	if s, exist := z.SGroup.SignerMap[z.FSMSigner]; exist {
+		leaving[z.FSMSigner] = s
+	}
+	oldnses, ok := moveOriginatedFrom(z, "zone_nses", "ns", leaving)
+	if !ok {
+		return false
+	}
+	remaining, ok := moveOriginatedFrom(z, "zone_nses", "ns", swapRemainingSigners(z))
+	if !ok {
+		return false
+	}
+
+	for _, s := range z.SGroup.SignerMap {
+		nses, ok := moveFetchNses(z, s)
+		if !ok {
+			return false
+		}
+		for ns := range nses {
+			if oldnses[ns] && !remaining[ns] {
+				z.SetStopReason(fmt.Sprintf("NS %s of leaving signer %s still exists in signer %s",
+					ns, z.FSMSigner, s.Name))
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// swapRemainingSigners returns the signers in the group except the leaving one.
+func swapRemainingSigners(z *music.Zone) map[string]*music.Signer {
+	remaining := map[string]*music.Signer{}
+	for name, s := range z.SGroup.SignerMap {
+		if name != z.FSMSigner {
+			remaining[name] = s
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,177 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var dbfile, dbformat string
+var dbredact, dbforce bool
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Export, import and snapshot the MUSIC DB",
+	Run: func(cmd *cobra.Command, args []string) {
+	},
+}
+
+var dbExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the complete MUSIC state as a YAML or JSON document",
+	Run: func(cmd *cobra.Command, args []string) {
+		dr := SendDBCmd(music.DBPost{
+			Command: "export",
+			Redact:  dbredact,
+		})
+		if dr.State == nil {
+			log.Fatalf("Error: musicd returned no state\n")
+		}
+
+		var out []byte
+		var err error
+		switch DBFormat(dbfile) {
+		case "json":
+			out, err = json.MarshalIndent(dr.State, "", "  ")
+			out = append(out, '\n')
+		default:
+			out, err = yaml.Marshal(dr.State)
+		}
+		if err != nil {
+			log.Fatalf("Error encoding state: %v\n", err)
+		}
+
+		if dbfile == "" || dbfile == "-" {
+			os.Stdout.Write(out)
+			return
+		}
+		// the document may contain signer secrets
+		err = ioutil.WriteFile(dbfile, out, 0600)
+		if err != nil {
+			log.Fatalf("Error writing %s: %v\n", dbfile, err)
+		}
+		fmt.Printf("Exported %d signers, %d signer groups and %d zones to %s.\n",
+			len(dr.State.Signers), len(dr.State.SignerGroups), len(dr.State.Zones), dbfile)
+	},
+}
+
+var dbImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Replace the complete MUSIC state with the contents of an exported document",
+	Run: func(cmd *cobra.Command, args []string) {
+		if dbfile == "" {
+			log.Fatalf("Error: file to import must be specified (--file)\n")
+		}
+		if !dbforce {
+			log.Fatalf("Error: import replaces ALL signers, signer groups and zones in MUSIC. Use --force if that is what you want.\n")
+		}
+
+		var buf []byte
+		var err error
+		if dbfile == "-" {
+			buf, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			buf, err = ioutil.ReadFile(dbfile)
+		}
+		if err != nil {
+			log.Fatalf("Error reading %s: %v\n", dbfile, err)
+		}
+
+		var state music.MusicState
+		if DBFormat(dbfile) == "json" {
+			err = json.Unmarshal(buf, &state)
+		} else {
+			err = yaml.Unmarshal(buf, &state) // also reads JSON
+		}
+		if err != nil {
+			log.Fatalf("Error parsing %s: %v\n", dbfile, err)
+		}
+
+		dr := SendDBCmd(music.DBPost{
+			Command: "import",
+			State:   &state,
+		})
+		if dr.Msg != "" {
+			fmt.Printf("%s\n", dr.Msg)
+		}
+	},
+}
+
+var dbSnapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Write a consistent copy of the (SQLite) MUSIC DB to a file in db.snapshotdir on the musicd host",
+	Run: func(cmd *cobra.Command, args []string) {
+		if dbfile == "" || dbfile == "-" {
+			log.Fatalf("Error: snapshot file must be specified (--file)\n")
+		}
+		if strings.ContainsAny(dbfile, "/\\") {
+			log.Fatalf("Error: snapshot file must be a file name, it is written to db.snapshotdir on the musicd host\n")
+		}
+		dr := SendDBCmd(music.DBPost{
+			Command: "snapshot",
+			File:    dbfile,
+		})
+		if dr.Msg != "" {
+			fmt.Printf("%s\n", dr.Msg)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbExportCmd, dbImportCmd, dbSnapshotCmd)
+
+	dbCmd.PersistentFlags().StringVarP(&dbfile, "file", "f", "", "file to export to or import from (\"-\" for stdout/stdin)")
+	dbCmd.PersistentFlags().StringVarP(&dbformat, "format", "", "",
+		"document format, \"yaml\" or \"json\" (default from file name, otherwise yaml)")
+	dbExportCmd.Flags().BoolVarP(&dbredact, "redact", "", false, "replace signer secrets with "+music.RedactedSecret)
+	dbImportCmd.Flags().BoolVarP(&dbforce, "force", "", false, "really replace the current state")
+}
+
+// DBFormat returns the format of the export document: the --format flag if
+// given, otherwise guessed from the file name.
+func DBFormat(file string) string {
+	if dbformat != "" {
+		return strings.ToLower(dbformat)
+	}
+	if strings.ToLower(filepath.Ext(file)) == ".json" {
+		return "json"
+	}
+	return "yaml"
+}
+
+func SendDBCmd(data music.DBPost) music.DBResponse {
+	bytebuf := new(bytes.Buffer)
+	json.NewEncoder(bytebuf).Encode(data)
+
+	status, buf, err := api.Post("/db", bytebuf.Bytes())
+	if err != nil {
+		log.Fatalf("SendDBCmd: Error from APIpost: %v\n", err)
+	}
+	if cliconf.Debug {
+		fmt.Printf("Status: %d\n", status)
+	}
+
+	var dr music.DBResponse
+	err = json.Unmarshal(buf, &dr)
+	if err != nil {
+		log.Fatalf("SendDBCmd: Error from unmarshal: %v\n", err)
+	}
+	if dr.Error {
+		log.Fatalf("Error: %s\n", dr.ErrorMsg)
+	}
+	return dr
+}
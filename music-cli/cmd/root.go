@@ -101,4 +101,13 @@ func initApi() {
 
 	api = music.NewClient("musicd", baseurl, apikey, authmethod, rootcafile,
 		cliconf.Verbose, cliconf.Debug)
+
+	clientcert := viper.GetString("musicd.clientcert")
+	clientkey := viper.GetString("musicd.clientkey")
+	if clientcert != "" {
+		err := api.SetClientCert(clientcert, clientkey)
+		if err != nil {
+			log.Fatalf("Error from SetClientCert: %v", err)
+		}
+	}
 }
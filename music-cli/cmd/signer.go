@@ -16,7 +16,7 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var signermethod, signerauth, signeraddress, signerport string
+var signermethod, signerauth, signeraddress, signerport, newsignername string
 var signernotcp, signernotsig bool
 
 // signerCmd represents the signer command
@@ -144,6 +144,34 @@ var leaveGroupCmd = &cobra.Command{
 	},
 }
 
+var swapGroupCmd = &cobra.Command{
+	Use:   "swap",
+	Short: "Replace a signer in a signer group with another signer in a single process",
+	Run: func(cmd *cobra.Command, args []string) {
+		if signername == "" {
+			log.Fatalf("SignerSwapGroup: signer to replace not specified. Terminating.\n")
+		}
+
+		if newsignername == "" {
+			log.Fatalf("SignerSwapGroup: new signer not specified (--new). Terminating.\n")
+		}
+
+		if sgroupname == "" {
+			log.Fatalf("SignerSwapGroup: signer group not specified. Terminating.\n")
+		}
+
+		sr := SendSignerCmd(music.SignerPost{
+			Command: "swap",
+			Signer: music.Signer{
+				Name:        signername,
+				SignerGroup: sgroupname,
+			},
+			NewSigner: newsignername,
+		})
+		PrintSignerResponse(sr.Error, sr.ErrorMsg, sr.Msg)
+	},
+}
+
 var deleteSignerCmd = &cobra.Command{
 	Use:   "delete",
 	Short: "Delete a signer from MuSiC",
@@ -201,7 +229,7 @@ var logoutSignerCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(signerCmd)
 	signerCmd.AddCommand(addSignerCmd, updateSignerCmd, deleteSignerCmd, listSignersCmd,
-		joinGroupCmd, leaveGroupCmd, loginSignerCmd, logoutSignerCmd)
+		joinGroupCmd, leaveGroupCmd, swapGroupCmd, loginSignerCmd, logoutSignerCmd)
 
 	signerCmd.PersistentFlags().StringVarP(&signermethod, "method", "m", "",
 		"update method (ddns|rlddns|desec-api|rldesec-api...)")
@@ -213,6 +241,7 @@ func init() {
 		"Port of signer")
 	signerCmd.PersistentFlags().BoolVarP(&signernotcp, "notcp", "", false, "Don't use TCP (use UDP), debug")
 	signerCmd.PersistentFlags().BoolVarP(&signernotsig, "notsig", "", false, "Don't use TSIG, debug")
+	swapGroupCmd.Flags().StringVarP(&newsignername, "new", "", "", "name of signer replacing the signer")
 }
 
 func SendSignerCmd(data music.SignerPost) music.SignerResponse {
@@ -0,0 +1,140 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+
+	"github.com/ryanuber/columnize"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var statefile string
+var stateprune bool
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Compare MUSIC with, or bring it to, a desired state described in a YAML or JSON file",
+	Run: func(cmd *cobra.Command, args []string) {
+	},
+}
+
+var statePlanCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show the changes needed to reach the desired state",
+	Run: func(cmd *cobra.Command, args []string) {
+		sr := SendStateCmd("plan", ReadDesiredState(statefile))
+		if len(sr.Actions) == 0 {
+			fmt.Printf("MUSIC is in the desired state. Nothing to do.\n")
+			return
+		}
+		PrintStateActions(sr.Actions)
+	},
+}
+
+var stateApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Make the changes needed to reach the desired state",
+	Run: func(cmd *cobra.Command, args []string) {
+		sr := SendStateCmd("apply", ReadDesiredState(statefile))
+		if len(sr.Actions) == 0 {
+			fmt.Printf("MUSIC is in the desired state. Nothing to do.\n")
+			return
+		}
+		PrintStateActions(sr.Actions)
+		if sr.Error {
+			log.Fatalf("Error: %s\n", sr.ErrorMsg)
+		}
+		for _, a := range sr.Actions {
+			if a.Status == music.ActionWaiting {
+				fmt.Printf("\nSome changes must wait for ongoing processes. Run apply again later.\n")
+				break
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+	stateCmd.AddCommand(statePlanCmd, stateApplyCmd)
+
+	stateCmd.PersistentFlags().StringVarP(&statefile, "file", "f", "", "desired state file (\"-\" for stdin)")
+	stateCmd.PersistentFlags().BoolVarP(&stateprune, "prune", "", false,
+		"also delete signers, signer groups and zones that are not in the file")
+}
+
+// ReadDesiredState reads a desired state document (YAML or JSON) and expands
+// the environment variables in the TSIG keys.
+func ReadDesiredState(file string) *music.DesiredState {
+	if file == "" {
+		log.Fatalf("Error: desired state file must be specified (--file)\n")
+	}
+
+	var buf []byte
+	var err error
+	if file == "-" {
+		buf, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		buf, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		log.Fatalf("Error reading %s: %v\n", file, err)
+	}
+
+	var ds music.DesiredState
+	err = yaml.UnmarshalStrict(buf, &ds) // also reads JSON
+	if err != nil {
+		log.Fatalf("Error parsing %s: %v\n", file, err)
+	}
+	ds.ExpandEnv()
+	return &ds
+}
+
+func SendStateCmd(command string, ds *music.DesiredState) music.StateResponse {
+	data := music.StatePost{
+		Command: command,
+		State:   ds,
+		Prune:   stateprune,
+	}
+	bytebuf := new(bytes.Buffer)
+	json.NewEncoder(bytebuf).Encode(data)
+
+	status, buf, err := api.Post("/state", bytebuf.Bytes())
+	if err != nil {
+		log.Fatalf("SendStateCmd: Error from APIpost: %v\n", err)
+	}
+	if cliconf.Debug {
+		fmt.Printf("Status: %d\n", status)
+	}
+
+	var sr music.StateResponse
+	err = json.Unmarshal(buf, &sr)
+	if err != nil {
+		log.Fatalf("SendStateCmd: Error from unmarshal: %v\n", err)
+	}
+	if sr.Error && len(sr.Actions) == 0 {
+		log.Fatalf("Error: %s\n", sr.ErrorMsg)
+	}
+	return sr
+}
+
+func PrintStateActions(actions []music.StateAction) {
+	out := []string{"Action|Kind|Name|Group|Status|Details"}
+	for _, a := range actions {
+		detail := a.Detail
+		if a.Status == music.ActionFailed {
+			detail = a.Msg
+		}
+		out = append(out, fmt.Sprintf("%s|%s|%s|%s|%s|%s", a.Op, a.Kind, a.Name, a.Group, a.Status, detail))
+	}
+	fmt.Printf("%s\n", columnize.SimpleFormat(out))
+}
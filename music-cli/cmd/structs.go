@@ -18,6 +18,8 @@ type Config struct {
 type MusicdConf struct {
 	BaseUrl    string `validate:"required"`
 	RootCApem  string `validate:"required,file"`
-	ApiKey     string `validate:"required"`
-	AuthMethod string `validate:"required"`
+	ApiKey     string // not needed when using a client cert
+	AuthMethod string `validate:"required"` // X-API-Key | none
+	ClientCert string `validate:"required_with=ClientKey,omitempty,file"`
+	ClientKey  string `validate:"required_with=ClientCert,omitempty,file"`
 }
@@ -80,7 +80,7 @@ func SendTestCommand(zone string, data music.TestPost) (music.TestResponse, erro
 	json.NewEncoder(bytebuf).Encode(data)
 	status, buf, err := api.Post("/test", bytebuf.Bytes())
 	if err != nil {
-		log.Fatalf("SendTestCommand: Error from APIpost:", err)
+		log.Fatalf("SendTestCommand: Error from APIpost: %v", err)
 
 	}
 	if cliconf.Debug {
@@ -0,0 +1,130 @@
+/*
+ *
+ */
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+)
+
+var watchtypes string
+var watchjson bool
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Follow zone state changes, stop reasons, process start/complete and signer failures as they happen",
+	Long: `Connects to the musicd event stream and prints events as they arrive.
+Use -z to only follow a single zone and --types to select event types:
+state-transition, stop-reason, zone-unblocked, delay, process-start,
+process-complete, signer-op-failure. The stream is automatically resumed after a disconnect.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		WatchEvents()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+
+	watchCmd.Flags().StringVarP(&watchtypes, "types", "t", "",
+		"comma separated list of event types to follow (default all)")
+	watchCmd.Flags().BoolVarP(&watchjson, "json", "j", false,
+		"print events as JSON (one per line)")
+}
+
+func WatchEvents() {
+	params := url.Values{}
+	if zonename != "" {
+		params.Set("zone", dns.Fqdn(zonename))
+	}
+	if watchtypes != "" {
+		params.Set("types", watchtypes)
+	}
+	endpoint := "/events"
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+
+	var lastseq uint64
+	for {
+		headers := map[string]string{}
+		if lastseq > 0 {
+			headers["Last-Event-ID"] = strconv.FormatUint(lastseq, 10)
+		}
+
+		resp, err := api.Stream(endpoint, headers)
+		if err != nil {
+			log.Printf("Error from api.Stream(%s): %v. Retrying in 5 seconds.", endpoint, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if cliconf.Verbose {
+			fmt.Printf("Connected to musicd event stream.\n")
+		}
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue // ignore id:, event:, keepalives and blank lines
+			}
+			data := strings.TrimPrefix(line, "data: ")
+
+			var ev music.MusicEvent
+			err = json.Unmarshal([]byte(data), &ev)
+			if err != nil {
+				log.Printf("Error from unmarshal: %v", err)
+				continue
+			}
+			lastseq = ev.Seq
+
+			if watchjson {
+				fmt.Println(data)
+			} else {
+				fmt.Println(FormatEvent(ev))
+			}
+		}
+		resp.Body.Close()
+
+		log.Printf("Event stream from musicd closed. Reconnecting in 5 seconds.")
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func FormatEvent(ev music.MusicEvent) string {
+	ts := ev.Time.Format("2006-01-02 15:04:05")
+	switch ev.Type {
+	case music.EventStateTransition, music.EventZoneUnblocked:
+		return fmt.Sprintf("%s %s: zone %s (process %s) transitioned from '%s' to '%s'",
+			ts, ev.Type, ev.Zone, ev.Process, ev.From, ev.To)
+	case music.EventStopReason, music.EventDelay:
+		return fmt.Sprintf("%s %s: zone %s (process %s, state %s): %s",
+			ts, ev.Type, ev.Zone, ev.Process, ev.From, ev.Reason)
+	case music.EventProcessStart:
+		if ev.Zone != "" {
+			return fmt.Sprintf("%s %s: zone %s entered process %s in state '%s'",
+				ts, ev.Type, ev.Zone, ev.Process, ev.To)
+		}
+		return fmt.Sprintf("%s %s: signer group %s started process %s (signer %s): %s",
+			ts, ev.Type, ev.SignerGroup, ev.Process, ev.Signer, ev.Reason)
+	case music.EventProcessComplete:
+		return fmt.Sprintf("%s %s: signer group %s completed process %s (signer %s)",
+			ts, ev.Type, ev.SignerGroup, ev.Process, ev.Signer)
+	case music.EventSignerOpFailure:
+		return fmt.Sprintf("%s %s: signer %s (%s), zone %s: %s",
+			ts, ev.Type, ev.Signer, ev.Updater, ev.Zone, ev.Reason)
+	}
+	return fmt.Sprintf("%s %s: %+v", ts, ev.Type, ev)
+}
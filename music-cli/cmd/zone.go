@@ -123,6 +123,31 @@ var zoneJoinGroupCmd = &cobra.Command{
 	},
 }
 
+var zoneMoveGroupCmd = &cobra.Command{
+	Use:   "move",
+	Short: "Move a zone to another signer group via the 'move-zone' process",
+	Run: func(cmd *cobra.Command, args []string) {
+		zone := dns.Fqdn(zonename)
+		if zone == "." {
+			log.Fatalf("ZoneMoveGroup: zone not specified. Terminating.\n")
+		}
+
+		if sgroupname == "" {
+			log.Fatalf("ZoneMoveGroup: signer group to move to not specified. Terminating.\n")
+		}
+
+		data := music.ZonePost{
+			Command: "move",
+			Zone: music.Zone{
+				Name: zone,
+			},
+			SignerGroup: sgroupname,
+		}
+		zr := SendZoneCommand(zone, data)
+		PrintZoneResponse(zr.Error, zr.ErrorMsg, zr.Msg)
+	},
+}
+
 var zoneLeaveGroupCmd = &cobra.Command{
 	Use:   "leave",
 	Short: "Remove a zone from a signer group",
@@ -177,11 +202,21 @@ var zoneMetaCmd = &cobra.Command{
 		case "":
 			log.Fatalf("ZoneMeta: Metadata key not specified. Terminating.\n")
 
-		case "parentaddr":
+		case "parentaddr", "notifyaddr":
 			err := validate.Var(metavalue, "required,hostname_port")
 			if err != nil {
 				log.Fatalf("ZoneMeta: Metadata value not a host:port: %v\n", err)
 			}
+
+		case music.MetaCdsDigests:
+			if _, err := music.ParseCdsPolicy(strings.Split(metavalue, ","), ""); err != nil {
+				log.Fatalf("ZoneMeta: %v\n", err)
+			}
+
+		case music.MetaCdsPublish:
+			if _, err := music.ParseCdsPolicy(nil, metavalue); err != nil {
+				log.Fatalf("ZoneMeta: %v\n", err)
+			}
 		}
 
 		data := music.ZonePost{
@@ -380,7 +415,7 @@ var listBlockedZonesCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(zoneCmd)
 	zoneCmd.AddCommand(addZoneCmd, updateZoneCmd, deleteZoneCmd, listZonesCmd,
-		zoneJoinGroupCmd, zoneLeaveGroupCmd, zoneFsmCmd,
+		zoneJoinGroupCmd, zoneLeaveGroupCmd, zoneMoveGroupCmd, zoneFsmCmd,
 		zoneStepFsmCmd, zoneGetRRsetsCmd, zoneListRRsetCmd,
 		zoneCopyRRsetCmd, zoneMetaCmd, statusZoneCmd)
 	listZonesCmd.AddCommand(listBlockedZonesCmd)
@@ -402,7 +437,7 @@ func init() {
 	zoneCmd.PersistentFlags().StringVarP(&rrtype, "rrtype", "r", "",
 		"RRtype of RRset")
 	zoneMetaCmd.Flags().StringVarP(&metakey, "metakey", "", "",
-		"Metadata key (known keys:'parentaddr')")
+		"Metadata key (known keys:'parentaddr', 'notifyaddr', 'parentupdater', 'cdsdigests', 'cdspublish')")
 	zoneMetaCmd.Flags().StringVarP(&metavalue, "metavalue", "", "",
 		"Metadata value")
 	zoneMetaCmd.MarkFlagRequired("zone")
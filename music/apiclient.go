@@ -482,31 +482,36 @@ func NewClient(name, baseurl, apikey, authmethod,
 	return &api
 }
 
-// request helper function
-func (api *Api) requestHelper(req *http.Request) (int, []byte, error) {
-
-	req.Header.Add("Content-Type", "application/json")
+// SetClientCert makes the API client present the certificate in certfile (with
+// the private key in keyfile) when the server asks for a client certificate.
+func (api *Api) SetClientCert(certfile, keyfile string) error {
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return fmt.Errorf("error loading client cert %s (key %s): %v",
+			certfile, keyfile, err)
+	}
 
-	if api.Authmethod == "" {
-		// do not add any authentication header at all
-	} else if api.Authmethod == "X-API-Key" {
-		req.Header.Add("X-API-Key", api.apiKey)
-	} else if api.Authmethod == "Authorization" {
-		req.Header.Add("Authorization", fmt.Sprintf("token %s", api.apiKey))
-	} else {
-		log.Printf("Error: Client API Post: unknown auth method: %s. Aborting.\n",
-			api.Authmethod)
-		return 501, []byte{}, fmt.Errorf("unknown auth method: %s", api.Authmethod)
+	transport, ok := api.Client.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil {
+		return fmt.Errorf("API client %s has no TLS config", api.Name)
 	}
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
 
 	if api.Debug {
-		fmt.Println()
-		fmt.Printf("requestHelper: about to send request using auth method '%s' and key '%s'\n",
-			api.Authmethod, api.apiKey)
+		fmt.Printf("SetClientCert: '%s' API client will use client cert in '%s'\n",
+			api.Name, certfile)
 	}
+	return nil
+}
 
-	if api.apiKey == "" {
-		log.Fatalf("api.requestHelper: Error: apikey not set.\n")
+// request helper function
+func (api *Api) requestHelper(req *http.Request) (int, []byte, error) {
+
+	req.Header.Add("Content-Type", "application/json")
+
+	err := api.addAuthHeader(req)
+	if err != nil {
+		return 501, []byte{}, err
 	}
 
 	resp, err := api.Client.Do(req)
@@ -532,6 +537,74 @@ func (api *Api) requestHelper(req *http.Request) (int, []byte, error) {
 	return resp.StatusCode, buf, err
 }
 
+// key returns the current API key (for deSEC it changes on every login).
+func (api *Api) key() string {
+	api.tokmu.Lock()
+	defer api.tokmu.Unlock()
+	return api.apiKey
+}
+
+func (api *Api) addAuthHeader(req *http.Request) error {
+	apikey := api.key()
+	if api.Authmethod == "" || api.Authmethod == "none" {
+		// do not add any authentication header at all (f.e. when
+		// authenticating via a client certificate)
+	} else if api.Authmethod == "X-API-Key" {
+		req.Header.Add("X-API-Key", apikey)
+	} else if api.Authmethod == "Authorization" {
+		req.Header.Add("Authorization", fmt.Sprintf("token %s", apikey))
+	} else {
+		log.Printf("Error: Client API Post: unknown auth method: %s. Aborting.\n",
+			api.Authmethod)
+		return fmt.Errorf("unknown auth method: %s", api.Authmethod)
+	}
+
+	if api.Debug {
+		fmt.Println()
+		fmt.Printf("requestHelper: about to send request using auth method '%s' and key '%s'\n",
+			api.Authmethod, apikey)
+	}
+
+	if apikey == "" && api.Authmethod != "" && api.Authmethod != "none" {
+		log.Fatalf("api.requestHelper: Error: apikey not set.\n")
+	}
+	return nil
+}
+
+// api Stream
+// Open a long-lived GET request (f.e. a Server-Sent Events stream). The caller
+// must read and close resp.Body.
+func (api *Api) Stream(endpoint string, headers map[string]string) (*http.Response, error) {
+	if api.Debug {
+		fmt.Printf("api.Stream: GET URL '%s'\n", api.BaseUrl+endpoint)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, api.BaseUrl+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "text/event-stream")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	err = api.addAuthHeader(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := api.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(buf)))
+	}
+	return resp, nil
+}
+
 // api Post
 func (api *Api) Post(endpoint string, data []byte) (int, []byte, error) {
 
@@ -5,6 +5,7 @@ package music
 
 import (
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -113,6 +114,7 @@ type SignerPost struct {
 	Command         string
 	Signer		Signer
 	SignerGroup	string
+	NewSigner	string	// for "swap": the signer replacing Signer
 }
 
 type SignerResponse struct {
@@ -138,6 +140,39 @@ type SignerGroupResponse struct {
 	SignerGroups map[string]SignerGroup
 }
 
+type DBPost struct {
+	Command string      // "export" | "import" | "snapshot"
+	Redact  bool        // export: replace signer secrets with RedactedSecret
+	State   *MusicState // import
+	File    string      // snapshot: file name on the musicd host
+}
+
+type DBResponse struct {
+	Time     time.Time
+	Status   int
+	Client   string
+	Error    bool
+	ErrorMsg string
+	Msg      string
+	State    *MusicState
+}
+
+type StatePost struct {
+	Command string        // "plan" | "apply"
+	State   *DesiredState // desired signers, signer groups and zones
+	Prune   bool          // remove signers, signer groups and zones not in State
+}
+
+type StateResponse struct {
+	Time     time.Time
+	Status   int
+	Client   string
+	Error    bool
+	ErrorMsg string
+	Msg      string
+	Actions  []StateAction
+}
+
 type Api struct {
      	Name	   string
 	Client     *http.Client
@@ -151,6 +186,11 @@ type Api struct {
 	Email    string
 	Password string
 	TokViper *viper.Viper
+	Secrets  *SecretBox // if set, the token in TokViper is stored encrypted
+
+	// The deSEC token is refreshed by the fetch and update workers in
+	// parallel. tokmu protects apiKey and TokViper.
+	tokmu sync.Mutex
 }
 
 type ProcessPost struct {
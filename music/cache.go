@@ -0,0 +1,170 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"sync"
+	"time"
+)
+
+// The in-memory state of a MusicDB is used at the same time by the FSM
+// engine workers, the API server and the DB updater, so all of it is
+// protected by locks. Never hand out the underlying maps, only copies.
+
+// stopReasonCache holds the latest stop reason for each blocked zone, so that
+// it is available before the dbupdater has written it to the DB.
+type stopReasonCache struct {
+	mu      sync.RWMutex
+	reasons map[string]string // key: zonename value: stopreason
+}
+
+func newStopReasonCache() *stopReasonCache {
+	return &stopReasonCache{reasons: map[string]string{}}
+}
+
+func (c *stopReasonCache) Get(zone string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	reason, exist := c.reasons[zone]
+	return reason, exist
+}
+
+func (c *stopReasonCache) Set(zone, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reasons[zone] = reason
+}
+
+// Pop removes the stop reason for the zone and returns what was there.
+func (c *stopReasonCache) Pop(zone string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reason, exist := c.reasons[zone]
+	delete(c.reasons, zone)
+	return reason, exist
+}
+
+func (c *stopReasonCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reasons = map[string]string{}
+}
+
+// fsmList is the set of processes (FSMs) that zones can be attached to.
+type fsmList struct {
+	mu   sync.RWMutex
+	fsms map[string]FSM
+}
+
+func newFSMList() *fsmList {
+	return &fsmList{fsms: map[string]FSM{}}
+}
+
+// SetFSMlist replaces the known processes. The map is copied, so the caller
+// may keep using it.
+func (mdb *MusicDB) SetFSMlist(fsms map[string]FSM) {
+	m := make(map[string]FSM, len(fsms))
+	for name, fsm := range fsms {
+		m[name] = fsm
+	}
+	mdb.fsmlist.mu.Lock()
+	defer mdb.fsmlist.mu.Unlock()
+	mdb.fsmlist.fsms = m
+}
+
+// GetFSM returns the process with the given name.
+func (mdb *MusicDB) GetFSM(name string) (FSM, bool) {
+	mdb.fsmlist.mu.RLock()
+	defer mdb.fsmlist.mu.RUnlock()
+	fsm, exist := mdb.fsmlist.fsms[name]
+	return fsm, exist
+}
+
+// FSMlist returns a copy of all known processes.
+func (mdb *MusicDB) FSMlist() map[string]FSM {
+	mdb.fsmlist.mu.RLock()
+	defer mdb.fsmlist.mu.RUnlock()
+	m := make(map[string]FSM, len(mdb.fsmlist.fsms))
+	for name, fsm := range mdb.fsmlist.fsms {
+		m[name] = fsm
+	}
+	return m
+}
+
+// parentCache holds the result of parent discovery for each zone until it
+// expires.
+type parentCache struct {
+	mu      sync.Mutex
+	parents map[string]*ParentInfo // key: zonename
+	names   map[string]string      // key: zonename, the parent zone, not expired
+	addrs   map[string]string      // key: zonename, kept until cleared by the parent agent
+}
+
+func newParentCache() *parentCache {
+	return &parentCache{parents: map[string]*ParentInfo{}, names: map[string]string{},
+		addrs: map[string]string{}}
+}
+
+func (c *parentCache) Get(zone string, now time.Time) (*ParentInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pi, exist := c.parents[zone]
+	if !exist || now.After(pi.Expires) {
+		delete(c.parents, zone)
+		return nil, false
+	}
+	cp := *pi
+	return &cp, true
+}
+
+func (c *parentCache) Set(zone string, pi *ParentInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp := *pi
+	c.parents[zone] = &cp
+}
+
+func (c *parentCache) Flush(zone string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.parents, zone)
+}
+
+func (c *parentCache) Name(zone string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	parent, exist := c.names[zone]
+	return parent, exist
+}
+
+func (c *parentCache) SetName(zone, parent string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names[zone] = parent
+}
+
+func (c *parentCache) Addr(zone string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addr, exist := c.addrs[zone]
+	return addr, exist
+}
+
+func (c *parentCache) SetAddr(zone, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addrs[zone] = addr
+}
+
+func (c *parentCache) ClearAddr(zone string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, exist := c.addrs[zone]
+	if exist {
+		delete(c.addrs, zone)
+		delete(c.names, zone) // set along with the address
+	}
+	return exist
+}
@@ -0,0 +1,121 @@
+package music
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// The tests in this file are only meaningful with the race detector:
+//
+//	go test -race ./...
+
+func TestStopReasonCacheConcurrent(t *testing.T) {
+	mdb, err := OpenDB(filepath.Join(t.TempDir(), "music.db"), "sqlite")
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer mdb.Close()
+	if _, err := mdb.Migrate(false); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+
+	// stands in for the dbupdater
+	mdb.UpdateC = make(chan DBUpdate)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-mdb.UpdateC:
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		z := &Zone{Name: fmt.Sprintf("zone%d.se.", i%3), MusicDB: mdb}
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				z.SetStopReason(fmt.Sprintf("reason %d.%d", i, j))
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, _, err := mdb.GetStopReason(nil, z); err != nil {
+					t.Errorf("GetStopReason: %v", err)
+					return
+				}
+				mdb.stopreasons.Pop(z.Name)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFSMlistConcurrent(t *testing.T) {
+	mdb, err := OpenDB(filepath.Join(t.TempDir(), "music.db"), "sqlite")
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer mdb.Close()
+
+	fsms := map[string]FSM{"test-process": {Name: "test-process", Desc: "test"}}
+	mdb.SetFSMlist(fsms)
+	delete(fsms, "test-process") // the MusicDB must have its own copy
+	if _, exist := mdb.GetFSM("test-process"); !exist {
+		t.Fatalf("GetFSM(test-process): process not found after the caller changed its map")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				mdb.SetFSMlist(map[string]FSM{
+					"test-process": {Name: "test-process", Desc: fmt.Sprintf("%d.%d", i, j)},
+				})
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				mdb.GetFSM("test-process")
+				processes, _, _ := mdb.ListProcesses()
+				if len(processes) != 1 {
+					t.Errorf("ListProcesses: got %d processes wanted 1", len(processes))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUpdatersConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			RegisterUpdater(fmt.Sprintf("test-%d", i), &DdnsUpdater{})
+		}(i)
+		go func() {
+			defer wg.Done()
+			GetUpdater("ddns")
+			ListUpdaters()
+		}()
+	}
+	wg.Wait()
+
+	if !ListUpdaters()["test-9"] {
+		t.Errorf("ListUpdaters: registered updater test-9 missing")
+	}
+}
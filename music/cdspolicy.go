@@ -0,0 +1,251 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// The CDS policy of a zone says which records the processes publish for the
+// KSKs of the signers (CDS, CDNSKEY or both) and which digest types the CDS
+// records, and thereby the DS records in the parent, have. Some parents
+// reject SHA384, others only look at CDNSKEY. The policy is taken from, in
+// order:
+//
+//	the zone metadata "cdsdigests" (f.e. "SHA256,SHA384") and "cdspublish"
+//	the entry for the parent zone in cdspolicy.parents
+//	cdspolicy.digests and cdspolicy.publish (default SHA256 and both)
+//
+// A process must use the same policy from publishing the CDS to checking
+// the parent DS, so if the policy of a zone can not be had (bad metadata,
+// or the parent zone can not be found while cdspolicy.parents is set) the
+// zone is stopped rather than given the default policy.
+
+const (
+	MetaCdsDigests = "cdsdigests"
+	MetaCdsPublish = "cdspublish"
+
+	CdsPublishCDS     = "cds"
+	CdsPublishCDNSKEY = "cdnskey"
+	CdsPublishBoth    = "both"
+)
+
+type CdsPolicy struct {
+	Digests []uint8 // digest types of the CDS and the parent DS records
+	CDS     bool
+	CDNSKEY bool
+}
+
+type ParentCdsPolicyConf struct {
+	Zone    string
+	Digests []string
+	Publish string
+}
+
+var DefaultCdsPolicy = CdsPolicy{Digests: []uint8{dns.SHA256}, CDS: true, CDNSKEY: true}
+
+// ParseCdsPolicy returns the policy given by the digest type names (e.g.
+// "SHA256" or "SHA-256") and the publication ("cds", "cdnskey" or "both").
+// Empty values give the defaults. The scanner parses the digest types of
+// its parents with it too, so both accept the same names.
+func ParseCdsPolicy(digests []string, publish string) (CdsPolicy, error) {
+	policy := CdsPolicy{Digests: DefaultCdsPolicy.Digests}
+	if len(digests) > 0 {
+		policy.Digests = nil
+		for _, name := range digests {
+			name = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(name), "-", ""))
+			if name == "" {
+				continue
+			}
+			dt, exist := dns.StringToHash[name]
+			if !exist || dt == dns.SHA1 || dt == dns.GOST94 {
+				return policy, fmt.Errorf("unsupported CDS digest type '%s'", name)
+			}
+			policy.Digests = append(policy.Digests, dt)
+		}
+		if len(policy.Digests) == 0 {
+			return policy, fmt.Errorf("no CDS digest types given")
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(publish)) {
+	case "", CdsPublishBoth:
+		policy.CDS, policy.CDNSKEY = true, true
+	case CdsPublishCDS:
+		policy.CDS = true
+	case CdsPublishCDNSKEY:
+		policy.CDNSKEY = true
+	default:
+		return policy, fmt.Errorf("unknown CDS publication '%s' (cds | cdnskey | both)", publish)
+	}
+	return policy, nil
+}
+
+// CdsPolicy returns the CDS policy of the zone. The parent zone is only
+// looked up if there are per-parent policies, and then only once (see
+// ParentZoneName).
+func (z *Zone) CdsPolicy() (CdsPolicy, error) {
+	digests := viper.GetStringSlice("cdspolicy.digests")
+	publish := viper.GetString("cdspolicy.publish")
+
+	var parents []ParentCdsPolicyConf
+	if err := viper.UnmarshalKey("cdspolicy.parents", &parents); err != nil {
+		return CdsPolicy{}, fmt.Errorf("Zone %s: Error from viper.UnmarshalKey(cdspolicy.parents): %v", z.Name, err)
+	}
+	if len(parents) > 0 {
+		parent, err := z.MusicDB.ParentZoneName(z.Name)
+		if err != nil {
+			return CdsPolicy{}, fmt.Errorf("Zone %s: unable to find the parent for the CDS policy: %v", z.Name, err)
+		}
+		for _, p := range parents {
+			if strings.EqualFold(dns.Fqdn(p.Zone), parent) {
+				if len(p.Digests) > 0 {
+					digests = p.Digests
+				}
+				if p.Publish != "" {
+					publish = p.Publish
+				}
+			}
+		}
+	}
+
+	value, exist, err := z.MusicDB.GetMeta(nil, z, MetaCdsDigests)
+	if err != nil {
+		return CdsPolicy{}, fmt.Errorf("Zone %s: Error retrieving %s: %v", z.Name, MetaCdsDigests, err)
+	}
+	if exist && value != "" {
+		digests = strings.Split(value, ",")
+	}
+	value, exist, err = z.MusicDB.GetMeta(nil, z, MetaCdsPublish)
+	if err != nil {
+		return CdsPolicy{}, fmt.Errorf("Zone %s: Error retrieving %s: %v", z.Name, MetaCdsPublish, err)
+	}
+	if exist && value != "" {
+		publish = value
+	}
+
+	policy, err := ParseCdsPolicy(digests, publish)
+	if err != nil {
+		return CdsPolicy{}, fmt.Errorf("Zone %s: bad CDS policy: %v", z.Name, err)
+	}
+	return policy, nil
+}
+
+// CdsPolicyOrStop returns the CDS policy of the zone and sets the
+// stop-reason if it can not be had.
+func (z *Zone) CdsPolicyOrStop() (CdsPolicy, error) {
+	policy, err := z.CdsPolicy()
+	if err != nil {
+		z.SetStopReason(err.Error())
+		return CdsPolicy{}, err
+	}
+	log.Printf("%s: CDS policy: %s", z.Name, policy)
+	return policy, nil
+}
+
+// DS returns the DS records, one per digest type, for the KSK.
+func (p CdsPolicy) DS(dnskey *dns.DNSKEY) []*dns.DS {
+	var dses []*dns.DS
+	for _, dt := range p.Digests {
+		if ds := dnskey.ToDS(dt); ds != nil {
+			dses = append(dses, ds)
+		}
+	}
+	return dses
+}
+
+// Records returns the CDS and CDNSKEY records that the policy publishes for the KSKs.
+func (p CdsPolicy) Records(ksks []*dns.DNSKEY) ([]dns.RR, []dns.RR) {
+	cdses, cdnskeys := []dns.RR{}, []dns.RR{}
+	for _, dnskey := range ksks {
+		if p.CDS {
+			for _, ds := range p.DS(dnskey) {
+				cdses = append(cdses, ds.ToCDS())
+			}
+		}
+		if p.CDNSKEY {
+			cdnskeys = append(cdnskeys, dnskey.ToCDNSKEY())
+		}
+	}
+	return cdses, cdnskeys
+}
+
+func (p CdsPolicy) String() string {
+	var digests []string
+	for _, dt := range p.Digests {
+		digests = append(digests, dns.HashToString[dt])
+	}
+	publish := CdsPublishBoth
+	if !p.CDNSKEY {
+		publish = CdsPublishCDS
+	} else if !p.CDS {
+		publish = CdsPublishCDNSKEY
+	}
+	return fmt.Sprintf("%s (%s)", publish, strings.Join(digests, ","))
+}
+
+// DSKey returns the DS (or CDS) record as "keytag algorithm digesttype digest",
+// for comparisons.
+func DSKey(ds *dns.DS) string {
+	return fmt.Sprintf("%d %d %d %s", ds.KeyTag, ds.Algorithm, ds.DigestType, strings.ToUpper(ds.Digest))
+}
+
+// PublishedDS returns the DS records that the CDS records published by the
+// signer ask the parent for or, if the policy does not publish CDS, the DS
+// records for the published CDNSKEYs. An RFC 8078 delete record gives an
+// empty map, while nil means that nothing is published, i.e. the DS RRset
+// in the parent is to be left alone.
+func (p CdsPolicy) PublishedDS(z *Zone, signer *Signer) (map[string]*dns.DS, error) {
+	updater := GetUpdater(signer.Method)
+	dses := map[string]*dns.DS{}
+	if p.CDS {
+		err, rrs := updater.FetchRRset(signer, z.Name, z.Name, dns.TypeCDS)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to fetch CDSes from %s: %v", signer.Name, err)
+		}
+		if len(rrs) == 0 {
+			return nil, nil
+		}
+		for _, rr := range rrs {
+			cds, ok := rr.(*dns.CDS)
+			if !ok {
+				continue
+			}
+			if cds.Algorithm == 0 {
+				return map[string]*dns.DS{}, nil
+			}
+			ds := cds.DS
+			ds.Hdr.Rrtype = dns.TypeDS
+			dses[DSKey(&ds)] = &ds
+		}
+		return dses, nil
+	}
+
+	err, rrs := updater.FetchRRset(signer, z.Name, z.Name, dns.TypeCDNSKEY)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch CDNSKEYs from %s: %v", signer.Name, err)
+	}
+	if len(rrs) == 0 {
+		return nil, nil
+	}
+	for _, rr := range rrs {
+		cdnskey, ok := rr.(*dns.CDNSKEY)
+		if !ok {
+			continue
+		}
+		if cdnskey.Algorithm == 0 {
+			return map[string]*dns.DS{}, nil
+		}
+		for _, ds := range p.DS(&cdnskey.DNSKEY) {
+			dses[DSKey(ds)] = ds
+		}
+	}
+	return dses, nil
+}
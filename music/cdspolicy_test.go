@@ -0,0 +1,141 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+func TestParseCdsPolicy(t *testing.T) {
+	tests := []struct {
+		digests []string
+		publish string
+		want    CdsPolicy
+		err     bool
+	}{
+		{nil, "", DefaultCdsPolicy, false},
+		{[]string{"SHA256", "sha384"}, "cds", CdsPolicy{Digests: []uint8{dns.SHA256, dns.SHA384}, CDS: true}, false},
+		{[]string{"SHA-384"}, "both", CdsPolicy{Digests: []uint8{dns.SHA384}, CDS: true, CDNSKEY: true}, false},
+		{nil, "CDNSKEY", CdsPolicy{Digests: []uint8{dns.SHA256}, CDNSKEY: true}, false},
+		{[]string{"SHA1"}, "", CdsPolicy{}, true},
+		{[]string{"MD5"}, "", CdsPolicy{}, true},
+		{nil, "ds", CdsPolicy{}, true},
+	}
+	for _, tc := range tests {
+		got, err := ParseCdsPolicy(tc.digests, tc.publish)
+		if tc.err {
+			if err == nil {
+				t.Errorf("ParseCdsPolicy(%v, %q): got no error", tc.digests, tc.publish)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseCdsPolicy(%v, %q): got %v, %v, want %v", tc.digests, tc.publish, got, err, tc.want)
+		}
+	}
+}
+
+func TestCdsPolicyRecords(t *testing.T) {
+	rr, err := dns.NewRR("test.se. 3600 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==")
+	if err != nil {
+		t.Fatalf("NewRR: %v", err)
+	}
+	ksk := rr.(*dns.DNSKEY)
+
+	policy := CdsPolicy{Digests: []uint8{dns.SHA256, dns.SHA384}, CDS: true, CDNSKEY: true}
+	cdses, cdnskeys := policy.Records([]*dns.DNSKEY{ksk})
+	if len(cdses) != 2 || len(cdnskeys) != 1 {
+		t.Fatalf("Records: got %d CDS and %d CDNSKEY, want 2 and 1", len(cdses), len(cdnskeys))
+	}
+	for i, dt := range policy.Digests {
+		cds := cdses[i].(*dns.CDS)
+		if cds.DigestType != dt || cds.KeyTag != ksk.KeyTag() {
+			t.Errorf("Records: CDS %d is %s", i, cds.String())
+		}
+	}
+
+	policy = CdsPolicy{Digests: []uint8{dns.SHA256}, CDNSKEY: true}
+	cdses, cdnskeys = policy.Records([]*dns.DNSKEY{ksk})
+	if len(cdses) != 0 || len(cdnskeys) != 1 {
+		t.Errorf("Records (cdnskey only): got %d CDS and %d CDNSKEY, want 0 and 1", len(cdses), len(cdnskeys))
+	}
+	if got := policy.String(); got != "cdnskey (SHA256)" {
+		t.Errorf("String: got %q", got)
+	}
+}
+
+func TestZoneCdsPolicy(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+		mdb.UpdateC = make(chan DBUpdate, 10)
+		z, exist, err := mdb.GetZone(nil, "test.se.")
+		if err != nil || !exist {
+			t.Fatalf("GetZone: %v %v", exist, err)
+		}
+		if got, err := z.CdsPolicy(); err != nil || !reflect.DeepEqual(got, DefaultCdsPolicy) {
+			t.Errorf("CdsPolicy: got %v, %v, want the default policy", got, err)
+		}
+
+		// the parent zone is only looked up for per-parent policies
+		viper.Set("cdspolicy.parents", []map[string]interface{}{{"zone": "se", "digests": []string{"SHA384"}}})
+		defer viper.Set("cdspolicy.parents", nil)
+		mdb.parents.Set("test.se.", &ParentInfo{Zone: "se.", Expires: time.Now().Add(time.Minute)})
+		want := CdsPolicy{Digests: []uint8{dns.SHA384}, CDS: true, CDNSKEY: true}
+		if got, err := z.CdsPolicy(); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("CdsPolicy: got %v, %v, want %v from cdspolicy.parents", got, err, want)
+		}
+		// the parent zone is kept after the discovered parent has expired
+		mdb.FlushParent("test.se.")
+		if got, err := z.CdsPolicy(); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("CdsPolicy: got %v, %v, want %v from the kept parent zone", got, err, want)
+		}
+
+		mdb.ZoneSetMeta(nil, z, MetaCdsDigests, "SHA384")
+		mdb.ZoneSetMeta(nil, z, MetaCdsPublish, "cds")
+		want = CdsPolicy{Digests: []uint8{dns.SHA384}, CDS: true}
+		if got, err := z.CdsPolicy(); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("CdsPolicy: got %v, %v, want %v from the zone metadata", got, err, want)
+		}
+
+		// bad metadata stops the zone instead of giving the default policy
+		mdb.ZoneSetMeta(nil, z, MetaCdsPublish, "bogus")
+		if got, err := z.CdsPolicyOrStop(); err == nil {
+			t.Errorf("CdsPolicyOrStop: got %v for bad metadata, want an error", got)
+		}
+		if reason, exist := mdb.stopreasons.Get(z.Name); !exist || reason == "" {
+			t.Errorf("CdsPolicyOrStop: no stop-reason set for bad metadata")
+		}
+	})
+}
+
+func TestParentZoneName(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		// set by the parent agent, and cleared with its address
+		mdb.SetParentAddress("test.example.", "Example", "192.0.2.2:53")
+		if parent, err := mdb.ParentZoneName("TEST.example"); err != nil || parent != "example." {
+			t.Errorf("ParentZoneName: got %s, %v, want example.", parent, err)
+		}
+		mdb.ClearParentAddress("test.example.")
+		if _, exist := mdb.parents.Name("test.example."); exist {
+			t.Errorf("ClearParentAddress: parent zone kept")
+		}
+
+		// from the discovered parent
+		mdb.parents.Set("test.se.", &ParentInfo{Zone: "se.", Expires: time.Now().Add(time.Minute)})
+		if parent, err := mdb.ParentZoneName("test.se."); err != nil || parent != "se." {
+			t.Errorf("ParentZoneName: got %s, %v, want se.", parent, err)
+		}
+		// not cleared by the parent agent for a zone it never handled
+		mdb.ClearParentAddress("test.se.")
+		if parent, exist := mdb.parents.Name("test.se."); !exist || parent != "se." {
+			t.Errorf("ClearParentAddress: got %s, %v, want se. kept", parent, exist)
+		}
+	})
+}
@@ -281,7 +281,7 @@ func (mdb *MusicDB) GetMeta(tx *sql.Tx, z *Zone, key string) (string, bool, erro
 
 func (mdb *MusicDB) GetStopReason(tx *sql.Tx, z *Zone) (string, bool, error) {
 
-	foo := mdb.StopReasonCache[z.Name]
+	foo, _ := mdb.stopreasons.Get(z.Name)
 	if foo != "" {
 		return foo, true, nil
 	}
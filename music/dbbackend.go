@@ -0,0 +1,130 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// A DBBackend hides the differences between the SQL databases that MusicDB
+// can use. All SQL in MUSIC is written in the SQLite dialect (with "?" as
+// placeholder); backends that speak another dialect translate the SQL when
+// it is sent to the DB (see PostgresDialect), so the rest of MUSIC doesn't
+// need to know which backend is in use.
+type DBBackend interface {
+	Name() string
+	Open(source string) (*sql.DB, error)
+	TableExists(db *sql.DB, table string) (bool, error)
+	ColumnExists(tx *sql.Tx, table, column string) (bool, error)
+	IsRetryable(err error) bool // "DB locked" and similar: try again later
+	Snapshot(db *sql.DB, dest string) error
+}
+
+// NewDBBackend returns the backend for db.mode:
+//
+//	"sqlite" (or "")  SQLite, source is the name of the DB file
+//	"WAL"             SQLite in write-ahead logging mode
+//	"postgres"        PostgreSQL, source is a connection string
+func NewDBBackend(mode string) (DBBackend, error) {
+	switch strings.ToLower(mode) {
+	case "", "sqlite":
+		return &SQLiteBackend{}, nil
+	case "wal":
+		return &SQLiteBackend{WAL: true}, nil
+	case "postgres":
+		return &PostgresBackend{}, nil
+	}
+	return nil, fmt.Errorf("unknown db mode '%s' (should be one of sqlite, WAL or postgres)", mode)
+}
+
+func DBModeIsPostgres(mode string) bool {
+	b, err := NewDBBackend(mode)
+	return err == nil && b.Name() == "postgres"
+}
+
+type SQLiteBackend struct {
+	WAL bool
+}
+
+func (b *SQLiteBackend) Name() string {
+	return "sqlite"
+}
+
+func (b *SQLiteBackend) Open(dbfile string) (*sql.DB, error) {
+	log.Printf("NewMusicDB: using sqlite db in file %s\n", dbfile)
+
+	_, err := os.Stat(dbfile)
+	if !os.IsNotExist(err) {
+		if err := os.Chmod(dbfile, 0664); err != nil {
+			log.Printf("NewMusicDB: Error trying to ensure that db %s is writable: %v", dbfile, err)
+		}
+	}
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		log.Printf("NewMusicDB: Error from sql.Open: %v", err)
+		return nil, err
+	}
+
+	if b.WAL {
+		_, err := db.Exec("PRAGMA journal_mode=WAL;")
+		if err != nil {
+			log.Fatalf("NewDB: Error entering DB WAL mode: %v", err)
+		}
+		log.Printf("NewDB: Running DB in WAL (write-ahead logging) mode.")
+	}
+	return db, nil
+}
+
+func (b *SQLiteBackend) TableExists(db *sql.DB, table string) (bool, error) {
+	const sqlq = "SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?"
+	var count int
+	err := db.QueryRow(sqlq, table).Scan(&count)
+	return count > 0, err
+}
+
+func (b *SQLiteBackend) ColumnExists(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info('%s')", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk)
+		if err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// Snapshot uses VACUUM INTO, which writes a consistent copy of the DB
+// without blocking other connections for more than the copy itself.
+func (b *SQLiteBackend) Snapshot(db *sql.DB, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("snapshot file %s already exists", dest)
+	}
+	_, err := db.Exec("VACUUM INTO ?", dest)
+	return err
+}
+
+func (b *SQLiteBackend) IsRetryable(err error) bool {
+	if sqliteerr, ok := err.(sqlite3.Error); ok {
+		return sqliteerr.Code == sqlite3.ErrLocked || sqliteerr.Code == sqlite3.ErrBusy
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package music
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// DSN of the PostgreSQL DB used by the tests ("" = postgres tests are skipped).
+// NOTE: the tests wipe the public schema of this DB.
+var testPostgresDSN string
+
+func TestMain(m *testing.M) {
+	stop := startTestPostgres()
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// startTestPostgres makes a PostgreSQL DB available to the tests. If
+// MUSIC_TEST_POSTGRES is set it is used as connection string. Otherwise, if
+// initdb and pg_ctl are in PATH, a throwaway cluster is started in a temp
+// directory (listening on a unix socket only) and stopped again afterwards.
+func startTestPostgres() func() {
+	if dsn := os.Getenv("MUSIC_TEST_POSTGRES"); dsn != "" {
+		testPostgresDSN = dsn
+		return func() {}
+	}
+
+	initdb, err1 := exec.LookPath("initdb")
+	pgctl, err2 := exec.LookPath("pg_ctl")
+	if err1 != nil || err2 != nil {
+		log.Printf("initdb/pg_ctl not found, postgres tests will be skipped")
+		return func() {}
+	}
+	if os.Geteuid() == 0 {
+		log.Printf("postgres refuses to run as root, postgres tests will be skipped")
+		return func() {}
+	}
+
+	dir, err := os.MkdirTemp("", "music-pgtest")
+	if err != nil {
+		log.Printf("Error creating temp dir: %v", err)
+		return func() {}
+	}
+	datadir := filepath.Join(dir, "data")
+
+	// any free port will do, it is only used to name the unix socket
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("Error finding a free port: %v", err)
+		return func() { os.RemoveAll(dir) }
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	out, err := exec.Command(initdb, "-D", datadir, "-U", "music", "--auth=trust").CombinedOutput()
+	if err != nil {
+		log.Printf("Error from initdb: %v: %s", err, out)
+		return func() { os.RemoveAll(dir) }
+	}
+	opts := fmt.Sprintf("-k %s -p %d -c listen_addresses=''", dir, port)
+	out, err = exec.Command(pgctl, "-D", datadir, "-o", opts, "-w", "start").CombinedOutput()
+	if err != nil {
+		log.Printf("Error from pg_ctl start: %v: %s", err, out)
+		return func() { os.RemoveAll(dir) }
+	}
+
+	testPostgresDSN = fmt.Sprintf("host=%s port=%d user=music dbname=postgres sslmode=disable", dir, port)
+	return func() {
+		exec.Command(pgctl, "-D", datadir, "-m", "immediate", "stop").Run()
+		os.RemoveAll(dir)
+	}
+}
+
+// forEachBackend runs f once per available backend, each time with a new,
+// empty and not yet migrated MusicDB.
+func forEachBackend(t *testing.T, f func(t *testing.T, mdb *MusicDB)) {
+	t.Run("sqlite", func(t *testing.T) {
+		mdb, err := OpenDB(filepath.Join(t.TempDir(), "music.db"), "sqlite")
+		if err != nil {
+			t.Fatalf("OpenDB: %v", err)
+		}
+		defer mdb.Close()
+		f(t, mdb)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		if testPostgresDSN == "" {
+			t.Skip("no PostgreSQL available (set MUSIC_TEST_POSTGRES or put initdb and pg_ctl in PATH)")
+		}
+		mdb, err := OpenDB(testPostgresDSN, "postgres")
+		if err != nil {
+			t.Fatalf("OpenDB: %v", err)
+		}
+		defer mdb.Close()
+		for _, sqlq := range []string{"DROP SCHEMA public CASCADE", "CREATE SCHEMA public"} {
+			if _, err = mdb.Exec(sqlq); err != nil {
+				t.Fatalf("Error resetting postgres schema: %v", err)
+			}
+		}
+		f(t, mdb)
+	})
+}
+
+func TestNewDBBackend(t *testing.T) {
+	for mode, want := range map[string]string{
+		"":         "sqlite",
+		"WAL":      "sqlite",
+		"sqlite":   "sqlite",
+		"postgres": "postgres",
+	} {
+		b, err := NewDBBackend(mode)
+		if err != nil {
+			t.Errorf("NewDBBackend(%s): %v", mode, err)
+			continue
+		}
+		if b.Name() != want {
+			t.Errorf("NewDBBackend(%s): got %s wanted %s", mode, b.Name(), want)
+		}
+	}
+	if _, err := NewDBBackend("mysql"); err == nil {
+		t.Errorf("NewDBBackend(mysql): got no error")
+	}
+}
+
+func TestPostgresDialect(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{
+			"SELECT name FROM zones WHERE name=? AND sgroup=?",
+			"SELECT name FROM zones WHERE name=$1 AND sgroup=$2",
+		},
+		{
+			"UPDATE zones SET state=? WHERE name='what?' AND fsm=?",
+			"UPDATE zones SET state=$1 WHERE name='what?' AND fsm=$2",
+		},
+		{
+			"INSERT OR IGNORE INTO zone_nses (zone, ns, signer) VALUES (?, ?, ?)",
+			"INSERT INTO zone_nses (zone, ns, signer) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		},
+		{
+			"INSERT OR REPLACE INTO metadata (zone, key, time, value) VALUES (?, ?, datetime('now'), ?)",
+			"INSERT INTO metadata (zone, key, time, value) VALUES ($1, $2, " + pgNowText +
+				", $3) ON CONFLICT (zone, key) DO UPDATE SET time=EXCLUDED.time, value=EXCLUDED.value",
+		},
+		{
+			"INSERT OR REPLACE INTO signergroups(name) VALUES (?)",
+			"INSERT INTO signergroups (name) VALUES ($1) ON CONFLICT (name) DO UPDATE SET " +
+				"locked=EXCLUDED.locked, curprocess=EXCLUDED.curprocess, pendadd=EXCLUDED.pendadd, " +
+				"pendremove=EXCLUDED.pendremove",
+		},
+		{
+			"CREATE TABLE IF NOT EXISTS 'x' (id INTEGER PRIMARY KEY, t DATETIME, b BOOLEAN NOT NULL DEFAULT 1 CHECK (b IN (0, 1)))",
+			"CREATE TABLE IF NOT EXISTS x (id SERIAL PRIMARY KEY, t TEXT, b BOOLEAN NOT NULL DEFAULT TRUE)",
+		},
+		{
+			"ALTER TABLE 'zones' ADD COLUMN foo DATETIME",
+			"ALTER TABLE zones ADD COLUMN foo TEXT",
+		},
+	}
+	for _, tt := range tests {
+		if got := PostgresDialect(tt.in); got != tt.want {
+			t.Errorf("PostgresDialect(%s):\ngot  %s\nwant %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBackendOps(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		if _, err := mdb.Migrate(false); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+
+		if _, err := mdb.AddSignerGroup(nil, "group1"); err != nil {
+			t.Fatalf("AddSignerGroup: %v", err)
+		}
+		if _, err := mdb.GetSignerGroup(nil, "group1", false); err != nil {
+			t.Errorf("GetSignerGroup: %v", err)
+		}
+
+		s := &Signer{Name: "signer1", Method: "ddns", Address: "127.0.0.1", Port: "53", UseTcp: true}
+		if _, err := mdb.AddSigner(nil, s, ""); err != nil {
+			t.Fatalf("AddSigner: %v", err)
+		}
+		dbsigner, err := mdb.GetSignerByName(nil, "signer1", false)
+		if err != nil {
+			t.Fatalf("GetSignerByName: %v", err)
+		}
+		if !dbsigner.UseTcp || dbsigner.UseTSIG {
+			t.Errorf("got UseTcp %v UseTSIG %v wanted true false", dbsigner.UseTcp, dbsigner.UseTSIG)
+		}
+
+		const ignoresql = "INSERT OR IGNORE INTO group_signers (name, signer) VALUES (?, ?)"
+		for i := 0; i < 2; i++ {
+			if _, err := mdb.Exec(ignoresql, "group1", "signer1"); err != nil {
+				t.Fatalf("INSERT OR IGNORE (%d): %v", i, err)
+			}
+		}
+
+		z := &Zone{Name: "test.se.", ZoneType: "normal", FSMMode: "manual"}
+		if _, err := mdb.AddZone(z, "", nil); err != nil {
+			t.Fatalf("AddZone: %v", err)
+		}
+		dbzone, exist, err := mdb.GetZone(nil, "test.se.")
+		if err != nil || !exist {
+			t.Fatalf("GetZone: exist: %v err: %v", exist, err)
+		}
+		for _, v := range []string{"first", "second"} {
+			if _, err := mdb.ZoneSetMeta(nil, dbzone, "stop-reason", v); err != nil {
+				t.Fatalf("ZoneSetMeta(%s): %v", v, err)
+			}
+		}
+		reason, _, err := mdb.GetStopReason(nil, dbzone)
+		if err != nil || reason != "second" {
+			t.Errorf("GetStopReason: got '%s' (err %v) wanted 'second'", reason, err)
+		}
+
+		zones, err := mdb.ListZones()
+		if err != nil || len(zones) != 1 {
+			t.Errorf("ListZones: got %d zones (err %v) wanted 1", len(zones), err)
+		}
+		counts, err := mdb.CountZones()
+		if err != nil || len(counts) != 1 || counts[0].Count != 1 {
+			t.Errorf("CountZones: got %v (err %v) wanted one zone", counts, err)
+		}
+	})
+}
+
+// INSERT OR REPLACE must replace the whole row on all backends, also the
+// columns that are not in the INSERT.
+func TestBackendInsertOrReplace(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		if _, err := mdb.Migrate(false); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		if _, err := mdb.AddSignerGroup(nil, "group1"); err != nil {
+			t.Fatalf("AddSignerGroup: %v", err)
+		}
+		const setsql = "UPDATE signergroups SET locked=1, curprocess=?, pendadd=?, pendremove=? WHERE name=?"
+		if _, err := mdb.Exec(setsql, "add-signer", "signer2", "signer3", "group1"); err != nil {
+			t.Fatalf("UPDATE: %v", err)
+		}
+
+		const replsql = "INSERT OR REPLACE INTO signergroups(name) VALUES (?)"
+		if _, err := mdb.Exec(replsql, "group1"); err != nil {
+			t.Fatalf("INSERT OR REPLACE: %v", err)
+		}
+
+		const getsql = "SELECT COUNT(*), MAX(locked), MAX(curprocess), MAX(pendadd), MAX(pendremove) FROM signergroups WHERE name=?"
+		var count, locked int
+		var curprocess, pendadd, pendremove string
+		err := mdb.db.QueryRow(getsql, "group1").Scan(&count, &locked, &curprocess, &pendadd, &pendremove)
+		if err != nil {
+			t.Fatalf("SELECT: %v", err)
+		}
+		if count != 1 || locked != 0 || curprocess != "" || pendadd != "" || pendremove != "" {
+			t.Errorf("after replace got %d rows locked=%d curprocess='%s' pendadd='%s' pendremove='%s', wanted one row with defaults",
+				count, locked, curprocess, pendadd, pendremove)
+		}
+	})
+}
@@ -14,32 +14,29 @@ type DdnsUpdater struct {
 }
 
 func init() {
-	Updaters["ddns"] = &DdnsUpdater{}
+	RegisterUpdater("ddns", &DdnsUpdater{})
 }
 
 func (u *DdnsUpdater) SetChannels(fetch, update chan SignerOp) {
 	// no-op
 }
 
-func (u *DdnsUpdater) SetApi(api Api) {
+func (u *DdnsUpdater) SetApi(api *Api) {
 	// no-op
 }
 
-func (u *DdnsUpdater) GetApi() Api {
+func (u *DdnsUpdater) GetApi() *Api {
 	// no-op
-	return Api{}
+	return nil
 }
 
-func (signer *Signer) NewDnsClient() dns.Client {
-	var c dns.Client
+func (signer *Signer) NewDnsClient() *dns.Client {
 	if signer.UseTcp {
-		c = dns.Client{Net: "tcp"}
-	} else {
-		log.Printf("DDNS: Accessing signer %s via UDP. This is a debugging mechanism only",
-			signer.Name)
-		c = dns.Client{Net: "udp"}
+		return &dns.Client{Net: "tcp"}
 	}
-	return c
+	log.Printf("DDNS: Accessing signer %s via UDP. This is a debugging mechanism only",
+		signer.Name)
+	return &dns.Client{Net: "udp"}
 }
 
 func (signer *Signer) PrepareTSIGExchange(c *dns.Client, m *dns.Msg) error {
@@ -84,7 +81,7 @@ func (u *DdnsUpdater) Update(signer *Signer, zone, fqdn string,
 
 	c := signer.NewDnsClient()
 	m := new(dns.Msg)
-	m.SetUpdate(fqdn)
+	m.SetUpdate(zone) // the zone that fqdn is in, which is the parent zone for DS and delegation NS
 	if inserts != nil {
 		for _, insert := range *inserts {
 			m.Insert(insert)
@@ -96,7 +93,7 @@ func (u *DdnsUpdater) Update(signer *Signer, zone, fqdn string,
 		}
 	}
 
-	signer.PrepareTSIGExchange(&c, m)
+	signer.PrepareTSIGExchange(c, m)
 
 	in, _, err := c.Exchange(m, signer.Address+":"+signer.Port) // TODO: add DnsAddress or solve this in a better way
 	if err != nil {
@@ -139,7 +136,7 @@ func (u *DdnsUpdater) RemoveRRset(signer *Signer, zone, fqdn string, rrsets [][]
 		m.RemoveRRset(rrset)
 	}
 
-	signer.PrepareTSIGExchange(&c, m)
+	signer.PrepareTSIGExchange(c, m)
 
 	in, _, err := c.Exchange(m, signer.Address+":"+signer.Port) // TODO: add DnsAddress or solve this in a better way
 	if err != nil {
@@ -167,7 +164,7 @@ func (u *DdnsUpdater) FetchRRset(signer *Signer, zone, fqdn string,
 	m.SetQuestion(fqdn, rrtype)
 	// m.SetEdns0(4096, true)
 
-	signer.PrepareTSIGExchange(&c, m)
+	signer.PrepareTSIGExchange(c, m)
 
 	r, _, err := c.Exchange(m, signer.Address+":"+signer.Port) // TODO: add DnsAddress or solve this in a better way
 	if err != nil {
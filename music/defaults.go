@@ -6,7 +6,9 @@ package music
 const (
 	SignerJoinGroupProcess  = "add-signer"
 	SignerLeaveGroupProcess = "remove-signer"
+	SignerSwapGroupProcess  = "swap-signer"
 	VerifyZoneInSyncProcess = "verify-zone-sync"
+	ZoneMoveProcess         = "move-zone"
 
 	SignerGroupMinimumSigners = 1
 )
@@ -66,7 +66,17 @@ func xxDesecLogin(cc *CliConfig, tokvip *viper.Viper) (DesecLResponse, error) {
 	return dlr, nil
 }
 
+// DesecTokenOwner is the owner of the deSEC token in the token file, see SecretBox.Seal.
+const DesecTokenOwner = "desec.token"
+
 func (api *Api) DesecLogin() (DesecLResponse, error) {
+	api.tokmu.Lock()
+	defer api.tokmu.Unlock()
+	return api.desecLogin()
+}
+
+// desecLogin must be called with api.tokmu held.
+func (api *Api) desecLogin() (DesecLResponse, error) {
 	endpoint := "/auth/login/"
 
 	dlp := DesecLPost{
@@ -101,7 +111,11 @@ func (api *Api) DesecLogin() (DesecLResponse, error) {
 	if tokvip == nil {
 		log.Fatalf("DesecLogin: Error: tokvip unset.\n")
 	}
-	tokvip.Set("desec.token", dlr.Token)
+	token, err := api.Secrets.Seal(dlr.Token, DesecTokenOwner)
+	if err != nil {
+		return dlr, fmt.Errorf("error encrypting deSEC token: %v", err)
+	}
+	tokvip.Set("desec.token", token)
 	tokvip.Set("desec.created", dlr.Created)
 	tokvip.Set("desec.maxunused", dlr.MaxUnused)
 	tokvip.Set("desec.maxage", dlr.MaxAge)
@@ -161,23 +175,30 @@ func xxDesecTokenRefreshIfNeeded(tokvip *viper.Viper) bool {
 }
 
 func (api *Api) DesecTokenRefresh() bool {
+	api.tokmu.Lock()
+	defer api.tokmu.Unlock()
+
 	tokvip := api.TokViper
 	apikey := api.apiKey
 	// perhaps the token is only on disk (due to restart), if so store it in api again
 	if apikey == "" {
-	   apikey = tokvip.GetString("desec.token")
+	   token, err := api.Secrets.Open(tokvip.GetString("desec.token"), DesecTokenOwner)
+	   if err != nil {
+	   	  log.Printf("DesecTokenRefresh: Error decrypting stored deSEC token: %v", err)
+	   }
+	   apikey = token
 	   api.apiKey = apikey
 	}
 	maxdur, _ := time.ParseDuration(tokvip.GetString("desec.maxunused"))
 	lasttouch, _ := time.Parse(layout, tokvip.GetString("desec.touched"))
 	remaining := time.Until(lasttouch.Add(maxdur))
 
-	fmt.Printf("Time remaining before token '%s' expires: %v\n", apikey, remaining)
+	fmt.Printf("Time remaining before deSEC token expires: %v\n", remaining)
 
 	if remaining.Minutes() < 2 {
 		fmt.Printf("api.DesecTokenRefresh: Less than 2 minutes remain. Need to login again.\n")
 
-		_, err := api.DesecLogin()
+		_, err := api.desecLogin()
 		if err != nil {
 			fmt.Printf("DesecTokenRefresh: deSEC login failed. Error: %v\n", err)
 		} else {
@@ -21,22 +21,22 @@ import (
 )
 
 type DesecUpdater struct {
-	Api Api
+	Api *Api
 }
 
 func init() {
-	Updaters["desec-api"] = &DesecUpdater{}
+	RegisterUpdater("desec-api", &DesecUpdater{Api: &Api{}})
 }
 
 func (u *DesecUpdater) SetChannels(fetch, update chan SignerOp) {
 	// no-op
 }
 
-func (u *DesecUpdater) SetApi(api Api) {
+func (u *DesecUpdater) SetApi(api *Api) {
 	u.Api = api
 }
 
-func (u *DesecUpdater) GetApi() Api {
+func (u *DesecUpdater) GetApi() *Api {
 	return u.Api
 }
 
@@ -244,7 +244,7 @@ func DesecUpdateRRset(s *Signer, zone, owner string, rrtype uint16, rrs []dns.RR
 	api := GetUpdater("desec-api").GetApi()
 	api.DesecTokenRefresh()
 	fmt.Printf("DesecUpdateRRset: deSEC API endpoint: %s. token: %s Data: %v\n",
-		endpoint, api.apiKey, data)
+		endpoint, api.key(), data)
 
 	status, buf, err := api.Post(endpoint, bytebuf.Bytes())
 	if status == 429 { // we have been rate-limited
@@ -316,7 +316,7 @@ func (u *DesecUpdater) Update(signer *Signer, zone, owner string,
 	api := GetUpdater("desec-api").GetApi()
 	api.DesecTokenRefresh()
 	fmt.Printf("DesecUpdater: deSEC API url: %s. token: %s Data: %v\n",
-		endpoint, api.apiKey, desecRRsets)
+		endpoint, api.key(), desecRRsets)
 
 	status, buf, err := api.Put(endpoint, bytebuf.Bytes())
 	if err != nil {
@@ -0,0 +1,600 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// A DesiredState document describes the signers, signer groups (with their
+// members) and zones (with their signer group) that MUSIC should have. It
+// is the declarative alternative to "music-cli signer add", "signergroup
+// add", "zone join", etc: PlanState computes the changes needed to get from
+// the current DB to the desired state and ApplyState performs them, using
+// the same operations as the imperative commands (so joins and leaves start
+// the usual processes).
+//
+// Signer groups and zones that are listed are fully described by the
+// document: signers not listed as members of a group are removed from it,
+// and a zone without a signer group leaves its group. Signers, groups and
+// zones that are not listed at all are only removed if prune is set.
+type DesiredState struct {
+	Signers      []DesiredSigner      `json:"signers" yaml:"signers"`
+	SignerGroups []DesiredSignerGroup `json:"signergroups" yaml:"signergroups"`
+	Zones        []DesiredZone        `json:"zones" yaml:"zones"`
+}
+
+type DesiredSigner struct {
+	Name    string       `json:"name" yaml:"name"`
+	Method  string       `json:"method" yaml:"method"`
+	Address string       `json:"address" yaml:"address"`
+	Port    string       `json:"port" yaml:"port"`
+	UseTcp  bool         `json:"usetcp" yaml:"usetcp"`
+	UseTSIG bool         `json:"usetsig" yaml:"usetsig"`
+	TSIG    *DesiredTSIG `json:"tsig,omitempty" yaml:"tsig,omitempty"` // not set: auth is not managed
+}
+
+// The TSIG key may be given as "${VARIABLE}", which music-cli expands from
+// its environment (see ExpandEnv), so that no secrets need to be committed
+// together with the rest of the desired state.
+type DesiredTSIG struct {
+	Alg  string `json:"alg" yaml:"alg"`
+	Name string `json:"name" yaml:"name"`
+	Key  string `json:"key" yaml:"key"`
+}
+
+type DesiredSignerGroup struct {
+	Name    string   `json:"name" yaml:"name"`
+	Signers []string `json:"signers" yaml:"signers"`
+}
+
+type DesiredZone struct {
+	Name        string `json:"name" yaml:"name"`
+	ZoneType    string `json:"zonetype,omitempty" yaml:"zonetype,omitempty"` // default "normal"
+	FSMMode     string `json:"fsmmode,omitempty" yaml:"fsmmode,omitempty"`   // default "auto"
+	SignerGroup string `json:"signergroup" yaml:"signergroup"`
+}
+
+// StateAction is one step of a plan. Actions that can not be done yet
+// (because a signer group is busy with a process) have Status "waiting" and
+// are done by a later apply.
+type StateAction struct {
+	Op     string // "add" | "update" | "delete" | "join" | "leave" | "move"
+	Kind   string // "signer" | "signergroup" | "zone"
+	Name   string
+	Group  string `json:",omitempty"` // join and leave, the new group for move
+	Detail string `json:",omitempty"`
+	Status string `json:",omitempty"` // "waiting", or after apply "done" | "failed" | "skipped"
+	Msg    string `json:",omitempty"`
+}
+
+func (a StateAction) String() string {
+	s := fmt.Sprintf("%s %s %s", a.Op, a.Kind, a.Name)
+	if a.Group != "" {
+		s += " group " + a.Group
+	}
+	if a.Detail != "" {
+		s += " (" + a.Detail + ")"
+	}
+	return s
+}
+
+const (
+	ActionWaiting = "waiting"
+	ActionDone    = "done"
+	ActionFailed  = "failed"
+	ActionSkipped = "skipped"
+)
+
+// ExpandEnv replaces ${VARIABLE} in the TSIG keys with the value of the
+// environment variable.
+func (ds *DesiredState) ExpandEnv() {
+	for i := range ds.Signers {
+		if tsig := ds.Signers[i].TSIG; tsig != nil {
+			tsig.Key = os.ExpandEnv(tsig.Key)
+		}
+	}
+}
+
+// Normalize fills in defaults and makes zone names FQDNs.
+func (ds *DesiredState) Normalize() {
+	for i := range ds.Signers {
+		if ds.Signers[i].Port == "" {
+			ds.Signers[i].Port = "53"
+		}
+	}
+	for i := range ds.Zones {
+		z := &ds.Zones[i]
+		z.Name = dns.Fqdn(z.Name)
+		if z.ZoneType == "" {
+			z.ZoneType = "normal"
+		}
+		if z.FSMMode == "" {
+			z.FSMMode = "auto"
+		}
+	}
+}
+
+// CheckDesiredState verifies that the document is consistent: no duplicates,
+// known signer methods, and group members and zone groups that are part of
+// the document.
+func CheckDesiredState(ds *DesiredState) error {
+	updaters := ListUpdaters()
+	signers := map[string]bool{}
+	for _, s := range ds.Signers {
+		switch {
+		case s.Name == "":
+			return fmt.Errorf("signer without name")
+		case signers[s.Name]:
+			return fmt.Errorf("signer %s listed more than once", s.Name)
+		case !updaters[s.Method]:
+			return fmt.Errorf("signer %s: unknown method '%s'", s.Name, s.Method)
+		case s.TSIG != nil && s.TSIG.Key == "":
+			return fmt.Errorf("signer %s: TSIG key is empty (unset environment variable?)", s.Name)
+		}
+		signers[s.Name] = true
+	}
+
+	groups := map[string]bool{}
+	for _, g := range ds.SignerGroups {
+		switch {
+		case g.Name == "":
+			return fmt.Errorf("signer group without name")
+		case groups[g.Name]:
+			return fmt.Errorf("signer group %s listed more than once", g.Name)
+		}
+		members := map[string]bool{}
+		for _, s := range g.Signers {
+			if !signers[s] {
+				return fmt.Errorf("signer group %s: signer %s is not in the document", g.Name, s)
+			}
+			if members[s] {
+				return fmt.Errorf("signer group %s: signer %s listed more than once", g.Name, s)
+			}
+			members[s] = true
+		}
+		groups[g.Name] = true
+	}
+
+	zones := map[string]bool{}
+	for _, z := range ds.Zones {
+		switch {
+		case z.Name == "" || z.Name == ".":
+			return fmt.Errorf("zone without name")
+		case zones[z.Name]:
+			return fmt.Errorf("zone %s listed more than once", z.Name)
+		case z.SignerGroup != "" && !groups[z.SignerGroup]:
+			return fmt.Errorf("zone %s: signer group %s is not in the document", z.Name, z.SignerGroup)
+		case z.FSMMode != "auto" && z.FSMMode != "manual":
+			return fmt.Errorf("zone %s: fsmmode must be 'auto' or 'manual'", z.Name)
+		}
+		zones[z.Name] = true
+	}
+	return nil
+}
+
+// currentState is the part of the DB that a DesiredState describes.
+type currentState struct {
+	signers map[string]ExportSigner
+	groups  map[string]ExportSignerGroup
+	zones   map[string]DesiredZone
+	fsms    map[string]string // zone --> process it is in
+}
+
+func (mdb *MusicDB) readCurrentState() (*currentState, error) {
+	tx, err := mdb.db.BeginTx(context.Background(),
+		&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		log.Printf("readCurrentState: Error from BeginTx: %v", err)
+		return nil, err
+	}
+	defer tx.Rollback() // read-only, nothing to commit
+
+	cs := &currentState{
+		signers: map[string]ExportSigner{},
+		groups:  map[string]ExportSignerGroup{},
+		zones:   map[string]DesiredZone{},
+		fsms:    map[string]string{},
+	}
+
+	signers, err := mdb.exportSigners(tx, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range signers {
+		cs.signers[s.Name] = s
+	}
+
+	groups, err := exportSignerGroups(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		cs.groups[g.Name] = g
+	}
+
+	const sqlq = `
+SELECT name, COALESCE(zonetype, ''), COALESCE(fsmmode, ''), COALESCE(sgroup, ''), COALESCE(fsm, '') FROM zones`
+	rows, err := tx.Query(sqlq)
+	if CheckSQLError("readCurrentState", sqlq, err, false) {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var z DesiredZone
+		var fsm string
+		if err = rows.Scan(&z.Name, &z.ZoneType, &z.FSMMode, &z.SignerGroup, &fsm); err != nil {
+			return nil, err
+		}
+		cs.zones[z.Name] = z
+		if fsm != "" && fsm != "---" {
+			cs.fsms[z.Name] = fsm
+		}
+	}
+	return cs, rows.Err()
+}
+
+// signerChanges describes how a signer differs from its desired state.
+func signerChanges(cur ExportSigner, ds DesiredSigner) []string {
+	var changes []string
+	if cur.Method != ds.Method {
+		changes = append(changes, fmt.Sprintf("method %s -> %s", cur.Method, ds.Method))
+	}
+	if cur.Address != ds.Address {
+		changes = append(changes, fmt.Sprintf("address %s -> %s", cur.Address, ds.Address))
+	}
+	if cur.Port != ds.Port {
+		changes = append(changes, fmt.Sprintf("port %s -> %s", cur.Port, ds.Port))
+	}
+	if cur.UseTcp != ds.UseTcp {
+		changes = append(changes, fmt.Sprintf("usetcp %v -> %v", cur.UseTcp, ds.UseTcp))
+	}
+	if cur.UseTSIG != ds.UseTSIG {
+		changes = append(changes, fmt.Sprintf("usetsig %v -> %v", cur.UseTSIG, ds.UseTSIG))
+	}
+	if ds.TSIG != nil && cur.Auth != fmt.Sprintf("%s:%s:%s", ds.TSIG.Alg, ds.TSIG.Name, ds.TSIG.Key) {
+		changes = append(changes, "tsig key") // never show the secret
+	}
+	return changes
+}
+
+// PlanState returns the actions needed to get from the current DB to the
+// desired state, in the order in which they must be done. The document must
+// have been normalized.
+func (mdb *MusicDB) PlanState(ds *DesiredState, prune bool) ([]StateAction, error) {
+	if err := CheckDesiredState(ds); err != nil {
+		return nil, err
+	}
+	cs, err := mdb.readCurrentState()
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []StateAction
+	add := func(a StateAction) { actions = append(actions, a) }
+
+	wanted := map[string]bool{} // "kind:name"
+	for _, g := range ds.SignerGroups {
+		wanted["signergroup:"+g.Name] = true
+		if _, exist := cs.groups[g.Name]; !exist {
+			add(StateAction{Op: "add", Kind: "signergroup", Name: g.Name})
+		}
+	}
+
+	for _, s := range ds.Signers {
+		wanted["signer:"+s.Name] = true
+		cur, exist := cs.signers[s.Name]
+		if !exist {
+			add(StateAction{Op: "add", Kind: "signer", Name: s.Name,
+				Detail: fmt.Sprintf("%s %s:%s", s.Method, s.Address, s.Port)})
+			continue
+		}
+		if changes := signerChanges(cur, s); len(changes) > 0 {
+			add(StateAction{Op: "update", Kind: "signer", Name: s.Name,
+				Detail: strings.Join(changes, ", ")})
+		}
+	}
+
+	// number of zones in each group once the zone leaves and joins are done
+	groupzones := map[string]int{}
+	var leaves, moves, joins []StateAction
+	movefrom := map[string]string{} // zone --> group it moves from
+	for _, z := range ds.Zones {
+		wanted["zone:"+z.Name] = true
+		cur, exist := cs.zones[z.Name]
+		if !exist {
+			add(StateAction{Op: "add", Kind: "zone", Name: z.Name,
+				Detail: fmt.Sprintf("type %s, fsmmode %s", z.ZoneType, z.FSMMode)})
+		} else if cur.ZoneType != z.ZoneType || cur.FSMMode != z.FSMMode {
+			add(StateAction{Op: "update", Kind: "zone", Name: z.Name,
+				Detail: fmt.Sprintf("type %s, fsmmode %s", z.ZoneType, z.FSMMode)})
+		}
+		switch {
+		case cur.SignerGroup == z.SignerGroup:
+		case cur.SignerGroup != "" && z.SignerGroup != "":
+			// a zone that changes group moves, it is never unsigned in between
+			moves = append(moves, StateAction{Op: "move", Kind: "zone", Name: z.Name, Group: z.SignerGroup,
+				Detail: "from " + cur.SignerGroup})
+			movefrom[z.Name] = cur.SignerGroup
+		case cur.SignerGroup != "":
+			leaves = append(leaves, StateAction{Op: "leave", Kind: "zone", Name: z.Name, Group: cur.SignerGroup})
+		default:
+			joins = append(joins, StateAction{Op: "join", Kind: "zone", Name: z.Name, Group: z.SignerGroup})
+		}
+		if z.SignerGroup != "" {
+			groupzones[z.SignerGroup]++
+		}
+	}
+	for name, z := range cs.zones {
+		if !wanted["zone:"+name] && z.SignerGroup != "" && !prune {
+			groupzones[z.SignerGroup]++
+		}
+	}
+
+	// a zone can not join or leave a group that is locked by an ongoing
+	// process, and a move needs both groups
+	locked := func(a *StateAction, groups ...string) {
+		for _, name := range groups {
+			if g, exist := cs.groups[name]; exist && g.Locked {
+				a.Status = ActionWaiting
+				a.Detail = fmt.Sprintf("signer group %s busy with '%s' process", name, g.CurrentProcess)
+				return
+			}
+		}
+	}
+	for _, a := range leaves {
+		locked(&a, a.Group)
+		add(a)
+	}
+	for _, a := range moves {
+		locked(&a, movefrom[a.Name], a.Group)
+		if fsm := cs.fsms[a.Name]; fsm != "" && a.Status == "" {
+			a.Status = ActionWaiting
+			a.Detail = fmt.Sprintf("zone busy with '%s' process", fsm)
+		}
+		add(a)
+	}
+	for _, a := range joins {
+		locked(&a, a.Group)
+		add(a)
+	}
+
+	// Signer joins and leaves may start a process for all zones in the
+	// group, and a group can only be in one process at a time. So at most
+	// one such change per group is done in each apply; the rest wait.
+	for _, g := range ds.SignerGroups {
+		cur := cs.groups[g.Name]
+		members := map[string]bool{}
+		for _, s := range cur.Signers {
+			if s != cur.PendingRemoval {
+				members[s] = true
+			}
+		}
+		desired := map[string]bool{}
+		for _, s := range g.Signers {
+			desired[s] = true
+		}
+
+		var changes []StateAction
+		for _, s := range g.Signers { // joins first, never go below the wanted size
+			if !members[s] {
+				changes = append(changes, StateAction{Op: "join", Kind: "signer", Name: s, Group: g.Name})
+			}
+		}
+		for _, s := range sortedKeys(members) {
+			if !desired[s] {
+				changes = append(changes, StateAction{Op: "leave", Kind: "signer", Name: s, Group: g.Name})
+			}
+		}
+
+		busy := ""
+		if cur.CurrentProcess != "" || cur.PendingAddition != "" || cur.PendingRemoval != "" {
+			busy = fmt.Sprintf("signer group busy with '%s' process", cur.CurrentProcess)
+		}
+		nsigners := len(members)
+		for _, a := range changes {
+			if busy != "" {
+				a.Status = ActionWaiting
+				a.Detail = busy
+				add(a)
+				continue
+			}
+			if a.Op == "join" {
+				nsigners++
+				if nsigners > 1 && groupzones[g.Name] > 0 {
+					busy = fmt.Sprintf("waiting for signer %s to join", a.Name)
+					a.Detail = fmt.Sprintf("starts '%s' process for %d zones", SignerJoinGroupProcess, groupzones[g.Name])
+				}
+			} else if groupzones[g.Name] > 0 {
+				busy = fmt.Sprintf("waiting for signer %s to leave", a.Name)
+				a.Detail = fmt.Sprintf("starts '%s' process for %d zones", SignerLeaveGroupProcess, groupzones[g.Name])
+			}
+			add(a)
+		}
+	}
+
+	if prune {
+		zonenames, groupnames, signernames := map[string]bool{}, map[string]bool{}, map[string]bool{}
+		for name := range cs.zones {
+			zonenames[name] = true
+		}
+		for name := range cs.groups {
+			groupnames[name] = true
+		}
+		for name := range cs.signers {
+			signernames[name] = true
+		}
+
+		for _, name := range sortedKeys(zonenames) {
+			if !wanted["zone:"+name] {
+				add(StateAction{Op: "delete", Kind: "zone", Name: name})
+			}
+		}
+		for _, name := range sortedKeys(groupnames) {
+			if !wanted["signergroup:"+name] {
+				add(StateAction{Op: "delete", Kind: "signergroup", Name: name})
+			}
+		}
+		for _, name := range sortedKeys(signernames) {
+			if wanted["signer:"+name] {
+				continue
+			}
+			a := StateAction{Op: "delete", Kind: "signer", Name: name}
+			for _, g := range ds.SignerGroups {
+				for _, s := range cs.groups[g.Name].Signers {
+					if s == name {
+						a.Status = ActionWaiting
+						a.Detail = fmt.Sprintf("still a member of signer group %s", g.Name)
+					}
+				}
+			}
+			add(a)
+		}
+	}
+	return actions, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ApplyState plans and performs the changes needed to reach the desired
+// state. Each change is committed separately, using the same operations as
+// the corresponding API commands. Apply stops at the first failure; the
+// remaining actions are returned as "skipped". Waiting actions are left for
+// a later apply, so applying the same document repeatedly (f.e. from a CI
+// pipeline) eventually reaches the desired state.
+func (mdb *MusicDB) ApplyState(ds *DesiredState, prune bool,
+	enginecheck chan EngineCheck) ([]StateAction, error) {
+	mdb.applymu.Lock()
+	defer mdb.applymu.Unlock()
+
+	actions, err := mdb.PlanState(ds, prune)
+	if err != nil {
+		return nil, err
+	}
+
+	signers := map[string]DesiredSigner{}
+	for _, s := range ds.Signers {
+		signers[s.Name] = s
+	}
+	zones := map[string]DesiredZone{}
+	for _, z := range ds.Zones {
+		zones[z.Name] = z
+	}
+
+	var failed error
+	for i := range actions {
+		a := &actions[i]
+		if a.Status == ActionWaiting {
+			continue
+		}
+		if failed != nil {
+			a.Status = ActionSkipped
+			continue
+		}
+		a.Msg, err = mdb.applyAction(*a, signers, zones, enginecheck)
+		if err != nil {
+			log.Printf("ApplyState: Error from %s: %v", a, err)
+			a.Status = ActionFailed
+			a.Msg = err.Error()
+			failed = fmt.Errorf("%s: %v", a, err)
+			continue
+		}
+		a.Status = ActionDone
+	}
+	return actions, failed
+}
+
+func (mdb *MusicDB) applyAction(a StateAction, signers map[string]DesiredSigner,
+	zones map[string]DesiredZone, enginecheck chan EngineCheck) (string, error) {
+	switch a.Kind + ":" + a.Op {
+	case "signergroup:add":
+		return mdb.AddSignerGroup(nil, a.Name)
+
+	case "signergroup:delete":
+		return mdb.DeleteSignerGroup(nil, a.Name)
+
+	case "signer:add":
+		ds := signers[a.Name]
+		return mdb.AddSigner(nil, desiredSigner(ds), "")
+
+	case "signer:update":
+		dbsigner, err := mdb.GetSignerByName(nil, a.Name, false)
+		if err != nil {
+			return "", err
+		}
+		return mdb.UpdateSigner(nil, dbsigner, *desiredSigner(signers[a.Name]))
+
+	case "signer:delete":
+		dbsigner, err := mdb.GetSignerByName(nil, a.Name, false)
+		if err != nil {
+			return "", err
+		}
+		return mdb.DeleteSigner(nil, dbsigner)
+
+	case "signer:join", "signer:leave":
+		dbsigner, err := mdb.GetSignerByName(nil, a.Name, false)
+		if err != nil {
+			return "", err
+		}
+		if a.Op == "join" {
+			return mdb.SignerJoinGroup(nil, dbsigner, a.Group)
+		}
+		return mdb.SignerLeaveGroup(nil, dbsigner, a.Group)
+
+	case "zone:add":
+		z := zones[a.Name]
+		return mdb.AddZone(&Zone{Name: z.Name, ZoneType: z.ZoneType, FSMMode: z.FSMMode}, "", enginecheck)
+
+	case "zone:update", "zone:delete", "zone:join", "zone:leave", "zone:move":
+		dbzone, _, err := mdb.GetZone(nil, a.Name)
+		if err != nil {
+			return "", err
+		}
+		switch a.Op {
+		case "update":
+			z := zones[a.Name]
+			return mdb.UpdateZone(dbzone, &Zone{ZoneType: z.ZoneType, FSMMode: z.FSMMode}, enginecheck)
+		case "delete":
+			return mdb.DeleteZone(dbzone)
+		case "join":
+			return mdb.ZoneJoinGroup(nil, dbzone, a.Group, enginecheck)
+		case "move":
+			return mdb.ZoneMoveGroup(nil, dbzone, a.Group, enginecheck)
+		default:
+			return mdb.ZoneLeaveGroup(nil, dbzone, a.Group)
+		}
+	}
+	return "", fmt.Errorf("unknown action %s %s", a.Op, a.Kind)
+}
+
+func desiredSigner(ds DesiredSigner) *Signer {
+	s := &Signer{
+		Name:    ds.Name,
+		Method:  ds.Method,
+		Address: ds.Address,
+		Port:    ds.Port,
+		UseTcp:  ds.UseTcp,
+		UseTSIG: ds.UseTSIG,
+	}
+	if ds.TSIG != nil {
+		s.Auth = AuthData{TSIGAlg: ds.TSIG.Alg, TSIGName: ds.TSIG.Name, TSIGKey: ds.TSIG.Key}
+	}
+	return s
+}
@@ -0,0 +1,199 @@
+package music
+
+import (
+	"testing"
+)
+
+func desiredStateTestDB(t *testing.T, mdb *MusicDB) chan EngineCheck {
+	if _, err := mdb.Migrate(false); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	mdb.SetFSMlist(map[string]FSM{
+		SignerJoinGroupProcess:  {Name: SignerJoinGroupProcess, InitialState: "start"},
+		SignerLeaveGroupProcess: {Name: SignerLeaveGroupProcess, InitialState: "start"},
+		ZoneMoveProcess:         {Name: ZoneMoveProcess, InitialState: "start"},
+	})
+	return make(chan EngineCheck, 100)
+}
+
+func testDesiredState() *DesiredState {
+	ds := &DesiredState{
+		Signers: []DesiredSigner{
+			{Name: "signer1", Method: "ddns", Address: "192.0.2.1",
+				TSIG: &DesiredTSIG{Alg: "hmac-sha256.", Name: "musiclab.", Key: "c2VjcmV0"}},
+			{Name: "signer2", Method: "ddns", Address: "192.0.2.2"},
+		},
+		SignerGroups: []DesiredSignerGroup{
+			{Name: "group1", Signers: []string{"signer1"}},
+		},
+		Zones: []DesiredZone{
+			{Name: "test.se", SignerGroup: "group1"},
+		},
+	}
+	ds.Normalize()
+	return ds
+}
+
+func countActions(actions []StateAction, status string) int {
+	n := 0
+	for _, a := range actions {
+		if a.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+func TestApplyState(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		ec := desiredStateTestDB(t, mdb)
+		ds := testDesiredState()
+
+		plan, err := mdb.PlanState(ds, false)
+		if err != nil {
+			t.Fatalf("PlanState: %v", err)
+		}
+		// add group, 2 signers, zone; zone join; signer join
+		if len(plan) != 6 {
+			t.Fatalf("PlanState: got %d actions wanted 6: %v", len(plan), plan)
+		}
+
+		actions, err := mdb.ApplyState(ds, false, ec)
+		if err != nil {
+			t.Fatalf("ApplyState: %v", err)
+		}
+		if n := countActions(actions, ActionDone); n != 6 {
+			t.Fatalf("ApplyState: %d actions done wanted 6: %v", n, actions)
+		}
+
+		s, err := mdb.GetSignerByName(nil, "signer1", false)
+		if err != nil || s.Auth.TSIGKey != "c2VjcmV0" || s.Port != "53" {
+			t.Errorf("signer1: got %+v, %v", s, err)
+		}
+		z, _, err := mdb.GetZone(nil, "test.se.")
+		if err != nil || z.SGname != "group1" || z.FSMMode != "auto" {
+			t.Errorf("test.se.: got %+v, %v", z, err)
+		}
+
+		plan, err = mdb.PlanState(ds, false)
+		if err != nil || len(plan) != 0 {
+			t.Fatalf("PlanState after apply: got %v, %v wanted nothing to do", plan, err)
+		}
+
+		// Adding a signer to a group with zones starts the add-signer
+		// process, so a second change to the group must wait.
+		ds.SignerGroups[0].Signers = []string{"signer2"}
+		actions, err = mdb.ApplyState(ds, false, ec)
+		if err != nil {
+			t.Fatalf("ApplyState: %v", err)
+		}
+		if len(actions) != 2 || actions[0].Op != "join" || actions[0].Status != ActionDone ||
+			actions[1].Op != "leave" || actions[1].Status != ActionWaiting {
+			t.Fatalf("ApplyState: got %v wanted join signer2 done, leave signer1 waiting", actions)
+		}
+		sg, err := mdb.GetSignerGroup(nil, "group1", false)
+		if err != nil || sg.CurrentProcess != SignerJoinGroupProcess || sg.PendingAddition != "signer2" {
+			t.Errorf("group1: got %+v, %v", sg, err)
+		}
+	})
+}
+
+func TestPlanStatePrune(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		ec := desiredStateTestDB(t, mdb)
+		if _, err := mdb.ApplyState(testDesiredState(), false, ec); err != nil {
+			t.Fatalf("ApplyState: %v", err)
+		}
+
+		empty := &DesiredState{}
+		plan, err := mdb.PlanState(empty, false)
+		if err != nil || len(plan) != 0 {
+			t.Errorf("PlanState(empty): got %v, %v wanted nothing to do", plan, err)
+		}
+
+		actions, err := mdb.ApplyState(empty, true, ec)
+		if err != nil {
+			t.Fatalf("ApplyState(prune): %v", err)
+		}
+		if n := countActions(actions, ActionDone); n != 4 {
+			t.Errorf("ApplyState(prune): %d actions done wanted 4: %v", n, actions)
+		}
+		state, err := mdb.ExportState(false)
+		if err != nil {
+			t.Fatalf("ExportState: %v", err)
+		}
+		if len(state.Signers)+len(state.SignerGroups)+len(state.Zones) != 0 {
+			t.Errorf("after prune: got %+v", state)
+		}
+	})
+}
+
+func TestPlanStateMoveZone(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		ec := desiredStateTestDB(t, mdb)
+		ds := testDesiredState()
+		ds.SignerGroups = append(ds.SignerGroups, DesiredSignerGroup{Name: "group2", Signers: []string{"signer2"}})
+		if _, err := mdb.ApplyState(ds, false, ec); err != nil {
+			t.Fatalf("ApplyState: %v", err)
+		}
+
+		// a zone that changes group is moved, not left and joined
+		ds.Zones[0].SignerGroup = "group2"
+		plan, err := mdb.PlanState(ds, false)
+		if err != nil || len(plan) != 1 || plan[0].Op != "move" || plan[0].Status != ActionWaiting {
+			t.Fatalf("PlanState: got %v, %v wanted move waiting for the join process", plan, err)
+		}
+		if _, err := mdb.Exec("UPDATE zones SET fsm='', state='' WHERE name=?", "test.se."); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		plan, err = mdb.PlanState(ds, false)
+		if err != nil {
+			t.Fatalf("PlanState: %v", err)
+		}
+		if len(plan) != 1 || plan[0].Op != "move" || plan[0].Group != "group2" || plan[0].Status != "" {
+			t.Fatalf("PlanState: got %v wanted move zone test.se. to group2", plan)
+		}
+
+		// nothing can join, leave or move while a group is locked
+		if _, err := mdb.Exec("UPDATE signergroups SET locked=1, curprocess=? WHERE name=?",
+			SignerJoinGroupProcess, "group1"); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		plan, err = mdb.PlanState(ds, false)
+		if err != nil || len(plan) != 1 || plan[0].Op != "move" || plan[0].Status != ActionWaiting {
+			t.Errorf("PlanState(locked): got %v, %v wanted move waiting", plan, err)
+		}
+		ds.Zones[0].SignerGroup = ""
+		plan, err = mdb.PlanState(ds, false)
+		if err != nil || len(plan) != 1 || plan[0].Op != "leave" || plan[0].Status != ActionWaiting {
+			t.Errorf("PlanState(locked): got %v, %v wanted leave waiting", plan, err)
+		}
+
+		if _, err := mdb.Exec("UPDATE signergroups SET locked=0, curprocess='' WHERE name=?", "group1"); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		ds.Zones[0].SignerGroup = "group2"
+		actions, err := mdb.ApplyState(ds, false, ec)
+		if err != nil || len(actions) != 1 || actions[0].Status != ActionDone {
+			t.Fatalf("ApplyState(move): got %v, %v", actions, err)
+		}
+		z, _, err := mdb.GetZone(nil, "test.se.")
+		if err != nil || z.FSM != ZoneMoveProcess {
+			t.Errorf("test.se.: got process '%s' (err %v) wanted %s", z.FSM, err, ZoneMoveProcess)
+		}
+	})
+}
+
+func TestCheckDesiredState(t *testing.T) {
+	for name, ds := range map[string]*DesiredState{
+		"unknown method": {Signers: []DesiredSigner{{Name: "s1", Method: "telnet"}}},
+		"unknown member": {SignerGroups: []DesiredSignerGroup{{Name: "g1", Signers: []string{"s1"}}}},
+		"unknown group":  {Zones: []DesiredZone{{Name: "test.se.", SignerGroup: "g1", FSMMode: "auto"}}},
+		"duplicate zone": {Zones: []DesiredZone{{Name: "test.se.", FSMMode: "auto"}, {Name: "test.se.", FSMMode: "auto"}}},
+		"empty tsig key": {Signers: []DesiredSigner{{Name: "s1", Method: "ddns", TSIG: &DesiredTSIG{Key: ""}}}},
+	} {
+		if err := CheckDesiredState(ds); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
@@ -5,9 +5,10 @@
 package music
 
 import (
-        "database/sql"
+	"errors"
 	"log"
 	"strings"
+	"sync"
 )
 
 const (
@@ -16,7 +17,7 @@ SELECT name, zonetype, fsm, fsmsigner, fsmstatus
 FROM zones WHERE fsmmode='auto' AND fsm != '' AND fsmstatus != 'blocked'`
 	AllAutoZones = `
 SELECT name, zonetype, fsm, fsmsigner, fsmstatus
-FROM zones WHERE fsmmode='auto' AND fsm != ''` 
+FROM zones WHERE fsmmode='auto' AND fsm != ''`
 )
 
 // PushZones: Try to move all "auto" zones forward through their respective processes until they
@@ -25,86 +26,113 @@ FROM zones WHERE fsmmode='auto' AND fsm != ''`
 // Note that we also need to add management for:
 // (a) trying stopped zones, but less frequently, as they may have become unwedged
 // (b)
+//
+// No transaction is held while the zones are pushed: moving a zone forward
+// involves DNS queries, DDNS updates and API calls to signers and parents.
+// Each zone is pushed on its own (see ZoneStepFsm), so an error for one zone
+// doesn't affect the others, and up to EngineLimits.Workers zones are pushed
+// in parallel. progress (if not nil) is called every time a zone is done,
+// so that a long run can show that it is still moving.
 
-func (mdb *MusicDB) PushZones(tx *sql.Tx, checkzones map[string]bool, checkall bool) ([]Zone, error) {
-	var zones []Zone
-	var err error
-
-	localtx, tx, err := mdb.StartTransaction(tx)
+func (mdb *MusicDB) PushZones(checkzones map[string]bool, checkall bool, progress func(zone string)) ([]Zone, error) {
+	zones, err := mdb.pushZoneCandidates(checkzones, checkall)
 	if err != nil {
-		log.Printf("ZoneJoinGroup: Error from mdb.StartTransaction(): %v\n", err)
 		return zones, err
 	}
-	defer mdb.CloseTransaction(localtx, tx, err)
+
+	if len(zones) > 0 {
+		zonelist := []string{}
+		for _, z := range zones {
+			zonelist = append(zonelist, z.Name)
+		}
+
+		log.Printf("PushZones: will push on these zones: %v", strings.Join(zonelist, " "))
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		jobs := make(chan Zone)
+		for i := 0; i < mdb.limits.Workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for z := range jobs {
+					tmperr := mdb.PushZone(z)
+					mu.Lock()
+					if err == nil {
+						err = tmperr // save first error encountered
+					}
+					mu.Unlock()
+					if progress != nil {
+						progress(z.Name)
+					}
+				}
+			}()
+		}
+
+		for _, z := range zones {
+			if z.FSMStatus == "delayed" {
+				log.Printf("PushZones: zone %s is delayed until %v. Leaving for now.",
+					z.Name, "time-when zone-has-waited-long-enough")
+			} else {
+				jobs <- z
+			}
+		}
+		close(jobs)
+		wg.Wait()
+	}
+	return zones, err
+}
+
+// pushZoneCandidates returns the zones that PushZones should try to move
+// forward. The rows are read and closed before any zone is pushed.
+func (mdb *MusicDB) pushZoneCandidates(checkzones map[string]bool, checkall bool) ([]Zone, error) {
+	var zones []Zone
 
 	sqlq := AutoZones
 	if checkall {
 		sqlq = AllAutoZones
 	}
 
-	rows, err := tx.Query(sqlq)
-	if err != nil {
-		log.Printf("PushZones: Error from tx.Query(%s): %v", sqlq, err)
+	rows, err := mdb.Query(sqlq)
+	if CheckSQLError("PushZones", sqlq, err, false) {
 		return zones, err
 	}
 	defer rows.Close()
 
-	if CheckSQLError("PushZones", AutoZones, err, false) {
-		return zones, err
-	} else {
-		var name, zonetype, fsm, fsmsigner, fsmstatus string
-		for rows.Next() {
-			err := rows.Scan(&name, &zonetype, &fsm, &fsmsigner, &fsmstatus)
-			if err != nil {
-				log.Fatalf("PushZones: Error from rows.Scan: %v", err)
-			}
-
-			z := Zone{ Name: name, FSMStatus: fsmstatus }
-
-			if len(checkzones) == 0 {
-			   zones = append(zones, z)
-			} else {
-			   if checkzones[name] {
-			      zones = append(zones, z)
-			   }
-			}
+	var name, zonetype, fsm, fsmsigner, fsmstatus string
+	for rows.Next() {
+		err := rows.Scan(&name, &zonetype, &fsm, &fsmsigner, &fsmstatus)
+		if err != nil {
+			log.Fatalf("PushZones: Error from rows.Scan: %v", err)
 		}
-	}
 
-	var tmperr error
-	if len(zones) > 0 {
-	   	      zonelist := []string{}
-		      for _, z := range zones {
-			    zonelist = append(zonelist, z.Name)
-		      }
+		z := Zone{Name: name, FSMStatus: fsmstatus}
 
-		log.Printf("PushZones: will push on these zones: %v", strings.Join(zonelist, " "))
-		for _, z := range zones {
-		        if z.FSMStatus == "delayed" {
-			   log.Printf("PushZones: zone %s is delayed until %v. Leaving for now.",
-			   			  z.Name, "time-when zone-has-waited-long-enough")
-			} else {
-				tmperr = mdb.PushZone(tx, z)
-				if err == nil {
-					err = tmperr // save first error encountered
-				}
-			}
+		if len(checkzones) == 0 || checkzones[name] {
+			zones = append(zones, z)
 		}
-	} 
-	return zones, err
+	}
+	return zones, rows.Err()
 }
 
-func (mdb *MusicDB) PushZone(tx *sql.Tx, z Zone) error {
-	dbzone, _, err := mdb.GetZone(tx, z.Name)
+func (mdb *MusicDB) PushZone(z Zone) error {
+	dbzone, _, err := mdb.GetZone(nil, z.Name)
 	if err != nil {
-	   return err
+		return err
 	}
-	success, _, _ := mdb.ZoneStepFsm(tx, dbzone, "")
 	oldstate := dbzone.State
+
+	release := mdb.signerslots.acquire(zoneSigners(dbzone))
+	success, _, err := mdb.ZoneStepFsm(dbzone, "")
+	release()
+	if errors.Is(err, ErrZoneBusy) {
+		log.Printf("PushZone: zone '%s' is already being processed. Leaving for now.", z.Name)
+		return nil
+	}
 	if success {
-		dbzone, _, err := mdb.GetZone(tx, z.Name)
+		dbzone, _, err := mdb.GetZone(nil, z.Name)
 		if err != nil {
-		   return err
+			return err
 		}
 		log.Printf("PushZone: successfully transitioned zone '%s' from '%s' to '%s'",
 			z.Name, oldstate, dbzone.State)
@@ -112,5 +140,5 @@ func (mdb *MusicDB) PushZone(tx *sql.Tx, z Zone) error {
 		log.Printf("PushZone: failed to transition zone '%s' from state '%s'",
 			z.Name, oldstate)
 	}
-	return nil
+	return err
 }
@@ -0,0 +1,122 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrZoneBusy is returned by ZoneStepFsm when the zone is already being
+// stepped by someone else (another engine worker or an API request).
+var ErrZoneBusy = errors.New("zone is already being processed")
+
+// EngineLimits controls how many zones PushZones works on at the same time.
+type EngineLimits struct {
+	Workers           int // number of zones stepped in parallel
+	SignerConcurrency int // max number of zones per signer stepped in parallel
+}
+
+var DefaultEngineLimits = EngineLimits{
+	Workers:           4,
+	SignerConcurrency: 2,
+}
+
+// zoneLocks ensures that a zone is never stepped twice at the same time.
+type zoneLocks struct {
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+func newZoneLocks() *zoneLocks {
+	return &zoneLocks{busy: map[string]bool{}}
+}
+
+// lock returns false if the zone is already locked.
+func (zl *zoneLocks) lock(zone string) bool {
+	zl.mu.Lock()
+	defer zl.mu.Unlock()
+	if zl.busy[zone] {
+		return false
+	}
+	zl.busy[zone] = true
+	return true
+}
+
+func (zl *zoneLocks) unlock(zone string) {
+	zl.mu.Lock()
+	defer zl.mu.Unlock()
+	delete(zl.busy, zone)
+}
+
+// signerSlots limits the number of zones per signer that are worked on at
+// the same time, so that the (rate-limited) signer updaters see an orderly
+// stream of operations rather than everything at once.
+type signerSlots struct {
+	mu    sync.Mutex
+	max   int
+	slots map[string]chan struct{}
+}
+
+func newSignerSlots(max int) *signerSlots {
+	if max < 1 {
+		max = 1
+	}
+	return &signerSlots{max: max, slots: map[string]chan struct{}{}}
+}
+
+func (ss *signerSlots) get(signer string) chan struct{} {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ch, exist := ss.slots[signer]
+	if !exist {
+		ch = make(chan struct{}, ss.max)
+		ss.slots[signer] = ch
+	}
+	return ch
+}
+
+// acquire blocks until there is a free slot for each of the signers and
+// returns a function that releases them again. The slots are always taken in
+// the same (sorted) order, to avoid deadlocks between zones that share
+// several signers.
+func (ss *signerSlots) acquire(signers []string) func() {
+	sort.Strings(signers)
+	var taken []chan struct{}
+	for _, s := range signers {
+		ch := ss.get(s)
+		ch <- struct{}{}
+		taken = append(taken, ch)
+	}
+	return func() {
+		for _, ch := range taken {
+			<-ch
+		}
+	}
+}
+
+// SetEngineLimits changes the concurrency limits used by PushZones. It must
+// not be called while PushZones is running.
+func (mdb *MusicDB) SetEngineLimits(limits EngineLimits) {
+	if limits.Workers < 1 {
+		limits.Workers = 1
+	}
+	if limits.SignerConcurrency < 1 {
+		limits.SignerConcurrency = 1
+	}
+	mdb.limits = limits
+	mdb.signerslots = newSignerSlots(limits.SignerConcurrency)
+}
+
+func zoneSigners(z *Zone) []string {
+	var signers []string
+	if z.SGroup != nil {
+		for name := range z.SGroup.Signers() {
+			signers = append(signers, name)
+		}
+	}
+	return signers
+}
@@ -0,0 +1,59 @@
+package music
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestZoneLocks(t *testing.T) {
+	zl := newZoneLocks()
+	if !zl.lock("a.se.") {
+		t.Fatalf("lock(a.se.): got false for an unlocked zone")
+	}
+	if zl.lock("a.se.") {
+		t.Errorf("lock(a.se.): got true for a locked zone")
+	}
+	if !zl.lock("b.se.") {
+		t.Errorf("lock(b.se.): got false for an unlocked zone")
+	}
+	zl.unlock("a.se.")
+	if !zl.lock("a.se.") {
+		t.Errorf("lock(a.se.): got false after unlock")
+	}
+}
+
+func TestSignerSlots(t *testing.T) {
+	const max = 2
+	ss := newSignerSlots(max)
+
+	var running, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			signers := []string{"signer1", "signer2"}
+			if i%2 == 1 {
+				signers = []string{"signer2", "signer1"} // order must not matter
+			}
+			release := ss.acquire(signers)
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			release()
+		}(i)
+	}
+	wg.Wait()
+
+	if peak > max {
+		t.Errorf("got %d zones in parallel per signer, wanted at most %d", peak, max)
+	}
+}
@@ -0,0 +1,363 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A minimal EPP client (RFC 5730, RFC 5734) for updating the delegation of a
+// zone at a registry: domain:info and domain:update (RFC 5731) with the
+// secDNS extension (RFC 5910) for DS data and host objects (RFC 5732) for
+// the nameservers. Host objects that do not exist at the registry are
+// created first, with addresses for in-bailiwick nameservers.
+
+const (
+	eppNSEpp     = "urn:ietf:params:xml:ns:epp-1.0"
+	eppNSDomain  = "urn:ietf:params:xml:ns:domain-1.0"
+	eppNSHost    = "urn:ietf:params:xml:ns:host-1.0"
+	eppNSSecDNS  = "urn:ietf:params:xml:ns:secDNS-1.1"
+	eppMaxFrame  = 1 << 20
+	eppRWTimeout = 30 * time.Second
+)
+
+type EPPConf struct {
+	Address  string // host:port, f.e. epp.registry.example:700
+	Username string
+	Password string
+	TLS      bool
+	Insecure bool // do not verify the server certificate (test setups only)
+}
+
+type EPPClient struct {
+	Conf   EPPConf
+	conn   net.Conn
+	trid   int
+	logged bool
+}
+
+type eppResult struct {
+	Code int    `xml:"code,attr"`
+	Msg  string `xml:"msg"`
+}
+
+type eppDsData struct {
+	KeyTag     uint16 `xml:"keyTag"`
+	Alg        uint8  `xml:"alg"`
+	DigestType uint8  `xml:"digestType"`
+	Digest     string `xml:"digest"`
+}
+
+type eppResponse struct {
+	Results []eppResult `xml:"response>result"`
+	Domain  struct {
+		Name string   `xml:"name"`
+		NS   []string `xml:"ns>hostObj"`
+	} `xml:"response>resData>infData"`
+	Hosts []struct {
+		Name  string `xml:",chardata"`
+		Avail string `xml:"avail,attr"`
+	} `xml:"response>resData>chkData>cd>name"`
+	DsData []eppDsData `xml:"response>extension>infData>dsData"`
+}
+
+// Connect opens the session: it connects, reads the greeting and logs in.
+func (c *EPPClient) Connect() error {
+	var err error
+	dialer := &net.Dialer{Timeout: eppRWTimeout}
+	if c.Conf.TLS {
+		host, _, _ := net.SplitHostPort(c.Conf.Address)
+		c.conn, err = tls.DialWithDialer(dialer, "tcp", c.Conf.Address, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: c.Conf.Insecure,
+		})
+	} else {
+		c.conn, err = dialer.Dial("tcp", c.Conf.Address)
+	}
+	if err != nil {
+		return fmt.Errorf("EPP: unable to connect to %s: %v", c.Conf.Address, err)
+	}
+
+	if _, err := c.readFrame(); err != nil { // the greeting
+		c.conn.Close()
+		return fmt.Errorf("EPP: no greeting from %s: %v", c.Conf.Address, err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<login><clID>%s</clID><pw>%s</pw>", eppEscape(c.Conf.Username),
+		eppEscape(c.Conf.Password))
+	b.WriteString("<options><version>1.0</version><lang>en</lang></options>")
+	fmt.Fprintf(&b, "<svcs><objURI>%s</objURI><objURI>%s</objURI>", eppNSDomain, eppNSHost)
+	fmt.Fprintf(&b, "<svcExtension><extURI>%s</extURI></svcExtension></svcs></login>", eppNSSecDNS)
+	if _, err := c.command(b.String(), ""); err != nil {
+		c.conn.Close()
+		return fmt.Errorf("EPP: login to %s failed: %v", c.Conf.Address, err)
+	}
+	c.logged = true
+	return nil
+}
+
+// Close logs out and closes the session.
+func (c *EPPClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	if c.logged {
+		if _, err := c.command("<logout/>", ""); err != nil {
+			log.Printf("EPP: logout from %s: %v", c.Conf.Address, err)
+		}
+		c.logged = false
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// DomainInfo returns the DS data and the nameservers that the registry has
+// for the domain.
+func (c *EPPClient) DomainInfo(domain string) ([]*dns.DS, []string, error) {
+	cmd := fmt.Sprintf("<info><domain:info xmlns:domain=\"%s\"><domain:name hosts=\"all\">%s</domain:name></domain:info></info>",
+		eppNSDomain, eppEscape(eppName(domain)))
+	resp, err := c.command(cmd, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dses []*dns.DS
+	for _, d := range resp.DsData {
+		dses = append(dses, &dns.DS{
+			Hdr:        dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeDS, Class: dns.ClassINET},
+			KeyTag:     d.KeyTag,
+			Algorithm:  d.Alg,
+			DigestType: d.DigestType,
+			Digest:     strings.ToUpper(strings.TrimSpace(d.Digest)),
+		})
+	}
+	var nses []string
+	for _, ns := range resp.Domain.NS {
+		nses = append(nses, dns.Fqdn(strings.ToLower(strings.TrimSpace(ns))))
+	}
+	return dses, nses, nil
+}
+
+// DomainUpdate sends the update as a domain:update. Host objects for added
+// nameservers are created first if the registry does not have them.
+func (c *EPPClient) DomainUpdate(pu ParentUpdate) error {
+	if err := c.ensureHosts(pu.Zone, pu.AddNS); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<update><domain:update xmlns:domain=\"%s\"><domain:name>%s</domain:name>",
+		eppNSDomain, eppEscape(eppName(pu.Zone)))
+	if len(pu.AddNS) > 0 {
+		b.WriteString("<domain:add>" + eppHostObjs(pu.AddNS) + "</domain:add>")
+	}
+	if len(pu.RemoveNS) > 0 {
+		b.WriteString("<domain:rem>" + eppHostObjs(pu.RemoveNS) + "</domain:rem>")
+	}
+	b.WriteString("</domain:update></update>")
+
+	var ext string
+	if len(pu.AddDS) > 0 || len(pu.RemoveDS) > 0 {
+		ext = fmt.Sprintf("<secDNS:update xmlns:secDNS=\"%s\">", eppNSSecDNS)
+		if len(pu.RemoveDS) > 0 {
+			ext += "<secDNS:rem>" + eppDsDatas(pu.RemoveDS) + "</secDNS:rem>"
+		}
+		if len(pu.AddDS) > 0 {
+			ext += "<secDNS:add>" + eppDsDatas(pu.AddDS) + "</secDNS:add>"
+		}
+		ext += "</secDNS:update>"
+	}
+
+	_, err := c.command(b.String(), ext)
+	return err
+}
+
+// ensureHosts creates the host objects that the registry does not have.
+// In-bailiwick nameservers get their addresses from the resolver.
+func (c *EPPClient) ensureHosts(zone string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<check><host:check xmlns:host=\"%s\">", eppNSHost)
+	for _, name := range names {
+		fmt.Fprintf(&b, "<host:name>%s</host:name>", eppEscape(eppName(name)))
+	}
+	b.WriteString("</host:check></check>")
+	resp, err := c.command(b.String(), "")
+	if err != nil {
+		return err
+	}
+
+	for _, host := range resp.Hosts {
+		if host.Avail != "1" && host.Avail != "true" {
+			continue // exists already
+		}
+		name := strings.TrimSpace(host.Name)
+		var addrs []string
+		if dns.IsSubDomain(dns.Fqdn(zone), dns.Fqdn(name)) {
+			addrs, err = lookupAddrs(name)
+			if err != nil {
+				return fmt.Errorf("EPP: host %s needs glue: %v", name, err)
+			}
+		}
+		var hb strings.Builder
+		fmt.Fprintf(&hb, "<create><host:create xmlns:host=\"%s\"><host:name>%s</host:name>", eppNSHost,
+			eppEscape(name))
+		for _, addr := range addrs {
+			ip := "v4"
+			if strings.Contains(addr, ":") {
+				ip = "v6"
+			}
+			fmt.Fprintf(&hb, "<host:addr ip=\"%s\">%s</host:addr>", ip, addr)
+		}
+		hb.WriteString("</host:create></create>")
+		if _, err := c.command(hb.String(), ""); err != nil {
+			return fmt.Errorf("EPP: unable to create host %s: %v", name, err)
+		}
+		log.Printf("EPP: created host %s %v at %s", name, addrs, c.Conf.Address)
+	}
+	return nil
+}
+
+// command sends the command (and the extension, if any) and returns the
+// response. Result codes other than 1xxx are returned as errors.
+func (c *EPPClient) command(cmd, ext string) (*eppResponse, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("EPP: not connected")
+	}
+	c.trid++
+	var b strings.Builder
+	fmt.Fprintf(&b, "<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"no\"?><epp xmlns=\"%s\"><command>", eppNSEpp)
+	b.WriteString(cmd)
+	if ext != "" {
+		b.WriteString("<extension>" + ext + "</extension>")
+	}
+	fmt.Fprintf(&b, "<clTRID>music-%d-%d</clTRID></command></epp>", time.Now().Unix(), c.trid)
+
+	if err := c.writeFrame([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	data, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	var resp eppResponse
+	if err := xml.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("EPP: unable to parse response: %v", err)
+	}
+	if len(resp.Results) == 0 {
+		return nil, fmt.Errorf("EPP: response without result")
+	}
+	for _, res := range resp.Results {
+		if res.Code < 1000 || res.Code >= 2000 {
+			return &resp, fmt.Errorf("EPP: %d %s", res.Code, res.Msg)
+		}
+	}
+	return &resp, nil
+}
+
+// EPP over TCP frames each message with a 4 byte length that includes itself.
+func (c *EPPClient) writeFrame(data []byte) error {
+	c.conn.SetDeadline(time.Now().Add(eppRWTimeout))
+	return eppWriteFrame(c.conn, data)
+}
+
+func (c *EPPClient) readFrame() ([]byte, error) {
+	c.conn.SetDeadline(time.Now().Add(eppRWTimeout))
+	return eppReadFrame(c.conn)
+}
+
+func eppWriteFrame(w io.Writer, data []byte) error {
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(4+len(data)))
+	_, err := w.Write(append(buf, data...))
+	return err
+}
+
+func eppReadFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(hdr[:])
+	if length < 4 || length > eppMaxFrame {
+		return nil, fmt.Errorf("EPP: bad frame length %d", length)
+	}
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func eppEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// eppName returns the name the way registries want it: without the final dot.
+func eppName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+func eppHostObjs(names []string) string {
+	var b strings.Builder
+	b.WriteString("<domain:ns>")
+	for _, name := range names {
+		fmt.Fprintf(&b, "<domain:hostObj>%s</domain:hostObj>", eppEscape(eppName(name)))
+	}
+	b.WriteString("</domain:ns>")
+	return b.String()
+}
+
+func eppDsDatas(dses []*dns.DS) string {
+	var b strings.Builder
+	for _, ds := range dses {
+		fmt.Fprintf(&b, "<secDNS:dsData><secDNS:keyTag>%d</secDNS:keyTag><secDNS:alg>%d</secDNS:alg>",
+			ds.KeyTag, ds.Algorithm)
+		fmt.Fprintf(&b, "<secDNS:digestType>%d</secDNS:digestType><secDNS:digest>%s</secDNS:digest></secDNS:dsData>",
+			ds.DigestType, strings.ToUpper(ds.Digest))
+	}
+	return b.String()
+}
+
+// EPPParentUpdater is a ParentUpdater that talks EPP to a registry (or a
+// registrar that offers EPP). Every operation is a session of its own.
+type EPPParentUpdater struct {
+	Conf EPPConf
+}
+
+func (epu *EPPParentUpdater) Current(zone string) ([]*dns.DS, []string, error) {
+	c := &EPPClient{Conf: epu.Conf}
+	if err := c.Connect(); err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+	return c.DomainInfo(zone)
+}
+
+func (epu *EPPParentUpdater) Update(pu ParentUpdate) error {
+	c := &EPPClient{Conf: epu.Conf}
+	if err := c.Connect(); err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.DomainUpdate(pu)
+}
@@ -0,0 +1,97 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEPPParentUpdater(t *testing.T) {
+	s := newMockEPPServer(t, "registrar", "secret")
+	olds := eppDsData{KeyTag: 1111, Alg: 13, DigestType: 2, Digest: "AABBCC"}
+	s.addDomain("test.se", []string{"ns1.example.net"}, []eppDsData{olds})
+
+	epu := &EPPParentUpdater{Conf: EPPConf{Address: s.addr(), Username: "registrar", Password: "secret"}}
+	dses, nses, err := epu.Current("test.se.")
+	if err != nil {
+		t.Fatalf("Current: %v", err)
+	}
+	if len(dses) != 1 || dses[0].KeyTag != 1111 || dses[0].Digest != "AABBCC" {
+		t.Errorf("Current: got DS %v", dses)
+	}
+	if !reflect.DeepEqual(nses, []string{"ns1.example.net."}) {
+		t.Errorf("Current: got NS %v", nses)
+	}
+
+	newds := &dns.DS{KeyTag: 2222, Algorithm: 13, DigestType: 2, Digest: "ddeeff"}
+	err = epu.Update(ParentUpdate{
+		Zone:     "test.se.",
+		AddDS:    []*dns.DS{newds},
+		RemoveDS: dses,
+		AddNS:    []string{"ns2.example.net."},
+		RemoveNS: []string{"ns1.example.net."},
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	d := s.domain("test.se")
+	if !reflect.DeepEqual(d.ns, []string{"ns2.example.net"}) {
+		t.Errorf("Update: registry has NS %v, want ns2.example.net", d.ns)
+	}
+	want := []eppDsData{{KeyTag: 2222, Alg: 13, DigestType: 2, Digest: "DDEEFF"}}
+	if !reflect.DeepEqual(d.ds, want) {
+		t.Errorf("Update: registry has DS %v, want %v", d.ds, want)
+	}
+	if _, exist := s.hosts["ns2.example.net"]; !exist {
+		t.Errorf("Update: host object ns2.example.net was not created")
+	}
+}
+
+func TestEPPErrors(t *testing.T) {
+	s := newMockEPPServer(t, "registrar", "secret")
+
+	epu := &EPPParentUpdater{Conf: EPPConf{Address: s.addr(), Username: "registrar", Password: "wrong"}}
+	if _, _, err := epu.Current("test.se."); err == nil {
+		t.Errorf("Current: login with a bad password succeeded")
+	}
+
+	epu.Conf.Password = "secret"
+	if _, _, err := epu.Current("unknown.se."); err == nil {
+		t.Errorf("Current: got no error for a domain the registry does not have")
+	}
+}
+
+func TestZoneParentUpdater(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+		z, exist, err := mdb.GetZone(nil, "test.se.")
+		if err != nil || !exist {
+			t.Fatalf("GetZone: %v %v", exist, err)
+		}
+
+		pu, err := z.ParentUpdater()
+		if err != nil || pu != nil {
+			t.Errorf("ParentUpdater: got %v, %v for a zone without parentupdater", pu, err)
+		}
+
+		if _, err := mdb.ZoneSetMeta(nil, z, MetaParentUpdater, "test-registry"); err != nil {
+			t.Fatalf("ZoneSetMeta: %v", err)
+		}
+		if _, err := z.ParentUpdater(); err == nil {
+			t.Errorf("ParentUpdater: got no error for an unconfigured parent updater")
+		}
+
+		epu := &EPPParentUpdater{}
+		RegisterParentUpdater("test-registry", epu)
+		pu, err = z.ParentUpdater()
+		if err != nil || pu != epu {
+			t.Errorf("ParentUpdater: got %v, %v, want the registered parent updater", pu, err)
+		}
+	})
+}
@@ -0,0 +1,243 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// mockEPPServer is a minimal EPP registry (plain TCP, no TLS) that knows
+// login, logout, domain:info, domain:update with secDNS, host:check and
+// host:create. It keeps its state in memory.
+type mockEPPServer struct {
+	username, password string
+
+	mu      sync.Mutex
+	domains map[string]*mockEPPDomain
+	hosts   map[string][]string
+	ln      net.Listener
+}
+
+type mockEPPDomain struct {
+	ns []string
+	ds []eppDsData
+}
+
+type mockEPPCommand struct {
+	Login *struct {
+		ClID string `xml:"clID"`
+		PW   string `xml:"pw"`
+	} `xml:"command>login"`
+	Logout *struct{} `xml:"command>logout"`
+	Info   *struct {
+		Name string `xml:"name"`
+	} `xml:"command>info>info"`
+	Update *struct {
+		Name  string   `xml:"name"`
+		AddNS []string `xml:"add>ns>hostObj"`
+		RemNS []string `xml:"rem>ns>hostObj"`
+	} `xml:"command>update>update"`
+	SecDNS *struct {
+		Add []eppDsData `xml:"add>dsData"`
+		Rem []eppDsData `xml:"rem>dsData"`
+	} `xml:"command>extension>update"`
+	Check *struct {
+		Names []string `xml:"name"`
+	} `xml:"command>check>check"`
+	Create *struct {
+		Name  string   `xml:"name"`
+		Addrs []string `xml:"addr"`
+	} `xml:"command>create>create"`
+	TRID string `xml:"command>clTRID"`
+}
+
+func newMockEPPServer(t *testing.T, username, password string) *mockEPPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("mock EPP server: %v", err)
+	}
+	s := &mockEPPServer{
+		username: username,
+		password: password,
+		domains:  map[string]*mockEPPDomain{},
+		hosts:    map[string][]string{},
+		ln:       ln,
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *mockEPPServer) addr() string { return s.ln.Addr().String() }
+
+func (s *mockEPPServer) addDomain(name string, ns []string, ds []eppDsData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range ns {
+		s.hosts[h] = nil
+	}
+	s.domains[name] = &mockEPPDomain{ns: ns, ds: ds}
+}
+
+func (s *mockEPPServer) domain(name string) mockEPPDomain {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := *s.domains[name]
+	ns := append([]string{}, d.ns...)
+	sort.Strings(ns)
+	return mockEPPDomain{ns: ns, ds: append([]eppDsData{}, d.ds...)}
+}
+
+func (s *mockEPPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	greeting := fmt.Sprintf("<epp xmlns=\"%s\"><greeting><svID>mock</svID></greeting></epp>", eppNSEpp)
+	if eppWriteFrame(conn, []byte(greeting)) != nil {
+		return
+	}
+	loggedin := false
+	for {
+		data, err := eppReadFrame(conn)
+		if err != nil {
+			return
+		}
+		var cmd mockEPPCommand
+		if err := xml.Unmarshal(data, &cmd); err != nil {
+			s.reply(conn, 2001, "Command syntax error", "", "", "")
+			continue
+		}
+
+		switch {
+		case cmd.Login != nil:
+			if cmd.Login.ClID != s.username || cmd.Login.PW != s.password {
+				s.reply(conn, 2200, "Authentication error", "", "", cmd.TRID)
+				return
+			}
+			loggedin = true
+			s.reply(conn, 1000, "Command completed successfully", "", "", cmd.TRID)
+		case !loggedin:
+			s.reply(conn, 2002, "Command use error", "", "", cmd.TRID)
+		case cmd.Logout != nil:
+			s.reply(conn, 1500, "Command completed successfully; ending session", "", "", cmd.TRID)
+			return
+		default:
+			code, msg, resdata, ext := s.handle(&cmd)
+			s.reply(conn, code, msg, resdata, ext, cmd.TRID)
+		}
+	}
+}
+
+func (s *mockEPPServer) handle(cmd *mockEPPCommand) (int, string, string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case cmd.Info != nil:
+		d, exist := s.domains[cmd.Info.Name]
+		if !exist {
+			return 2303, "Object does not exist", "", ""
+		}
+		resdata := fmt.Sprintf("<domain:infData xmlns:domain=\"%s\"><domain:name>%s</domain:name>%s</domain:infData>",
+			eppNSDomain, cmd.Info.Name, eppHostObjs(d.ns))
+		var dses []*dns.DS
+		for _, ds := range d.ds {
+			dses = append(dses, &dns.DS{KeyTag: ds.KeyTag, Algorithm: ds.Alg, DigestType: ds.DigestType,
+				Digest: ds.Digest})
+		}
+		ext := fmt.Sprintf("<secDNS:infData xmlns:secDNS=\"%s\">%s</secDNS:infData>", eppNSSecDNS,
+			eppDsDatas(dses))
+		return 1000, "Command completed successfully", resdata, ext
+
+	case cmd.Update != nil:
+		d, exist := s.domains[cmd.Update.Name]
+		if !exist {
+			return 2303, "Object does not exist", "", ""
+		}
+		for _, ns := range cmd.Update.AddNS {
+			if _, exist := s.hosts[ns]; !exist {
+				return 2303, "Object does not exist: host " + ns, "", ""
+			}
+		}
+		ns := map[string]bool{}
+		for _, h := range d.ns {
+			ns[h] = true
+		}
+		for _, h := range cmd.Update.RemNS {
+			delete(ns, h)
+		}
+		for _, h := range cmd.Update.AddNS {
+			ns[h] = true
+		}
+		d.ns = nil
+		for h := range ns {
+			d.ns = append(d.ns, h)
+		}
+		if cmd.SecDNS != nil {
+			var keep []eppDsData
+			for _, ds := range d.ds {
+				removed := false
+				for _, rem := range cmd.SecDNS.Rem {
+					if ds == rem {
+						removed = true
+					}
+				}
+				if !removed {
+					keep = append(keep, ds)
+				}
+			}
+			d.ds = append(keep, cmd.SecDNS.Add...)
+		}
+		return 1000, "Command completed successfully", "", ""
+
+	case cmd.Check != nil:
+		var b strings.Builder
+		fmt.Fprintf(&b, "<host:chkData xmlns:host=\"%s\">", eppNSHost)
+		for _, name := range cmd.Check.Names {
+			avail := "1"
+			if _, exist := s.hosts[name]; exist {
+				avail = "0"
+			}
+			fmt.Fprintf(&b, "<host:cd><host:name avail=\"%s\">%s</host:name></host:cd>", avail, name)
+		}
+		b.WriteString("</host:chkData>")
+		return 1000, "Command completed successfully", b.String(), ""
+
+	case cmd.Create != nil:
+		if _, exist := s.hosts[cmd.Create.Name]; exist {
+			return 2302, "Object exists", "", ""
+		}
+		s.hosts[cmd.Create.Name] = cmd.Create.Addrs
+		return 1000, "Command completed successfully", "", ""
+	}
+	return 2101, "Unimplemented command", "", ""
+}
+
+func (s *mockEPPServer) reply(conn net.Conn, code int, msg, resdata, ext, trid string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<epp xmlns=\"%s\"><response><result code=\"%d\"><msg>%s</msg></result>", eppNSEpp, code, msg)
+	if resdata != "" {
+		b.WriteString("<resData>" + resdata + "</resData>")
+	}
+	if ext != "" {
+		b.WriteString("<extension>" + ext + "</extension>")
+	}
+	fmt.Fprintf(&b, "<trID><clTRID>%s</clTRID><svTRID>mock</svTRID></trID></response></epp>", trid)
+	eppWriteFrame(conn, []byte(b.String()))
+}
@@ -0,0 +1,140 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event types published on MusicDB.EventC
+const (
+	EventStateTransition = "state-transition"
+	EventStopReason      = "stop-reason" // i.e. the zone is now blocked
+	EventZoneUnblocked   = "zone-unblocked"
+	EventDelay           = "delay"
+	EventProcessStart    = "process-start"
+	EventProcessComplete = "process-complete"
+	EventSignerOpFailure = "signer-op-failure"
+	EventParentUpdate    = "parent-update" // DS or NS changed in the parent by the parent agent
+)
+
+// A MusicEvent describes something that happened to a zone, signer group or
+// signer. Events are sent to the event manager in musicd (via MusicDB.EventC)
+// which passes them on to whoever is listening.
+type MusicEvent struct {
+	Seq         uint64 // assigned by the event manager
+	Time        time.Time
+	Type        string
+	Zone        string `json:",omitempty"`
+	SignerGroup string `json:",omitempty"`
+	Signer      string `json:",omitempty"`
+	Process     string `json:",omitempty"`
+	From        string `json:",omitempty"` // state transitions only
+	To          string `json:",omitempty"` // state transitions only
+	Reason      string `json:",omitempty"` // stop-reason, delay, signer op error, etc
+	Updater     string `json:",omitempty"` // signer op failures only
+}
+
+// PublishEvent sends an event to the event manager. It never blocks: if there
+// is no event manager (EventC is nil), or it is not keeping up, the event is
+// dropped. Events are informational, the DB remains the source of truth.
+func (mdb *MusicDB) PublishEvent(ev MusicEvent) {
+	if mdb == nil || mdb.EventC == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	select {
+	case mdb.EventC <- ev:
+	default:
+		log.Printf("PublishEvent: event queue full. Dropping %s event for zone '%s'", ev.Type, ev.Zone)
+	}
+}
+
+// Events about changes made in a transaction must not reach subscribers
+// (and webhooks) before the change is committed: if the transaction is
+// rolled back the event is false. PublishEventTx therefore holds on to them
+// until CloseTransaction (or Rollback) knows the outcome.
+type txEvents struct {
+	mu     sync.Mutex
+	events map[*sql.Tx][]MusicEvent
+}
+
+func newTxEvents() *txEvents {
+	return &txEvents{events: map[*sql.Tx][]MusicEvent{}}
+}
+
+// PublishEventTx publishes the event once tx has been committed. The event
+// is dropped if tx is rolled back. With tx == nil it is published right away.
+func (mdb *MusicDB) PublishEventTx(tx *sql.Tx, ev MusicEvent) {
+	if mdb == nil || mdb.EventC == nil {
+		return
+	}
+	if tx == nil || mdb.txevents == nil {
+		mdb.PublishEvent(ev)
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	mdb.txevents.mu.Lock()
+	defer mdb.txevents.mu.Unlock()
+	mdb.txevents.events[tx] = append(mdb.txevents.events[tx], ev)
+}
+
+// txDone publishes the events held for tx if it was committed and drops them otherwise.
+func (mdb *MusicDB) txDone(tx *sql.Tx, committed bool) {
+	if mdb.txevents == nil {
+		return
+	}
+	mdb.txevents.mu.Lock()
+	events := mdb.txevents.events[tx]
+	delete(mdb.txevents.events, tx)
+	mdb.txevents.mu.Unlock()
+
+	if !committed {
+		if len(events) > 0 {
+			log.Printf("Transaction rolled back. Dropping %d events", len(events))
+		}
+		return
+	}
+	for _, ev := range events {
+		mdb.PublishEvent(ev)
+	}
+}
+
+var opFailureCounter func(signer, updater string)
+
+// SetOpFailureCounter makes OpFailed call count for every failed signer
+// operation. Unlike the signer-op-failure events, which are dropped when
+// the event queue or a subscriber is full, no failure is missed. It must
+// be called before any updater is used.
+func SetOpFailureCounter(count func(signer, updater string)) {
+	opFailureCounter = count
+}
+
+// OpFailed publishes a signer-op-failure event. It is called (via the
+// updater returned by GetUpdater) whenever an operation towards the signer
+// fails, f.e. because the signer is unreachable or refuses the update.
+func (s *Signer) OpFailed(class, zone, op string, err error) {
+	if s == nil {
+		return
+	}
+	if opFailureCounter != nil {
+		opFailureCounter(s.Name, class)
+	}
+	s.DB.PublishEvent(MusicEvent{
+		Type:    EventSignerOpFailure,
+		Zone:    zone,
+		Signer:  s.Name,
+		Updater: class,
+		Reason:  fmt.Sprintf("%s: %v", op, err),
+	})
+}
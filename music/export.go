@@ -0,0 +1,510 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A MusicState document holds everything that is needed to recreate a MUSIC
+// installation: signers, signer groups and their members, zones with their
+// process state, metadata and the RRs collected from the signers. It is
+// written by "music-cli db export" and read by "music-cli db import".
+//
+// Bump MusicStateVersion when the document changes in a way that older
+// versions of MUSIC can not read.
+const (
+	MusicStateFormat  = "music-state"
+	MusicStateVersion = 1
+
+	// RedactedSecret replaces signer secrets in a redacted export. On import
+	// the secrets of existing signers are kept.
+	RedactedSecret = "REDACTED"
+)
+
+type MusicState struct {
+	Format        string              `json:"format" yaml:"format"`
+	Version       int                 `json:"version" yaml:"version"`
+	SchemaVersion int                 `json:"schemaversion" yaml:"schemaversion"` // informational
+	Exported      time.Time           `json:"exported" yaml:"exported"`
+	Redacted      bool                `json:"redacted" yaml:"redacted"`
+	Signers       []ExportSigner      `json:"signers" yaml:"signers"`
+	SignerGroups  []ExportSignerGroup `json:"signergroups" yaml:"signergroups"`
+	Zones         []ExportZone        `json:"zones" yaml:"zones"`
+}
+
+type ExportSigner struct {
+	Name    string `json:"name" yaml:"name"`
+	Method  string `json:"method" yaml:"method"`
+	Auth    string `json:"auth" yaml:"auth"` // "alg:name:secret" for TSIG
+	Address string `json:"address" yaml:"address"`
+	Port    string `json:"port" yaml:"port"`
+	UseTcp  bool   `json:"usetcp" yaml:"usetcp"`
+	UseTSIG bool   `json:"usetsig" yaml:"usetsig"`
+}
+
+type ExportSignerGroup struct {
+	Name            string   `json:"name" yaml:"name"`
+	Locked          bool     `json:"locked" yaml:"locked"`
+	CurrentProcess  string   `json:"currentprocess" yaml:"currentprocess"`
+	PendingAddition string   `json:"pendingaddition" yaml:"pendingaddition"`
+	PendingRemoval  string   `json:"pendingremoval" yaml:"pendingremoval"`
+	Signers         []string `json:"signers" yaml:"signers"`
+}
+
+type ExportZone struct {
+	Name        string           `json:"name" yaml:"name"`
+	ZoneType    string           `json:"zonetype" yaml:"zonetype"`
+	SignerGroup string           `json:"signergroup" yaml:"signergroup"`
+	FSM         string           `json:"fsm" yaml:"fsm"`
+	State       string           `json:"state" yaml:"state"`
+	Statestamp  string           `json:"statestamp" yaml:"statestamp"`
+	FSMSigner   string           `json:"fsmsigner" yaml:"fsmsigner"`
+	FSMMode     string           `json:"fsmmode" yaml:"fsmmode"`
+	FSMStatus   string           `json:"fsmstatus" yaml:"fsmstatus"`
+	Metadata    []ExportMetadata `json:"metadata" yaml:"metadata"`
+	DNSKEYs     []ExportRR       `json:"dnskeys" yaml:"dnskeys"`
+	NSes        []ExportRR       `json:"nses" yaml:"nses"`
+	Records     []ExportRecord   `json:"records" yaml:"records"`
+}
+
+type ExportMetadata struct {
+	Key   string `json:"key" yaml:"key"`
+	Time  string `json:"time" yaml:"time"`
+	Value string `json:"value" yaml:"value"`
+}
+
+type ExportRR struct {
+	Signer string `json:"signer" yaml:"signer"`
+	RR     string `json:"rr" yaml:"rr"`
+}
+
+type ExportRecord struct {
+	Owner  string `json:"owner" yaml:"owner"`
+	Signer string `json:"signer" yaml:"signer"`
+	RRtype int    `json:"rrtype" yaml:"rrtype"`
+	Rdata  string `json:"rdata" yaml:"rdata"`
+}
+
+// ExportState reads the complete state of the DB in one read-only
+// transaction, so the result is consistent even if the FSM engine is
+// working at the same time. If redact is true signer secrets are replaced
+// with RedactedSecret.
+func (mdb *MusicDB) ExportState(redact bool) (*MusicState, error) {
+	version, err := mdb.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := mdb.db.BeginTx(context.Background(),
+		&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		log.Printf("ExportState: Error from BeginTx: %v", err)
+		return nil, err
+	}
+	defer tx.Rollback() // read-only, nothing to commit
+
+	state := &MusicState{
+		Format:        MusicStateFormat,
+		Version:       MusicStateVersion,
+		SchemaVersion: version,
+		Exported:      time.Now().UTC(),
+		Redacted:      redact,
+	}
+
+	if state.Signers, err = mdb.exportSigners(tx, redact); err != nil {
+		return nil, err
+	}
+	if state.SignerGroups, err = exportSignerGroups(tx); err != nil {
+		return nil, err
+	}
+	if state.Zones, err = exportZones(tx); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Secrets are exported decrypted, so that the document can be imported
+// into a MUSIC with another master key.
+func (mdb *MusicDB) exportSigners(tx *sql.Tx, redact bool) ([]ExportSigner, error) {
+	const sqlq = `
+SELECT name, method, auth, addr, port, usetcp, usetsig FROM signers ORDER BY name`
+	rows, err := tx.Query(sqlq)
+	if CheckSQLError("ExportState", sqlq, err, false) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var signers []ExportSigner
+	for rows.Next() {
+		var s ExportSigner
+		err = rows.Scan(&s.Name, &s.Method, &s.Auth, &s.Address, &s.Port, &s.UseTcp, &s.UseTSIG)
+		if err != nil {
+			return nil, err
+		}
+		if redact && s.Auth != "" {
+			s.Auth = RedactedSecret
+		} else if s.Auth, err = mdb.openSecret(s.Name, s.Auth); err != nil {
+			return nil, err
+		}
+		signers = append(signers, s)
+	}
+	return signers, rows.Err()
+}
+
+func exportSignerGroups(tx *sql.Tx) ([]ExportSignerGroup, error) {
+	const sqlq = `
+SELECT name, locked, COALESCE(curprocess, ''), COALESCE(pendadd, ''), COALESCE(pendremove, '')
+FROM signergroups ORDER BY name`
+	rows, err := tx.Query(sqlq)
+	if CheckSQLError("ExportState", sqlq, err, false) {
+		return nil, err
+	}
+	var groups []ExportSignerGroup
+	for rows.Next() {
+		var sg ExportSignerGroup
+		var locked int
+		err = rows.Scan(&sg.Name, &locked, &sg.CurrentProcess, &sg.PendingAddition, &sg.PendingRemoval)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sg.Locked = locked == 1
+		groups = append(groups, sg)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	const membersql = "SELECT signer FROM group_signers WHERE name=? ORDER BY signer"
+	for i := range groups {
+		groups[i].Signers, err = exportStrings(tx, membersql, groups[i].Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func exportZones(tx *sql.Tx) ([]ExportZone, error) {
+	const sqlq = `
+SELECT name, zonetype, sgroup, fsm, state, COALESCE(statestamp, ''), fsmsigner, fsmmode, fsmstatus
+FROM zones ORDER BY name`
+	rows, err := tx.Query(sqlq)
+	if CheckSQLError("ExportState", sqlq, err, false) {
+		return nil, err
+	}
+	var zones []ExportZone
+	for rows.Next() {
+		var z ExportZone
+		err = rows.Scan(&z.Name, &z.ZoneType, &z.SignerGroup, &z.FSM, &z.State, &z.Statestamp,
+			&z.FSMSigner, &z.FSMMode, &z.FSMStatus)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		zones = append(zones, z)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range zones {
+		z := &zones[i]
+		if z.Metadata, err = exportMetadata(tx, z.Name); err != nil {
+			return nil, err
+		}
+		const dnskeysql = "SELECT signer, dnskey FROM zone_dnskeys WHERE zone=? ORDER BY signer, dnskey"
+		if z.DNSKEYs, err = exportSignerRRs(tx, dnskeysql, z.Name); err != nil {
+			return nil, err
+		}
+		const nssql = "SELECT signer, ns FROM zone_nses WHERE zone=? ORDER BY signer, ns"
+		if z.NSes, err = exportSignerRRs(tx, nssql, z.Name); err != nil {
+			return nil, err
+		}
+		if z.Records, err = exportRecords(tx, z.Name); err != nil {
+			return nil, err
+		}
+	}
+	return zones, nil
+}
+
+func exportMetadata(tx *sql.Tx, zone string) ([]ExportMetadata, error) {
+	const sqlq = "SELECT key, COALESCE(time, ''), value FROM metadata WHERE zone=? ORDER BY key"
+	rows, err := tx.Query(sqlq, zone)
+	if CheckSQLError("ExportState", sqlq, err, false) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var md []ExportMetadata
+	for rows.Next() {
+		var m ExportMetadata
+		if err = rows.Scan(&m.Key, &m.Time, &m.Value); err != nil {
+			return nil, err
+		}
+		md = append(md, m)
+	}
+	return md, rows.Err()
+}
+
+func exportSignerRRs(tx *sql.Tx, sqlq, zone string) ([]ExportRR, error) {
+	rows, err := tx.Query(sqlq, zone)
+	if CheckSQLError("ExportState", sqlq, err, false) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rrs []ExportRR
+	for rows.Next() {
+		var rr ExportRR
+		if err = rows.Scan(&rr.Signer, &rr.RR); err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, rows.Err()
+}
+
+func exportRecords(tx *sql.Tx, zone string) ([]ExportRecord, error) {
+	const sqlq = `
+SELECT COALESCE(owner, ''), COALESCE(signer, ''), COALESCE(rrtype, 0), COALESCE(rdata, '')
+FROM records WHERE zone=? ORDER BY owner, rrtype, signer, rdata`
+	rows, err := tx.Query(sqlq, zone)
+	if CheckSQLError("ExportState", sqlq, err, false) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []ExportRecord
+	for rows.Next() {
+		var r ExportRecord
+		if err = rows.Scan(&r.Owner, &r.Signer, &r.RRtype, &r.Rdata); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func exportStrings(tx *sql.Tx, sqlq string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(sqlq, args...)
+	if CheckSQLError("ExportState", sqlq, err, false) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// CheckState verifies that a MusicState document can be imported: the
+// format and version must be known and all references (group members,
+// zone signer groups, processes) must point to something in the document.
+func (mdb *MusicDB) CheckState(state *MusicState) error {
+	if state.Format != MusicStateFormat {
+		return fmt.Errorf("not a MUSIC state document (format '%s', should be '%s')",
+			state.Format, MusicStateFormat)
+	}
+	if state.Version < 1 || state.Version > MusicStateVersion {
+		return fmt.Errorf("unsupported MUSIC state version %d (this version of MUSIC supports 1-%d)",
+			state.Version, MusicStateVersion)
+	}
+
+	signers := map[string]bool{}
+	for _, s := range state.Signers {
+		if s.Name == "" || signers[s.Name] {
+			return fmt.Errorf("signer name '%s' is empty or duplicated", s.Name)
+		}
+		signers[s.Name] = true
+	}
+
+	groups := map[string]bool{}
+	for _, sg := range state.SignerGroups {
+		if sg.Name == "" || groups[sg.Name] {
+			return fmt.Errorf("signer group name '%s' is empty or duplicated", sg.Name)
+		}
+		groups[sg.Name] = true
+		for _, s := range sg.Signers {
+			if !signers[s] {
+				return fmt.Errorf("signer group %s: unknown signer %s", sg.Name, s)
+			}
+		}
+	}
+
+	zones := map[string]bool{}
+	for _, z := range state.Zones {
+		if z.Name == "" || zones[z.Name] {
+			return fmt.Errorf("zone name '%s' is empty or duplicated", z.Name)
+		}
+		zones[z.Name] = true
+		if z.SignerGroup != "" && !groups[z.SignerGroup] {
+			return fmt.Errorf("zone %s: unknown signer group %s", z.Name, z.SignerGroup)
+		}
+		if z.FSM != "" && z.FSM != "---" {
+			if _, exist := mdb.GetFSM(z.FSM); !exist {
+				return fmt.Errorf("zone %s: unknown process %s", z.Name, z.FSM)
+			}
+		}
+	}
+	return nil
+}
+
+// ImportState replaces the complete contents of the DB with the state in
+// the document. Everything is done in one transaction, so if anything fails
+// the DB is left as it was. Signers with redacted secrets keep the secret
+// they have in the DB (if any). The returned messages describe what was
+// done.
+func (mdb *MusicDB) ImportState(state *MusicState) ([]string, error) {
+	err := mdb.CheckState(state)
+	if err != nil {
+		return nil, err
+	}
+
+	var tx *sql.Tx
+	localtx, tx, err := mdb.StartTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		mdb.CloseTransaction(localtx, tx, err)
+	}()
+
+	var msgs []string
+	oldauth := map[string]string{}
+	if state.Redacted {
+		var rows *sql.Rows
+		rows, err = tx.Query("SELECT name, auth FROM signers")
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name, auth string
+			if err = rows.Scan(&name, &auth); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			oldauth[name] = auth
+		}
+		rows.Close()
+	}
+
+	for _, table := range []string{"signers", "signergroups", "group_signers", "zones",
+		"metadata", "zone_dnskeys", "zone_nses", "records"} {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s", table))
+		if err != nil {
+			return nil, fmt.Errorf("error clearing table %s: %v", table, err)
+		}
+	}
+
+	const signersql = `
+INSERT INTO signers(name, method, auth, addr, port, usetcp, usetsig) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	for _, s := range state.Signers {
+		var auth string
+		if s.Auth == RedactedSecret {
+			auth = oldauth[s.Name] // as stored, i.e. already encrypted
+			if auth == "" {
+				msgs = append(msgs, fmt.Sprintf("Signer %s: secret was redacted and is not known. Please update the signer.", s.Name))
+			}
+		} else if auth, err = mdb.sealSecret(s.Name, s.Auth); err != nil {
+			return nil, fmt.Errorf("signer %s: error encrypting secret: %v", s.Name, err)
+		}
+		_, err = tx.Exec(signersql, s.Name, s.Method, auth, s.Address, s.Port, s.UseTcp, s.UseTSIG)
+		if err != nil {
+			return nil, fmt.Errorf("signer %s: %v", s.Name, err)
+		}
+	}
+
+	const groupsql = `
+INSERT INTO signergroups(name, locked, curprocess, pendadd, pendremove) VALUES (?, ?, ?, ?, ?)`
+	const membersql = "INSERT INTO group_signers(name, signer) VALUES (?, ?)"
+	for _, sg := range state.SignerGroups {
+		locked := 0
+		if sg.Locked {
+			locked = 1
+		}
+		_, err = tx.Exec(groupsql, sg.Name, locked, sg.CurrentProcess, sg.PendingAddition, sg.PendingRemoval)
+		if err != nil {
+			return nil, fmt.Errorf("signer group %s: %v", sg.Name, err)
+		}
+		for _, s := range sg.Signers {
+			if _, err = tx.Exec(membersql, sg.Name, s); err != nil {
+				return nil, fmt.Errorf("signer group %s: %v", sg.Name, err)
+			}
+		}
+	}
+
+	const zonesql = `
+INSERT INTO zones(name, zonetype, sgroup, fsm, state, statestamp, fsmsigner, fsmmode, fsmstatus)
+VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?)`
+	const metasql = "INSERT INTO metadata(zone, key, time, value) VALUES (?, ?, NULLIF(?, ''), ?)"
+	const dnskeysql = "INSERT INTO zone_dnskeys(zone, signer, dnskey) VALUES (?, ?, ?)"
+	const nssql = "INSERT INTO zone_nses(zone, signer, ns) VALUES (?, ?, ?)"
+	const recordsql = "INSERT INTO records(zone, owner, signer, rrtype, rdata) VALUES (?, ?, ?, ?, ?)"
+	for _, z := range state.Zones {
+		_, err = tx.Exec(zonesql, z.Name, z.ZoneType, z.SignerGroup, z.FSM, z.State, z.Statestamp,
+			z.FSMSigner, z.FSMMode, z.FSMStatus)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: %v", z.Name, err)
+		}
+		for _, m := range z.Metadata {
+			if _, err = tx.Exec(metasql, z.Name, m.Key, m.Time, m.Value); err != nil {
+				return nil, fmt.Errorf("zone %s: metadata %s: %v", z.Name, m.Key, err)
+			}
+		}
+		for _, rr := range z.DNSKEYs {
+			if _, err = tx.Exec(dnskeysql, z.Name, rr.Signer, rr.RR); err != nil {
+				return nil, fmt.Errorf("zone %s: DNSKEY: %v", z.Name, err)
+			}
+		}
+		for _, rr := range z.NSes {
+			if _, err = tx.Exec(nssql, z.Name, rr.Signer, rr.RR); err != nil {
+				return nil, fmt.Errorf("zone %s: NS: %v", z.Name, err)
+			}
+		}
+		for _, r := range z.Records {
+			if _, err = tx.Exec(recordsql, z.Name, r.Owner, r.Signer, r.RRtype, r.Rdata); err != nil {
+				return nil, fmt.Errorf("zone %s: record: %v", z.Name, err)
+			}
+		}
+	}
+
+	// the cached stop reasons belong to the old state
+	mdb.stopreasons.Clear()
+
+	msgs = append(msgs, fmt.Sprintf("Imported %d signers, %d signer groups and %d zones.",
+		len(state.Signers), len(state.SignerGroups), len(state.Zones)))
+	return msgs, nil
+}
+
+// Snapshot writes a consistent copy of the DB to the file name in dir while
+// MUSIC keeps running. Only supported for SQLite (use pg_dump for PostgreSQL).
+// The name comes from the API, so it must be a plain file name: snapshots
+// can only be written to the configured directory.
+func (mdb *MusicDB) Snapshot(dir, name string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("snapshots are disabled (no snapshot directory configured)")
+	}
+	if name == "" || name == "." || strings.Contains(name, "..") || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("invalid snapshot file name '%s' (only a file name, no directories)", name)
+	}
+	dest := filepath.Join(dir, name)
+	return dest, mdb.backend.Snapshot(mdb.db, dest)
+}
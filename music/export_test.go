@@ -0,0 +1,181 @@
+package music
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func exportTestDB(t *testing.T, mdb *MusicDB) {
+	if _, err := mdb.Migrate(false); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if _, err := mdb.AddSignerGroup(nil, "group1"); err != nil {
+		t.Fatalf("AddSignerGroup: %v", err)
+	}
+	s := &Signer{Name: "signer1", Method: "ddns", Address: "127.0.0.1", Port: "53", UseTcp: true,
+		Auth: AuthData{TSIGAlg: "hmac-sha256.", TSIGName: "musiclab.", TSIGKey: "c2VjcmV0"}}
+	if _, err := mdb.AddSigner(nil, s, ""); err != nil {
+		t.Fatalf("AddSigner: %v", err)
+	}
+	for _, q := range []struct {
+		sqlq string
+		args []interface{}
+	}{
+		{"INSERT INTO group_signers (name, signer) VALUES (?, ?)", []interface{}{"group1", "signer1"}},
+		{"INSERT INTO zones (name, zonetype, sgroup, fsmmode, statestamp) VALUES (?, ?, ?, ?, datetime('now'))",
+			[]interface{}{"test.se.", "normal", "group1", "auto"}},
+		{"INSERT INTO metadata (zone, key, time, value) VALUES (?, ?, datetime('now'), ?)",
+			[]interface{}{"test.se.", "parentaddr", "192.0.2.1:53"}},
+		{"INSERT INTO zone_dnskeys (zone, signer, dnskey) VALUES (?, ?, ?)",
+			[]interface{}{"test.se.", "signer1", "test.se. 3600 IN DNSKEY 257 3 13 AAAA"}},
+		{"INSERT INTO records (zone, owner, signer, rrtype, rdata) VALUES (?, ?, ?, ?, ?)",
+			[]interface{}{"test.se.", "test.se.", "signer1", 2, "ns1.test.se."}},
+	} {
+		if _, err := mdb.Exec(q.sqlq, q.args...); err != nil {
+			t.Fatalf("Exec(%s): %v", q.sqlq, err)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+
+		state, err := mdb.ExportState(false)
+		if err != nil {
+			t.Fatalf("ExportState: %v", err)
+		}
+		if len(state.Signers) != 1 || len(state.SignerGroups) != 1 || len(state.Zones) != 1 {
+			t.Fatalf("ExportState: got %d signers, %d groups, %d zones wanted 1, 1, 1",
+				len(state.Signers), len(state.SignerGroups), len(state.Zones))
+		}
+		if got := state.SignerGroups[0].Signers; len(got) != 1 || got[0] != "signer1" {
+			t.Errorf("group1 members: got %v wanted [signer1]", got)
+		}
+		z := state.Zones[0]
+		if len(z.Metadata) != 1 || len(z.DNSKEYs) != 1 || len(z.Records) != 1 || z.Statestamp == "" {
+			t.Errorf("zone test.se.: got %+v", z)
+		}
+
+		redacted, err := mdb.ExportState(true)
+		if err != nil {
+			t.Fatalf("ExportState(redact): %v", err)
+		}
+		if redacted.Signers[0].Auth != RedactedSecret {
+			t.Errorf("redacted export: got auth '%s'", redacted.Signers[0].Auth)
+		}
+
+		// import into an empty DB, then export again: must be identical
+		newdb, err := OpenDB(filepath.Join(t.TempDir(), "new.db"), "sqlite")
+		if err != nil {
+			t.Fatalf("OpenDB: %v", err)
+		}
+		defer newdb.Close()
+		if _, err := newdb.Migrate(false); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		if _, err := newdb.ImportState(state); err != nil {
+			t.Fatalf("ImportState: %v", err)
+		}
+		again, err := newdb.ExportState(false)
+		if err != nil {
+			t.Fatalf("ExportState: %v", err)
+		}
+		again.Exported = state.Exported
+		if !reflect.DeepEqual(state, again) {
+			t.Errorf("export after import differs:\ngot  %+v\nwant %+v", again, state)
+		}
+
+		// a redacted import keeps the secrets that are already there
+		if _, err := newdb.ImportState(redacted); err != nil {
+			t.Fatalf("ImportState(redacted): %v", err)
+		}
+		again, _ = newdb.ExportState(false)
+		if again.Signers[0].Auth != state.Signers[0].Auth {
+			t.Errorf("redacted import: got auth '%s' wanted '%s'", again.Signers[0].Auth, state.Signers[0].Auth)
+		}
+	})
+}
+
+func TestImportStateInvalid(t *testing.T) {
+	mdb, err := OpenDB(filepath.Join(t.TempDir(), "music.db"), "sqlite")
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer mdb.Close()
+	exportTestDB(t, mdb)
+
+	good := func() *MusicState {
+		return &MusicState{
+			Format:       MusicStateFormat,
+			Version:      MusicStateVersion,
+			Exported:     time.Now(),
+			Signers:      []ExportSigner{{Name: "s1"}},
+			SignerGroups: []ExportSignerGroup{{Name: "g1", Signers: []string{"s1"}}},
+			Zones:        []ExportZone{{Name: "z1.se.", SignerGroup: "g1"}},
+		}
+	}
+	tests := map[string]func(s *MusicState){
+		"format":         func(s *MusicState) { s.Format = "something-else" },
+		"version":        func(s *MusicState) { s.Version = MusicStateVersion + 1 },
+		"unknown signer": func(s *MusicState) { s.SignerGroups[0].Signers = []string{"s2"} },
+		"unknown group":  func(s *MusicState) { s.Zones[0].SignerGroup = "g2" },
+		"unknown fsm":    func(s *MusicState) { s.Zones[0].FSM = "no-such-process" },
+		"duplicate zone": func(s *MusicState) { s.Zones = append(s.Zones, s.Zones[0]) },
+	}
+	for name, broken := range tests {
+		s := good()
+		broken(s)
+		if _, err := mdb.ImportState(s); err == nil {
+			t.Errorf("%s: ImportState succeeded", name)
+		}
+	}
+
+	// nothing must have changed
+	state, err := mdb.ExportState(false)
+	if err != nil || len(state.Zones) != 1 || state.Zones[0].Name != "test.se." {
+		t.Errorf("DB changed by failed imports: %+v (err %v)", state, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	mdb, err := OpenDB(filepath.Join(t.TempDir(), "music.db"), "sqlite")
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer mdb.Close()
+	exportTestDB(t, mdb)
+
+	snapdir := t.TempDir()
+	snapfile, err := mdb.Snapshot(snapdir, "snapshot.db")
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if snapfile != filepath.Join(snapdir, "snapshot.db") {
+		t.Errorf("Snapshot: got file %s wanted it in %s", snapfile, snapdir)
+	}
+	if _, err := mdb.Snapshot(snapdir, "snapshot.db"); err == nil {
+		t.Errorf("Snapshot: overwrote an existing file")
+	}
+	for _, name := range []string{"", ".", "..", "../snapshot2.db", "sub/snapshot2.db", "/tmp/snapshot2.db",
+		"sub\\snapshot2.db", "snapshot..db"} {
+		if _, err := mdb.Snapshot(snapdir, name); err == nil {
+			t.Errorf("Snapshot(%s): no error", name)
+		}
+	}
+	if _, err := mdb.Snapshot("", "snapshot2.db"); err == nil {
+		t.Errorf("Snapshot without a snapshot directory: no error")
+	}
+
+	snapdb, err := OpenDB(snapfile, "sqlite")
+	if err != nil {
+		t.Fatalf("OpenDB(snapshot): %v", err)
+	}
+	defer snapdb.Close()
+	state, err := snapdb.ExportState(false)
+	if err != nil || len(state.Zones) != 1 {
+		t.Errorf("snapshot: got %+v (err %v) wanted one zone", state, err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/miekg/dns"
 )
 
 func (mdb *MusicDB) ZoneAttachFsm(tx *sql.Tx, dbzone *Zone, fsm, fsmsigner string,
@@ -39,7 +40,7 @@ func (mdb *MusicDB) ZoneAttachFsm(tx *sql.Tx, dbzone *Zone, fsm, fsmsigner strin
 
 	var exist bool
 	var process FSM
-	if process, exist = mdb.FSMlist[fsm]; !exist {
+	if process, exist = mdb.GetFSM(fsm); !exist {
 		return "", fmt.Errorf("Process %s unknown. Sorry.", fsm)
 	}
 
@@ -62,6 +63,18 @@ func (mdb *MusicDB) ZoneAttachFsm(tx *sql.Tx, dbzone *Zone, fsm, fsmsigner strin
 	if CheckSQLError("JoinGroup", sqlq, err, false) {
 		return msg, err
 	}
+	// a preempted process may have left the zone blocked
+	if err = mdb.clearStopReason(tx, dbzone, dbzone.State, initialstate); err != nil {
+		return msg, err
+	}
+	mdb.PublishEventTx(tx, MusicEvent{
+		Type:        EventProcessStart,
+		Zone:        dbzone.Name,
+		SignerGroup: sgname,
+		Signer:      fsmsigner,
+		Process:     fsm,
+		To:          initialstate,
+	})
 	return msg + fmt.Sprintf("Zone %s has now started process '%s' in state '%s'.",
 		dbzone.Name, fsm, initialstate), nil
 }
@@ -80,7 +93,7 @@ func (mdb *MusicDB) ZoneDetachFsm(tx *sql.Tx, dbzone *Zone, fsm, fsmsigner strin
 	}
 
 	var exist bool
-	if _, exist = mdb.FSMlist[fsm]; !exist {
+	if _, exist = mdb.GetFSM(fsm); !exist {
 		return "", fmt.Errorf("Process %s unknown. Sorry.", fsm)
 	}
 
@@ -108,6 +121,9 @@ func (mdb *MusicDB) ZoneDetachFsm(tx *sql.Tx, dbzone *Zone, fsm, fsmsigner strin
 	if CheckSQLError("DetachFsm", sqlq, err, false) {
 		return "", err
 	}
+	if err = mdb.clearStopReason(tx, dbzone, dbzone.State, ""); err != nil {
+		return "", err
+	}
 	return fmt.Sprintf("Zone %s has now left process '%s'.",
 		dbzone.Name, fsm), nil
 }
@@ -115,7 +131,7 @@ func (mdb *MusicDB) ZoneDetachFsm(tx *sql.Tx, dbzone *Zone, fsm, fsmsigner strin
 // XXX: Returning a map[string]Zone just to get rid of an extra call
 // to ListZones() was a mistake. Let's simplify.
 
-func (mdb *MusicDB) ZoneStepFsm(tx *sql.Tx, dbzone *Zone, nextstate string) (bool, string, error) {
+func (mdb *MusicDB) ZoneStepFsm(dbzone *Zone, nextstate string) (bool, string, error) {
 
 	if !dbzone.Exists {
 		return false, "", fmt.Errorf("Zone %s unknown", dbzone.Name)
@@ -127,37 +143,17 @@ func (mdb *MusicDB) ZoneStepFsm(tx *sql.Tx, dbzone *Zone, nextstate string) (boo
 		return false, "", fmt.Errorf("Zone %s not attached to any process.", dbzone.Name)
 	}
 
-	CurrentFsm := mdb.FSMlist[fsmname]
+	if !mdb.zonelocks.lock(dbzone.Name) {
+		return false, "", fmt.Errorf("Zone %s: %w", dbzone.Name, ErrZoneBusy)
+	}
+	defer mdb.zonelocks.unlock(dbzone.Name)
 
-	state := dbzone.State
+	CurrentFsm, _ := mdb.GetFSM(fsmname)
 
-	localtx, tx, err := mdb.StartTransaction(tx)
-	if err != nil {
-		log.Printf("ZoneStepFsm: Error from mdb.StartTransaction(): %v\n", err)
-		return false, "fail", err
-	}
-	defer mdb.CloseTransaction(localtx, tx, err)
+	state := dbzone.State
 
 	if state == FsmStateStop {
-		// 1. Zone leaves process
-		// 2. Count of #zones in process in signergroup is decremented
-		msg, err := mdb.ZoneDetachFsm(tx, dbzone, fsmname, "")
-		if err != nil {
-			log.Printf("ZoneStepFsm: Error from ZoneDetachFsm(%s, %s): %v",
-				dbzone.Name, fsmname, err)
-			return false, "", err
-		}
-
-		res, msg2, err := mdb.CheckIfProcessComplete(tx, dbzone.SignerGroup())
-		if err != nil {
-			// "process complete" is the more important message
-			return false, fmt.Sprintf("Error from CheckIfProcessComplete(): %v", err), err
-		}
-		if res {
-			// "process complete" is the more important message
-			return true, fmt.Sprintf("%s\n%s", msg, msg2), nil
-		}
-		return true, msg, nil
+		return mdb.zoneLeaveFsm(dbzone, fsmname)
 	}
 
 	var CurrentState FSMState
@@ -181,7 +177,7 @@ func (mdb *MusicDB) ZoneStepFsm(tx *sql.Tx, dbzone *Zone, nextstate string) (boo
 	if len(CurrentState.Next) == 1 {
 		nextname := transitions[0]
 		t := CurrentState.Next[nextname]
-		success, msg, err := dbzone.AttemptStateTransition(tx, nextname, t)
+		success, msg, err := dbzone.AttemptStateTransition(nextname, t)
 		// return dbzone.AttemptStateTransition(nextname, t)
 		log.Printf("ZoneStepFsm debug: result from AttemptStateTransition: success: %v, err: %v, msg: '%s'\n", success, err, msg)
 		return success, msg, err
@@ -198,8 +194,8 @@ func (mdb *MusicDB) ZoneStepFsm(tx *sql.Tx, dbzone *Zone, nextstate string) (boo
 		if nextstate != "" {
 			if _, exist := CurrentState.Next[nextstate]; exist {
 				t := CurrentState.Next[nextstate]
-				// success, err, msg := dbzone.AttemptStateTransition(tx, nextstate, t)
-				return dbzone.AttemptStateTransition(tx, nextstate, t)
+				// success, err, msg := dbzone.AttemptStateTransition(nextstate, t)
+				return dbzone.AttemptStateTransition(nextstate, t)
 			} else {
 				return false, "", fmt.Errorf(
 					"State '%s' is not a possible next state from '%s'",
@@ -218,26 +214,61 @@ func (mdb *MusicDB) ZoneStepFsm(tx *sql.Tx, dbzone *Zone, nextstate string) (boo
 		"Zero possible next states from '%s': you lose.", state)
 }
 
+// zoneLeaveFsm detaches a zone that has reached the stop state from its
+// process. This only touches the DB, so it is done in one transaction.
+func (mdb *MusicDB) zoneLeaveFsm(dbzone *Zone, fsmname string) (bool, string, error) {
+	var tx *sql.Tx
+	localtx, tx, err := mdb.StartTransaction(tx)
+	if err != nil {
+		log.Printf("ZoneStepFsm: Error from mdb.StartTransaction(): %v\n", err)
+		return false, "fail", err
+	}
+	defer func() {
+		mdb.CloseTransaction(localtx, tx, err)
+	}()
+
+	// 1. Zone leaves process
+	// 2. Count of #zones in process in signergroup is decremented
+	msg, err := mdb.ZoneDetachFsm(tx, dbzone, fsmname, "")
+	if err != nil {
+		log.Printf("ZoneStepFsm: Error from ZoneDetachFsm(%s, %s): %v",
+			dbzone.Name, fsmname, err)
+		return false, "", err
+	}
+	if fsmname == ZoneMoveProcess {
+		if err = mdb.zoneMoveDone(tx, dbzone.Name); err != nil {
+			return false, "", err
+		}
+	}
+
+	res, msg2, err := mdb.CheckIfProcessComplete(tx, dbzone.SignerGroup())
+	if err != nil {
+		// "process complete" is the more important message
+		return false, fmt.Sprintf("Error from CheckIfProcessComplete(): %v", err), err
+	}
+	if res {
+		// "process complete" is the more important message
+		return true, fmt.Sprintf("%s\n%s", msg, msg2), nil
+	}
+	return true, msg, nil
+}
+
 // pre-condition false ==> return false, nil, "msg": no transit, no error
 // pre-cond true + no post-cond ==> return false, error, "msg": no transit, error
 // pre-cond true + post-cond false ==> return false, nil, "msg"
 // pre-cond true + post-cond true ==> return true, nil, "msg": all ok
-func (z *Zone) AttemptStateTransition(tx *sql.Tx, nextstate string,
+//
+// No DB transaction is held while the pre-condition, action and
+// post-condition run, as they do network I/O (DNS queries, DDNS updates,
+// signer APIs). Only the resulting state change is committed, and it only
+// succeeds if the zone is still in the state it was in when we started.
+func (z *Zone) AttemptStateTransition(nextstate string,
 	t FSMTransition) (bool, string, error) {
 
-	mdb := z.MusicDB
 	currentstate := z.State
 
 	log.Printf("AttemptStateTransition: zone '%s' to state '%s'\n", z.Name, nextstate)
 
-	localtx, tx, err := mdb.StartTransaction(tx)
-	if err != nil {
-		log.Printf("AttemptStateTransition: Error from mdb.StartTransaction(): %v\n", err)
-		// XXX: What is the correct thing to return here?
-		return false, "fail", err
-	}
-	defer mdb.CloseTransaction(localtx, tx, err)
-
 	// If pre-condition(aka criteria)==true ==> execute action
 	// If post-condition==true ==> change state.
 	// If post-condition==false ==> bump hold time
@@ -247,12 +278,16 @@ func (z *Zone) AttemptStateTransition(tx *sql.Tx, nextstate string,
 		if t.PostCondition != nil { //TODO XXX: remove once we have post conditions everywhere.
 			postcond := t.PostCondition(z)
 			if postcond {
-				z.StateTransition(tx, currentstate, nextstate) // success
+				err := z.StateTransition(nil, currentstate, nextstate) // success
+				if err != nil {
+					return false, fmt.Sprintf("Zone %s did not transition from %s to %s: %v",
+						z.Name, currentstate, nextstate, err), err
+				}
 				return true,
 					fmt.Sprintf("Zone %s transitioned from '%s' to '%s'",
 						z.Name, currentstate, nextstate), nil
 			} else {
-				stopreason, exist, err := z.MusicDB.GetMeta(tx, z, "stop-reason")
+				stopreason, exist, err := z.MusicDB.GetMeta(nil, z, "stop-reason")
 				if err != nil {
 					return false, fmt.Sprintf("Error retrieving metadata for zone %s", z.Name), err
 				}
@@ -272,7 +307,7 @@ func (z *Zone) AttemptStateTransition(tx *sql.Tx, nextstate string,
 		}
 	}
 	// pre-condition returns false
-	stopreason, exist, err := z.MusicDB.GetStopReason(tx, z)
+	stopreason, exist, err := z.MusicDB.GetStopReason(nil, z)
 	if err != nil {
 		return false, fmt.Sprintf("%s: Error retrieving current stop reason: %v",
 			z.Name, stopreason), err
@@ -288,7 +323,7 @@ func (z *Zone) AttemptStateTransition(tx *sql.Tx, nextstate string,
 
 func (mdb *MusicDB) ListProcesses() ([]Process, error, string) {
 	var resp []Process
-	for name, fsm := range mdb.FSMlist {
+	for name, fsm := range mdb.FSMlist() {
 		resp = append(resp, Process{
 			Name: name,
 			Desc: fsm.Desc,
@@ -297,20 +332,54 @@ func (mdb *MusicDB) ListProcesses() ([]Process, error, string) {
 	return resp, nil, ""
 }
 
-func (z *Zone) GetParentAddressOrStop() (string, error) {
-	var parentAddress string
-	var exist bool
-	var err error
+// parentAddressOverride returns the address of the parent server to check
+// the DS and NS RRsets of the zone in, if discovery is not to be used. It is
+// the "parentaddr" metadata if set, then the address set by the parent agent
+// (see SetParentAddress).
+func (z *Zone) parentAddressOverride() (string, bool, error) {
+	parentAddress, exist, err := z.MusicDB.GetMeta(nil, z, "parentaddr")
+	if err != nil {
+		return "", false, fmt.Errorf("Zone %s: Error retrieving parent address: %v", z.Name, err)
+	}
+	if exist {
+		return parentAddress, true, nil // manual override
+	}
+	parentAddress, exist = z.MusicDB.ParentAddress(z.Name)
+	return parentAddress, exist, nil // parent agent
+}
 
-	if parentAddress, exist, err = z.MusicDB.GetMeta(nil, z, "parentaddr"); err != nil {
-		return "", fmt.Errorf("Zone %s: Error retrieving parent address: %v", z.Name, err)
+// ParentRRsetOrStop returns the DS or NS RRset of the zone in the parent and
+// sets the stop-reason if it can not be had. With a parent address override
+// that server is asked, otherwise all discovered parent servers, which must
+// agree (see RefreshParent). As the processes wait for the parent to change,
+// the RRsets never come from the parent cache.
+func (z *Zone) ParentRRsetOrStop(rrtype uint16) ([]dns.RR, error) {
+	parentAddress, exist, err := z.parentAddressOverride()
+	if err != nil {
+		z.SetStopReason(err.Error())
+		return nil, err
+	}
+	if exist {
+		rrs, _, err := parentRRset(z.Name, rrtype, parentAddress)
+		if err != nil {
+			z.SetStopReason(fmt.Sprintf("Unable to fetch %s from parent: %v", dns.TypeToString[rrtype], err))
+			return nil, err
+		}
+		return rrs, nil
 	}
 
-	if !exist {
-		z.SetStopReason("No parent-agent address registered")
-		return "", fmt.Errorf("Zone %s has no parent address registered", z.Name)
+	pi, err := z.MusicDB.RefreshParent(z.Name)
+	if err != nil {
+		z.SetStopReason(fmt.Sprintf("Parent discovery failed: %v", err))
+		return nil, fmt.Errorf("Zone %s: parent discovery failed: %v", z.Name, err)
+	}
+	switch rrtype {
+	case dns.TypeDS:
+		return pi.DS, nil
+	case dns.TypeNS:
+		return pi.NS, nil
 	}
-	return parentAddress, nil
+	return nil, fmt.Errorf("Zone %s: parent RRset %s is not discovered", z.Name, dns.TypeToString[rrtype])
 }
 
 func GetSortedTransitionKeys(fsm string) ([]string, error) {
@@ -322,7 +391,7 @@ func (mdb *MusicDB) GraphProcess(fsm string) (string, error) {
 	var exist bool
 	var process FSM
 
-	if process, exist = mdb.FSMlist[fsm]; !exist {
+	if process, exist = mdb.GetFSM(fsm); !exist {
 		return "", fmt.Errorf("Process %s unknown. Sorry.", fsm)
 	}
 
@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	github.com/go-playground/validator/v10 v10.9.0
+	github.com/lib/pq v1.10.7
 	github.com/mattn/go-sqlite3 v1.14.9
 	github.com/miekg/dns v1.1.26
 	github.com/spf13/viper v1.9.0
@@ -0,0 +1,155 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// A Migration moves the DB schema from Version-1 to Version. Apply must be
+// idempotent (i.e. use "IF NOT EXISTS", AddColumnIfMissing, etc), as a DB
+// may already have parts of the change, f.e. if it was created by an older
+// version of MUSIC that didn't record the schema version.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(mdb *MusicDB, tx *sql.Tx) error
+}
+
+// Migrations is the ordered list of all schema changes. Never change or
+// remove an existing migration, add a new one at the end instead.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema (zones, signers, signergroups, records, metadata, ...)",
+		Apply: func(mdb *MusicDB, tx *sql.Tx) error {
+			for t, s := range DefaultTables {
+				_, err := tx.Exec(s)
+				if err != nil {
+					return fmt.Errorf("error creating table %s: %v", t, err)
+				}
+			}
+			return nil
+		},
+	},
+}
+
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS 'schema_version' (
+version     INTEGER PRIMARY KEY,
+description TEXT NOT NULL DEFAULT '',
+applied     DATETIME
+)`
+
+func LatestSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// ColumnExists reports whether table has a column with the given name.
+func (mdb *MusicDB) ColumnExists(tx *sql.Tx, table, column string) (bool, error) {
+	return mdb.backend.ColumnExists(tx, table, column)
+}
+
+// AddColumnIfMissing adds a column to a table, unless it is already there.
+// decl is the column definition, f.e. "INTEGER NOT NULL DEFAULT 0". Stick to
+// types that all backends understand (TEXT, INTEGER, BOOLEAN, DATETIME).
+func (mdb *MusicDB) AddColumnIfMissing(tx *sql.Tx, table, column, decl string) error {
+	exist, err := mdb.ColumnExists(tx, table, column)
+	if err != nil || exist {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE '%s' ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
+// SchemaVersion returns the version of the schema of the DB. A DB without a
+// schema_version table (i.e. empty, or created before migrations existed)
+// is version 0.
+func (mdb *MusicDB) SchemaVersion() (int, error) {
+	exist, err := mdb.backend.TableExists(mdb.db, "schema_version")
+	if err != nil || !exist {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = mdb.db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// PendingMigrations returns the migrations that have not been applied to
+// the DB, in the order they will be applied.
+func (mdb *MusicDB) PendingMigrations() ([]Migration, error) {
+	current, err := mdb.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestSchemaVersion() {
+		return nil, fmt.Errorf("DB schema version %d is newer than the latest known version (%d). Refusing to touch it",
+			current, LatestSchemaVersion())
+	}
+
+	var pending []Migration
+	prev := 0
+	for _, m := range Migrations {
+		if m.Version <= prev {
+			return nil, fmt.Errorf("migration %d (%s) is out of order", m.Version, m.Description)
+		}
+		prev = m.Version
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies all pending migrations, each in its own transaction, and
+// returns the migrations that were applied. If dryrun is true nothing is
+// changed and the pending migrations are returned.
+func (mdb *MusicDB) Migrate(dryrun bool) ([]Migration, error) {
+	pending, err := mdb.PendingMigrations()
+	if err != nil || dryrun {
+		return pending, err
+	}
+
+	_, err = mdb.db.Exec(schemaVersionTable)
+	if err != nil {
+		return nil, fmt.Errorf("error creating schema_version table: %v", err)
+	}
+
+	var applied []Migration
+	for _, m := range pending {
+		err = mdb.applyMigration(m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		log.Printf("Migrate: DB schema migrated to version %d: %s", m.Version, m.Description)
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+func (mdb *MusicDB) applyMigration(m Migration) error {
+	var tx *sql.Tx
+	localtx, tx, err := mdb.StartTransaction(tx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		mdb.CloseTransaction(localtx, tx, err)
+	}()
+
+	err = m.Apply(mdb, tx)
+	if err != nil {
+		return err
+	}
+
+	const sqlq = "INSERT INTO schema_version (version, description, applied) VALUES (?, ?, datetime('now'))"
+	_, err = tx.Exec(sqlq, m.Version, m.Description)
+	return err
+}
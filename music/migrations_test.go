@@ -0,0 +1,84 @@
+package music
+
+import (
+	"testing"
+)
+
+func TestMigrateFreshDB(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		pending, err := mdb.Migrate(true)
+		if err != nil {
+			t.Fatalf("Migrate(dryrun): %v", err)
+		}
+		if len(pending) != len(Migrations) {
+			t.Errorf("got %d pending migrations wanted %d", len(pending), len(Migrations))
+		}
+		if version, _ := mdb.SchemaVersion(); version != 0 {
+			t.Errorf("dry-run changed schema version to %d", version)
+		}
+
+		if _, err = mdb.Migrate(false); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		version, err := mdb.SchemaVersion()
+		if err != nil {
+			t.Fatalf("SchemaVersion: %v", err)
+		}
+		if version != LatestSchemaVersion() {
+			t.Errorf("got schema version %d wanted %d", version, LatestSchemaVersion())
+		}
+
+		applied, err := mdb.Migrate(false)
+		if err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		if len(applied) != 0 {
+			t.Errorf("second Migrate applied %d migrations wanted 0", len(applied))
+		}
+	})
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		// a DB created before there were migrations has the tables but no version
+		for _, s := range DefaultTables {
+			if _, err := mdb.Exec(s); err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+		}
+		if _, err := mdb.Exec("INSERT INTO zones (name) VALUES ('test.se.')"); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+
+		if _, err := mdb.Migrate(false); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		var count int
+		if err := mdb.db.QueryRow("SELECT COUNT(*) FROM zones").Scan(&count); err != nil || count != 1 {
+			t.Errorf("got %d zones (err %v) wanted 1", count, err)
+		}
+	})
+}
+
+func TestAddColumnIfMissing(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		if _, err := mdb.Migrate(false); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		tx, err := mdb.Begin()
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		defer tx.Rollback()
+
+		for i := 0; i < 2; i++ {
+			if err := mdb.AddColumnIfMissing(tx, "zones", "testcol", "DATETIME"); err != nil {
+				t.Fatalf("AddColumnIfMissing (%d): %v", i, err)
+			}
+		}
+		exist, err := mdb.ColumnExists(tx, "zones", "testcol")
+		if err != nil || !exist {
+			t.Errorf("got exist %v (err %v) wanted true", exist, err)
+		}
+	})
+}
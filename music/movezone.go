@@ -0,0 +1,240 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Moving a zone from one signer group to another is done by the "move-zone"
+// process rather than by leaving one group and joining the other, as that
+// would leave the zone with only the new signers while the parent still
+// points at the old ones. The process has two halves:
+//
+//  1. While the zone is still in the old group, its signer group is the union
+//     of the old and the new group (see GetZone). The same steps as in
+//     "add-signer" bring DNSKEYs, CDS and NS in sync across all signers and
+//     update the DS and NS RRsets in the parent.
+//  2. The zone then switches to the new group and the old group's NSes and
+//     DNSKEYs are removed from the new signers, followed by new CSYNC and CDS
+//     so that the parent drops the old NS and DS records.
+//
+// The groups involved are kept in the zone metadata, so that the process
+// survives a restart of musicd.
+const (
+	MetaMoveFrom = "move-from"
+	MetaMoveTo   = "move-to"
+)
+
+// ZoneMoveGroup starts moving the zone to signer group g.
+func (mdb *MusicDB) ZoneMoveGroup(tx *sql.Tx, dbzone *Zone, g string,
+	enginecheck chan EngineCheck) (string, error) {
+	if !dbzone.Exists {
+		return "", fmt.Errorf("Zone %s unknown", dbzone.Name)
+	}
+
+	from := dbzone.SignerGroup()
+	if from == nil || from.Name == "" {
+		return "", fmt.Errorf("Zone %s is not in any signer group. Use \"zone join\" instead.", dbzone.Name)
+	}
+	if from.Name == g {
+		return "", fmt.Errorf("Zone %s is already in signer group %s", dbzone.Name, g)
+	}
+	if dbzone.FSM != "" {
+		return "", fmt.Errorf("Zone %s is in process '%s'. Only one process at a time possible.",
+			dbzone.Name, dbzone.FSM)
+	}
+
+	localtx, tx, err := mdb.StartTransaction(tx)
+	if err != nil {
+		log.Printf("ZoneMoveGroup: Error from mdb.StartTransaction(): %v\n", err)
+		return "fail", err
+	}
+	defer func() {
+		mdb.CloseTransaction(localtx, tx, err)
+	}()
+
+	var to *SignerGroup
+	if to, err = mdb.GetSignerGroup(tx, g, false); err != nil { // not apisafe
+		return "", err
+	}
+	if len(to.SignerMap) == 0 {
+		err = fmt.Errorf("Signer group %s has no signers", g)
+		return "", err
+	}
+	for _, sg := range []*SignerGroup{from, to} {
+		if sg.Locked {
+			err = fmt.Errorf("Signer group %s locked from zones joining or leaving due to ongoing '%s' process.",
+				sg.Name, sg.CurrentProcess)
+			return "", err
+		}
+	}
+
+	for key, value := range map[string]string{MetaMoveFrom: from.Name, MetaMoveTo: g} {
+		if _, err = mdb.ZoneSetMeta(tx, dbzone, key, value); err != nil {
+			return "", err
+		}
+	}
+
+	msg, err := mdb.ZoneAttachFsm(tx, dbzone, ZoneMoveProcess, "", false) // false=no preempting
+	if err != nil {
+		return msg, err
+	}
+
+	if enginecheck != nil {
+		enginecheck <- EngineCheck{ZoneName: dbzone.Name}
+	}
+	return fmt.Sprintf("Zone %s is moving from signer group %s to %s (process '%s').",
+		dbzone.Name, from.Name, g, ZoneMoveProcess), nil
+}
+
+// moveZoneSignerGroup returns the signer group that a zone in the move-zone
+// process works with: until the zone has switched groups that is the old
+// group extended with the signers of the new group.
+func (mdb *MusicDB) moveZoneSignerGroup(tx *sql.Tx, zone string, sg *SignerGroup) (*SignerGroup, error) {
+	to, _, err := mdb.GetMeta(tx, &Zone{Name: zone}, MetaMoveTo)
+	if err != nil || to == "" || to == sg.Name {
+		return sg, err
+	}
+
+	tosigners, err := mdb.GetGroupSigners(tx, to, false) // not apisafe
+	if err != nil {
+		return nil, err
+	}
+	union := *sg
+	union.SignerMap = map[string]*Signer{}
+	for name, s := range sg.SignerMap {
+		union.SignerMap[name] = s
+	}
+	for name, s := range tosigners {
+		union.SignerMap[name] = s
+	}
+	return &union, nil
+}
+
+// ZoneMoveSwitchGroup moves a zone in the move-zone process to the new
+// signer group. It is done once the parent has the DS and NS records of
+// both groups.
+func (mdb *MusicDB) ZoneMoveSwitchGroup(z *Zone) error {
+	var tx *sql.Tx
+	localtx, tx, err := mdb.StartTransaction(tx)
+	if err != nil {
+		log.Printf("ZoneMoveSwitchGroup: Error from mdb.StartTransaction(): %v\n", err)
+		return err
+	}
+	defer func() {
+		mdb.CloseTransaction(localtx, tx, err)
+	}()
+
+	to, exist, err := mdb.GetMeta(tx, z, MetaMoveTo)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		err = fmt.Errorf("Zone %s: signer group to move to is unknown", z.Name)
+		return err
+	}
+
+	var sg *SignerGroup
+	if sg, err = mdb.GetSignerGroup(tx, to, false); err != nil { // not apisafe
+		return err
+	}
+	if sg.Locked {
+		err = fmt.Errorf("Signer group %s is locked due to ongoing '%s' process",
+			sg.Name, sg.CurrentProcess)
+		return err
+	}
+
+	const sqlq = "UPDATE zones SET sgroup=? WHERE name=? AND fsm=?"
+	res, err := tx.Exec(sqlq, to, z.Name, ZoneMoveProcess)
+	if CheckSQLError("ZoneMoveSwitchGroup", sqlq, err, false) {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("ZoneMoveSwitchGroup: Error from RowsAffected(): %v\n", err)
+		return err
+	}
+	if rows == 0 {
+		err = fmt.Errorf("Zone %s is no longer in the %s process", z.Name, ZoneMoveProcess)
+		return err
+	}
+	log.Printf("ZoneMoveSwitchGroup: zone %s is now in signer group %s", z.Name, to)
+	return nil
+}
+
+// MoveZoneGroups returns the signer groups that a zone in the move-zone
+// process is moving from and to.
+func (mdb *MusicDB) MoveZoneGroups(z *Zone) (string, string, error) {
+	from, _, err := mdb.GetMeta(nil, z, MetaMoveFrom)
+	if err != nil {
+		return "", "", err
+	}
+	to, _, err := mdb.GetMeta(nil, z, MetaMoveTo)
+	if err != nil {
+		return "", "", err
+	}
+	if from == "" || to == "" {
+		return "", "", fmt.Errorf("Zone %s is not moving between signer groups", z.Name)
+	}
+	return from, to, nil
+}
+
+// MoveZoneLeavingSigners returns the signers of the old signer group that
+// are not also in the new group, i.e. the signers that the zone is leaving.
+func (mdb *MusicDB) MoveZoneLeavingSigners(z *Zone) (map[string]*Signer, error) {
+	from, to, err := mdb.MoveZoneGroups(z)
+	if err != nil {
+		return nil, err
+	}
+	fromsigners, err := mdb.GetGroupSigners(nil, from, false) // not apisafe
+	if err != nil {
+		return nil, err
+	}
+	tosigners, err := mdb.GetGroupSigners(nil, to, false) // not apisafe
+	if err != nil {
+		return nil, err
+	}
+	for name := range tosigners {
+		delete(fromsigners, name)
+	}
+	return fromsigners, nil
+}
+
+// zoneMoveDone removes the move metadata once the zone has left the process.
+func (mdb *MusicDB) zoneMoveDone(tx *sql.Tx, zone string) error {
+	const sqlq = "DELETE FROM metadata WHERE zone=? AND key IN (?, ?)"
+	_, err := tx.Exec(sqlq, zone, MetaMoveFrom, MetaMoveTo)
+	if CheckSQLError("zoneMoveDone", sqlq, err, false) {
+		return err
+	}
+	return nil
+}
+
+// movingZones returns the zones that are moving into or out of the signer
+// group. Signers can not join or leave such a group, as that would start a
+// process that preempts the move.
+func (mdb *MusicDB) movingZones(tx *sql.Tx, group string) ([]string, error) {
+	const sqlq = `
+SELECT DISTINCT m.zone FROM metadata m, zones z
+WHERE m.zone=z.name AND z.fsm=? AND m.key IN (?, ?) AND m.value=?`
+	rows, err := tx.Query(sqlq, ZoneMoveProcess, MetaMoveFrom, MetaMoveTo, group)
+	if CheckSQLError("movingZones", sqlq, err, false) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var zones []string
+	for rows.Next() {
+		var zone string
+		if err = rows.Scan(&zone); err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, rows.Err()
+}
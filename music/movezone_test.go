@@ -0,0 +1,97 @@
+package music
+
+import (
+	"testing"
+)
+
+func TestZoneMoveGroup(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+		mdb.SetFSMlist(map[string]FSM{
+			ZoneMoveProcess:        {Name: ZoneMoveProcess, InitialState: "signers-unsynced"},
+			SignerJoinGroupProcess: {Name: SignerJoinGroupProcess, InitialState: "signers-unsynced"},
+		})
+		ec := make(chan EngineCheck, 10)
+
+		if _, err := mdb.AddSignerGroup(nil, "group2"); err != nil {
+			t.Fatalf("AddSignerGroup: %v", err)
+		}
+		for _, name := range []string{"signer2", "signer3"} {
+			s := &Signer{Name: name, Method: "ddns", Address: "127.0.0.1", Port: "53"}
+			if _, err := mdb.AddSigner(nil, s, ""); err != nil {
+				t.Fatalf("AddSigner: %v", err)
+			}
+		}
+
+		z, _, err := mdb.GetZone(nil, "test.se.")
+		if err != nil {
+			t.Fatalf("GetZone: %v", err)
+		}
+		if _, err := mdb.ZoneMoveGroup(nil, z, "group2", ec); err == nil {
+			t.Errorf("ZoneMoveGroup to group without signers: got no error")
+		}
+		if _, err := mdb.ZoneMoveGroup(nil, z, "group1", ec); err == nil {
+			t.Errorf("ZoneMoveGroup to current group: got no error")
+		}
+
+		if _, err := mdb.Exec("INSERT INTO group_signers (name, signer) VALUES (?, ?)", "group2", "signer2"); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		if _, err := mdb.ZoneMoveGroup(nil, z, "group2", ec); err != nil {
+			t.Fatalf("ZoneMoveGroup: %v", err)
+		}
+
+		// Until the switch the zone works with the signers of both groups.
+		z, _, err = mdb.GetZone(nil, "test.se.")
+		if err != nil || z.FSM != ZoneMoveProcess || z.SGname != "group1" || len(z.SGroup.SignerMap) != 2 {
+			t.Fatalf("GetZone: got %+v, %v wanted group1 with signer1 and signer2", z, err)
+		}
+		if _, err := mdb.ZoneMoveGroup(nil, z, "group2", ec); err == nil {
+			t.Errorf("ZoneMoveGroup while moving: got no error")
+		}
+		signer3, err := mdb.GetSignerByName(nil, "signer3", false)
+		if err != nil {
+			t.Fatalf("GetSignerByName: %v", err)
+		}
+		if _, err := mdb.SignerJoinGroup(nil, signer3, "group2"); err == nil {
+			t.Errorf("SignerJoinGroup while a zone moves into the group: got no error")
+		}
+
+		// a zone that has left the process (f.e. preempted) is not switched
+		const fsmsql = "UPDATE zones SET fsm=? WHERE name=?"
+		if _, err := mdb.Exec(fsmsql, "other-process", z.Name); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		if err := mdb.ZoneMoveSwitchGroup(z); err == nil {
+			t.Errorf("ZoneMoveSwitchGroup of a zone in another process: got no error")
+		}
+		if _, err := mdb.Exec(fsmsql, ZoneMoveProcess, z.Name); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		if z, _, err := mdb.GetZone(nil, "test.se."); err != nil || z.SGname != "group1" {
+			t.Fatalf("GetZone after a refused switch: got %+v, %v wanted group1", z, err)
+		}
+
+		if err := mdb.ZoneMoveSwitchGroup(z); err != nil {
+			t.Fatalf("ZoneMoveSwitchGroup: %v", err)
+		}
+		z, _, err = mdb.GetZone(nil, "test.se.")
+		if err != nil || z.SGname != "group2" || len(z.SGroup.SignerMap) != 1 {
+			t.Fatalf("GetZone after switch: got %+v, %v wanted group2 with signer2", z, err)
+		}
+		leaving, err := mdb.MoveZoneLeavingSigners(z)
+		if _, ok := leaving["signer1"]; err != nil || !ok || len(leaving) != 1 {
+			t.Errorf("MoveZoneLeavingSigners: got %v, %v wanted signer1", leaving, err)
+		}
+
+		if _, _, err := mdb.zoneLeaveFsm(z, ZoneMoveProcess); err != nil {
+			t.Fatalf("zoneLeaveFsm: %v", err)
+		}
+		if _, _, err := mdb.MoveZoneGroups(z); err == nil {
+			t.Errorf("MoveZoneGroups after the move: got no error")
+		}
+		if _, err := mdb.SignerJoinGroup(nil, signer3, "group2"); err != nil {
+			t.Errorf("SignerJoinGroup after the move: %v", err)
+		}
+	})
+}
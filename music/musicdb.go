@@ -8,8 +8,6 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
-	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 	// "github.com/spf13/viper"
@@ -99,75 +97,76 @@ UNIQUE (zone, key)
 )`,
 }
 
-func dbSetupTables(mdb *MusicDB) (bool, error) {
-	fmt.Printf("Setting up missing tables\n")
-
-	var tx *sql.Tx
-	localtx, tx, err := mdb.StartTransaction(tx)
+// NewDB opens the DB and migrates the schema to the latest version. If
+// force is true all tables are dropped first.
+func NewDB(source, dbmode string, force bool) (*MusicDB, error) {
+	mdb, err := OpenDB(source, dbmode)
 	if err != nil {
-		log.Printf("dbSetupTables: Error from mdb.StartTransaction(): %v\n", err)
-		return false, err
-	}
-	defer mdb.CloseTransaction(localtx, tx, err)
-
-	for t, s := range DefaultTables {
-		_, err = tx.Exec(s)
-		if err != nil {
-			log.Fatalf("Failed to set up db schema for table %s: %s. Error: %v", t, s, err)
-		}
-	}
-
-	return false, nil
-}
-
-func NewDB(dbfile, dbmode string, force bool) (*MusicDB, error) {
-	log.Printf("NewMusicDB: using sqlite db in file %s\n", dbfile)
-
-	_, err := os.Stat(dbfile)
-	if !os.IsNotExist(err) {
-		if err := os.Chmod(dbfile, 0664); err != nil {
-			log.Printf("NewMusicDB: Error trying to ensure that db %s is writable: %v", dbfile, err)
-		}
-	}
-	db, err := sql.Open("sqlite3", dbfile)
-	if err != nil {
-		log.Printf("NewMusicDB: Error from sql.Open: %v", err)
 		return nil, err
 	}
 
-	if dbmode == "WAL" {
-		_, err := db.Exec("PRAGMA journal_mode=WAL;")
-		if err != nil {
-			log.Fatalf("NewDB: Error entering DB WAL mode: %v", err)
-		}
-		log.Printf("NewDB: Running DB in WAL (write-ahead logging) mode.")
-	}
-
 	if force {
 		for table, _ := range DefaultTables {
 			sqlcmd := fmt.Sprintf("DROP TABLE %s", table)
-			_, err = db.Exec(sqlcmd)
+			_, err = mdb.db.Exec(sqlcmd)
 			if err != nil {
 				log.Printf("NewMusicDB: Error when dropping table %s: %v", table, err)
 				return nil, err
 			}
 		}
+		_, err = mdb.db.Exec("DROP TABLE IF EXISTS schema_version")
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	var mdb = MusicDB{
-		db:              db,
-		FSMlist:         map[string]FSM{},
-		StopReasonCache: map[string]string{},
+	_, err = mdb.Migrate(false)
+	if err != nil {
+		log.Printf("NewMusicDB: Error from Migrate: %v", err)
+		return nil, err
+	}
+
+	return mdb, nil
+}
+
+// OpenDB opens the DB without touching the schema (see NewDB and Migrate).
+// dbmode selects the backend (see NewDBBackend), source is the DB file for
+// SQLite and the connection string for PostgreSQL.
+func OpenDB(source, dbmode string) (*MusicDB, error) {
+	backend, err := NewDBBackend(dbmode)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = dbSetupTables(&mdb)
+	db, err := backend.Open(source)
 	if err != nil {
 		return nil, err
 	}
 
+	var mdb = MusicDB{
+		db:          db,
+		backend:     backend,
+		fsmlist:     newFSMList(),
+		stopreasons: newStopReasonCache(),
+		parents:     newParentCache(),
+		txevents:    newTxEvents(),
+		zonelocks:   newZoneLocks(),
+	}
+	mdb.SetEngineLimits(DefaultEngineLimits)
+
 	return &mdb, nil
 }
 
+func (mdb *MusicDB) Close() error {
+	return mdb.db.Close()
+}
+
+// IsRetryable reports whether err is a transient error (f.e. the DB being
+// locked by another connection) so that the operation should be retried.
+func (mdb *MusicDB) IsRetryable(err error) bool {
+	return mdb.backend.IsRetryable(err)
+}
+
 func (mdb *MusicDB) Query(sqlq string, args ...interface{}) (*sql.Rows, error) {
 	return mdb.db.Query(sqlq, args...)
 }
@@ -180,6 +179,16 @@ func (mdb *MusicDB) Prepare(sqlq string) (*sql.Stmt, error) {
 	return mdb.db.Prepare(sqlq)
 }
 
+// Ping verifies that the DB is reachable and that the zones table can be read.
+func (mdb *MusicDB) Ping() error {
+	var name string
+	err := mdb.db.QueryRow("SELECT name FROM zones LIMIT 1").Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
 func (mdb *MusicDB) Begin() (*sql.Tx, error) {
 	return mdb.db.Begin()
 }
@@ -201,6 +210,7 @@ func (mdb *MusicDB) Rollback(localtx bool, tx *sql.Tx) {
 		if err != nil {
 			log.Printf("Error from tx.Rollback(): %v", err)
 		}
+		mdb.txDone(tx, false)
 		return
 	}
 }
@@ -213,12 +223,14 @@ func (mdb *MusicDB) CloseTransaction(localtx bool, tx *sql.Tx, err error) {
 			if err != nil {
 				log.Printf("Error from tx.Rollback(): %v", err)
 			}
+			mdb.txDone(tx, false)
 		} else {
 			// Commit path
 			err := tx.Commit()
 			if err != nil {
 				log.Printf("Error from tx.Commit(): %v", err)
 			}
+			mdb.txDone(tx, err == nil)
 		}
 	} else {
 		// not a localtx, so we mustn't txRollback(), nor tx.Commit()
@@ -300,19 +312,22 @@ func (mdb *MusicDB) GetSigner(tx *sql.Tx, s *Signer, apisafe bool) (*Signer, err
 			log.Fatalf("mdb.GetSigner: Error from signer.GetSignerGroups: %v", err)
 		}
 
-		auth := AuthData{}
-		p := strings.Split(authstr, ":")
-		if len(p) == 3 {
-			auth = AuthData{
-				TSIGAlg:  p[0],
-				TSIGName: p[1],
-				TSIGKey:  p[2],
-			}
+		authstr, err = mdb.openSecret(name, authstr)
+		if err != nil && !apisafe {
+			return &Signer{
+				Name:    name,
+				Exists:  true,
+				Method:  method,
+				Address: address,
+				Port:    port,
+			}, err
 		}
+		auth := ParseAuthStr(authstr)
 
 		dbref := mdb
 		if apisafe {
 			dbref = nil
+			authstr, auth = RedactAuth(auth)
 		}
 		return &Signer{
 			Name:         name,
@@ -0,0 +1,209 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// Generalized NOTIFY (draft-ietf-dnsop-generalized-notify): once CDS or
+// CSYNC is published in all signers, MUSIC sends NOTIFY(CDS) or
+// NOTIFY(CSYNC) to the parent's notification target so that the parent
+// scans the zone right away instead of at its next scheduled scan.
+//
+// The target is taken from the zone metadata "notifyaddr" (host:port) if
+// set. Otherwise it is looked up in the DSYNC RRset of the parent, first at
+// <child labels>._dsync.<parent> and then at _dsync.<parent>.
+
+const (
+	TypeDSYNC         = 66 // not (yet) known to miekg/dns
+	DsyncSchemeNotify = 1
+)
+
+type DsyncTarget struct {
+	RRtype uint16
+	Scheme uint8
+	Port   uint16
+	Target string
+}
+
+// NotifyParent sends NOTIFY(rrtype) for the zone to the parent's
+// notification target.
+func (z *Zone) NotifyParent(rrtype uint16) error {
+	target, err := z.NotifyTarget(rrtype)
+	if err != nil {
+		return err
+	}
+
+	m := new(dns.Msg)
+	m.SetNotify(z.Name)
+	m.Question[0].Qtype = rrtype
+	c := new(dns.Client)
+	r, _, err := c.Exchange(m, target)
+	if err != nil {
+		return fmt.Errorf("NOTIFY(%s) for %s to %s: %v", dns.TypeToString[rrtype], z.Name, target, err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("NOTIFY(%s) for %s to %s: rcode %s", dns.TypeToString[rrtype], z.Name,
+			target, dns.RcodeToString[r.Rcode])
+	}
+	log.Printf("Zone %s: sent NOTIFY(%s) to %s", z.Name, dns.TypeToString[rrtype], target)
+	return nil
+}
+
+// NotifyTarget returns the address (host:port) that NOTIFY(rrtype) for the
+// zone should be sent to.
+func (z *Zone) NotifyTarget(rrtype uint16) (string, error) {
+	addr, exist, err := z.MusicDB.GetMeta(nil, z, "notifyaddr")
+	if err != nil {
+		return "", err
+	}
+	if exist && addr != "" {
+		return addr, nil
+	}
+
+	parent, err := ParentZone(z.Name)
+	if err != nil {
+		return "", err
+	}
+	target, err := LookupDsync(z.Name, parent, rrtype)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := lookupAddrs(target.Target)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addrs[0], strconv.Itoa(int(target.Port))), nil
+}
+
+// Resolver returns the address of the resolver used for lookups of the
+// parent and its DSYNC records: common.resolver, or else the first
+// nameserver in /etc/resolv.conf.
+func Resolver() string {
+	if resolver := viper.GetString("common.resolver"); resolver != "" {
+		return resolver
+	}
+	cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(cc.Servers) == 0 {
+		return "127.0.0.1:53"
+	}
+	return net.JoinHostPort(cc.Servers[0], cc.Port)
+}
+
+func resolverQuery(qname string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(qname), qtype)
+	c := new(dns.Client)
+	r, _, err := c.Exchange(m, Resolver())
+	if err != nil {
+		return nil, fmt.Errorf("lookup of %s %s failed: %v", qname, dns.TypeToString[qtype], err)
+	}
+	return r, nil
+}
+
+// ParentZone returns the name of the zone that the delegation of zone is in.
+func ParentZone(zone string) (string, error) {
+	labels := dns.SplitDomainName(zone)
+	if len(labels) < 2 {
+		return ".", nil
+	}
+	// the SOA in the answer (or, for a name that is not a zone apex, in the
+	// authority section) is that of the enclosing zone
+	r, err := resolverQuery(strings.Join(labels[1:], ".")+".", dns.TypeSOA)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("unable to find the parent zone of %s", zone)
+}
+
+// LookupDsync returns the DSYNC target for NOTIFY(rrtype) for child in
+// parent, preferring a child specific DSYNC RRset.
+func LookupDsync(child, parent string, rrtype uint16) (*DsyncTarget, error) {
+	child, parent = dns.Fqdn(child), dns.Fqdn(parent)
+	prefix := strings.TrimSuffix(child, parent)
+	if parent == "." {
+		prefix = child
+	}
+	for _, qname := range []string{prefix + "_dsync." + parent, "_dsync." + parent} {
+		r, err := resolverQuery(qname, TypeDSYNC)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range r.Answer {
+			target, err := parseDsync(rr)
+			if err != nil {
+				log.Printf("LookupDsync: %s: %v", qname, err)
+				continue
+			}
+			if target.Scheme == DsyncSchemeNotify && target.RRtype == rrtype {
+				return target, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no DSYNC for NOTIFY(%s) found for %s in %s",
+		dns.TypeToString[rrtype], child, parent)
+}
+
+// parseDsync parses the rdata of an (unknown to miekg/dns) DSYNC RR:
+// RRtype (16 bits), Scheme (8 bits), Port (16 bits), Target (domain name).
+func parseDsync(rr dns.RR) (*DsyncTarget, error) {
+	unknown, ok := rr.(*dns.RFC3597)
+	if !ok || unknown.Hdr.Rrtype != TypeDSYNC {
+		return nil, fmt.Errorf("not a DSYNC record: %s", rr.String())
+	}
+	rdata, err := hex.DecodeString(unknown.Rdata)
+	if err != nil {
+		return nil, err
+	}
+	if len(rdata) < 6 {
+		return nil, fmt.Errorf("DSYNC rdata too short")
+	}
+	target, _, err := dns.UnpackDomainName(rdata, 5)
+	if err != nil {
+		return nil, err
+	}
+	return &DsyncTarget{
+		RRtype: uint16(rdata[0])<<8 | uint16(rdata[1]),
+		Scheme: rdata[2],
+		Port:   uint16(rdata[3])<<8 | uint16(rdata[4]),
+		Target: target,
+	}, nil
+}
+
+func lookupAddrs(name string) ([]string, error) {
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		r, err := resolverQuery(name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address found for %s", name)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,34 @@
+package music
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseDsync(t *testing.T) {
+	target := make([]byte, 64)
+	n, err := dns.PackDomainName("notify.example.net.", target, 0, nil, false)
+	if err != nil {
+		t.Fatalf("PackDomainName: %v", err)
+	}
+	rdata := append([]byte{0x00, 0x3b, DsyncSchemeNotify, 0x14, 0xb4}, target[:n]...)
+	rr := &dns.RFC3597{
+		Hdr:   dns.RR_Header{Name: "_dsync.example.net.", Rrtype: TypeDSYNC, Class: dns.ClassINET},
+		Rdata: hex.EncodeToString(rdata),
+	}
+
+	ds, err := parseDsync(rr)
+	if err != nil {
+		t.Fatalf("parseDsync: %v", err)
+	}
+	if ds.RRtype != dns.TypeCDS || ds.Scheme != DsyncSchemeNotify || ds.Port != 5300 ||
+		ds.Target != "notify.example.net." {
+		t.Errorf("parseDsync: got %+v", ds)
+	}
+
+	if _, err := parseDsync(&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}}); err == nil {
+		t.Errorf("parseDsync: expected error for an A record")
+	}
+}
@@ -0,0 +1,261 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// The processes check the DS and NS RRsets of the zone in the parent. The
+// parent is found automatically: the zone cut above the zone is located via
+// the resolver (see ParentZone), then all authoritative servers of the
+// parent are asked for the DS and NS RRsets of the zone. They must all give
+// the same answer, otherwise the parent is not in a consistent state (f.e.
+// an update has not reached all servers yet). The result is cached for the
+// TTL of the answers, but never longer than common.parentcachettl seconds
+// (default 60). Processes waiting for the parent to change use
+// RefreshParent, which only takes the parent servers from the cache. The
+// "parentaddr" metadata of a zone overrides discovery, as does the parent
+// address set by the parent agent (see SetParentAddress).
+
+const DefaultParentCacheTTL = 60
+
+type ParentInfo struct {
+	Zone    string   // the parent zone
+	Servers []string // host:port of the authoritative servers of the parent
+	DS      []dns.RR
+	NS      []dns.RR
+	Expires time.Time
+}
+
+// DiscoverParent returns the parent of the zone, from the cache if possible.
+func (mdb *MusicDB) DiscoverParent(zone string) (*ParentInfo, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	if pi, exist := mdb.parents.Get(zone, time.Now()); exist {
+		return pi, nil
+	}
+
+	pi, err := discoverParent(zone)
+	if err != nil {
+		return nil, err
+	}
+	mdb.parents.Set(zone, pi)
+	log.Printf("DiscoverParent: zone %s: parent %s, servers %v (cached until %s)", zone, pi.Zone,
+		pi.Servers, pi.Expires.Format(time.RFC3339))
+	return pi, nil
+}
+
+// RefreshParent returns the parent of the zone like DiscoverParent, but the
+// DS and NS RRsets are always fetched from the parent servers. Only the
+// parent zone and its servers may come from the cache.
+func (mdb *MusicDB) RefreshParent(zone string) (*ParentInfo, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	pi, exist := mdb.parents.Get(zone, time.Now())
+	if !exist {
+		return mdb.DiscoverParent(zone)
+	}
+	if _, err := pi.fetchRRsets(zone, 0); err != nil {
+		return nil, err
+	}
+	mdb.parents.Set(zone, pi)
+	return pi, nil
+}
+
+// FlushParent removes the zone from the parent cache, f.e. after the parent
+// has been updated.
+func (mdb *MusicDB) FlushParent(zone string) {
+	mdb.parents.Flush(dns.Fqdn(strings.ToLower(zone)))
+}
+
+// ParentZoneName returns the name of the parent zone of the zone. It is
+// looked up once and then kept, as it is used on every state transition
+// that depends on the CDS policy (see CdsPolicy) and a zone cut very rarely
+// moves. The parent zone set by the parent agent or found by DiscoverParent
+// is used if there is one.
+func (mdb *MusicDB) ParentZoneName(zone string) (string, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	if parent, exist := mdb.parents.Name(zone); exist {
+		return parent, nil
+	}
+	parent := ""
+	if pi, exist := mdb.parents.Get(zone, time.Now()); exist {
+		parent = pi.Zone
+	} else {
+		var err error
+		if parent, err = ParentZone(zone); err != nil {
+			return "", err
+		}
+	}
+	parent = dns.Fqdn(strings.ToLower(parent))
+	mdb.parents.SetName(zone, parent)
+	return parent, nil
+}
+
+// SetParentAddress makes the processes check the parent zone of the zone at
+// addr (host:port) instead of discovering it. The parent agent uses it for
+// the parents that it updates itself, which may be hidden primaries. Unlike the
+// "parentaddr" metadata it is only kept in memory and the parent agent
+// clears it (see ClearParentAddress) once it no longer handles the zone, so
+// that discovery is used again.
+func (mdb *MusicDB) SetParentAddress(zone, parent, addr string) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	mdb.parents.SetName(zone, dns.Fqdn(strings.ToLower(parent)))
+	mdb.parents.SetAddr(zone, addr)
+}
+
+// ClearParentAddress removes the address and parent zone set with
+// SetParentAddress. It returns true if there was an address.
+func (mdb *MusicDB) ClearParentAddress(zone string) bool {
+	return mdb.parents.ClearAddr(dns.Fqdn(strings.ToLower(zone)))
+}
+
+// ParentAddress returns the address set with SetParentAddress, if any.
+func (mdb *MusicDB) ParentAddress(zone string) (string, bool) {
+	return mdb.parents.Addr(dns.Fqdn(strings.ToLower(zone)))
+}
+
+func discoverParent(zone string) (*ParentInfo, error) {
+	parent, err := ParentZone(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := resolverQuery(parent, dns.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+	ttl := uint32(viper.GetInt("common.parentcachettl"))
+	if ttl == 0 {
+		ttl = DefaultParentCacheTTL
+	}
+	var servers []string
+	for _, rr := range r.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		if ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+		addrs, err := lookupAddrs(ns.Ns)
+		if err != nil {
+			log.Printf("DiscoverParent: parent %s: %v", parent, err)
+			continue
+		}
+		for _, addr := range addrs {
+			servers = append(servers, net.JoinHostPort(addr, "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no authoritative servers found for parent %s of %s", parent, zone)
+	}
+	sort.Strings(servers)
+
+	pi := &ParentInfo{Zone: parent, Servers: servers}
+	if ttl, err = pi.fetchRRsets(zone, ttl); err != nil {
+		return nil, err
+	}
+	pi.Expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	return pi, nil
+}
+
+// fetchRRsets asks all parent servers for the DS and NS RRsets of the zone,
+// which must agree. It returns ttl lowered to the TTLs of the answers.
+func (pi *ParentInfo) fetchRRsets(zone string, ttl uint32) (uint32, error) {
+	dsrrs := map[string][]dns.RR{}
+	nsrrs := map[string][]dns.RR{}
+	dsanswers := map[string]string{}
+	nsanswers := map[string]string{}
+	for _, server := range pi.Servers {
+		ds, dsttl, err := parentRRset(zone, dns.TypeDS, server)
+		if err != nil {
+			return 0, err
+		}
+		ns, nsttl, err := parentRRset(zone, dns.TypeNS, server)
+		if err != nil {
+			return 0, err
+		}
+		for _, t := range []uint32{dsttl, nsttl} {
+			if t > 0 && t < ttl {
+				ttl = t
+			}
+		}
+		dsrrs[server], nsrrs[server] = ds, ns
+		dsanswers[server] = rrsetString(ds)
+		nsanswers[server] = rrsetString(ns)
+	}
+	if err := compareParentServers("DS", dsanswers); err != nil {
+		return 0, fmt.Errorf("parent %s of %s: %v", pi.Zone, zone, err)
+	}
+	if err := compareParentServers("NS", nsanswers); err != nil {
+		return 0, fmt.Errorf("parent %s of %s: %v", pi.Zone, zone, err)
+	}
+	// the servers agree, so the RRsets of the first are those of all of them
+	pi.DS, pi.NS = dsrrs[pi.Servers[0]], nsrrs[pi.Servers[0]]
+	return ttl, nil
+}
+
+// parentRRset asks a parent server for the DS or NS RRset of the zone. The
+// NS RRset is in the authority section of the referral.
+func parentRRset(zone string, rrtype uint16, server string) ([]dns.RR, uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, rrtype)
+	c := new(dns.Client)
+	r, _, err := c.Exchange(m, server)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to fetch %s %s from parent server %s: %v", zone,
+			dns.TypeToString[rrtype], server, err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, 0, fmt.Errorf("%s %s from parent server %s: rcode %s", zone,
+			dns.TypeToString[rrtype], server, dns.RcodeToString[r.Rcode])
+	}
+	var rrs []dns.RR
+	var ttl uint32
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if rr.Header().Rrtype == rrtype && strings.EqualFold(rr.Header().Name, zone) {
+			rrs = append(rrs, rr)
+			ttl = rr.Header().Ttl
+		}
+	}
+	return rrs, ttl, nil
+}
+
+// rrsetString returns the RRset without TTLs, sorted, for comparisons.
+func rrsetString(rrs []dns.RR) string {
+	var rdata []string
+	for _, rr := range rrs {
+		rdata = append(rdata, strings.ToLower(strings.TrimPrefix(rr.String(), rr.Header().String())))
+	}
+	sort.Strings(rdata)
+	return strings.Join(rdata, ", ")
+}
+
+// compareParentServers returns an error listing the differing answers if
+// the parent servers do not agree on the RRset.
+func compareParentServers(rrtype string, answers map[string]string) error {
+	views := map[string][]string{}
+	for server, answer := range answers {
+		views[answer] = append(views[answer], server)
+	}
+	if len(views) <= 1 {
+		return nil
+	}
+	var diffs []string
+	for answer, servers := range views {
+		sort.Strings(servers)
+		diffs = append(diffs, fmt.Sprintf("%s: [%s]", strings.Join(servers, " "), answer))
+	}
+	sort.Strings(diffs)
+	return fmt.Errorf("parent servers have different %s RRsets: %s", rrtype, strings.Join(diffs, "; "))
+}
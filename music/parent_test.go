@@ -0,0 +1,247 @@
+package music
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCompareParentServers(t *testing.T) {
+	same := map[string]string{
+		"192.0.2.1:53": "ns1.test.se., ns2.test.se.",
+		"192.0.2.2:53": "ns1.test.se., ns2.test.se.",
+	}
+	if err := compareParentServers("NS", same); err != nil {
+		t.Errorf("compareParentServers: unexpected error: %v", err)
+	}
+
+	differ := map[string]string{
+		"192.0.2.1:53": "ns1.test.se., ns2.test.se.",
+		"192.0.2.2:53": "ns1.test.se.",
+	}
+	err := compareParentServers("NS", differ)
+	if err == nil {
+		t.Fatalf("compareParentServers: expected an error for differing NS RRsets")
+	}
+	if !strings.Contains(err.Error(), "192.0.2.2:53") {
+		t.Errorf("compareParentServers: error does not name the server: %v", err)
+	}
+}
+
+func TestRRsetString(t *testing.T) {
+	a, _ := dns.NewRR("test.se. 3600 IN NS NS2.test.se.")
+	b, _ := dns.NewRR("test.se. 60 IN NS ns1.test.se.")
+	c, _ := dns.NewRR("test.se. 300 IN NS ns1.test.se.")
+	d, _ := dns.NewRR("test.se. 300 IN NS ns2.test.se.")
+	if rrsetString([]dns.RR{a, b}) != rrsetString([]dns.RR{c, d}) {
+		t.Errorf("rrsetString: order, TTL and case should not matter: %q != %q",
+			rrsetString([]dns.RR{a, b}), rrsetString([]dns.RR{c, d}))
+	}
+}
+
+func TestParentCache(t *testing.T) {
+	c := newParentCache()
+	now := time.Now()
+	c.Set("test.se.", &ParentInfo{Zone: "se.", Servers: []string{"192.0.2.1:53"},
+		Expires: now.Add(time.Minute)})
+
+	pi, exist := c.Get("test.se.", now)
+	if !exist || pi.Zone != "se." {
+		t.Fatalf("parentCache.Get: got %v, %v", pi, exist)
+	}
+	if _, exist := c.Get("test.se.", now.Add(2*time.Minute)); exist {
+		t.Errorf("parentCache.Get: expired entry returned")
+	}
+
+	c.Set("test.se.", &ParentInfo{Zone: "se.", Expires: now.Add(time.Minute)})
+	c.Flush("test.se.")
+	if _, exist := c.Get("test.se.", now); exist {
+		t.Errorf("parentCache.Get: flushed entry returned")
+	}
+}
+
+func TestGetParentAddressOverride(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+		z, exist, err := mdb.GetZone(nil, "test.se.")
+		if err != nil || !exist {
+			t.Fatalf("GetZone: %v %v", exist, err)
+		}
+		addr, exist, err := z.parentAddressOverride()
+		if err != nil {
+			t.Fatalf("parentAddressOverride: %v", err)
+		}
+		if !exist || addr != "192.0.2.1:53" {
+			t.Errorf("parentAddressOverride: got %s, want the parentaddr metadata", addr)
+		}
+	})
+}
+
+func TestSetParentAddress(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+		z, exist, err := mdb.GetZone(nil, "test.se.")
+		if err != nil || !exist {
+			t.Fatalf("GetZone: %v %v", exist, err)
+		}
+		mdb.SetParentAddress("TEST.se", "se", "192.0.2.2:53")
+		if addr, exist := mdb.ParentAddress("test.se."); !exist || addr != "192.0.2.2:53" {
+			t.Errorf("ParentAddress: got %s, %v", addr, exist)
+		}
+
+		// the parentaddr metadata wins
+		addr, _, err := z.parentAddressOverride()
+		if err != nil || addr != "192.0.2.1:53" {
+			t.Errorf("parentAddressOverride: got %s, %v, want the parentaddr metadata", addr, err)
+		}
+		if _, err := mdb.Exec("DELETE FROM metadata WHERE zone=? AND key=?", z.Name, "parentaddr"); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		addr, _, err = z.parentAddressOverride()
+		if err != nil || addr != "192.0.2.2:53" {
+			t.Errorf("parentAddressOverride: got %s, %v, want the parent agent address", addr, err)
+		}
+
+		// the parent agent no longer handles the zone
+		if !mdb.ClearParentAddress("test.se.") {
+			t.Errorf("ClearParentAddress: got false for a zone with a parent address")
+		}
+		if addr, exist, err := z.parentAddressOverride(); err != nil || exist {
+			t.Errorf("parentAddressOverride: got %s, %v, %v after ClearParentAddress", addr, exist, err)
+		}
+		if mdb.ClearParentAddress("test.se.") {
+			t.Errorf("ClearParentAddress: got true for a zone without a parent address")
+		}
+	})
+}
+
+// testParentServer is a parent server on localhost that answers DS queries
+// with ds, which may be changed while it runs.
+type testParentServer struct {
+	mu   sync.Mutex
+	ds   []dns.RR
+	addr string
+}
+
+func startTestParentServer(t *testing.T, ds ...dns.RR) *testParentServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	ps := &testParentServer{ds: ds, addr: pc.LocalAddr().String()}
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeDS {
+			ps.mu.Lock()
+			m.Answer = ps.ds
+			ps.mu.Unlock()
+		}
+		w.WriteMsg(m)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(handler),
+		NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return ps
+}
+
+func (ps *testParentServer) setDS(ds ...dns.RR) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.ds = ds
+}
+
+func TestFetchParentRRsets(t *testing.T) {
+	ds1, _ := dns.NewRR("test.se. 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF")
+	ds2, _ := dns.NewRR("test.se. 60 IN DS 54321 13 2 FEDCBA9876543210FEDCBA9876543210FEDCBA9876543210FEDCBA9876543210")
+	s1 := startTestParentServer(t, ds1)
+	s2 := startTestParentServer(t, ds1)
+
+	pi := &ParentInfo{Zone: "se.", Servers: []string{s1.addr, s2.addr}}
+	if _, err := pi.fetchRRsets("test.se.", 60); err != nil {
+		t.Fatalf("fetchRRsets: %v", err)
+	}
+	if len(pi.DS) != 1 || pi.DS[0].(*dns.DS).KeyTag != 12345 {
+		t.Errorf("fetchRRsets: got DS %v", pi.DS)
+	}
+
+	// an update that has only reached the second server
+	s2.setDS(ds1, ds2)
+	if _, err := pi.fetchRRsets("test.se.", 60); err == nil {
+		t.Errorf("fetchRRsets: servers disagree, got no error")
+	} else if !strings.Contains(err.Error(), s2.addr) {
+		t.Errorf("fetchRRsets: error does not name the server: %v", err)
+	}
+
+	s1.setDS(ds1, ds2)
+	ttl, err := pi.fetchRRsets("test.se.", 600)
+	if err != nil {
+		t.Fatalf("fetchRRsets: %v", err)
+	}
+	if len(pi.DS) != 2 {
+		t.Errorf("fetchRRsets: got DS %v", pi.DS)
+	}
+	if ttl != 60 {
+		t.Errorf("fetchRRsets: got ttl %d wanted the lowest TTL 60", ttl)
+	}
+}
+
+func TestParentRRsetOrStopNotCached(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+		ds1, _ := dns.NewRR("test.se. 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF")
+		ds2, _ := dns.NewRR("test.se. 3600 IN DS 54321 13 2 FEDCBA9876543210FEDCBA9876543210FEDCBA9876543210FEDCBA9876543210")
+		ps := startTestParentServer(t, ds1)
+
+		z, exist, err := mdb.GetZone(nil, "test.se.")
+		if err != nil || !exist {
+			t.Fatalf("GetZone: %v %v", exist, err)
+		}
+		if _, err := mdb.Exec("DELETE FROM metadata WHERE zone=? AND key=?", z.Name, "parentaddr"); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		// the parent servers are cached with a stale DS RRset
+		mdb.parents.Set("test.se.", &ParentInfo{Zone: "se.", Servers: []string{ps.addr},
+			DS: []dns.RR{ds2}, Expires: time.Now().Add(time.Hour)})
+
+		for _, want := range [][]dns.RR{{ds1}, {ds1, ds2}} {
+			ps.setDS(want...)
+			dses, err := z.ParentRRsetOrStop(dns.TypeDS)
+			if err != nil {
+				t.Fatalf("ParentRRsetOrStop: %v", err)
+			}
+			if rrsetString(dses) != rrsetString(want) {
+				t.Errorf("ParentRRsetOrStop: got %v wanted %v", dses, want)
+			}
+		}
+	})
+}
+
+func TestSignerParentUpdaterLooksUpSigner(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		if _, err := mdb.Migrate(false); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		spu := &SignerParentUpdater{MusicDB: mdb, Signer: "parent1", ParentZone: "se."}
+		if _, _, err := spu.Current("test.se."); err == nil || !strings.Contains(err.Error(), "parent1") {
+			t.Errorf("Current with an unknown signer: got %v", err)
+		}
+
+		// a signer added after the parent updater was set up is used
+		s := &Signer{Name: "parent1", Method: "ddns", Address: "127.0.0.1", Port: "53"}
+		if _, err := mdb.AddSigner(nil, s, ""); err != nil {
+			t.Fatalf("AddSigner: %v", err)
+		}
+		if _, _, err := spu.Current("test.se."); err == nil || !strings.Contains(err.Error(), "No TSIG") {
+			t.Errorf("Current with a signer without TSIG: got %v", err)
+		}
+	})
+}
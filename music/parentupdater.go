@@ -0,0 +1,267 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Not every parent scans for CDS and CSYNC. For f.e. a TLD the parent is a
+// registry that is only reachable through the registrar's EPP interface. For
+// such zones MUSIC pushes the DS and NS changes to the parent itself, via a
+// parent updater. Parent updaters are configured in musicd (see
+// RegisterParentUpdater) and selected per zone with the "parentupdater"
+// metadata. Zones without it are left to the parent to scan.
+
+const MetaParentUpdater = "parentupdater"
+
+// A ParentUpdate is a change of the DS and NS RRsets of a zone in its parent.
+type ParentUpdate struct {
+	Zone     string
+	AddDS    []*dns.DS
+	RemoveDS []*dns.DS
+	AddNS    []string // nameserver names
+	RemoveNS []string
+}
+
+func (pu ParentUpdate) Empty() bool {
+	return len(pu.AddDS) == 0 && len(pu.RemoveDS) == 0 && len(pu.AddNS) == 0 && len(pu.RemoveNS) == 0
+}
+
+type ParentUpdater interface {
+	// Current returns the DS RRset and the NS names that the parent has for the zone.
+	Current(zone string) ([]*dns.DS, []string, error)
+	Update(pu ParentUpdate) error
+}
+
+var parentUpdaters = struct {
+	mu       sync.RWMutex
+	updaters map[string]ParentUpdater
+}{updaters: map[string]ParentUpdater{}}
+
+// RegisterParentUpdater makes the parent updater available to zones under the name.
+func RegisterParentUpdater(name string, pu ParentUpdater) {
+	parentUpdaters.mu.Lock()
+	defer parentUpdaters.mu.Unlock()
+	parentUpdaters.updaters[name] = pu
+}
+
+func GetParentUpdater(name string) (ParentUpdater, bool) {
+	parentUpdaters.mu.RLock()
+	defer parentUpdaters.mu.RUnlock()
+	pu, exist := parentUpdaters.updaters[name]
+	return pu, exist
+}
+
+// ParentUpdater returns the parent updater selected for the zone, or nil if
+// the zone has none.
+func (z *Zone) ParentUpdater() (ParentUpdater, error) {
+	name, exist, err := z.MusicDB.GetMeta(nil, z, MetaParentUpdater)
+	if err != nil || !exist || name == "" {
+		return nil, err
+	}
+	pu, exist := GetParentUpdater(name)
+	if !exist {
+		return nil, fmt.Errorf("Zone %s: parent updater '%s' is not configured", z.Name, name)
+	}
+	return pu, nil
+}
+
+// PushToParent makes the parent have the DS RRset that the published CDS
+// (or CDNSKEY, see CdsPolicy) RRset points to (rrtype CDS) or the NS RRset
+// that the signers publish (rrtype CSYNC), using the zone's parent updater.
+func (z *Zone) PushToParent(pu ParentUpdater, rrtype uint16) error {
+	curds, curns, err := pu.Current(z.Name)
+	if err != nil {
+		return fmt.Errorf("unable to get DS and NS of %s from the parent: %v", z.Name, err)
+	}
+
+	update := ParentUpdate{Zone: z.Name}
+	switch rrtype {
+	case dns.TypeCDS:
+		signer, err := z.firstSigner()
+		if err != nil {
+			return err
+		}
+		policy, err := z.CdsPolicy()
+		if err != nil {
+			return err
+		}
+		want, err := policy.PublishedDS(z, signer)
+		if err != nil {
+			return err
+		}
+		if want == nil {
+			log.Printf("Zone %s: no CDS/CDNSKEY published, parent DS left alone", z.Name)
+			return nil
+		}
+		have := map[string]bool{}
+		for _, ds := range curds {
+			have[DSKey(ds)] = true
+			if _, exist := want[DSKey(ds)]; !exist {
+				update.RemoveDS = append(update.RemoveDS, ds)
+			}
+		}
+		for key, ds := range want {
+			if !have[key] {
+				update.AddDS = append(update.AddDS, ds)
+			}
+		}
+
+	case dns.TypeCSYNC:
+		rrs, err := z.fetchFromSigner(dns.TypeNS)
+		if err != nil {
+			return err
+		}
+		want := map[string]bool{}
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok {
+				want[strings.ToLower(dns.Fqdn(ns.Ns))] = true
+			}
+		}
+		have := map[string]bool{}
+		for _, ns := range curns {
+			ns = strings.ToLower(dns.Fqdn(ns))
+			have[ns] = true
+			if !want[ns] {
+				update.RemoveNS = append(update.RemoveNS, ns)
+			}
+		}
+		for ns := range want {
+			if !have[ns] {
+				update.AddNS = append(update.AddNS, ns)
+			}
+		}
+		sort.Strings(update.AddNS)
+		sort.Strings(update.RemoveNS)
+
+	default:
+		return fmt.Errorf("can not push %s to the parent", dns.TypeToString[rrtype])
+	}
+
+	if update.Empty() {
+		log.Printf("Zone %s: parent is already up to date (%s)", z.Name, dns.TypeToString[rrtype])
+		return nil
+	}
+	if err := pu.Update(update); err != nil {
+		return err
+	}
+	log.Printf("Zone %s: parent updated: DS +%d -%d, NS +%v -%v", z.Name, len(update.AddDS),
+		len(update.RemoveDS), update.AddNS, update.RemoveNS)
+	z.MusicDB.FlushParent(z.Name)
+	z.MusicDB.PublishEvent(MusicEvent{
+		Type: EventParentUpdate,
+		Zone: z.Name,
+		Reason: fmt.Sprintf("DS: %d added, %d removed. NS: %d added, %d removed", len(update.AddDS),
+			len(update.RemoveDS), len(update.AddNS), len(update.RemoveNS)),
+	})
+	return nil
+}
+
+// firstSigner returns one of the signers of the zone. It is used once the
+// RRsets are known to be in sync across all signers.
+func (z *Zone) firstSigner() (*Signer, error) {
+	if z.SGroup == nil || len(z.SGroup.SignerMap) == 0 {
+		return nil, fmt.Errorf("Zone %s has no signers", z.Name)
+	}
+	var names []string
+	for name := range z.SGroup.SignerMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return z.SGroup.SignerMap[names[0]], nil
+}
+
+// fetchFromSigner fetches the RRset from one of the signers of the zone.
+func (z *Zone) fetchFromSigner(rrtype uint16) ([]dns.RR, error) {
+	signer, err := z.firstSigner()
+	if err != nil {
+		return nil, err
+	}
+	err, rrs := GetUpdater(signer.Method).FetchRRset(signer, z.Name, z.Name, rrtype)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s from signer %s: %v", dns.TypeToString[rrtype],
+			signer.Name, err)
+	}
+	return rrs, nil
+}
+
+// SignerParentUpdater updates a parent zone that is served by a MUSIC signer
+// (f.e. the primary of a parent zone that we operate) via its updater.
+type SignerParentUpdater struct {
+	MusicDB    *MusicDB
+	Signer     string
+	ParentZone string
+}
+
+// signer looks up the signer every time, so that changes to it via the API
+// are seen and a signer added after startup can be used.
+func (spu *SignerParentUpdater) signer() (*Signer, error) {
+	signer, err := spu.MusicDB.GetSignerByName(nil, spu.Signer, false) // not apisafe
+	if err != nil {
+		return nil, fmt.Errorf("parent signer %s: %v", spu.Signer, err)
+	}
+	return signer, nil
+}
+
+func (spu *SignerParentUpdater) Current(zone string) ([]*dns.DS, []string, error) {
+	signer, err := spu.signer()
+	if err != nil {
+		return nil, nil, err
+	}
+	updater := GetUpdater(signer.Method)
+	err, rrs := updater.FetchRRset(signer, spu.ParentZone, zone, dns.TypeDS)
+	if err != nil {
+		return nil, nil, err
+	}
+	var dses []*dns.DS
+	for _, rr := range rrs {
+		if ds, ok := rr.(*dns.DS); ok {
+			dses = append(dses, ds)
+		}
+	}
+	err, rrs = updater.FetchRRset(signer, spu.ParentZone, zone, dns.TypeNS)
+	if err != nil {
+		return nil, nil, err
+	}
+	var nses []string
+	for _, rr := range rrs {
+		if ns, ok := rr.(*dns.NS); ok {
+			nses = append(nses, ns.Ns)
+		}
+	}
+	return dses, nses, nil
+}
+
+func (spu *SignerParentUpdater) Update(pu ParentUpdate) error {
+	signer, err := spu.signer()
+	if err != nil {
+		return err
+	}
+	var adds, removes []dns.RR
+	for _, ds := range pu.AddDS {
+		ds.Hdr = dns.RR_Header{Name: pu.Zone, Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: 3600}
+		adds = append(adds, ds)
+	}
+	for _, ds := range pu.RemoveDS {
+		removes = append(removes, ds)
+	}
+	for _, ns := range pu.AddNS {
+		adds = append(adds, &dns.NS{Hdr: dns.RR_Header{Name: pu.Zone, Rrtype: dns.TypeNS,
+			Class: dns.ClassINET, Ttl: 3600}, Ns: ns})
+	}
+	for _, ns := range pu.RemoveNS {
+		removes = append(removes, &dns.NS{Hdr: dns.RR_Header{Name: pu.Zone, Rrtype: dns.TypeNS,
+			Class: dns.ClassINET}, Ns: ns})
+	}
+	return GetUpdater(signer.Method).Update(signer, spu.ParentZone, pu.Zone,
+		&[][]dns.RR{adds}, &[][]dns.RR{removes})
+}
@@ -0,0 +1,226 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// PostgresBackend stores the MusicDB in PostgreSQL. The SQL used throughout
+// MUSIC is SQLite flavoured, so connections are made via the "music-postgres"
+// driver, which is lib/pq with the SQL translated by PostgresDialect.
+type PostgresBackend struct{}
+
+func (b *PostgresBackend) Name() string {
+	return "postgres"
+}
+
+func (b *PostgresBackend) Open(dsn string) (*sql.DB, error) {
+	log.Printf("NewMusicDB: using postgres db")
+	db, err := sql.Open("music-postgres", dsn)
+	if err != nil {
+		log.Printf("NewMusicDB: Error from sql.Open: %v", err)
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		log.Printf("NewMusicDB: Error connecting to postgres: %v", err)
+		return nil, err
+	}
+	return db, nil
+}
+
+func (b *PostgresBackend) TableExists(db *sql.DB, table string) (bool, error) {
+	const sqlq = `
+SELECT COUNT(*) FROM information_schema.tables WHERE table_schema=current_schema() AND table_name=?`
+	var count int
+	err := db.QueryRow(sqlq, table).Scan(&count)
+	return count > 0, err
+}
+
+func (b *PostgresBackend) ColumnExists(tx *sql.Tx, table, column string) (bool, error) {
+	const sqlq = `
+SELECT COUNT(*) FROM information_schema.columns
+WHERE table_schema=current_schema() AND table_name=? AND column_name=?`
+	var count int
+	err := tx.QueryRow(sqlq, table, column).Scan(&count)
+	return count > 0, err
+}
+
+func (b *PostgresBackend) IsRetryable(err error) bool {
+	if pqerr, ok := err.(*pq.Error); ok {
+		switch pqerr.Code {
+		case "40001", "40P01", "55P03": // serialization_failure, deadlock_detected, lock_not_available
+			return true
+		}
+	}
+	return false
+}
+
+func (b *PostgresBackend) Snapshot(db *sql.DB, dest string) error {
+	return fmt.Errorf("snapshots are not supported for postgres, use pg_dump instead")
+}
+
+func init() {
+	sql.Register("music-postgres", pgDriver{})
+}
+
+type pgDriver struct{}
+
+func (d pgDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := pq.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &pgConn{conn}, nil
+}
+
+// pgConn only exposes Prepare, Begin, BeginTx and Close, so database/sql
+// sends all statements via Prepare, where they are translated.
+type pgConn struct {
+	driver.Conn
+}
+
+func (c *pgConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(PostgresDialect(query))
+}
+
+func (c *pgConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+var pgDialectCache sync.Map // sqlite query --> postgres query
+
+var (
+	pgQuotedTable  = regexp.MustCompile(`(?i)(TABLE(?:\s+IF\s+NOT\s+EXISTS)?)\s+'(\w+)'`)
+	pgIntegerPK    = regexp.MustCompile(`(?i)\bINTEGER\s+PRIMARY\s+KEY\b`)
+	pgDatetime     = regexp.MustCompile(`(?i)\bDATETIME\b`)
+	pgBoolean      = regexp.MustCompile(`(?i)\bBOOLEAN(\s+NOT\s+NULL)?\s+DEFAULT\s+([01])\s+CHECK\s*\(\s*\w+\s+IN\s*\(\s*0\s*,\s*1\s*\)\s*\)`)
+	pgNow          = regexp.MustCompile(`(?i)datetime\s*\(\s*'now'\s*\)`)
+	pgInsertIgnore = regexp.MustCompile(`(?is)^(\s*)INSERT\s+OR\s+IGNORE\s+INTO\s+(.*)$`)
+	pgInsertRepl   = regexp.MustCompile(`(?is)^(\s*)INSERT\s+OR\s+REPLACE\s+INTO\s+(\w+)\s*\(([^)]*)\)(.*)$`)
+	pgUnique       = regexp.MustCompile(`(?i)UNIQUE\s*\(([^)]*)\)`)
+	pgColumn       = regexp.MustCompile(`(?m)^\s*(\w+)\s+(?:TEXT|INTEGER|DATETIME|BOOLEAN)\b`)
+)
+
+// SQLite stores datetime('now') as text. We do the same in postgres, so that
+// timestamps look the same regardless of backend.
+const pgNowText = `to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')`
+
+// PostgresDialect translates the SQLite flavoured SQL used in MUSIC to SQL
+// that PostgreSQL understands:
+//   - "?" placeholders become $1, $2, ...
+//   - INSERT OR IGNORE becomes INSERT ... ON CONFLICT DO NOTHING
+//   - INSERT OR REPLACE becomes INSERT ... ON CONFLICT (<unique key>) DO UPDATE
+//   - datetime('now') becomes a text timestamp in the same format as SQLite's
+//   - in CREATE/ALTER TABLE: 'table' quoting, INTEGER PRIMARY KEY, DATETIME
+//     and 0/1 BOOLEANs are changed to their postgres equivalents
+func PostgresDialect(query string) string {
+	if cached, ok := pgDialectCache.Load(query); ok {
+		return cached.(string)
+	}
+
+	q := pgNow.ReplaceAllString(query, pgNowText)
+	q = pgQuotedTable.ReplaceAllString(q, "$1 $2")
+	q = pgIntegerPK.ReplaceAllString(q, "SERIAL PRIMARY KEY")
+	q = pgDatetime.ReplaceAllString(q, "TEXT")
+	q = pgBoolean.ReplaceAllStringFunc(q, func(m string) string {
+		sm := pgBoolean.FindStringSubmatch(m)
+		if sm[2] == "1" {
+			return "BOOLEAN" + sm[1] + " DEFAULT TRUE"
+		}
+		return "BOOLEAN" + sm[1] + " DEFAULT FALSE"
+	})
+
+	if sm := pgInsertIgnore.FindStringSubmatch(q); sm != nil {
+		q = fmt.Sprintf("%sINSERT INTO %s ON CONFLICT DO NOTHING", sm[1], strings.TrimRight(sm[2], " \t\n;"))
+	} else if sm := pgInsertRepl.FindStringSubmatch(q); sm != nil {
+		q = pgUpsert(sm[1], sm[2], sm[3], strings.TrimRight(sm[4], " \t\n;"))
+	}
+
+	q = pgPlaceholders(q)
+	pgDialectCache.Store(query, q)
+	return q
+}
+
+// pgUpsert emulates INSERT OR REPLACE. The conflict target is the UNIQUE
+// constraint of the table in DefaultTables. SQLite replaces the whole row, so
+// all other columns of the table are updated, the ones that are not in the
+// INSERT get their defaults (via EXCLUDED).
+func pgUpsert(indent, table, columns, rest string) string {
+	var key []string
+	if sm := pgUnique.FindStringSubmatch(DefaultTables[table]); sm != nil {
+		for _, k := range strings.Split(sm[1], ",") {
+			key = append(key, strings.TrimSpace(k))
+		}
+	}
+	if len(key) == 0 {
+		log.Printf("PostgresDialect: table %s has no unique key. INSERT OR REPLACE becomes INSERT", table)
+		return fmt.Sprintf("%sINSERT INTO %s (%s)%s", indent, table, columns, rest)
+	}
+
+	iskey := map[string]bool{}
+	for _, k := range key {
+		iskey[k] = true
+	}
+	var sets []string
+	for _, c := range pgTableColumns(table, columns) {
+		if !iskey[c] && c != "id" {
+			sets = append(sets, fmt.Sprintf("%s=EXCLUDED.%s", c, c))
+		}
+	}
+	action := "DO NOTHING"
+	if len(sets) > 0 {
+		action = "DO UPDATE SET " + strings.Join(sets, ", ")
+	}
+	return fmt.Sprintf("%sINSERT INTO %s (%s)%s ON CONFLICT (%s) %s",
+		indent, table, columns, rest, strings.Join(key, ", "), action)
+}
+
+// pgTableColumns returns the columns of the table in DefaultTables, followed
+// by any columns in the INSERT that are not there.
+func pgTableColumns(table, columns string) []string {
+	var cols []string
+	seen := map[string]bool{}
+	for _, sm := range pgColumn.FindAllStringSubmatch(DefaultTables[table], -1) {
+		cols = append(cols, sm[1])
+		seen[sm[1]] = true
+	}
+	for _, c := range strings.Split(columns, ",") {
+		if c = strings.TrimSpace(c); !seen[c] {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+// pgPlaceholders replaces "?" with $1, $2, ... except inside string literals.
+func pgPlaceholders(q string) string {
+	var b strings.Builder
+	var n int
+	var inquote bool
+	for _, c := range q {
+		switch {
+		case c == '\'':
+			inquote = !inquote
+			b.WriteRune(c)
+		case c == '?' && !inquote:
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
@@ -16,7 +16,7 @@ type RLDdnsUpdater struct {
 }
 
 func init() {
-	Updaters["rlddns"] = &RLDdnsUpdater{}
+	RegisterUpdater("rlddns", &RLDdnsUpdater{})
 }
 
 func (u *RLDdnsUpdater) SetChannels(fetch, update chan SignerOp) {
@@ -25,13 +25,13 @@ func (u *RLDdnsUpdater) SetChannels(fetch, update chan SignerOp) {
 }
 
 // DDNS has no API
-func (u *RLDdnsUpdater) SetApi(api Api) {
+func (u *RLDdnsUpdater) SetApi(api *Api) {
 	// no-op
 }
 
-func (u *RLDdnsUpdater) GetApi() Api {
+func (u *RLDdnsUpdater) GetApi() *Api {
 	// no-op
-	return Api{}
+	return nil
 }
 
 func (u *RLDdnsUpdater) Update(signer *Signer, zone, owner string,
@@ -93,7 +93,7 @@ func RLDdnsUpdate(udop SignerOp) (bool, int, error) {
 
 	c := signer.NewDnsClient()
 	m := new(dns.Msg)
-	m.SetUpdate(owner)
+	m.SetUpdate(udop.Zone) // the zone that owner is in, which is the parent zone for DS and delegation NS
 	if inserts != nil {
 		for _, insert := range *inserts {
 			m.Insert(insert)
@@ -105,7 +105,7 @@ func RLDdnsUpdate(udop SignerOp) (bool, int, error) {
 		}
 	}
 
-	signer.PrepareTSIGExchange(&c, m)
+	signer.PrepareTSIGExchange(c, m)
 
 	in, _, err := c.Exchange(m, signer.Address+":"+signer.Port) // TODO: add DnsAddress or solve this in a better way
 	if err != nil {
@@ -169,7 +169,7 @@ func RLDdnsRemoveRRset(udop SignerOp) (bool, int, error) {
 		m.RemoveRRset(rrset)
 	}
 
-	signer.PrepareTSIGExchange(&c, m)	
+	signer.PrepareTSIGExchange(c, m)	
 
 	in, _, err := c.Exchange(m, signer.Address+":"+signer.Port) // TODO: add DnsAddress or solve this in a better way
 	if err != nil {
@@ -231,7 +231,7 @@ func RLDdnsFetchRRset(fdop SignerOp) (bool, int, error) {
 	m.SetQuestion(owner, rrtype)
 	// m.SetEdns0(4096, true)
 
-	signer.PrepareTSIGExchange(&c, m)
+	signer.PrepareTSIGExchange(c, m)
 
 	r, _, err := c.Exchange(m, signer.Address+":"+signer.Port) // TODO: add DnsAddress or solve this in a better way
 	if err != nil {
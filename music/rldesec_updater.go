@@ -19,13 +19,13 @@ import (
 type RLDesecUpdater struct {
 	FetchCh  chan SignerOp
 	UpdateCh chan SignerOp
-	Api      Api
+	Api      *Api
 }
 
 func init() {
-	Updaters["rldesec-api"] = &RLDesecUpdater{
-		Api: Api{},
-	}
+	RegisterUpdater("rldesec-api", &RLDesecUpdater{
+		Api: &Api{},
+	})
 }
 
 func (u *RLDesecUpdater) SetChannels(fetch, update chan SignerOp) {
@@ -33,11 +33,11 @@ func (u *RLDesecUpdater) SetChannels(fetch, update chan SignerOp) {
 	u.UpdateCh = update
 }
 
-func (u *RLDesecUpdater) SetApi(api Api) {
+func (u *RLDesecUpdater) SetApi(api *Api) {
 	u.Api = api
 }
 
-func (u *RLDesecUpdater) GetApi() Api {
+func (u *RLDesecUpdater) GetApi() *Api {
 	return u.Api
 }
 
@@ -81,7 +81,7 @@ func RLDesecFetchRRset(fdop SignerOp) (bool, int, error) {
 	api := GetUpdater("rldesec-api").GetApi()
 	api.DesecTokenRefresh()
 
-	fmt.Printf("FetchRRset: deSEC API endpoint: %s. token: %s\n", endpoint, api.apiKey)
+	fmt.Printf("FetchRRset: deSEC API endpoint: %s. token: %s\n", endpoint, api.key())
 	status, buf, err := api.Get(endpoint)
 
 	if err != nil {
@@ -0,0 +1,349 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package music
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// Signer secrets (TSIG keys, API tokens) are stored encrypted with envelope
+// encryption: every secret is encrypted (AES-256-GCM) with its own random
+// data key, and the data key is in turn encrypted with the master key. A
+// stored secret looks like
+//
+//	enc:v2:<key id>:<encrypted data key>:<encrypted secret>
+//
+// where the key id is derived from the master key, so that a secret that was
+// encrypted with another master key is reported as such. The key id and the
+// owner of the secret (the signer name) are authenticated, so a secret can
+// not be moved to another signer in the DB. Secrets without the "enc:"
+// prefix are from before encryption was enabled and are used as is.
+
+const (
+	secretPrefix  = "enc:v2:"
+	MasterKeySize = 32 // AES-256
+
+	// MasterKeyEnv is the environment variable that may hold the master key
+	// (base64), as an alternative to a key file.
+	MasterKeyEnv = "MUSIC_MASTER_KEY"
+)
+
+type SecretBox struct {
+	keys    map[string][]byte // key id --> master key
+	current string            // key id of the key used for new secrets
+}
+
+// NewSecretBox returns a SecretBox that encrypts with master and decrypts
+// secrets encrypted with master or any of the old keys.
+func NewSecretBox(master []byte, old ...[]byte) (*SecretBox, error) {
+	sb := &SecretBox{keys: map[string][]byte{}}
+	for _, key := range append([][]byte{master}, old...) {
+		if len(key) != MasterKeySize {
+			return nil, fmt.Errorf("master key must be %d bytes, not %d", MasterKeySize, len(key))
+		}
+		sb.keys[masterKeyID(key)] = key
+	}
+	sb.current = masterKeyID(master)
+	return sb, nil
+}
+
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("music-master-key:"), key...))
+	return hex.EncodeToString(sum[:4])
+}
+
+// ParseMasterKey decodes a base64 encoded master key (f.e. the output of
+// "openssl rand -base64 32").
+func ParseMasterKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %v", err)
+	}
+	if len(key) != MasterKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, not %d", MasterKeySize, len(key))
+	}
+	return key, nil
+}
+
+// LoadMasterKey reads the master key from file or, if file is empty, from
+// the environment variable MUSIC_MASTER_KEY. It returns nil (and no error)
+// if neither is set, i.e. secrets are not encrypted.
+func LoadMasterKey(file string) ([]byte, error) {
+	if file != "" {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode().Perm()&0077 != 0 {
+			log.Printf("LoadMasterKey: Warning: master key file %s is accessible by others (mode %v)",
+				file, fi.Mode().Perm())
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return ParseMasterKey(string(data))
+	}
+	if env := os.Getenv(MasterKeyEnv); env != "" {
+		return ParseMasterKey(env)
+	}
+	return nil, nil
+}
+
+// KeyID returns the id of the key used to encrypt new secrets ("" if
+// encryption is not enabled).
+func (sb *SecretBox) KeyID() string {
+	if sb == nil {
+		return ""
+	}
+	return sb.current
+}
+
+func IsSealed(secret string) bool {
+	return strings.HasPrefix(secret, secretPrefix)
+}
+
+func secretAAD(keyid, owner string) []byte {
+	return []byte(keyid + ":" + owner)
+}
+
+func gcmSeal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func gcmOpen(key, ciphertext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ct := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ct, aad)
+}
+
+// Seal encrypts the secret of owner (f.e. the signer name). Empty secrets are
+// not encrypted, and with a nil SecretBox (no master key configured) the
+// secret is returned as is.
+func (sb *SecretBox) Seal(secret, owner string) (string, error) {
+	if sb == nil || secret == "" {
+		return secret, nil
+	}
+
+	datakey := make([]byte, MasterKeySize)
+	if _, err := io.ReadFull(rand.Reader, datakey); err != nil {
+		return "", err
+	}
+	aad := secretAAD(sb.current, owner)
+	wrapped, err := gcmSeal(sb.keys[sb.current], datakey, aad)
+	if err != nil {
+		return "", err
+	}
+	ct, err := gcmSeal(datakey, []byte(secret), aad)
+	if err != nil {
+		return "", err
+	}
+	return secretPrefix + sb.current + ":" + base64.StdEncoding.EncodeToString(wrapped) +
+		":" + base64.StdEncoding.EncodeToString(ct), nil
+}
+
+// Open decrypts a secret of owner encrypted by Seal. Secrets that are not
+// encrypted are returned as is.
+func (sb *SecretBox) Open(stored, owner string) (string, error) {
+	if !IsSealed(stored) {
+		return stored, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(stored, secretPrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed encrypted secret")
+	}
+	if sb == nil {
+		return "", fmt.Errorf("secret is encrypted (key id %s), but no master key is configured", parts[0])
+	}
+	key, exist := sb.keys[parts[0]]
+	if !exist {
+		return "", fmt.Errorf("secret is encrypted with unknown master key (key id %s)", parts[0])
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	ct, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	aad := secretAAD(parts[0], owner)
+	datakey, err := gcmOpen(key, wrapped, aad)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting data key: %v", err)
+	}
+	secret, err := gcmOpen(datakey, ct, aad)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting secret: %v", err)
+	}
+	return string(secret), nil
+}
+
+// ParseAuthStr splits the auth string stored in the DB ("alg:name:secret"
+// for TSIG) into its parts.
+func ParseAuthStr(authstr string) AuthData {
+	p := strings.Split(authstr, ":")
+	if len(p) == 3 {
+		return AuthData{
+			TSIGAlg:  p[0],
+			TSIGName: p[1],
+			TSIGKey:  p[2],
+		}
+	}
+	return AuthData{}
+}
+
+// RedactAuth removes the secrets from auth, for API responses. The key
+// algorithm and name are kept, as they are useful when debugging.
+func RedactAuth(auth AuthData) (string, AuthData) {
+	auth.TSIGKey = ""
+	auth.ApiToken = ""
+	return "", auth
+}
+
+// SetSecretBox enables encryption of signer secrets in the DB (nil disables
+// it). It must be called before the DB is used.
+func (mdb *MusicDB) SetSecretBox(sb *SecretBox) {
+	mdb.secrets = sb
+}
+
+func (mdb *MusicDB) sealSecret(signer, secret string) (string, error) {
+	return mdb.secrets.Seal(secret, signer)
+}
+
+// openSecret decrypts the secret of the signer. An error must never be
+// treated as an empty secret: that would wipe the credential when the
+// signer is written back.
+func (mdb *MusicDB) openSecret(signer, stored string) (string, error) {
+	secret, err := mdb.secrets.Open(stored, signer)
+	if err != nil {
+		log.Printf("Signer %s: Error decrypting signer secret: %v", signer, err)
+		return "", fmt.Errorf("signer %s: unable to decrypt the signer secret: %v", signer, err)
+	}
+	return secret, nil
+}
+
+// PlaintextSecrets returns the names of the signers with secrets that are
+// not encrypted.
+func (mdb *MusicDB) PlaintextSecrets() ([]string, error) {
+	rows, err := mdb.Query("SELECT name, auth FROM signers ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name, auth string
+		if err = rows.Scan(&name, &auth); err != nil {
+			return nil, err
+		}
+		if auth != "" && !IsSealed(auth) {
+			names = append(names, name)
+		}
+	}
+	return names, rows.Err()
+}
+
+// RotateSecrets re-encrypts all signer secrets with newbox, in one
+// transaction. The current SecretBox must be able to decrypt all secrets
+// (plaintext secrets are simply encrypted). Afterwards newbox is used for
+// all secrets. It returns the number of secrets that were re-encrypted.
+// Like SetSecretBox it must be called before the DB is used ("musicd
+// --rotate-secrets" exits when it is done).
+func (mdb *MusicDB) RotateSecrets(newbox *SecretBox) (int, error) {
+	tx, err := mdb.Begin()
+	if err != nil {
+		return 0, err
+	}
+	count, err := mdb.rotateSecrets(tx, newbox)
+	if err != nil {
+		if rberr := tx.Rollback(); rberr != nil {
+			log.Printf("RotateSecrets: Error from tx.Rollback(): %v", rberr)
+		}
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// only switch to the new key once the secrets encrypted with it are in the DB
+	mdb.secrets = newbox
+	return count, nil
+}
+
+func (mdb *MusicDB) rotateSecrets(tx *sql.Tx, newbox *SecretBox) (int, error) {
+	rows, err := tx.Query("SELECT name, auth FROM signers")
+	if err != nil {
+		return 0, err
+	}
+	auths := map[string]string{}
+	for rows.Next() {
+		var name, auth string
+		if err = rows.Scan(&name, &auth); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		auths[name] = auth
+	}
+	rows.Close()
+
+	count := 0
+	for name, auth := range auths {
+		if auth == "" {
+			continue
+		}
+		var secret string
+		secret, err = mdb.secrets.Open(auth, name)
+		if err != nil {
+			err = fmt.Errorf("signer %s: %v", name, err)
+			return 0, err
+		}
+		auth, err = newbox.Seal(secret, name)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec("UPDATE signers SET auth=? WHERE name=?", auth, name)
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
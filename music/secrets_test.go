@@ -0,0 +1,192 @@
+package music
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testMasterKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, MasterKeySize)
+}
+
+func TestSecretBoxSealOpen(t *testing.T) {
+	sb, err := NewSecretBox(testMasterKey(1))
+	if err != nil {
+		t.Fatalf("NewSecretBox: %v", err)
+	}
+	sealed, err := sb.Seal("c2VjcmV0", "signer1")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if !IsSealed(sealed) {
+		t.Fatalf("Seal: got %s, not encrypted", sealed)
+	}
+	if secret, err := sb.Open(sealed, "signer1"); err != nil || secret != "c2VjcmV0" {
+		t.Errorf("Open: got %s, %v wanted c2VjcmV0", secret, err)
+	}
+
+	// plaintext (from before encryption was enabled) passes through
+	if secret, err := sb.Open("plain", "signer1"); err != nil || secret != "plain" {
+		t.Errorf("Open(plain): got %s, %v", secret, err)
+	}
+
+	other, _ := NewSecretBox(testMasterKey(2))
+	if _, err := other.Open(sealed, "signer1"); err == nil {
+		t.Errorf("Open with wrong master key: no error")
+	}
+	var nobox *SecretBox
+	if _, err := nobox.Open(sealed, "signer1"); err == nil {
+		t.Errorf("Open without master key: no error")
+	}
+
+	// a box with the old key in its key ring can still decrypt
+	rotated, _ := NewSecretBox(testMasterKey(2), testMasterKey(1))
+	if secret, err := rotated.Open(sealed, "signer1"); err != nil || secret != "c2VjcmV0" {
+		t.Errorf("Open with old key: got %s, %v", secret, err)
+	}
+
+	// the secret of one signer can not be used for another
+	if _, err := sb.Open(sealed, "signer2"); err == nil {
+		t.Errorf("Open for another owner: no error")
+	}
+
+	if _, err := NewSecretBox([]byte("short")); err == nil {
+		t.Errorf("NewSecretBox(short key): no error")
+	}
+}
+
+func TestRotateSecrets(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb) // signer1 with a plaintext TSIG key
+
+		if plain, err := mdb.PlaintextSecrets(); err != nil || len(plain) != 1 {
+			t.Fatalf("PlaintextSecrets: got %v, %v wanted [signer1]", plain, err)
+		}
+
+		box1, _ := NewSecretBox(testMasterKey(1))
+		if n, err := mdb.RotateSecrets(box1); err != nil || n != 1 {
+			t.Fatalf("RotateSecrets: got %d, %v wanted 1", n, err)
+		}
+
+		var stored string
+		if err := mdb.db.QueryRow("SELECT auth FROM signers WHERE name=?", "signer1").Scan(&stored); err != nil {
+			t.Fatalf("QueryRow: %v", err)
+		}
+		if !IsSealed(stored) {
+			t.Fatalf("stored auth: got %s, not encrypted", stored)
+		}
+
+		box2, _ := NewSecretBox(testMasterKey(2))
+		if _, err := mdb.RotateSecrets(box2); err != nil {
+			t.Fatalf("RotateSecrets(box2): %v", err)
+		}
+
+		s, err := mdb.GetSignerByName(nil, "signer1", false)
+		if err != nil {
+			t.Fatalf("GetSignerByName: %v", err)
+		}
+		if s.Auth.TSIGKey != "c2VjcmV0" {
+			t.Errorf("TSIGKey after rotation: got %s wanted c2VjcmV0", s.Auth.TSIGKey)
+		}
+
+		s, err = mdb.GetSignerByName(nil, "signer1", true)
+		if err != nil {
+			t.Fatalf("GetSignerByName(apisafe): %v", err)
+		}
+		if s.Auth.TSIGKey != "" || s.AuthStr != "" {
+			t.Errorf("apisafe signer contains secret: %+v", s)
+		}
+		if s.Auth.TSIGName != "musiclab." {
+			t.Errorf("apisafe TSIGName: got %s wanted musiclab.", s.Auth.TSIGName)
+		}
+
+		ss, err := mdb.ListSigners(nil, true)
+		if err != nil {
+			t.Fatalf("ListSigners: %v", err)
+		}
+		if ss["signer1"].Auth.TSIGKey != "" {
+			t.Errorf("ListSigners(apisafe) contains secret")
+		}
+	})
+}
+
+func TestRotateSecretsFailed(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+
+		box1, _ := NewSecretBox(testMasterKey(1))
+		if _, err := mdb.RotateSecrets(box1); err != nil {
+			t.Fatalf("RotateSecrets: %v", err)
+		}
+
+		// a failed rotation leaves the current key in use
+		box2, _ := NewSecretBox(testMasterKey(2))
+		mdb.SetSecretBox(box2) // can not open the secrets sealed by box1
+		if _, err := mdb.RotateSecrets(box1); err == nil {
+			t.Fatalf("RotateSecrets with the wrong current key: no error")
+		}
+		if mdb.secrets != box2 {
+			t.Errorf("failed RotateSecrets replaced the SecretBox")
+		}
+	})
+}
+
+func TestUpdateSignerUndecryptableSecret(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+
+		box1, _ := NewSecretBox(testMasterKey(1))
+		if _, err := mdb.RotateSecrets(box1); err != nil {
+			t.Fatalf("RotateSecrets: %v", err)
+		}
+		var stored string
+		const authsql = "SELECT auth FROM signers WHERE name=?"
+		if err := mdb.db.QueryRow(authsql, "signer1").Scan(&stored); err != nil {
+			t.Fatalf("QueryRow: %v", err)
+		}
+
+		// wrong master key: the signer can not be used, nor updated
+		box2, _ := NewSecretBox(testMasterKey(2))
+		mdb.SetSecretBox(box2)
+		dbsigner, err := mdb.GetSignerByName(nil, "signer1", false)
+		if err == nil {
+			t.Errorf("GetSignerByName with the wrong master key: no error")
+		}
+		if _, err := mdb.UpdateSigner(nil, dbsigner, Signer{Address: "127.0.0.2"}); err == nil {
+			t.Errorf("UpdateSigner with an undecryptable secret: no error")
+		}
+		var after string
+		if err := mdb.db.QueryRow(authsql, "signer1").Scan(&after); err != nil {
+			t.Fatalf("QueryRow: %v", err)
+		}
+		if after != stored {
+			t.Errorf("UpdateSigner changed the stored secret: got %s wanted %s", after, stored)
+		}
+
+		// new auth data replaces the broken secret
+		newauth := Signer{Method: "ddns", Address: "127.0.0.2",
+			Auth: AuthData{TSIGAlg: "hmac-sha256.", TSIGName: "musiclab.", TSIGKey: "bmV3"}}
+		if _, err := mdb.UpdateSigner(nil, dbsigner, newauth); err != nil {
+			t.Fatalf("UpdateSigner with new auth data: %v", err)
+		}
+		s, err := mdb.GetSignerByName(nil, "signer1", false)
+		if err != nil || s.Auth.TSIGKey != "bmV3" {
+			t.Errorf("after update: got TSIGKey '%s' (err %v) wanted bmV3", s.Auth.TSIGKey, err)
+		}
+
+		// a secret copied to another signer can not be opened
+		s2 := &Signer{Name: "signer2", Method: "ddns", Address: "127.0.0.3", Port: "53"}
+		if _, err := mdb.AddSigner(nil, s2, ""); err != nil {
+			t.Fatalf("AddSigner: %v", err)
+		}
+		if err := mdb.db.QueryRow(authsql, "signer1").Scan(&stored); err != nil {
+			t.Fatalf("QueryRow: %v", err)
+		}
+		if _, err := mdb.Exec("UPDATE signers SET auth=? WHERE name=?", stored, "signer2"); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		if _, err := mdb.GetSignerByName(nil, "signer2", false); err == nil {
+			t.Errorf("GetSignerByName with the secret of another signer: no error")
+		}
+	})
+}
@@ -391,6 +391,8 @@ func (mdb *MusicDB) CheckIfProcessComplete(tx *sql.Tx, sg *SignerGroup) (bool, s
 			sqlq = "UPDATE signergroups SET locked=0, curprocess='', pendadd='' WHERE name=?"
 		} else if cp == SignerLeaveGroupProcess {
 			sqlq = "UPDATE signergroups SET locked=0, curprocess='', pendremove='' WHERE name=?"
+		} else if cp == SignerSwapGroupProcess {
+			sqlq = "UPDATE signergroups SET locked=0, curprocess='', pendadd='', pendremove='' WHERE name=?"
 		} else if cp == "" { // curprocess is "" for zones in verify-zone-sync
 			sqlq = "UPDATE signergroups SET locked=0, curprocess='', pendremove='' WHERE name=?"
 		} else {
@@ -403,7 +405,7 @@ func (mdb *MusicDB) CheckIfProcessComplete(tx *sql.Tx, sg *SignerGroup) (bool, s
 			return false, fmt.Sprintf("Error from tx.Exec(%s): %v", sqlq, err), err
 		}
 
-		if cp == SignerLeaveGroupProcess {
+		if cp == SignerLeaveGroupProcess || cp == SignerSwapGroupProcess {
 			sqlq = "DELETE FROM group_signers WHERE name=? AND signer=?"
 			_, err = tx.Exec(sqlq, sg.Name, pr)
 			if err != nil {
@@ -413,6 +415,18 @@ func (mdb *MusicDB) CheckIfProcessComplete(tx *sql.Tx, sg *SignerGroup) (bool, s
 			}
 		}
 
+		signer := sg.PendingAddition
+		if cp == SignerLeaveGroupProcess {
+			signer = pr
+		}
+		mdb.PublishEventTx(tx, MusicEvent{
+			Type:        EventProcessComplete,
+			SignerGroup: sg.Name,
+			Signer:      signer,
+			Process:     cp,
+			Reason:      msg,
+		})
+
 		return true, msg, nil
 	}
 	return false, "", nil	// not an error
@@ -8,7 +8,6 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/spf13/viper"
@@ -49,14 +48,20 @@ func (mdb *MusicDB) AddSigner(tx *sql.Tx, dbsigner *Signer, group string) (strin
 		}
 	}
 
+	authstr, err := mdb.sealSecret(dbsigner.Name, dbsigner.AuthStr)
+	if err != nil {
+		log.Printf("AddSigner: Error encrypting signer secret: %v", err)
+		return msg, err
+	}
+
 	const sqlq = `
 	INSERT INTO signers(name, method, auth, addr, port, usetcp, usetsig) VALUES (?, ?, ?, ?, ?, ?, ?)`
 
 	_, err = tx.Exec(sqlq, dbsigner.Name, dbsigner.Method,
-		dbsigner.AuthStr, dbsigner.Address, dbsigner.Port, dbsigner.UseTcp, dbsigner.UseTSIG)
+		authstr, dbsigner.Address, dbsigner.Port, dbsigner.UseTcp, dbsigner.UseTSIG)
 	if err != nil {
-		log.Printf("AddSigner: failure: %s, %s, %s, %s, %s, %t, %t\n",
-			dbsigner.Name, dbsigner.Method, dbsigner.AuthStr,
+		log.Printf("AddSigner: failure: %s, %s, %s, %s, %t, %t\n",
+			dbsigner.Name, dbsigner.Method,
 			dbsigner.Address, dbsigner.Port, dbsigner.UseTcp, dbsigner.UseTSIG)
 		return msg, err
 	}
@@ -78,8 +83,8 @@ func (mdb *MusicDB) AddSigner(tx *sql.Tx, dbsigner *Signer, group string) (strin
 			dbsigner.Name, group), nil
 	}
 
-	log.Printf("AddSigner: success: %s, %s, %s, %s, %s\n", dbsigner.Name,
-		dbsigner.Method, dbsigner.AuthStr, dbsigner.Address, dbsigner.Port)
+	log.Printf("AddSigner: success: %s, %s, %s, %s\n", dbsigner.Name,
+		dbsigner.Method, dbsigner.Address, dbsigner.Port)
 	return fmt.Sprintf("New signer %s successfully added.", dbsigner.Name), nil
 }
 
@@ -104,12 +109,35 @@ func (mdb *MusicDB) UpdateSigner(tx *sql.Tx, dbsigner *Signer, us Signer) (strin
 			dbsigner.Method, updatermap)
 	}
 
+	newauth := false
 	if us.Method != "" {
 		dbsigner.Method = us.Method
 
 		if us.Auth.TSIGKey != "" { // only possible to update auth data together with method
 			dbsigner.Auth = us.Auth
 			dbsigner.AuthStr = fmt.Sprintf("%s:%s:%s", us.Auth.TSIGAlg, us.Auth.TSIGName, us.Auth.TSIGKey)
+			newauth = true
+		}
+	}
+
+	// Without new auth data the stored secret is kept as it is. If it can
+	// not be decrypted (f.e. wrong master key) the signer is broken, and
+	// writing it back would replace the secret with nothing.
+	var authstr string
+	if newauth {
+		authstr, err = mdb.sealSecret(dbsigner.Name, dbsigner.AuthStr)
+		if err != nil {
+			log.Printf("UpdateSigner: Error encrypting signer secret: %v", err)
+			return fmt.Sprintf("UpdateSigner: Error encrypting signer secret: %v", err), err
+		}
+	} else {
+		const authsql = "SELECT auth FROM signers WHERE name=?"
+		if err = tx.QueryRow(authsql, dbsigner.Name).Scan(&authstr); err != nil {
+			log.Printf("UpdateSigner: Error from tx.QueryRow(%s): %v\n", authsql, err)
+			return fmt.Sprintf("UpdateSigner: Error reading signer %s: %v", dbsigner.Name, err), err
+		}
+		if _, err = mdb.openSecret(dbsigner.Name, authstr); err != nil {
+			return fmt.Sprintf("Signer %s not updated: %v. Update the auth data too.", dbsigner.Name, err), err
 		}
 	}
 
@@ -127,16 +155,15 @@ func (mdb *MusicDB) UpdateSigner(tx *sql.Tx, dbsigner *Signer, us Signer) (strin
 
 	const sqlq = "UPDATE signers SET method=?, auth=?, addr=?, port=?, usetcp=?, usetsig=? WHERE name =?"
 
-	_, err = tx.Exec(sqlq, dbsigner.Method, dbsigner.AuthStr, dbsigner.Address, dbsigner.Port,
+	_, err = tx.Exec(sqlq, dbsigner.Method, authstr, dbsigner.Address, dbsigner.Port,
 		dbsigner.UseTcp, dbsigner.UseTSIG, dbsigner.Name)
 	if err != nil {
 		log.Printf("UpdateSigner: Error from tx.Exec(%s): %v\n", sqlq, err)
 		return fmt.Sprintf("UpdateSigner: Error from tx.Exec: %v", err), err
 	}
 
-	log.Printf("UpdateSigner: success: %s, %s, %s, %s, %s\n", dbsigner.Name,
-		dbsigner.Method, dbsigner.Auth,
-		dbsigner.Address, dbsigner.Port)
+	log.Printf("UpdateSigner: success: %s, %s, %s, %s\n", dbsigner.Name,
+		dbsigner.Method, dbsigner.Address, dbsigner.Port)
 	return fmt.Sprintf("Signer %s successfully updated.", dbsigner.Name), nil
 }
 
@@ -186,6 +213,15 @@ func (mdb *MusicDB) SignerJoinGroup(tx *sql.Tx, dbsigner *Signer, g string) (str
 			sg.Name, sg.PendingRemoval)
 	}
 
+	moving, err := mdb.movingZones(tx, sg.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(moving) > 0 {
+		return "", fmt.Errorf("Signer group %s has zones %v moving in or out and does not accept signer addition.",
+			sg.Name, moving)
+	}
+
 	// johani: Issue #116
 	// if sg.NumProcessZones != 0 {
 	//	return fmt.Errorf("Signer group %s has %d zones executing processes and does not accept signer addition.",
@@ -243,6 +279,13 @@ func (mdb *MusicDB) SignerJoinGroup(tx *sql.Tx, dbsigner *Signer, g string) (str
 			}
 			log.Printf("SJG: Message from ZAF: %s", msg)
 		}
+		mdb.PublishEventTx(tx, MusicEvent{
+			Type:        EventProcessStart,
+			SignerGroup: sg.Name,
+			Signer:      dbsigner.Name,
+			Process:     SignerJoinGroupProcess,
+			Reason:      fmt.Sprintf("%d zones entered the process", len(zones)),
+		})
 		return fmt.Sprintf(
 			"Signer %s has joined signer group %s and %d zones have entered the 'add-signer' process.",
 			dbsigner.Name, g, len(zones)), nil
@@ -300,6 +343,15 @@ func (mdb *MusicDB) SignerLeaveGroup(tx *sql.Tx, dbsigner *Signer, g string) (st
 			sg.Name, sg.PendingAddition)
 	}
 
+	moving, err := mdb.movingZones(tx, sg.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(moving) > 0 {
+		return "", fmt.Errorf("Signer group %s has zones %v moving in or out and does not accept signer removal.",
+			sg.Name, moving)
+	}
+
 	// johani: Issue #116
 	// if sg.NumProcessZones != 0 {
 	//	return fmt.Errorf("Signer group %s has %d zones executing processes and does not accept signer removal.",
@@ -350,6 +402,13 @@ func (mdb *MusicDB) SignerLeaveGroup(tx *sql.Tx, dbsigner *Signer, g string) (st
 				z.Name, dbsigner.Name), err
 		}
 	}
+	mdb.PublishEventTx(tx, MusicEvent{
+		Type:        EventProcessStart,
+		SignerGroup: sg.Name,
+		Signer:      dbsigner.Name,
+		Process:     SignerLeaveGroupProcess,
+		Reason:      fmt.Sprintf("%d zones entered the process", len(zones)),
+	})
 
 	// https://github.com/DNSSEC-Provisioning/music/issues/130, testing to remove the leaving signer from the signermap. /rog
 	log.Printf("remove %v from SignerMap %v: for %v", dbsigner.Name, sg.SignerMap, sg.Name)
@@ -364,6 +423,116 @@ func (mdb *MusicDB) SignerLeaveGroup(tx *sql.Tx, dbsigner *Signer, g string) (st
 		dbsigner.Name, g, len(zones), SignerLeaveGroupProcess), nil
 }
 
+// Semantics:
+// 1. Replace signer oldsigner in the signer group with newsigner in a single
+//    "swap-signer" process, instead of an "add-signer" followed by a
+//    "remove-signer", which would take two rounds of DS and NS updates in the
+//    parent.
+// 2. newsigner joins the group at once and oldsigner is put in
+//    sg.PendingRemoval until all zones are done with the process, after which
+//    it is removed from the group (in CheckIfProcessComplete).
+// 3. If there are no zones attached to the group the swap is immediate.
+
+func (mdb *MusicDB) SignerSwapGroup(tx *sql.Tx, oldsigner, newsigner *Signer, g string) (string, error) {
+	var sg *SignerGroup
+
+	localtx, tx, err := mdb.StartTransaction(tx)
+	if err != nil {
+		log.Printf("SignerSwapGroup: Error from mdb.StartTransaction(): %v\n", err)
+		return "Error starting transaction", err
+	}
+	defer func() {
+		mdb.CloseTransaction(localtx, tx, err)
+	}()
+
+	if !oldsigner.Exists {
+		return "", fmt.Errorf("Signer %s is unknown.", oldsigner.Name)
+	}
+	if !newsigner.Exists {
+		return "", fmt.Errorf("Signer %s is unknown.", newsigner.Name)
+	}
+
+	if sg, err = mdb.GetSignerGroup(tx, g, false); err != nil { // not apisafe
+		return "", err
+	}
+
+	if _, member := sg.SignerMap[oldsigner.Name]; !member {
+		return "", fmt.Errorf("Signer %s is not a member of group %s", oldsigner.Name, sg.Name)
+	}
+	if _, member := sg.SignerMap[newsigner.Name]; member {
+		return "", fmt.Errorf("Signer %s is already a member of group %s", newsigner.Name, sg.Name)
+	}
+
+	if sg.CurrentProcess != "" {
+		return "", fmt.Errorf("Signer group %s is currently in the '%s' process and does not accept signer replacement.",
+			sg.Name, sg.CurrentProcess)
+	}
+	if sg.PendingAddition != "" || sg.PendingRemoval != "" {
+		return "", fmt.Errorf("Signer group %s has signers in the PendingAddition (%s) or PendingRemoval (%s) slot, and only one process at a time is possible",
+			sg.Name, sg.PendingAddition, sg.PendingRemoval)
+	}
+
+	moving, err := mdb.movingZones(tx, sg.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(moving) > 0 {
+		return "", fmt.Errorf("Signer group %s has zones %v moving in or out and does not accept signer replacement.",
+			sg.Name, moving)
+	}
+
+	zones, err := mdb.GetSignerGroupZones(tx, sg)
+	if err != nil {
+		return "", err
+	}
+
+	const sqlq = "INSERT OR IGNORE INTO group_signers (name, signer) VALUES (?, ?)"
+	_, err = tx.Exec(sqlq, sg.Name, newsigner.Name)
+	if CheckSQLError("SignerSwapGroup", sqlq, err, false) {
+		return "", err
+	}
+
+	// If the signer group has no zones attached to it, then it is ok to swap
+	// the signers immediately
+	if len(zones) == 0 {
+		const sqlq2 = "DELETE FROM group_signers WHERE name=? AND signer=?"
+		_, err = tx.Exec(sqlq2, sg.Name, oldsigner.Name)
+		if CheckSQLError("SignerSwapGroup", sqlq2, err, false) {
+			return "", err
+		}
+		return fmt.Sprintf(
+			"Signer %s was replaced by %s in signer group %s immediately (because the signer group has no zones).",
+			oldsigner.Name, newsigner.Name, g), nil
+	}
+
+	const sqlq3 = "UPDATE signergroups SET curprocess=?, pendadd=?, pendremove=?, locked=1 WHERE name=?"
+	_, err = tx.Exec(sqlq3, SignerSwapGroupProcess, newsigner.Name, oldsigner.Name, sg.Name)
+	if CheckSQLError("SignerSwapGroup", sqlq3, err, false) {
+		return "", err
+	}
+
+	// The zones are attached with the leaving signer as FSMSigner, as that
+	// is what the "remove-signer" steps at the end of the process use.
+	for _, z := range zones {
+		_, err = mdb.ZoneAttachFsm(tx, z, SignerSwapGroupProcess, // we know that z exist
+			oldsigner.Name, true) // true=preempt
+		if err != nil {
+			return fmt.Sprintf("Failed to attach zone %s to the SWAP-SIGNER process.", z.Name), err
+		}
+	}
+	mdb.PublishEventTx(tx, MusicEvent{
+		Type:        EventProcessStart,
+		SignerGroup: sg.Name,
+		Signer:      newsigner.Name,
+		Process:     SignerSwapGroupProcess,
+		Reason:      fmt.Sprintf("%d zones entered the process to replace signer %s", len(zones), oldsigner.Name),
+	})
+
+	return fmt.Sprintf(
+		"Signer %s is replacing %s in signer group %s and therefore %d zones entered the '%s' process.",
+		newsigner.Name, oldsigner.Name, g, len(zones), SignerSwapGroupProcess), nil
+}
+
 // XXX: It should not be possible to delete a signer that is part of a signer group.
 //
 //	Full stop.
@@ -400,7 +569,9 @@ func (mdb *MusicDB) DeleteSigner(tx *sql.Tx, dbsigner *Signer) (string, error) {
 	return fmt.Sprintf("Signer %s deleted.", dbsigner.Name), nil
 }
 
-func (mdb *MusicDB) ListSigners(tx *sql.Tx) (map[string]Signer, error) {
+// ListSigners returns all signers. If apisafe is true the secrets are
+// removed, so that the result can be sent to API clients.
+func (mdb *MusicDB) ListSigners(tx *sql.Tx, apisafe bool) (map[string]Signer, error) {
 	var sl = make(map[string]Signer, 2)
 
 	localtx, tx, err := mdb.StartTransaction(tx)
@@ -424,15 +595,13 @@ func (mdb *MusicDB) ListSigners(tx *sql.Tx) (map[string]Signer, error) {
 				log.Fatal("ListSigners: Error from rows.Next():", err)
 			}
 
-			auth := AuthData{}
-			authparts := strings.Split(authstr, ":")
-			log.Printf("ListSigners: authparts: '%s'", authparts)
-			if len(authparts) == 3 {
-				auth = AuthData{
-					TSIGAlg:  authparts[0],
-					TSIGName: authparts[1],
-					TSIGKey:  authparts[2],
-				}
+			authstr, err = mdb.openSecret(name, authstr)
+			if err != nil && !apisafe {
+				return sl, err
+			}
+			auth := ParseAuthStr(authstr)
+			if apisafe {
+				authstr, auth = RedactAuth(auth)
 			}
 			s := Signer{
 				Name:    name,
@@ -514,7 +683,7 @@ func (mdb *MusicDB) SignerLogout(dbsigner *Signer, cliconf *CliConfig,
 }
 
 func (mdb *MusicDB) SaveSigners(tx *sql.Tx) error {
-	_, _ = mdb.ListSigners(tx)
+	_, _ = mdb.ListSigners(tx, false)
 
 	return nil
 }
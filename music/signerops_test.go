@@ -0,0 +1,72 @@
+package music
+
+import (
+	"testing"
+)
+
+func TestSignerSwapGroup(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+		mdb.SetFSMlist(map[string]FSM{
+			SignerSwapGroupProcess: {Name: SignerSwapGroupProcess, InitialState: "signers-unsynced"},
+		})
+
+		if _, err := mdb.AddSigner(nil, &Signer{Name: "signer2", Method: "ddns", Address: "127.0.0.1", Port: "53"}, ""); err != nil {
+			t.Fatalf("AddSigner: %v", err)
+		}
+		signer1, _ := mdb.GetSignerByName(nil, "signer1", false)
+		signer2, _ := mdb.GetSignerByName(nil, "signer2", false)
+
+		if _, err := mdb.SignerSwapGroup(nil, signer2, signer1, "group1"); err == nil {
+			t.Errorf("SignerSwapGroup with non-member as old signer: got no error")
+		}
+		if _, err := mdb.SignerSwapGroup(nil, signer1, signer2, "group1"); err != nil {
+			t.Fatalf("SignerSwapGroup: %v", err)
+		}
+
+		// Both signers are in the group while the zones are in the process.
+		sg, err := mdb.GetSignerGroup(nil, "group1", false)
+		if err != nil || sg.CurrentProcess != SignerSwapGroupProcess || !sg.Locked ||
+			sg.PendingAddition != "signer2" || sg.PendingRemoval != "signer1" || len(sg.SignerMap) != 2 {
+			t.Fatalf("group1: got %+v, %v", sg, err)
+		}
+		z, _, err := mdb.GetZone(nil, "test.se.")
+		if err != nil || z.FSM != SignerSwapGroupProcess || z.FSMSigner != "signer1" {
+			t.Fatalf("test.se.: got %+v, %v", z, err)
+		}
+		if _, err := mdb.SignerLeaveGroup(nil, signer2, "group1"); err == nil {
+			t.Errorf("SignerLeaveGroup during swap: got no error")
+		}
+
+		if _, _, err := mdb.zoneLeaveFsm(z, SignerSwapGroupProcess); err != nil {
+			t.Fatalf("zoneLeaveFsm: %v", err)
+		}
+		sg, err = mdb.GetSignerGroup(nil, "group1", false)
+		if _, member := sg.SignerMap["signer2"]; err != nil || sg.Locked || sg.CurrentProcess != "" ||
+			sg.PendingAddition != "" || sg.PendingRemoval != "" || len(sg.SignerMap) != 1 || !member {
+			t.Errorf("group1 after swap: got %+v, %v wanted only signer2", sg, err)
+		}
+	})
+}
+
+func TestSignerSwapGroupNoZones(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		exportTestDB(t, mdb)
+		if _, err := mdb.Exec("DELETE FROM zones"); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		if _, err := mdb.AddSigner(nil, &Signer{Name: "signer2", Method: "ddns", Address: "127.0.0.1", Port: "53"}, ""); err != nil {
+			t.Fatalf("AddSigner: %v", err)
+		}
+		signer1, _ := mdb.GetSignerByName(nil, "signer1", false)
+		signer2, _ := mdb.GetSignerByName(nil, "signer2", false)
+
+		if _, err := mdb.SignerSwapGroup(nil, signer1, signer2, "group1"); err != nil {
+			t.Fatalf("SignerSwapGroup: %v", err)
+		}
+		sg, err := mdb.GetSignerGroup(nil, "group1", false)
+		if _, member := sg.SignerMap["signer2"]; err != nil || sg.CurrentProcess != "" || len(sg.SignerMap) != 1 || !member {
+			t.Errorf("group1: got %+v, %v wanted only signer2", sg, err)
+		}
+	})
+}
@@ -5,6 +5,7 @@ package music
 
 import (
 	"database/sql"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -17,10 +18,11 @@ type CliConfig struct {
 }
 
 type DBUpdate struct {
-	Type  string
-	Zone  string
-	Key   string
-	Value string
+	Type   string
+	Zone   string
+	Key    string
+	Value  string
+	Queued time.Time // set by dbUpdater, for queue age reporting
 }
 
 type EngineCheck struct {
@@ -97,11 +99,23 @@ type AuthData struct {
 }
 
 type MusicDB struct {
-	db              *sql.DB
-	UpdateC         chan DBUpdate
-	FSMlist         map[string]FSM
-	Tokvip          *viper.Viper
-	StopReasonCache map[string]string // key: zonename value: stopreason
+	db      *sql.DB
+	backend DBBackend
+	UpdateC chan DBUpdate
+	Tokvip  *viper.Viper
+	EventC  chan MusicEvent
+
+	fsmlist     *fsmList
+	stopreasons *stopReasonCache
+	parents     *parentCache
+	txevents    *txEvents
+	secrets     *SecretBox
+
+	limits      EngineLimits
+	zonelocks   *zoneLocks
+	signerslots *signerSlots
+
+	applymu sync.Mutex // serializes ApplyState
 }
 
 type SignerOp struct {
@@ -113,6 +127,7 @@ type SignerOp struct {
 	Inserts  *[][]dns.RR
 	Removes  *[][]dns.RR
 	Response chan SignerOpResult
+	Queued   time.Time // set by the rate-limiting managers, for queue age reporting
 }
 
 type SignerOpResult struct {
@@ -1,7 +1,9 @@
 package music
 
 import (
+	"fmt"
 	"log"
+	"sync"
 
 	"github.com/miekg/dns"
 )
@@ -15,30 +17,81 @@ import (
 //
 type Updater interface {
 	SetChannels(fetch, update chan SignerOp)
-	SetApi(api Api)
-	GetApi() Api
+	SetApi(api *Api) // the API client is shared by all workers
+	GetApi() *Api
 
 	Update(signer *Signer, zone, fqdn string, inserts, removes *[][]dns.RR) error
 	RemoveRRset(signer *Signer, zone, fqdn string, rrsets [][]dns.RR) error
 	FetchRRset(signer *Signer, zone, fqdn string, rrtype uint16) (error, []dns.RR)
 }
 
-var Updaters map[string]Updater = make(map[string]Updater)
+// updaters is the registry of all updater types, filled in by the init()
+// functions of the updaters.
+var updaters = struct {
+	sync.RWMutex
+	m map[string]Updater
+}{m: map[string]Updater{}}
+
+func RegisterUpdater(type_ string, updater Updater) {
+	updaters.Lock()
+	defer updaters.Unlock()
+	updaters.m[type_] = updater
+}
 
 func GetUpdater(type_ string) Updater {
-	updater, ok := Updaters[type_]
+	updaters.RLock()
+	updater, ok := updaters.m[type_]
+	updaters.RUnlock()
 	if !ok {
 		log.Fatal("No updater type", type_)
 	}
-	return updater
+	return &eventUpdater{Updater: updater, class: type_}
+}
+
+// eventUpdater wraps the real updater and reports failed signer operations
+// (via Signer.OpFailed) so that nobody has to look in the log to find out
+// that a signer is unreachable.
+type eventUpdater struct {
+	Updater
+	class string
+}
+
+func (u *eventUpdater) Update(signer *Signer, zone, fqdn string,
+	inserts, removes *[][]dns.RR) error {
+	err := u.Updater.Update(signer, zone, fqdn, inserts, removes)
+	if err != nil {
+		signer.OpFailed(u.class, zone, "update "+fqdn, err)
+	}
+	return err
+}
+
+func (u *eventUpdater) RemoveRRset(signer *Signer, zone, fqdn string,
+	rrsets [][]dns.RR) error {
+	err := u.Updater.RemoveRRset(signer, zone, fqdn, rrsets)
+	if err != nil {
+		signer.OpFailed(u.class, zone, "remove rrset "+fqdn, err)
+	}
+	return err
+}
+
+func (u *eventUpdater) FetchRRset(signer *Signer, zone, fqdn string,
+	rrtype uint16) (error, []dns.RR) {
+	err, rrs := u.Updater.FetchRRset(signer, zone, fqdn, rrtype)
+	if err != nil {
+		signer.OpFailed(u.class, zone,
+			fmt.Sprintf("fetch %s %s", fqdn, dns.TypeToString[rrtype]), err)
+	}
+	return err, rrs
 }
 
 func ListUpdaters() map[string]bool {
-     res := map[string]bool{}
-     for u, _ := range Updaters {
-     	 res[u] = true
-     }
-     return res
+	updaters.RLock()
+	defer updaters.RUnlock()
+	res := map[string]bool{}
+	for u := range updaters.m {
+		res[u] = true
+	}
+	return res
 }
 
 
@@ -155,7 +155,7 @@ func (mdb *MusicDB) DeleteZone(z *Zone) (string, error) {
 func (z *Zone) SetStopReason(value string) (error, string) {
 	mdb := z.MusicDB
 
-	mdb.StopReasonCache[z.Name] = value
+	mdb.stopreasons.Set(z.Name, value)
 
 	mdb.UpdateC <- DBUpdate{
 		Type:  "STOPREASON",
@@ -164,10 +164,58 @@ func (z *Zone) SetStopReason(value string) (error, string) {
 		Value: value,
 	}
 
+	mdb.PublishEvent(MusicEvent{
+		Type:        EventStopReason,
+		Zone:        z.Name,
+		SignerGroup: z.SGname,
+		Process:     z.FSM,
+		From:        z.State,
+		Reason:      value,
+	})
+
 	log.Printf("%s: %s\n", z.Name, value)
 	return nil, fmt.Sprintf("Zone %s stop-reason documented as '%s'", z.Name, value)
 }
 
+// clearStopReason removes the stop-reason of the zone and unblocks it.
+func (mdb *MusicDB) clearStopReason(tx *sql.Tx, z *Zone, from, to string) error {
+	const sqlq = "INSERT OR REPLACE INTO metadata (zone, key, time, value) VALUES (?, 'stop-reason', datetime('now'), '')"
+	_, err := tx.Exec(sqlq, z.Name)
+	if CheckSQLError("clearStopReason", sqlq, err, false) {
+		return err
+	}
+	return mdb.unblockZone(tx, z, from, to)
+}
+
+// unblockZone clears the blocked status of the zone and, if it was blocked,
+// publishes a zone-unblocked event. It must be called wherever the stop-reason
+// goes away, not only on state transitions.
+func (mdb *MusicDB) unblockZone(tx *sql.Tx, z *Zone, from, to string) error {
+	const sqlq = "UPDATE zones SET fsmstatus='' WHERE name=? AND fsmstatus='blocked'"
+	res, err := tx.Exec(sqlq, z.Name)
+	if CheckSQLError("unblockZone", sqlq, err, false) {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	stopreason, wasblocked := mdb.stopreasons.Pop(z.Name)
+	if wasblocked || rows > 0 || z.FSMStatus == "blocked" {
+		mdb.PublishEventTx(tx, MusicEvent{
+			Type:        EventZoneUnblocked,
+			Zone:        z.Name,
+			SignerGroup: z.SGname,
+			Process:     z.FSM,
+			From:        from,
+			To:          to,
+			Reason:      stopreason,
+		})
+	}
+	return nil
+}
+
 // XXX: SetDelayReason is not yet in use, but is needed for the wait-for-parent-ds stuff
 func (z *Zone) SetDelayReason(tx *sql.Tx, value string, delay time.Duration) (string, error) {
 	mdb := z.MusicDB
@@ -184,12 +232,25 @@ func (z *Zone) SetDelayReason(tx *sql.Tx, value string, delay time.Duration) (st
 		return msg, err
 	}
 
+	// a delayed zone is no longer blocked
+	if err = mdb.clearStopReason(tx, z, z.State, z.State); err != nil {
+		return "fail", err
+	}
+
 	const sqlq = "UPDATE zones SET fsmstatus='delayed' WHERE name=?"
 
 	_, err = tx.Exec(sqlq, z.Name)
 	if err != nil {
 		log.Fatalf("DocumentStop: Error from tx.Exec(%s): %v", sqlq, err)
 	}
+	mdb.PublishEventTx(tx, MusicEvent{
+		Type:        EventDelay,
+		Zone:        z.Name,
+		SignerGroup: z.SGname,
+		Process:     z.FSM,
+		From:        z.State,
+		Reason:      fmt.Sprintf("%s (delay: %v)", value, delay),
+	})
 	log.Printf("%s\n", value)
 	return msg, err
 }
@@ -219,6 +280,12 @@ func (mdb *MusicDB) ZoneSetMeta(tx *sql.Tx, z *Zone, key, value string) (string,
 		return "", err
 	}
 
+	if key == "stop-reason" && value == "" {
+		if err = mdb.unblockZone(tx, z, z.State, ""); err != nil {
+			return "", err
+		}
+	}
+
 	return fmt.Sprintf("Zone %s metadata '%s' updated to be '%s'",
 		z.Name, key, value), nil
 }
@@ -264,7 +331,9 @@ func (z *Zone) StateTransition(tx *sql.Tx, from, to string) error {
 		log.Printf("StateTransition: Error from mdb.StartTransaction(): %v\n", err)
 		return err
 	}
-	defer mdb.CloseTransaction(localtx, tx, err)
+	defer func() {
+		mdb.CloseTransaction(localtx, tx, err)
+	}()
 
 	fmt.Printf("This is %s StateTransition(%s-->%s) in process %s\n", z.Name, from, to, fsm)
 	if fsm == "" {
@@ -282,18 +351,40 @@ func (z *Zone) StateTransition(tx *sql.Tx, from, to string) error {
 		fsm = "---"
 	}
 
-	_, err = tx.Exec("UPDATE zones SET state=?, fsm=?, fsmstatus=? WHERE name=?", to, fsm, "", z.Name)
+	// The zone is not locked while its transition is attempted, so only
+	// change the state if nobody else has changed it in the meantime.
+	const sqlq = "UPDATE zones SET state=?, fsm=?, fsmstatus=? WHERE name=? AND state=? AND fsm=?"
+	res, err := tx.Exec(sqlq, to, fsm, "", z.Name, from, z.FSM)
 	if err != nil {
 		log.Printf("StateTransition: Error from tx.Exec(): %v\n", err)
 		return err
 	}
-	_, err = mdb.ZoneSetMeta(tx, z, "stop-reason", "") // remove old stop-reason if there
+	rows, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("StateTransition: Error from RowsAffected(): %v\n", err)
+		return err
+	}
+	if rows == 0 {
+		err = fmt.Errorf("StateTransition: zone %s is no longer in state '%s' in process %s",
+			z.Name, from, z.FSM)
+		return err
+	}
+	err = mdb.clearStopReason(tx, z, from, to) // remove old stop-reason if there
 	if err != nil {
-		log.Printf("StateTransition: Error from ZoneSetMeta: %v\n", err)
+		log.Printf("StateTransition: Error from clearStopReason: %v\n", err)
 		return err
 	}
 	log.Printf("Zone %s transitioned from %s to %s in process %s", z.Name, from, to, fsm)
 
+	mdb.PublishEventTx(tx, MusicEvent{
+		Type:        EventStateTransition,
+		Zone:        z.Name,
+		SignerGroup: z.SGname,
+		Process:     z.FSM,
+		From:        from,
+		To:          to,
+	})
+
 	return nil
 }
 
@@ -319,14 +410,14 @@ func (mdb *MusicDB) GetZone(tx *sql.Tx, zonename string) (*Zone, bool, error) {
 
 	const qsql = `
 SELECT name, zonetype, state, fsmmode, COALESCE(statestamp, datetime('now')) AS timestamp,
-       fsm, fsmsigner, COALESCE(sgroup, '') AS signergroup
+       fsm, fsmsigner, fsmstatus, COALESCE(sgroup, '') AS signergroup
 FROM zones WHERE name=?`
 
 	row := tx.QueryRow(qsql, zonename)
 
-	var name, zonetype, state, fsmmode, timestamp, fsm, fsmsigner, signergroup string
+	var name, zonetype, state, fsmmode, timestamp, fsm, fsmsigner, fsmstatus, signergroup string
 	switch err = row.Scan(&name, &zonetype, &state, &fsmmode, &timestamp,
-		&fsm, &fsmsigner, &signergroup); err {
+		&fsm, &fsmsigner, &fsmstatus, &signergroup); err {
 	case sql.ErrNoRows:
 		// fmt.Printf("GetZone: Zone \"%s\" does not exist\n", zonename)
 		return &Zone{
@@ -345,8 +436,15 @@ FROM zones WHERE name=?`
 		if err != nil {
 			return nil, false, err
 		}
+		if fsm == ZoneMoveProcess {
+			sg, err = mdb.moveZoneSignerGroup(tx, name, sg)
+			if err != nil {
+				return nil, false, err
+			}
+		}
 
-		nexttransitions := mdb.FSMlist[fsm].States[state].Next
+		process, _ := mdb.GetFSM(fsm)
+		nexttransitions := process.States[state].Next
 		next := map[string]bool{}
 		for k, _ := range nexttransitions {
 			next[k] = true
@@ -362,6 +460,7 @@ FROM zones WHERE name=?`
 			NextState:  next,
 			FSM:        fsm,
 			FSMSigner:  fsmsigner, // is this still used for anything?
+			FSMStatus:  fsmstatus,
 			SGroup:     sg,
 			SGname:     sg.Name,
 			MusicDB:    mdb, // can not be json encoded, i.e. not used in API
@@ -615,7 +714,8 @@ FROM zones`
 				sg.Name = signergroup
 			}
 
-			nexttransitions := mdb.FSMlist[fsm].States[state].Next
+			process, _ := mdb.GetFSM(fsm)
+			nexttransitions := process.States[state].Next
 			next := map[string]bool{}
 			for k, _ := range nexttransitions {
 				next[k] = true
@@ -652,3 +752,33 @@ FROM zones`
 
 	return zl, nil
 }
+
+type ZoneStateCount struct {
+	Process   string
+	State     string
+	FSMStatus string // "" | "blocked" | "delayed"
+	Count     int
+}
+
+// CountZones returns the number of zones per process, state and fsmstatus.
+// It is cheap enough to be called on every metrics scrape.
+func (mdb *MusicDB) CountZones() ([]ZoneStateCount, error) {
+	const sqlq = "SELECT fsm, state, fsmstatus, COUNT(*) FROM zones GROUP BY fsm, state, fsmstatus"
+
+	rows, err := mdb.Query(sqlq)
+	if CheckSQLError("CountZones", sqlq, err, false) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []ZoneStateCount
+	for rows.Next() {
+		var zsc ZoneStateCount
+		err = rows.Scan(&zsc.Process, &zsc.State, &zsc.FSMStatus, &zsc.Count)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, zsc)
+	}
+	return res, rows.Err()
+}
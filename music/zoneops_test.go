@@ -0,0 +1,160 @@
+package music
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStateTransitionConcurrentChange(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		if _, err := mdb.Migrate(false); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		z := &Zone{Name: "test.se.", ZoneType: "normal", FSMMode: "auto"}
+		if _, err := mdb.AddZone(z, "", nil); err != nil {
+			t.Fatalf("AddZone: %v", err)
+		}
+		const sqlq = "UPDATE zones SET fsm=?, state=? WHERE name=?"
+		if _, err := mdb.Exec(sqlq, "test-process", "first", z.Name); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+
+		dbzone, _, err := mdb.GetZone(nil, z.Name)
+		if err != nil {
+			t.Fatalf("GetZone: %v", err)
+		}
+		// someone else moves the zone while we are working on it
+		if _, err := mdb.Exec(sqlq, "test-process", "second", z.Name); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		if err := dbzone.StateTransition(nil, "first", "third"); err == nil {
+			t.Errorf("StateTransition of a zone that changed state: got no error")
+		}
+		dbzone, _, _ = mdb.GetZone(nil, z.Name)
+		if dbzone.State != "second" {
+			t.Errorf("got state '%s' wanted 'second'", dbzone.State)
+		}
+
+		if err := dbzone.StateTransition(nil, "second", "third"); err != nil {
+			t.Errorf("StateTransition: %v", err)
+		}
+		dbzone, _, _ = mdb.GetZone(nil, z.Name)
+		if dbzone.State != "third" {
+			t.Errorf("got state '%s' wanted 'third'", dbzone.State)
+		}
+	})
+}
+
+func TestEventsPublishedAfterCommit(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		if _, err := mdb.Migrate(false); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		mdb.EventC = make(chan MusicEvent, 10)
+		z := &Zone{Name: "test.se.", ZoneType: "normal", FSMMode: "auto"}
+		if _, err := mdb.AddZone(z, "", nil); err != nil {
+			t.Fatalf("AddZone: %v", err)
+		}
+		dbzone, _, err := mdb.GetZone(nil, z.Name)
+		if err != nil {
+			t.Fatalf("GetZone: %v", err)
+		}
+
+		for _, commit := range []bool{false, true} {
+			_, tx, err := mdb.StartTransaction(nil)
+			if err != nil {
+				t.Fatalf("StartTransaction: %v", err)
+			}
+			if _, err := dbzone.SetDelayReason(tx, "waiting", 0); err != nil {
+				t.Fatalf("SetDelayReason: %v", err)
+			}
+			if n := len(mdb.EventC); n != 0 {
+				t.Errorf("commit=%v: %d events published before the transaction ended", commit, n)
+			}
+			if commit {
+				mdb.CloseTransaction(true, tx, nil)
+			} else {
+				mdb.Rollback(true, tx)
+			}
+
+			want := 0
+			if commit {
+				want = 1
+			}
+			if n := len(mdb.EventC); n != want {
+				t.Errorf("commit=%v: got %d events wanted %d", commit, n, want)
+			}
+			if want == 1 {
+				if ev := <-mdb.EventC; ev.Type != EventDelay || ev.Zone != z.Name {
+					t.Errorf("got event %+v", ev)
+				}
+			}
+		}
+	})
+}
+
+func TestClearStopReasonUnblocks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mdb *MusicDB) {
+		if _, err := mdb.Migrate(false); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		mdb.EventC = make(chan MusicEvent, 10)
+		z := &Zone{Name: "test.se.", ZoneType: "normal", FSMMode: "auto"}
+		if _, err := mdb.AddZone(z, "", nil); err != nil {
+			t.Fatalf("AddZone: %v", err)
+		}
+		const sqlq = "UPDATE zones SET fsm=?, state=?, fsmstatus='blocked' WHERE name=?"
+		if _, err := mdb.Exec(sqlq, "test-process", "first", z.Name); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		dbzone, _, err := mdb.GetZone(nil, z.Name)
+		if err != nil {
+			t.Fatalf("GetZone: %v", err)
+		}
+		if _, err := mdb.ZoneSetMeta(nil, dbzone, "stop-reason", "parent is unreachable"); err != nil {
+			t.Fatalf("ZoneSetMeta: %v", err)
+		}
+		if n := len(mdb.EventC); n != 0 {
+			t.Fatalf("setting a stop-reason published %d events", n)
+		}
+
+		// clearing the stop-reason without a state transition
+		if _, err := mdb.ZoneSetMeta(nil, dbzone, "stop-reason", ""); err != nil {
+			t.Fatalf("ZoneSetMeta: %v", err)
+		}
+		if n := len(mdb.EventC); n != 1 {
+			t.Fatalf("got %d events wanted 1", n)
+		}
+		if ev := <-mdb.EventC; ev.Type != EventZoneUnblocked || ev.Zone != z.Name || ev.From != "first" {
+			t.Errorf("got event %+v", ev)
+		}
+		dbzone, _, _ = mdb.GetZone(nil, z.Name)
+		if dbzone.FSMStatus != "" {
+			t.Errorf("got fsmstatus '%s' wanted ''", dbzone.FSMStatus)
+		}
+
+		// an unblocked zone is not unblocked again
+		if _, err := mdb.ZoneSetMeta(nil, dbzone, "stop-reason", ""); err != nil {
+			t.Fatalf("ZoneSetMeta: %v", err)
+		}
+		if n := len(mdb.EventC); n != 0 {
+			t.Errorf("got %d events for a zone that was not blocked", n)
+		}
+	})
+}
+
+func TestOpFailedCounted(t *testing.T) {
+	counts := map[string]int{}
+	SetOpFailureCounter(func(signer, updater string) { counts[signer+" "+updater]++ })
+	defer SetOpFailureCounter(nil)
+
+	// no event queue, or a full one, does not lose the count
+	mdb := &MusicDB{EventC: make(chan MusicEvent)}
+	s := &Signer{Name: "signer1", DB: mdb}
+	for i := 0; i < 3; i++ {
+		s.OpFailed("ddns", "test.se.", "update test.se.", fmt.Errorf("refused"))
+	}
+	if counts["signer1 ddns"] != 3 {
+		t.Errorf("got counts %v wanted 3 for signer1 ddns", counts)
+	}
+}
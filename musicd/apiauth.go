@@ -0,0 +1,184 @@
+/*
+ * apiauth.go
+ *
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+)
+
+// ApiIdentity is the authenticated client behind an API request. It is
+// stored in the request context by APIauth and can be retrieved with
+// GetApiIdentity().
+type ApiIdentity struct {
+	Subject string // cert subject CN, or "api-key" for key based auth
+	Role    string
+	Method  string // "mtls" | "api-key"
+}
+
+type apiIdentityKey struct{}
+
+func GetApiIdentity(r *http.Request) ApiIdentity {
+	if id, ok := r.Context().Value(apiIdentityKey{}).(ApiIdentity); ok {
+		return id
+	}
+	return ApiIdentity{}
+}
+
+// ClientAuthMode returns the configured mode for client certificates:
+// "none" (default), "optional" or "require".
+func ClientAuthMode() string {
+	mode := strings.ToLower(viper.GetString("apiserver.clientauth.mode"))
+	if mode == "" {
+		mode = "none"
+	}
+	return mode
+}
+
+// SetupServerTLSConfig returns the TLS config for the API server. If client
+// authentication is enabled the client CA file is loaded and client certs
+// will be verified against it.
+func SetupServerTLSConfig() (*tls.Config, error) {
+	tlsconf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	mode := ClientAuthMode()
+	switch mode {
+	case "none":
+		return tlsconf, nil
+	case "optional":
+		tlsconf.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsconf.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown apiserver.clientauth.mode: '%s'", mode)
+	}
+
+	cafile := viper.GetString("apiserver.clientauth.cafile")
+	if cafile == "" {
+		return nil, fmt.Errorf("client auth mode '%s' requires apiserver.clientauth.cafile", mode)
+	}
+	caPEM, err := ioutil.ReadFile(cafile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA file '%s': %v", cafile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no usable certificates in client CA file '%s'", cafile)
+	}
+	tlsconf.ClientCAs = pool
+	log.Printf("APIdispatcher: client certificates (mode %s) verified against CAs in %s\n",
+		mode, cafile)
+	return tlsconf, nil
+}
+
+// SubjectToRole maps the subject of a verified client certificate to a role.
+// The mapping is in apiserver.clientauth.subjects. Subjects not listed get the
+// apiserver.clientauth.defaultrole, if any.
+func SubjectToRole(subject string) string {
+	var subjects []SubjectConf
+	if err := viper.UnmarshalKey("apiserver.clientauth.subjects", &subjects); err != nil {
+		log.Printf("SubjectToRole: error parsing apiserver.clientauth.subjects: %v", err)
+		return ""
+	}
+	for _, s := range subjects {
+		if strings.EqualFold(s.CN, subject) {
+			return s.Role
+		}
+	}
+	return viper.GetString("apiserver.clientauth.defaultrole")
+}
+
+// RoleAllowed reports whether role may use the endpoint. The role "admin" may
+// use everything, other roles must list their endpoints in apiserver.roles.
+func RoleAllowed(role, endpoint string) bool {
+	if role == "admin" {
+		return true
+	}
+	roles := viper.GetStringMapStringSlice("apiserver.roles")
+	for _, ep := range roles[strings.ToLower(role)] {
+		if ep == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+func apiAuthFailure(w http.ResponseWriter, status int, msg string) {
+	resp := music.APIstatus{Status: status, Message: msg}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Printf("Error from Encoder: %v\n", err)
+	}
+}
+
+// APIauth is the middleware that authenticates all requests to /api/v1. A
+// verified client certificate takes precedence. Without one the request
+// must carry the correct X-API-Key header, unless client certs are required
+// in which case the API key is not accepted at all.
+func APIauth(conf *Config) func(http.Handler) http.Handler {
+	apikey := viper.GetString("apiserver.apikey")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var id ApiIdentity
+			endpoint := strings.TrimPrefix(r.URL.Path, "/api/v1")
+
+			if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 &&
+				len(r.TLS.VerifiedChains[0]) > 0 {
+				cert := r.TLS.VerifiedChains[0][0]
+				id.Subject = cert.Subject.CommonName
+				if id.Subject == "" {
+					id.Subject = cert.Subject.String()
+				}
+				id.Method = "mtls"
+				id.Role = SubjectToRole(id.Subject)
+				if id.Role == "" {
+					log.Printf("APIauth: %s %s from %s: client cert subject \"%s\" has no role. Denied.\n",
+						r.Method, r.URL.Path, r.RemoteAddr, id.Subject)
+					apiAuthFailure(w, http.StatusForbidden, "client certificate not authorized")
+					return
+				}
+			} else if ClientAuthMode() != "require" && apikey != "" &&
+				subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(apikey)) == 1 {
+				id = ApiIdentity{Subject: "api-key", Role: "admin", Method: "api-key"}
+			} else {
+				log.Printf("APIauth: %s %s from %s: no valid credentials. Denied.\n",
+					r.Method, r.URL.Path, r.RemoteAddr)
+				apiAuthFailure(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+
+			if !RoleAllowed(id.Role, endpoint) {
+				log.Printf("APIauth: %s %s from %s: \"%s\" (role %s) not allowed. Denied.\n",
+					r.Method, r.URL.Path, r.RemoteAddr, id.Subject, id.Role)
+				apiAuthFailure(w, http.StatusForbidden,
+					fmt.Sprintf("role %s may not use %s", id.Role, endpoint))
+				return
+			}
+
+			log.Printf("APIauth: %s %s from %s: \"%s\" (role %s, via %s)\n",
+				r.Method, r.URL.Path, r.RemoteAddr, id.Subject, id.Role, id.Method)
+			ctx := context.WithValue(r.Context(), apiIdentityKey{}, id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
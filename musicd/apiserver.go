@@ -11,6 +11,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -18,6 +20,7 @@ import (
 	"github.com/DNSSEC-Provisioning/music/music"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 )
 
@@ -277,6 +280,13 @@ func APIzone(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 					resp.ErrorMsg = err.Error()
 				}
 
+			case "move":
+				resp.Msg, err = mdb.ZoneMoveGroup(nil, dbzone, zp.SignerGroup, enginecheck)
+				if err != nil {
+					resp.Error = true
+					resp.ErrorMsg = err.Error()
+				}
+
 			// XXX: A single zone cannot "choose" to join an FSM, it's the Group that does that.
 			//      This endpoint is only here for development and debugging reasons.
 			case "fsm":
@@ -290,10 +300,10 @@ func APIzone(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 			case "step-fsm":
 				// var zones map[string]music.Zone
 				// var success bool
-				// err, resp.Msg, zones = mdb.ZoneStepFsm(nil, dbzone, zp.FsmNextState)
+				// err, resp.Msg, zones = mdb.ZoneStepFsm(dbzone, zp.FsmNextState)
 				// log.Printf("APISERVER: STEP-FSM: Calling ZoneStepFsm for zone %s and %v\n", dbzone.Name, zp.FsmNextState)
 				var success bool
-				success, resp.Msg, err = mdb.ZoneStepFsm(nil, dbzone, zp.FsmNextState)
+				success, resp.Msg, err = mdb.ZoneStepFsm(dbzone, zp.FsmNextState)
 				if err != nil {
 					log.Printf("APISERVER: Error from ZoneStepFsm: %v", err)
 					resp.Error = true
@@ -444,7 +454,7 @@ func APIsigner(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 
 		switch sp.Command {
 		case "list":
-			ss, err := mdb.ListSigners(nil)
+			ss, err := mdb.ListSigners(nil, true) // apisafe
 			if err != nil {
 				log.Printf("Error from GetSigners: %v", err)
 			}
@@ -490,6 +500,14 @@ func APIsigner(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 				resp.ErrorMsg = err.Error()
 			}
 
+		case "swap":
+			newsigner, _ := mdb.GetSignerByName(nil, sp.NewSigner, false) // not apisafe
+			resp.Msg, err = mdb.SignerSwapGroup(nil, dbsigner, newsigner, sp.Signer.SignerGroup)
+			if err != nil {
+				resp.Error = true
+				resp.ErrorMsg = err.Error()
+			}
+
 		case "login":
 			err, resp.Msg = mdb.SignerLogin(dbsigner, &cliconf, tokvip)
 			if err != nil {
@@ -507,7 +525,7 @@ func APIsigner(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 		default:
 		}
 
-		ss, err := mdb.ListSigners(nil)
+		ss, err := mdb.ListSigners(nil, true) // apisafe
 		if err != nil {
 			log.Printf("Error from ListSigners: %v", err)
 		}
@@ -581,6 +599,122 @@ func APIsignergroup(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func APIdb(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	mdb := conf.Internal.MusicDB
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		log.Printf("APIdb: received /db request from %s.\n", r.RemoteAddr)
+
+		decoder := json.NewDecoder(r.Body)
+		var dp music.DBPost
+		err := decoder.Decode(&dp)
+		if err != nil {
+			log.Println("APIdb: error decoding db post:", err)
+		}
+
+		var resp = music.DBResponse{
+			Time:   time.Now(),
+			Client: r.RemoteAddr,
+		}
+
+		switch dp.Command {
+		case "export":
+			resp.State, err = mdb.ExportState(dp.Redact)
+			if err != nil {
+				log.Printf("Error from ExportState: %v", err)
+			}
+
+		case "import":
+			if dp.State == nil {
+				err = fmt.Errorf("no state to import")
+				break
+			}
+			var msgs []string
+			msgs, err = mdb.ImportState(dp.State)
+			if err != nil {
+				log.Printf("Error from ImportState: %v", err)
+				break
+			}
+			resp.Msg = strings.Join(msgs, "\n")
+
+		case "snapshot":
+			if dp.File == "" {
+				err = fmt.Errorf("no snapshot file name specified")
+				break
+			}
+			var snapfile string
+			snapfile, err = mdb.Snapshot(viper.GetString("db.snapshotdir"), dp.File)
+			if err != nil {
+				log.Printf("Error from Snapshot: %v", err)
+				break
+			}
+			resp.Msg = fmt.Sprintf("Snapshot of the MUSIC DB written to %s on the musicd host.", snapfile)
+
+		default:
+			err = fmt.Errorf("unknown db command: '%s'", dp.Command)
+		}
+
+		if err != nil {
+			resp.Error = true
+			resp.ErrorMsg = err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			log.Printf("Error from Encoder: %v\n", err)
+		}
+	}
+}
+
+func APIstate(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	mdb := conf.Internal.MusicDB
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		log.Printf("APIstate: received /state request from %s.\n", r.RemoteAddr)
+
+		decoder := json.NewDecoder(r.Body)
+		var sp music.StatePost
+		err := decoder.Decode(&sp)
+		if err != nil {
+			log.Println("APIstate: error decoding state post:", err)
+		}
+
+		var resp = music.StateResponse{
+			Time:   time.Now(),
+			Client: r.RemoteAddr,
+		}
+
+		if sp.State == nil {
+			err = fmt.Errorf("no desired state in request")
+		} else {
+			sp.State.Normalize()
+			switch sp.Command {
+			case "plan":
+				resp.Actions, err = mdb.PlanState(sp.State, sp.Prune)
+
+			case "apply":
+				resp.Actions, err = mdb.ApplyState(sp.State, sp.Prune, conf.Internal.EngineCheck)
+
+			default:
+				err = fmt.Errorf("unknown state command: '%s'", sp.Command)
+			}
+		}
+
+		if err != nil {
+			log.Printf("APIstate: Error from %s: %v", sp.Command, err)
+			resp.Error = true
+			resp.ErrorMsg = err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			log.Printf("Error from Encoder: %v\n", err)
+		}
+	}
+}
+
 func APIprocess(conf *Config) func(w http.ResponseWriter, r *http.Request) {
 	mdb := conf.Internal.MusicDB
 	var check music.EngineCheck
@@ -691,19 +825,115 @@ func APIshow(conf *Config, router *mux.Router) func(w http.ResponseWriter, r *ht
 	}
 }
 
+// APIevents streams zone, process and signer events to the client as
+// Server-Sent Events. Query parameters "zone" and "types" (comma separated)
+// limit what is sent. A client that reconnects with a Last-Event-ID header
+// (or a "since" parameter) first gets the events it missed.
+func APIevents(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		q := r.URL.Query()
+		sub := &EventSubscriber{
+			Types:  map[string]bool{},
+			Remote: fmt.Sprintf("%s (%s)", r.RemoteAddr, GetApiIdentity(r).Subject),
+		}
+		if zone := q.Get("zone"); zone != "" {
+			sub.Zone = dns.Fqdn(zone)
+		}
+		for _, t := range strings.Split(q.Get("types"), ",") {
+			if t != "" {
+				sub.Types[t] = true
+			}
+		}
+
+		since := r.Header.Get("Last-Event-ID")
+		if since == "" {
+			since = q.Get("since")
+		}
+		sinceseq, _ := strconv.ParseUint(since, 10, 64)
+
+		eb := conf.Internal.EventBroker
+		missed := eb.Subscribe(sub, sinceseq)
+		defer eb.Unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		send := func(ev music.MusicEvent) bool {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("APIevents: Error from json.Marshal: %v", err)
+				return true
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data)
+			if err != nil {
+				return false
+			}
+			flusher.Flush()
+			return true
+		}
+
+		for _, ev := range missed {
+			if !send(ev) {
+				return
+			}
+		}
+
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case ev, ok := <-sub.C:
+				if !ok {
+					// dropped by the broker for not keeping up. Ending the
+					// stream makes the client reconnect with Last-Event-ID.
+					return
+				}
+				if !send(ev) {
+					return
+				}
+			case <-keepalive.C:
+				_, err := fmt.Fprintf(w, ": keepalive\n\n")
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
 func SetupRouter(conf *Config) *mux.Router {
 	r := mux.NewRouter().StrictSlash(true)
 	r.HandleFunc("/", homeLink)
+	// health checks are for the orchestrator and are not authenticated
+	r.HandleFunc("/healthz", APIhealthz(conf)).Methods("GET")
+	r.HandleFunc("/readyz", APIreadyz(conf)).Methods("GET")
 
-	sr := r.PathPrefix("/api/v1").Headers("X-API-Key",
-		viper.GetString("apiserver.apikey")).Subrouter()
+	sr := r.PathPrefix("/api/v1").Subrouter()
+	sr.Use(APIauth(conf))
 	sr.HandleFunc("/ping", APIping(conf)).Methods("POST")
 	sr.HandleFunc("/signer", APIsigner(conf)).Methods("POST")
 	sr.HandleFunc("/zone", APIzone(conf)).Methods("POST")
 	sr.HandleFunc("/signergroup", APIsignergroup(conf)).Methods("POST")
 	sr.HandleFunc("/test", APItest(conf)).Methods("POST")
 	sr.HandleFunc("/process", APIprocess(conf)).Methods("POST")
+	sr.HandleFunc("/db", APIdb(conf)).Methods("POST")
+	sr.HandleFunc("/state", APIstate(conf)).Methods("POST")
 	sr.HandleFunc("/show", APIshow(conf, r)).Methods("POST")
+	sr.HandleFunc("/events", APIevents(conf)).Methods("GET")
+	sr.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	return r
 }
@@ -736,9 +966,23 @@ func APIdispatcher(conf *Config) error {
 	certFile := viper.GetString("apiserver.certFile")
 	keyFile := viper.GetString("apiserver.keyFile")
 
+	tlsconf, err := SetupServerTLSConfig()
+	if err != nil {
+		log.Fatalf("APIdispatcher: Error from SetupServerTLSConfig: %v", err)
+	}
+	if viper.GetString("apiserver.apikey") == "" && ClientAuthMode() == "none" {
+		log.Printf("APIdispatcher: Warning: neither apikey nor client certs configured. All API requests will be denied.\n")
+	}
+
 	if address != "" {
 		log.Println("Starting API dispatcher. Listening on", address)
-		log.Fatal(http.ListenAndServeTLS(address, certFile, keyFile, router))
+		conf.Internal.Health.Beat("apidispatcher", 0)
+		server := &http.Server{
+			Addr:      address,
+			Handler:   router,
+			TLSConfig: tlsconf,
+		}
+		log.Fatal(server.ListenAndServeTLS(certFile, keyFile))
 	}
 
 	log.Println("API dispatcher: unclear how to stop the http server nicely.")
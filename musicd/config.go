@@ -18,25 +18,51 @@ var cfgFile string
 var verbose bool
 
 type Config struct {
-	ApiServer ApiServerConf
-	Signers   []SignerConf
-	Db        DbConf
-	Common    CommonConf
-	Internal  InternalConf
-	FSMEngine FSMEngineConf
+	ApiServer      ApiServerConf
+	Signers        SignersConf
+	Db             DbConf
+	Common         CommonConf
+	Internal       InternalConf
+	FSMEngine      FSMEngineConf
+	Webhooks       []WebhookConf `validate:"dive"`
+	ParentAgent    ParentAgentConf
+	ParentUpdaters []ParentUpdaterConf `validate:"dive"`
+	CdsPolicy      CdsPolicyConf
 }
 
 type ApiServerConf struct {
-	Address  string `validate:"required,hostname_port"`
-	ApiKey   string `validate:"required"`
-	CertFile string `validate:"required,file"`
-	KeyFile  string `validate:"required,file"`
-	UseTLS   bool
+	Address    string `validate:"required,hostname_port"`
+	ApiKey     string // not needed if clientauth.mode is "require"
+	CertFile   string `validate:"required,file"`
+	KeyFile    string `validate:"required,file"`
+	UseTLS     bool
+	ClientAuth ClientAuthConf
+	Roles      map[string][]string // role --> allowed endpoints ("admin" may use all)
+}
+
+type ClientAuthConf struct {
+	Mode        string        `validate:"omitempty,oneof=none optional require"`
+	CAFile      string        `validate:"omitempty,file"`
+	Subjects    []SubjectConf `validate:"dive"`
+	DefaultRole string
+}
+
+// SubjectConf maps a client cert subject CN to a role. This is a list and not
+// a map as CNs contain dots, which viper would split into nested keys.
+type SubjectConf struct {
+	CN   string `validate:"required"`
+	Role string `validate:"required"`
 }
 
 type FSMEngineConf struct {
-	Active    bool `validate:"required"`
-	Intervals IntervalsConf
+	Active      bool `validate:"required"`
+	Intervals   IntervalsConf
+	Concurrency ConcurrencyConf
+}
+
+type ConcurrencyConf struct {
+	Workers   int `validate:"omitempty,gte=1,lte=256"` // zones stepped in parallel
+	PerSigner int `validate:"omitempty,gte=1"`         // zones per signer stepped in parallel
 }
 
 type IntervalsConf struct {
@@ -46,14 +72,24 @@ type IntervalsConf struct {
 	Complete int `validate:"required,gte=3599,lte=86401"` // must be greater 1hr and less than 24hr
 }
 
-type SignerConf struct {
-	Name    string
-	Address string `validate:"hostname_port"`
-	BaseURL string `validate:"url"`
-	Method  string // ddns | desec | ...
-	Auth    string // tsig | userpasstoken
-	Tsig    TsigConf
-	Limits  RateLimitsConf
+// SignersConf configures the signer methods. The signers themselves are not
+// in the config but in the DB, managed with "music-cli signer" or from a
+// desired-state file (see music.DesiredState).
+type SignersConf struct {
+	Ddns  DdnsConf
+	Desec DesecConf
+}
+
+type DdnsConf struct {
+	Limits RateLimitsConf
+}
+
+type DesecConf struct {
+	Enabled  bool
+	Email    string `validate:"required_if=Enabled true,omitempty,email"`
+	Password string `validate:"required_if=Enabled true"`
+	BaseURL  string `validate:"required_if=Enabled true,omitempty,url"`
+	Limits   RateLimitsConf
 }
 
 type RateLimitsConf struct {
@@ -61,15 +97,20 @@ type RateLimitsConf struct {
 	Update int // update rrset ops / second
 }
 
-type TsigConf struct {
-	KeyName   string `dns:"domain-name"`
-	KeyAlg    string // dns.HmacSHA256 is most common
-	KeySecret string
+type DbConf struct {
+	File string `validate:"required_unless=Mode postgres,omitempty,file"`
+	Dsn  string `validate:"required_if=Mode postgres"` // postgres connection string
+	Mode string `validate:"required,oneof=sqlite WAL postgres"`
+
+	Masterkey   string `validate:"omitempty,file"` // encrypts signer secrets, see music.SecretBox
+	SnapshotDir string `validate:"omitempty,dir"`  // "music-cli db snapshot" writes here (unset: disabled)
 }
 
-type DbConf struct {
-	File string `validate:"file,required"`
-	Mode string `validate:"required"`
+// CdsPolicyConf is the default CDS policy of the zones, see music.CdsPolicy.
+type CdsPolicyConf struct {
+	Digests []string                    // digest types of the CDS records (default SHA256)
+	Publish string                      `validate:"omitempty,oneof=cds cdnskey both"` // default both
+	Parents []music.ParentCdsPolicyConf // per parent zone
 }
 
 type CommonConf struct {
@@ -90,6 +131,8 @@ type InternalConf struct {
 	DdnsFetch   chan music.SignerOp
 	DdnsUpdate  chan music.SignerOp
 	Processes   map[string]music.FSM
+	EventBroker *EventBroker
+	Health      *HealthRegistry
 }
 
 func ValidateConfig(v *viper.Viper, cfgfile string, safemode bool) error {
@@ -128,6 +171,26 @@ func ValidateConfig(v *viper.Viper, cfgfile string, safemode bool) error {
 		if err := validate.Struct(&config); err != nil {
 			log.Fatalf("Config \"%s\" is missing required attributes:\n%v\n", cfgfile, err)
 		}
+		if _, err := music.ParseCdsPolicy(config.CdsPolicy.Digests, config.CdsPolicy.Publish); err != nil {
+			log.Fatalf("Config \"%s\": cdspolicy: %v\n", cfgfile, err)
+		}
+		for _, p := range config.CdsPolicy.Parents {
+			if _, err := music.ParseCdsPolicy(p.Digests, p.Publish); err != nil {
+				log.Fatalf("Config \"%s\": cdspolicy for parent %s: %v\n", cfgfile, p.Zone, err)
+			}
+		}
+		for _, wc := range config.Webhooks {
+			if wc.Secret != "" {
+				log.Fatalf("Config \"%s\": webhook %s: secret must not be in the config, use secretfile\n",
+					cfgfile, wc.Name)
+			}
+		}
+		for _, puc := range config.ParentUpdaters {
+			if puc.Password != "" {
+				log.Fatalf("Config \"%s\": parent updater %s: password must not be in the config, use passwordfile\n",
+					cfgfile, puc.Name)
+			}
+		}
 		// fmt.Printf("config: %v\n", config)
 	}
 	return nil
@@ -8,8 +8,6 @@ import (
 	"log"
 	"time"
 
-	"github.com/mattn/go-sqlite3"
-
 	"github.com/DNSSEC-Provisioning/music/music"
 )
 
@@ -18,6 +16,7 @@ func dbUpdater(conf *Config) {
 	log.Printf("dbUpdater: Starting DB Update Service.")
 
 	mdb := conf.Internal.MusicDB
+	health := conf.Internal.Health
 
 	dbupdateC := make(chan music.DBUpdate, 5)
 	mdb.UpdateC = dbupdateC
@@ -52,35 +51,41 @@ func dbUpdater(conf *Config) {
 			tx, err := mdb.Begin()
 			if err != nil {
 				log.Printf("RunDBQueue: Error from mdb.Begin(): %v", err)
+				health.Result("dbupdater", err)
+				return
 			}
 
 			switch t {
 			case "STOPREASON":
 				_, err := tx.Stmt(mstmt).Exec(u.Zone, u.Key, u.Value)
 				if err != nil {
-					if err.(sqlite3.Error).Code == sqlite3.ErrLocked {
+					if mdb.IsRetryable(err) {
 						// database is locked by other connection
 						log.Printf("RunDBQueue: UPDATE db locked. will try again. queue: %d",
 							len(queue))
 						tx.Rollback()
+						health.Result("dbupdater", err)
 						return // let's try again later
 					} else {
 						log.Printf("RunDBQueue: UPDATE Error from sqlupdate.Exec: %v",
 							err)
+						health.Result("dbupdater", err)
 						return
 					}
 				}
 				_, err = tx.Stmt(blockstmt).Exec(u.Zone)
 				if err != nil {
-					if err.(sqlite3.Error).Code == sqlite3.ErrLocked {
+					if mdb.IsRetryable(err) {
 						// database is locked by other connection
 						log.Printf("RunDBQueue: UPDATE db locked. will try again. queue: %d",
 							len(queue))
 						tx.Rollback()
+						health.Result("dbupdater", err)
 						return // let's try again later
 					} else {
 						log.Printf("RunDBQueue: UPDATE Error from sqlupdate.Exec: %v",
 							err)
+						health.Result("dbupdater", err)
 						return
 					}
 				}
@@ -89,21 +94,37 @@ func dbUpdater(conf *Config) {
 			err = tx.Commit()
 			if err != nil {
 				log.Printf("dbUpdater: RunQueue: Error from tx.Commit: %v", err)
+				health.Result("dbupdater", err)
 			} else {
+				health.Result("dbupdater", nil)
 				log.Printf("dbUpdater: Updated zone %s stop-reason to '%s'", u.Zone, u.Value)
 				queue = queue[1:] // only drop item after successful commit
 			}
 		}
 	}
 
+	ReportQueue := func() {
+		metricDBUpdateQueue.Set(float64(len(queue)))
+		if len(queue) > 0 {
+			health.Queue("dbupdater", len(queue), queue[0].Queued)
+		} else {
+			health.Queue("dbupdater", 0, time.Time{})
+		}
+		health.Beat("dbupdater", 30*time.Second)
+	}
+
+	health.Beat("dbupdater", 30*time.Second)
 	for {
 		select {
 		case update = <-dbupdateC:
+			update.Queued = time.Now()
 			queue = append(queue, update)
 			RunDBQueue()
+			ReportQueue()
 
 		case <-ticker.C:
 			RunDBQueue()
+			ReportQueue()
 		}
 	}
 }
@@ -42,6 +42,10 @@ func ddnsmgr(conf *Config, done <-chan struct{}) {
 	// fetch_ticker := time.NewTicker(time.Minute)
 	// update_ticker := time.NewTicker(time.Minute)
 	fetch_ticker := time.NewTicker(5 * time.Second)
+	// if a manager misses three ticks in a row it is considered stuck
+	heartbeat := 3 * 5 * time.Second
+	health := conf.Internal.Health
+
 	update_ticker := time.NewTicker(5 * time.Second)
 
 	//	go Recoverer("DDNS fetch routine", func() {
@@ -52,10 +56,14 @@ func ddnsmgr(conf *Config, done <-chan struct{}) {
 		var err error
 		var fdop, op music.SignerOp
 		var fetch_ops, hold int
+		health.Beat("ddnsmgr-fetch", heartbeat)
 		for {
 			select {
 			case op = <-ddnsfetch:
+				op.Queued = time.Now()
 				fetchOpQueue = append(fetchOpQueue, op)
+				metricSignerOpQueue.WithLabelValues("ddnsmgr", "fetch").Set(float64(len(fetchOpQueue)))
+				health.SignerOpQueue("ddnsmgr-fetch", fetchOpQueue)
 				// fmt.Printf("ddnsmgr: request for '%s %s'\n", op.Owner, dns.TypeToString[op.RRtype])
 
 			case <-fetch_ticker.C:
@@ -64,6 +72,7 @@ func ddnsmgr(conf *Config, done <-chan struct{}) {
 						fetch_ops, len(fetchOpQueue))
 				}
 				fetch_ops = 0
+				health.Beat("ddnsmgr-fetch", heartbeat)
 				for {
 					if len(fetchOpQueue) == 0 {
 						// fmt.Printf("DDNS fetch: queue empty, nothing to do\n")
@@ -71,26 +80,37 @@ func ddnsmgr(conf *Config, done <-chan struct{}) {
 					}
 					fdop = fetchOpQueue[0]
 					fetchOpQueue = fetchOpQueue[1:]
+					metricSignerOpQueue.WithLabelValues("ddnsmgr", "fetch").Set(float64(len(fetchOpQueue)))
+					health.SignerOpQueue("ddnsmgr-fetch", fetchOpQueue)
 
 					log.Printf("ddnsmgr: Fetch request to signer %s (%s) for '%s %s'\n",
 						fdop.Signer.Name, fdop.Signer.Address,
 						fdop.Owner, dns.TypeToString[fdop.RRtype])
 					for {
+						start := time.Now()
 						rl, hold, err = music.RLDdnsFetchRRset(fdop)
+						metricSignerOpLatency.WithLabelValues("ddnsmgr", "fetch").Observe(time.Since(start).Seconds())
 						if err != nil {
 							log.Printf("ddnsmgr: Error from RLDdnsFetchRRset: %v\n", err)
 						}
 						// fmt.Printf("ddnsmgr: response from RLDdnsFetchRRset: rl: %v hold: %d err: %v\n", rl, hold, err)
 						if !rl {
+							health.Result("ddnsmgr-fetch", err)
 							// fmt.Printf("ddnsmgr: all ok, done with this request\n")
 							break
 						} else {
 							fmt.Printf("ddnsmgr: fetch was rate-limited. Will sleep for %d seconds\n", hold)
+							metricRateLimitHits.WithLabelValues("ddnsmgr", "fetch", "remote").Inc()
+							health.Beat("ddnsmgr-fetch", time.Duration(hold)*time.Second+heartbeat)
 							time.Sleep(time.Duration(hold) * time.Second)
 						}
 					}
+					health.Beat("ddnsmgr-fetch", heartbeat)
 					fetch_ops++
 					if fetch_ops >= fetch_limit {
+						if len(fetchOpQueue) > 0 {
+							metricRateLimitHits.WithLabelValues("ddnsmgr", "fetch", "local").Inc()
+						}
 						break // the loop for this minute
 					}
 
@@ -114,10 +134,14 @@ func ddnsmgr(conf *Config, done <-chan struct{}) {
 		var err error
 		var op, udop music.SignerOp
 		var update_ops, hold int
+		health.Beat("ddnsmgr-update", heartbeat)
 		for {
 			select {
 			case op = <-ddnsupdate:
+				op.Queued = time.Now()
 				updateOpQueue = append(updateOpQueue, op)
+				metricSignerOpQueue.WithLabelValues("ddnsmgr", "update").Set(float64(len(updateOpQueue)))
+				health.SignerOpQueue("ddnsmgr-update", updateOpQueue)
 				// log.Printf("ddnsmgr: request for '%s %s'\n", op.Owner, dns.TypeToString[op.RRtype])
 
 			case <-update_ticker.C:
@@ -126,6 +150,7 @@ func ddnsmgr(conf *Config, done <-chan struct{}) {
 						update_ops, len(updateOpQueue))
 				}
 				update_ops = 0
+				health.Beat("ddnsmgr-update", heartbeat)
 				for {
 					if len(updateOpQueue) == 0 {
 						// fmt.Printf("DDNS update: queue empty, nothing to do\n")
@@ -133,25 +158,36 @@ func ddnsmgr(conf *Config, done <-chan struct{}) {
 					}
 					udop = updateOpQueue[0]
 					updateOpQueue = updateOpQueue[1:]
+					metricSignerOpQueue.WithLabelValues("ddnsmgr", "update").Set(float64(len(updateOpQueue)))
+					health.SignerOpQueue("ddnsmgr-update", updateOpQueue)
 
 					// log.Printf("ddnsmgr: update request for '%s %s'\n",
 					// 			udop.Owner, dns.TypeToString[udop.RRtype])
 					for {
+						start := time.Now()
 						rl, hold, err = music.RLDdnsUpdate(udop)
+						metricSignerOpLatency.WithLabelValues("ddnsmgr", "update").Observe(time.Since(start).Seconds())
 						if err != nil {
 							log.Printf("ddnsmgr: Error from RLDdnsUpdate: %v\n", err)
 						}
 						// fmt.Printf("ddnsmgr: response from RLDdnsUpdate: rl: %v hold: %d err: %v\n", rl, hold, err)
 						if !rl {
+							health.Result("ddnsmgr-update", err)
 							// fmt.Printf("ddnsmgr: all ok, done with this request\n")
 							break
 						} else {
 							fmt.Printf("ddnsmgr: update was rate-limited. Will sleep for %d seconds\n", hold)
+							metricRateLimitHits.WithLabelValues("ddnsmgr", "update", "remote").Inc()
+							health.Beat("ddnsmgr-update", time.Duration(hold)*time.Second+heartbeat)
 							time.Sleep(time.Duration(hold) * time.Second)
 						}
 					}
+					health.Beat("ddnsmgr-update", heartbeat)
 					update_ops++
 					if update_ops >= update_limit {
+						if len(updateOpQueue) > 0 {
+							metricRateLimitHits.WithLabelValues("ddnsmgr", "update", "local").Inc()
+						}
 						break // the loop for this minute
 					}
 				}
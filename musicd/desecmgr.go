@@ -40,6 +40,10 @@ func deSECmgr(conf *Config, done <-chan struct{}) {
 	log.Println("Starting deSEC Manager. Will rate-limit deSEC API requests.")
 
 	fetch_ticker := time.NewTicker(time.Minute)
+	// if a manager misses three ticks in a row it is considered stuck
+	heartbeat := 3 * time.Minute
+	health := conf.Internal.Health
+
 	update_ticker := time.NewTicker(time.Minute)
 
 	go func() {
@@ -48,10 +52,14 @@ func deSECmgr(conf *Config, done <-chan struct{}) {
 		var err error
 		var fdop, op music.SignerOp
 		var fetch_ops, hold int
+		health.Beat("desecmgr-fetch", heartbeat)
 		for {
 			select {
 			case op = <-desecfetch:
+				op.Queued = time.Now()
 				fetchOpQueue = append(fetchOpQueue, op)
+				metricSignerOpQueue.WithLabelValues("desecmgr", "fetch").Set(float64(len(fetchOpQueue)))
+				health.SignerOpQueue("desecmgr-fetch", fetchOpQueue)
 
 			case <-fetch_ticker.C:
 				if cliconf.Debug {
@@ -59,6 +67,7 @@ func deSECmgr(conf *Config, done <-chan struct{}) {
 						time.Now(), fetch_ops, len(fetchOpQueue))
 				}
 				fetch_ops = 0
+				health.Beat("desecmgr-fetch", heartbeat)
 
 				for {
 					if len(fetchOpQueue) == 0 {
@@ -67,21 +76,34 @@ func deSECmgr(conf *Config, done <-chan struct{}) {
 					}
 					fdop = fetchOpQueue[0]
 					fetchOpQueue = fetchOpQueue[1:]
+					metricSignerOpQueue.WithLabelValues("desecmgr", "fetch").Set(float64(len(fetchOpQueue)))
+					health.SignerOpQueue("desecmgr-fetch", fetchOpQueue)
 
 					log.Printf("deSECMgr: fetch request for '%s %s'\n",
 						fdop.Owner, dns.TypeToString[fdop.RRtype])
 					for {
+						start := time.Now()
 						rl, hold, err = music.RLDesecFetchRRset(fdop)
+						metricSignerOpLatency.WithLabelValues("desecmgr", "fetch").Observe(time.Since(start).Seconds())
 						if err != nil {
 							log.Printf("deSECmgr: Error from RLDesecFetchRRset: rl: %v hold: %d err: %v\n", rl, hold, err)
 						}
 						if !rl {
+							health.Result("desecmgr-fetch", err)
+							break
+						} else {
 							// fmt.Printf("deSECmgr: fetch was rate-limited. Will sleep for %d seconds.\n", hold)
+							metricRateLimitHits.WithLabelValues("desecmgr", "fetch", "remote").Inc()
+							health.Beat("desecmgr-fetch", time.Duration(hold)*time.Second+heartbeat)
 							time.Sleep(time.Duration(hold) * time.Second)
 						}
 					}
+					health.Beat("desecmgr-fetch", heartbeat)
 					fetch_ops++
 					if fetch_ops >= fetch_limit {
+						if len(fetchOpQueue) > 0 {
+							metricRateLimitHits.WithLabelValues("desecmgr", "fetch", "local").Inc()
+						}
 						break // the loop for this minute
 					}
 				}
@@ -100,10 +122,14 @@ func deSECmgr(conf *Config, done <-chan struct{}) {
 		var err error
 		var op, udop music.SignerOp
 		var update_ops, hold int
+		health.Beat("desecmgr-update", heartbeat)
 		for {
 			select {
 			case op = <-desecupdate:
+				op.Queued = time.Now()
 				updateOpQueue = append(updateOpQueue, op)
+				metricSignerOpQueue.WithLabelValues("desecmgr", "update").Set(float64(len(updateOpQueue)))
+				health.SignerOpQueue("desecmgr-update", updateOpQueue)
 				// fmt.Printf("deSEC Mgr: request for '%s %s'\n", op.Owner, dns.TypeToString[op.RRtype])
 
 			case <-update_ticker.C:
@@ -112,6 +138,7 @@ func deSECmgr(conf *Config, done <-chan struct{}) {
 						time.Now(), update_ops, len(updateOpQueue))
 				}
 				update_ops = 0
+				health.Beat("desecmgr-update", heartbeat)
 				for {
 					if len(updateOpQueue) == 0 {
 						// fmt.Printf("deSEC Update: queue empty, nothing to do\n")
@@ -119,25 +146,36 @@ func deSECmgr(conf *Config, done <-chan struct{}) {
 					}
 					udop = updateOpQueue[0]
 					updateOpQueue = updateOpQueue[1:]
+					metricSignerOpQueue.WithLabelValues("desecmgr", "update").Set(float64(len(updateOpQueue)))
+					health.SignerOpQueue("desecmgr-update", updateOpQueue)
 
 					// log.Printf("deSEC Mgr: update request for '%s %s'\n",
 					// 			udop.Owner, dns.TypeToString[udop.RRtype])
 					for {
+						start := time.Now()
 						rl, hold, err = music.RLDesecUpdate(udop)
+						metricSignerOpLatency.WithLabelValues("desecmgr", "update").Observe(time.Since(start).Seconds())
 						if err != nil {
 							log.Printf("deSEC Mgr: Error from RLDesecUpdate: %v\n", err)
 						}
 						// fmt.Printf("deSEC Mgr: response from RLDdnsUpdate: rl: %v hold: %d err: %v\n", rl, hold, err)
 						if !rl {
+							health.Result("desecmgr-update", err)
 							// fmt.Printf("deSEC Mgr: all ok, done with this request\n")
 							break
 						} else {
 							fmt.Printf("deSEC Mgr: update was rate-limited. Will sleep for %d seconds\n", hold)
+							metricRateLimitHits.WithLabelValues("desecmgr", "update", "remote").Inc()
+							health.Beat("desecmgr-update", time.Duration(hold)*time.Second+heartbeat)
 							time.Sleep(time.Duration(hold) * time.Second)
 						}
 					}
+					health.Beat("desecmgr-update", heartbeat)
 					update_ops++
 					if update_ops >= update_limit {
+						if len(updateOpQueue) > 0 {
+							metricRateLimitHits.WithLabelValues("desecmgr", "update", "local").Inc()
+						}
 						break // the loop for this minute
 					}
 				}
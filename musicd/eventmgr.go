@@ -0,0 +1,127 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+)
+
+// Number of old events kept around so that a client that reconnects can
+// catch up on what it missed (via Last-Event-ID).
+const EventBacklogSize = 1000
+
+type EventSubscriber struct {
+	C      chan music.MusicEvent
+	Zone   string          // only events for this zone ("" = all zones)
+	Types  map[string]bool // only these event types (empty = all types)
+	Remote string
+}
+
+func (s *EventSubscriber) Wants(ev music.MusicEvent) bool {
+	if s.Zone != "" && s.Zone != ev.Zone {
+		return false
+	}
+	if len(s.Types) > 0 && !s.Types[ev.Type] {
+		return false
+	}
+	return true
+}
+
+type EventBroker struct {
+	mu      sync.Mutex
+	seq     uint64
+	backlog []music.MusicEvent
+	subs    map[*EventSubscriber]bool
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{
+		subs: map[*EventSubscriber]bool{},
+	}
+}
+
+// Subscribe registers a new subscriber and returns it together with all
+// events in the backlog newer than since (that the subscriber wants). A
+// subscriber that does not keep up is dropped and its channel closed; it
+// must then subscribe again with the last event it got to catch up.
+func (eb *EventBroker) Subscribe(sub *EventSubscriber, since uint64) []music.MusicEvent {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	sub.C = make(chan music.MusicEvent, 100)
+	eb.subs[sub] = true
+
+	var missed []music.MusicEvent
+	if since > 0 {
+		for _, ev := range eb.backlog {
+			if ev.Seq > since && sub.Wants(ev) {
+				missed = append(missed, ev)
+			}
+		}
+	}
+	log.Printf("EventBroker: new subscriber %s (zone: '%s'). %d subscribers.",
+		sub.Remote, sub.Zone, len(eb.subs))
+	return missed
+}
+
+// Unsubscribe removes the subscriber, if it has not already been dropped.
+func (eb *EventBroker) Unsubscribe(sub *EventSubscriber) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	delete(eb.subs, sub)
+	log.Printf("EventBroker: subscriber %s left. %d subscribers.", sub.Remote, len(eb.subs))
+}
+
+func (eb *EventBroker) Publish(ev music.MusicEvent) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	eb.seq++
+	ev.Seq = eb.seq
+	eb.backlog = append(eb.backlog, ev)
+	if len(eb.backlog) > EventBacklogSize {
+		eb.backlog = eb.backlog[len(eb.backlog)-EventBacklogSize:]
+	}
+
+	for sub := range eb.subs {
+		if !sub.Wants(ev) {
+			continue
+		}
+		select {
+		case sub.C <- ev:
+		default:
+			// slow subscriber. Rather than silently losing events it is
+			// dropped, and catches up via Last-Event-ID when it reconnects.
+			delete(eb.subs, sub)
+			close(sub.C)
+			log.Printf("EventBroker: subscriber %s not keeping up at event %d. Dropped. %d subscribers.",
+				sub.Remote, ev.Seq, len(eb.subs))
+		}
+	}
+}
+
+// EventManager reads the events published by the music package (on
+// MusicDB.EventC) and hands them to the broker, which distributes them to
+// the subscribers (i.e. /events API clients).
+func EventManager(conf *Config, done <-chan struct{}) {
+	mdb := conf.Internal.MusicDB
+	eb := conf.Internal.EventBroker
+
+	log.Printf("EventManager: Starting event distribution service.")
+
+	for {
+		select {
+		case ev := <-mdb.EventC:
+			eb.Publish(ev)
+
+		case <-done:
+			log.Println("EventManager: stop signal received.")
+			return
+		}
+	}
+}
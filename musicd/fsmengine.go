@@ -39,9 +39,11 @@ func FSMEngine(conf *Config, stopch chan struct{}) {
 	var checkitem music.EngineCheck
 	var emptymap = map[string]bool{}
 	checkch := conf.Internal.EngineCheck
+	health := conf.Internal.Health
 
 	if !viper.GetBool("fsmengine.active") {
 		log.Printf("FSM Engine is NOT active. All state transitions must be managed manually.")
+		health.Inactive("fsmengine")
 		for {
 			select {
 			case <-checkch: // ensure that we keep reading to keep the
@@ -77,12 +79,45 @@ func FSMEngine(conf *Config, stopch chan struct{}) {
 		}
 	}
 
-	log.Printf("Starting FSM Engine (will run once every %d seconds)", current)
+	limits := music.DefaultEngineLimits
+	if w := viper.GetInt("fsmengine.concurrency.workers"); w > 0 {
+		limits.Workers = w
+	}
+	if ps := viper.GetInt("fsmengine.concurrency.persigner"); ps > 0 {
+		limits.SignerConcurrency = ps
+	}
+	mdb.SetEngineLimits(limits)
+
+	log.Printf("Starting FSM Engine (will run once every %d seconds, %d zones in parallel, max %d per signer)",
+		current, limits.Workers, limits.SignerConcurrency)
+	metricEngineInterval.Set(float64(current))
+
+	// The engine is considered stuck if it hasn't completed a run within two
+	// intervals (plus some slack). During a run it beats for every zone that
+	// is done, so a run over many zones is not mistaken for a stuck engine.
+	Heartbeat := func() {
+		health.Beat("fsmengine", time.Duration(2*current+60)*time.Second)
+	}
+	ZoneDone := func(zone string) {
+		Heartbeat()
+	}
+
+	// kind is only used for metrics: "check" | "auto" | "all"
+	PushZones := func(kind string, checkzones map[string]bool, checkall bool) ([]music.Zone, error) {
+		start := time.Now()
+		zones, err := mdb.PushZones(checkzones, checkall, ZoneDone)
+		metricEngineRunDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+		health.Result("fsmengine", err)
+		Heartbeat()
+		return zones, err
+	}
+
+	Heartbeat()
 
 	ticker := time.NewTicker(time.Duration(current) * time.Second)
 	completeticker := time.NewTicker(time.Duration(completeinterval) * time.Second)
 
-	_, err = mdb.PushZones(nil, emptymap, true) // check ALL zones
+	_, err = PushZones("all", emptymap, true) // check ALL zones
 	if err != nil {
 		log.Printf("FSMEngine: Error from PushZones: %v", err)
 	}
@@ -94,11 +129,14 @@ func FSMEngine(conf *Config, stopch chan struct{}) {
 			log.Printf("FSM Engine: changing run interval from %d to %d seconds", current, ni)
 			current = ni
 			ticker = time.NewTicker(time.Duration(current) * time.Second)
+			metricEngineInterval.Set(float64(current))
+			Heartbeat()
 		}
 	}
 
 	ReportProgress := func() {
 		count = len(zones)
+		metricEngineZonesPushed.Set(float64(count))
 		if count > 0 {
 			zonelist := []string{}
 			for _, z := range zones {
@@ -119,10 +157,10 @@ func FSMEngine(conf *Config, stopch chan struct{}) {
 			if zonename != "" {
 				log.Printf("FSM Engine: Someone wants me to check the zone '%s', so I'll do that.",
 					zonename)
-				zones, err = mdb.PushZones(nil, map[string]bool{zonename: true}, false)
+				zones, err = PushZones("check", map[string]bool{zonename: true}, false)
 			} else {
 				log.Print("FSM Engine: Someone wants me to do a run now, so I'll do that.")
-				zones, err = mdb.PushZones(nil, emptymap, false)
+				zones, err = PushZones("check", emptymap, false)
 			}
 			if err != nil {
 				log.Printf("FSMEngine: Error from PushZones: %v", err)
@@ -131,7 +169,7 @@ func FSMEngine(conf *Config, stopch chan struct{}) {
 			UpdateTicker()
 
 		case <-ticker.C:
-			zones, err = mdb.PushZones(nil, emptymap, false) // check non-blocked zones only
+			zones, err = PushZones("auto", emptymap, false) // check non-blocked zones only
 			if err != nil {
 				log.Printf("FSMEngine: Error from PushZones: %v", err)
 			}
@@ -139,7 +177,7 @@ func FSMEngine(conf *Config, stopch chan struct{}) {
 			UpdateTicker()
 
 		case <-completeticker.C:
-			zones, err = mdb.PushZones(nil, emptymap, true) // check ALL zones
+			zones, err = PushZones("all", emptymap, true) // check ALL zones
 			if err != nil {
 				log.Printf("FSMEngine: Error from PushZones: %v", err)
 			}
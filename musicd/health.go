@@ -0,0 +1,219 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+)
+
+// Each long-running goroutine in musicd reports a heartbeat to the health
+// registry every time it comes around its main loop, together with a promise
+// of when it will be back. If a goroutine dies or gets stuck (f.e. ddnsmgr
+// waiting for a signer that never answers) the promise is broken and the
+// subsystem is reported as "stale", which makes /healthz fail.
+type SubsystemHealth struct {
+	Status      string // "ok" | "stale" | "inactive"
+	LastBeat    time.Time
+	NextBeat    time.Time // stale if no heartbeat before this
+	LastSuccess time.Time // last time real work was done without error
+	Failing     bool      // last piece of work failed. The error is only logged, not exposed
+	QueueLength int
+	QueueAge    float64 // seconds since the oldest item in the queue was queued
+
+	oldest time.Time
+}
+
+type HealthRegistry struct {
+	mu   sync.Mutex
+	subs map[string]*SubsystemHealth
+}
+
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{
+		subs: map[string]*SubsystemHealth{},
+	}
+}
+
+func (hr *HealthRegistry) get(name string) *SubsystemHealth {
+	s, exist := hr.subs[name]
+	if !exist {
+		s = &SubsystemHealth{Status: "ok"}
+		hr.subs[name] = s
+	}
+	return s
+}
+
+// Beat records a heartbeat for the subsystem. The subsystem promises to beat
+// again within next (0 = no promise, f.e. for subsystems that only wait).
+func (hr *HealthRegistry) Beat(name string, next time.Duration) {
+	if hr == nil {
+		return
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	s := hr.get(name)
+	s.Status = "ok"
+	s.LastBeat = time.Now()
+	if next > 0 {
+		s.NextBeat = s.LastBeat.Add(next)
+	} else {
+		s.NextBeat = time.Time{}
+	}
+}
+
+// Inactive marks a subsystem that is running but intentionally not doing
+// anything (f.e. the FSM engine when fsmengine.active is false).
+func (hr *HealthRegistry) Inactive(name string) {
+	if hr == nil {
+		return
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	s := hr.get(name)
+	s.Status = "inactive"
+	s.LastBeat = time.Now()
+	s.NextBeat = time.Time{}
+}
+
+// Result records the outcome of a piece of real work.
+func (hr *HealthRegistry) Result(name string, err error) {
+	if hr == nil {
+		return
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	s := hr.get(name)
+	if err != nil {
+		s.Failing = true
+		return
+	}
+	s.LastSuccess = time.Now()
+	s.Failing = false
+}
+
+// Queue records the current queue length and the time the oldest item in the
+// queue was queued (ignored if the queue is empty).
+func (hr *HealthRegistry) Queue(name string, length int, oldest time.Time) {
+	if hr == nil {
+		return
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	s := hr.get(name)
+	s.QueueLength = length
+	s.oldest = oldest
+	if length == 0 {
+		s.oldest = time.Time{}
+	}
+}
+
+func (hr *HealthRegistry) SignerOpQueue(name string, queue []music.SignerOp) {
+	if len(queue) > 0 {
+		hr.Queue(name, len(queue), queue[0].Queued)
+	} else {
+		hr.Queue(name, 0, time.Time{})
+	}
+}
+
+// Snapshot returns a copy of the state of all subsystems, with the status of
+// subsystems that have missed their heartbeat set to "stale".
+func (hr *HealthRegistry) Snapshot() map[string]SubsystemHealth {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	now := time.Now()
+	snap := map[string]SubsystemHealth{}
+	for name, s := range hr.subs {
+		c := *s
+		if c.Status == "ok" && !c.NextBeat.IsZero() && now.After(c.NextBeat) {
+			c.Status = "stale"
+		}
+		if !c.oldest.IsZero() {
+			c.QueueAge = now.Sub(c.oldest).Seconds()
+		}
+		snap[name] = c
+	}
+	return snap
+}
+
+// The health endpoints are unauthenticated, so the responses must not
+// contain error messages (they may contain addresses, DSNs, etc).
+type HealthResponse struct {
+	Status     string // "ok" | "fail"
+	Time       time.Time
+	Problems   []string `json:",omitempty"`
+	Subsystems map[string]SubsystemHealth
+}
+
+func writeHealth(w http.ResponseWriter, resp HealthResponse) {
+	resp.Time = time.Now()
+	resp.Status = "ok"
+	code := http.StatusOK
+	if len(resp.Problems) > 0 {
+		sort.Strings(resp.Problems)
+		resp.Status = "fail"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Printf("Error from Encoder: %v\n", err)
+	}
+}
+
+func staleSubsystems(subs map[string]SubsystemHealth) []string {
+	var problems []string
+	for name, s := range subs {
+		if s.Status == "stale" {
+			problems = append(problems, name+": no heartbeat since "+
+				s.LastBeat.Format(time.RFC3339))
+		}
+	}
+	return problems
+}
+
+// APIhealthz is the liveness check: it fails if any subsystem has missed its
+// heartbeat, i.e. the daemon is wedged and should be restarted.
+func APIhealthz(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subs := conf.Internal.Health.Snapshot()
+		writeHealth(w, HealthResponse{
+			Problems:   staleSubsystems(subs),
+			Subsystems: subs,
+		})
+	}
+}
+
+// APIreadyz is the readiness check: in addition to the liveness check it
+// fails if the DB is not usable or the FSM engine has not run within its
+// expected interval.
+func APIreadyz(conf *Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subs := conf.Internal.Health.Snapshot()
+		problems := staleSubsystems(subs)
+
+		err := conf.Internal.MusicDB.Ping()
+		if err != nil {
+			log.Printf("APIreadyz: Error from MusicDB.Ping(): %v", err)
+			problems = append(problems, "db: not usable")
+		}
+		if _, exist := subs["fsmengine"]; !exist {
+			problems = append(problems, "fsmengine: not started")
+		}
+
+		writeHealth(w, HealthResponse{
+			Problems:   problems,
+			Subsystems: subs,
+		})
+	}
+}
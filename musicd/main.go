@@ -125,15 +125,146 @@ func LoadConfig(conf *Config, safemode bool) error {
 	return nil
 }
 
+// DBSource returns the DB file (sqlite) or connection string (postgres).
+func DBSource() string {
+	if music.DBModeIsPostgres(viper.GetString("db.mode")) {
+		return viper.GetString("db.dsn")
+	}
+	return viper.GetString("db.file")
+}
+
+// MigrateDB migrates the DB schema (or, if dryrun is true, just prints the
+// pending migrations) and returns the exit code.
+func MigrateDB(dryrun bool) int {
+	source := DBSource()
+	mdb, err := music.OpenDB(source, viper.GetString("db.mode"))
+	if err != nil {
+		log.Printf("Error from OpenDB(%s): %v", viper.GetString("db.mode"), err)
+		return 1
+	}
+
+	current, err := mdb.SchemaVersion()
+	if err != nil {
+		log.Printf("Error from SchemaVersion: %v", err)
+		return 1
+	}
+	fmt.Printf("DB (%s): schema version %d, latest version %d\n",
+		viper.GetString("db.mode"), current, music.LatestSchemaVersion())
+
+	migrations, err := mdb.Migrate(dryrun)
+	for _, m := range migrations {
+		if dryrun {
+			fmt.Printf("pending:  %d: %s\n", m.Version, m.Description)
+		} else {
+			fmt.Printf("migrated: %d: %s\n", m.Version, m.Description)
+		}
+	}
+	if err != nil {
+		log.Printf("Error from Migrate: %v", err)
+		return 1
+	}
+	if len(migrations) == 0 {
+		fmt.Printf("DB schema is up to date.\n")
+	}
+	return 0
+}
+
+// LoadSecretBox returns the SecretBox for the master key in db.masterkey (or
+// $MUSIC_MASTER_KEY), or nil if no master key is configured.
+func LoadSecretBox() (*music.SecretBox, error) {
+	key, err := music.LoadMasterKey(viper.GetString("db.masterkey"))
+	if err != nil || key == nil {
+		return nil, err
+	}
+	return music.NewSecretBox(key)
+}
+
+// RotateSecrets re-encrypts all signer secrets with the master key in
+// newkeyfile (or, if newkeyfile is empty, with the current master key, which
+// encrypts any plaintext secrets) and returns the exit code.
+func RotateSecrets(newkeyfile string) int {
+	mdb, err := music.OpenDB(DBSource(), viper.GetString("db.mode"))
+	if err != nil {
+		log.Printf("Error from OpenDB(%s): %v", viper.GetString("db.mode"), err)
+		return 1
+	}
+
+	oldbox, err := LoadSecretBox()
+	if err != nil {
+		log.Printf("Error loading current master key: %v", err)
+		return 1
+	}
+	mdb.SetSecretBox(oldbox)
+
+	var newkey []byte
+	if newkeyfile != "" {
+		newkey, err = music.LoadMasterKey(newkeyfile)
+	} else {
+		newkey, err = music.LoadMasterKey(viper.GetString("db.masterkey"))
+	}
+	if err == nil && newkey == nil {
+		err = fmt.Errorf("no master key configured (db.masterkey or $%s)", music.MasterKeyEnv)
+	}
+	if err != nil {
+		log.Printf("Error loading new master key: %v", err)
+		return 1
+	}
+	newbox, err := music.NewSecretBox(newkey)
+	if err != nil {
+		log.Printf("Error from NewSecretBox: %v", err)
+		return 1
+	}
+
+	count, err := mdb.RotateSecrets(newbox)
+	if err != nil {
+		log.Printf("Error from RotateSecrets: %v. No secrets were changed.", err)
+		return 1
+	}
+	fmt.Printf("%d signer secrets encrypted with master key %s.\n", count, newbox.KeyID())
+
+	// the deSEC token in the token file is encrypted with the same key
+	if stored := tokvip.GetString("desec.token"); stored != "" {
+		token, err := oldbox.Open(stored, music.DesecTokenOwner)
+		if err == nil {
+			token, err = newbox.Seal(token, music.DesecTokenOwner)
+		}
+		if err == nil {
+			tokvip.Set("desec.token", token)
+			err = tokvip.WriteConfig()
+		}
+		if err != nil {
+			log.Printf("Error re-encrypting deSEC token in %s: %v. Do a new signer login.",
+				tokvip.ConfigFileUsed(), err)
+			return 1
+		}
+		fmt.Printf("deSEC token in %s encrypted with master key %s.\n", tokvip.ConfigFileUsed(), newbox.KeyID())
+	}
+	if newkeyfile != "" {
+		fmt.Printf("Now change db.masterkey to %s and restart musicd.\n", newkeyfile)
+	}
+	return 0
+}
+
 func main() {
 	var conf Config
 	var err error
 
+	var verbose, migrateonly, migratedryrun, rotatesecrets bool
+	var newmasterkey string
+	flag.BoolVar(&verbose, "v", false, "verbose output (same as common.verbose)")
+	flag.BoolVar(&migrateonly, "migrate-only", false, "migrate the DB schema to the latest version and exit")
+	flag.BoolVar(&migratedryrun, "migrate-dry-run", false, "print pending DB schema migrations and exit")
+	flag.BoolVar(&rotatesecrets, "rotate-secrets", false, "re-encrypt all signer secrets and exit")
+	flag.StringVar(&newmasterkey, "new-master-key", "", "with --rotate-secrets: file with the new master key")
 	flag.Usage = func() {
 		flag.PrintDefaults()
 	}
+	flag.Parse()
 
 	LoadConfig(&conf, false) // on initial startup a config error should cause an abort.
+	if verbose {
+		cliconf.Verbose = true
+	}
 
 	// initialise empty conf.Internal struct
 	conf.Internal = InternalConf{}
@@ -141,16 +272,41 @@ func main() {
 	apistopper := make(chan struct{})
 	conf.Internal.EngineCheck = make(chan music.EngineCheck, 100)
 
-	conf.Internal.MusicDB, err = music.NewDB(viper.GetString("db.file"), viper.GetString("db.mode"), false) // Don't drop status tables if they exist
+	if migrateonly || migratedryrun {
+		os.Exit(MigrateDB(migratedryrun))
+	}
+	if rotatesecrets {
+		os.Exit(RotateSecrets(newmasterkey))
+	}
+
+	conf.Internal.MusicDB, err = music.NewDB(DBSource(), viper.GetString("db.mode"), false) // Don't drop status tables if they exist
+	if err != nil {
+		log.Fatalf("Error from NewDB(%s): %v", viper.GetString("db.mode"), err)
+	}
+
+	secretbox, err := LoadSecretBox()
 	if err != nil {
-		log.Fatalf("Error from NewDB(%s): %v", viper.GetString("db.file"), err)
+		log.Fatalf("Error loading master key: %v", err)
+	}
+	conf.Internal.MusicDB.SetSecretBox(secretbox)
+	if secretbox != nil {
+		log.Printf("Signer secrets are encrypted with master key %s", secretbox.KeyID())
+		plain, err := conf.Internal.MusicDB.PlaintextSecrets()
+		if err != nil {
+			log.Printf("Error from PlaintextSecrets: %v", err)
+		}
+		if len(plain) > 0 {
+			log.Printf("Warning: signers %v have unencrypted secrets. Run \"musicd --rotate-secrets\" to encrypt them.", plain)
+		}
+	} else {
+		log.Printf("Warning: no master key configured (db.masterkey), signer secrets are stored unencrypted.")
 	}
 
 	conf.Internal.TokViper = tokvip
 	conf.Internal.MusicDB.Tokvip = tokvip
 	fsml := fsm.NewFSMlist()
 	conf.Internal.Processes = fsml
-	conf.Internal.MusicDB.FSMlist = fsml
+	conf.Internal.MusicDB.SetFSMlist(fsml)
 
 	conf.Internal.DdnsFetch = make(chan music.SignerOp, 100)
 	conf.Internal.DdnsUpdate = make(chan music.SignerOp, 100)
@@ -166,26 +322,39 @@ func main() {
 			log.Fatalf("Error from DesecSetupClient: %v\n", err)
 		}
 		desecapi.TokViper = tokvip
+		desecapi.Secrets = secretbox
 
-		rldu := music.Updaters["rldesec-api"]
+		rldu := music.GetUpdater("rldesec-api")
 		rldu.SetChannels(conf.Internal.DesecFetch, conf.Internal.DesecUpdate)
-		rldu.SetApi(*desecapi)
-		du := music.Updaters["desec-api"]
-		du.SetApi(*desecapi) // it is ok to reuse the same object here
+		rldu.SetApi(desecapi)
+		du := music.GetUpdater("desec-api")
+		du.SetApi(desecapi) // it is ok to reuse the same object here
 	}
 
-	rlddu := music.Updaters["rlddns"]
+	rlddu := music.GetUpdater("rlddns")
 	rlddu.SetChannels(conf.Internal.DdnsFetch, conf.Internal.DdnsUpdate)
 
+	conf.Internal.MusicDB.EventC = make(chan music.MusicEvent, 100)
+	conf.Internal.EventBroker = NewEventBroker()
+	conf.Internal.Health = NewHealthRegistry()
+
 	var done = make(chan struct{}, 1)
 
+	SetupMetrics(&conf)
+	SetupParentUpdaters(&conf)
+
 	go dbUpdater(&conf)
+	go EventManager(&conf, done)
+	go WebhookManager(&conf, done)
+	go MetricsEventCounter(&conf, done)
+	go MetricsDispatcher(&conf)
 	go APIdispatcher(&conf)
 	if viper.GetBool("signers.desec.enabled") {
 		go deSECmgr(&conf, done)
 	}
 	go ddnsmgr(&conf, done)
 	go FSMEngine(&conf, done)
+	go ParentAgent(&conf, done)
 
 	mainloop(&conf, apistopper)
 }
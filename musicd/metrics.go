@@ -0,0 +1,193 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+)
+
+var (
+	metricEngineRunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "music_fsmengine_run_duration_seconds",
+		Help:    "Time spent by the FSM engine in one run through the zones.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"kind"}) // kind: "auto" | "all" | "check"
+
+	metricEngineInterval = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "music_fsmengine_interval_seconds",
+		Help: "Current interval between FSM engine runs.",
+	})
+
+	metricEngineZonesPushed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "music_fsmengine_zones_pushed",
+		Help: "Number of zones the FSM engine tried to move forward in the last run.",
+	})
+
+	metricSignerOpQueue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "music_signerop_queue_length",
+		Help: "Number of signer operations waiting in the rate-limiting managers.",
+	}, []string{"manager", "op"}) // manager: "ddnsmgr" | "desecmgr", op: "fetch" | "update"
+
+	metricSignerOpLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "music_signerop_duration_seconds",
+		Help:    "Time to execute a signer operation in the rate-limiting managers.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"manager", "op"})
+
+	metricRateLimitHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "music_ratelimit_hits_total",
+		Help: "Number of times an operation was held back by rate-limiting.",
+	}, []string{"manager", "op", "source"}) // source: "local" (our limit) | "remote" (signer said so)
+
+	metricUpdaterErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "music_updater_errors_total",
+		Help: "Number of failed signer operations.",
+	}, []string{"signer", "updater"})
+
+	metricDBUpdateQueue = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "music_dbupdater_queue_length",
+		Help: "Number of pending updates in the dbUpdater queue.",
+	})
+
+	metricEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "music_events_total",
+		Help: "Number of events published, by type.",
+	}, []string{"type"})
+)
+
+// zoneCollector computes the zone gauges from the DB at scrape time, so that
+// they are always correct, regardless of who changed what.
+type zoneCollector struct {
+	mdb     *music.MusicDB
+	zones   *prometheus.Desc
+	blocked *prometheus.Desc
+	delayed *prometheus.Desc
+}
+
+func newZoneCollector(mdb *music.MusicDB) *zoneCollector {
+	return &zoneCollector{
+		mdb: mdb,
+		zones: prometheus.NewDesc("music_zones",
+			"Number of zones per process and state.", []string{"process", "state"}, nil),
+		blocked: prometheus.NewDesc("music_zones_blocked",
+			"Number of zones that are blocked (have a stop-reason).", nil, nil),
+		delayed: prometheus.NewDesc("music_zones_delayed",
+			"Number of zones that are delayed.", nil, nil),
+	}
+}
+
+func (zc *zoneCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- zc.zones
+	ch <- zc.blocked
+	ch <- zc.delayed
+}
+
+func (zc *zoneCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := zc.mdb.CountZones()
+	if err != nil {
+		log.Printf("Metrics: Error from CountZones: %v", err)
+		return
+	}
+
+	type pskey struct{ process, state string }
+	zones := map[pskey]int{}
+	var blocked, delayed int
+	for _, c := range counts {
+		process := c.Process
+		if process == "" || process == "---" {
+			process = "none"
+		}
+		zones[pskey{process, c.State}] += c.Count
+		switch c.FSMStatus {
+		case "blocked":
+			blocked += c.Count
+		case "delayed":
+			delayed += c.Count
+		}
+	}
+
+	for k, n := range zones {
+		ch <- prometheus.MustNewConstMetric(zc.zones, prometheus.GaugeValue,
+			float64(n), k.process, k.state)
+	}
+	ch <- prometheus.MustNewConstMetric(zc.blocked, prometheus.GaugeValue, float64(blocked))
+	ch <- prometheus.MustNewConstMetric(zc.delayed, prometheus.GaugeValue, float64(delayed))
+}
+
+func SetupMetrics(conf *Config) {
+	prometheus.MustRegister(
+		metricEngineRunDuration,
+		metricEngineInterval,
+		metricEngineZonesPushed,
+		metricSignerOpQueue,
+		metricSignerOpLatency,
+		metricRateLimitHits,
+		metricUpdaterErrors,
+		metricDBUpdateQueue,
+		metricEvents,
+		newZoneCollector(conf.Internal.MusicDB),
+	)
+	// counted where the failure happens, not from the (lossy) event stream
+	music.SetOpFailureCounter(func(signer, updater string) {
+		metricUpdaterErrors.WithLabelValues(signer, updater).Inc()
+	})
+}
+
+// MetricsEventCounter counts the events from the event broker. Failed signer
+// operations are counted where they fail instead (see SetupMetrics), as
+// events may be dropped.
+func MetricsEventCounter(conf *Config, done <-chan struct{}) {
+	eb := conf.Internal.EventBroker
+	sub := &EventSubscriber{Remote: "metrics"}
+	eb.Subscribe(sub, 0)
+	defer eb.Unsubscribe(sub)
+
+	var last uint64
+	count := func(ev music.MusicEvent) {
+		last = ev.Seq
+		metricEvents.WithLabelValues(ev.Type).Inc()
+	}
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				// dropped by the broker, catch up from its backlog
+				for _, ev := range eb.Subscribe(sub, last) {
+					count(ev)
+				}
+				continue
+			}
+			count(ev)
+		case <-done:
+			return
+		}
+	}
+}
+
+// MetricsDispatcher serves /metrics (and /healthz and /readyz) on a separate
+// plain HTTP listener if metrics.address is configured. The metrics are also
+// available via the API server (as /api/v1/metrics), subject to normal API
+// authentication.
+func MetricsDispatcher(conf *Config) {
+	address := viper.GetString("metrics.address")
+	if address == "" {
+		log.Printf("MetricsDispatcher: metrics.address not set, /metrics only available via the API server.")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", APIhealthz(conf))
+	mux.HandleFunc("/readyz", APIreadyz(conf))
+	log.Printf("Starting metrics dispatcher. Listening on %s", address)
+	log.Fatal(http.ListenAndServe(address, mux))
+}
@@ -0,0 +1,335 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+)
+
+// For parent zones that we operate ourselves musicd can act as the parent
+// agent, instead of a separate scanner. For every zone in a process whose
+// parent is one of the configured parents, the parent agent fetches CDS and
+// CSYNC from all signers of the zone and, if they agree, updates the DS and
+// NS RRsets in the parent via the parent's signer. The parent's signer is an
+// ordinary MUSIC signer (f.e. the primary for the parent zone) and is updated
+// via the Updater interface, just like any other signer.
+//
+// When an update lands the FSM engine is asked to check the zone right away,
+// so that a zone waiting for the parent moves on without waiting for the
+// next FSM engine run.
+
+type ParentAgentConf struct {
+	Active   bool
+	Interval int                `validate:"omitempty,gte=10,lte=3600"` // seconds between scans (default 30)
+	Parents  []ParentAgentEntry `validate:"dive"`
+}
+
+type ParentAgentEntry struct {
+	Zone   string `validate:"required"` // parent zone
+	Signer string `validate:"required"` // MUSIC signer that serves the parent zone and accepts updates
+}
+
+func ParentAgent(conf *Config, stopch chan struct{}) {
+	mdb := conf.Internal.MusicDB
+	health := conf.Internal.Health
+
+	if !viper.GetBool("parentagent.active") {
+		log.Printf("ParentAgent: not active.")
+		health.Inactive("parentagent")
+		return
+	}
+
+	var parents []ParentAgentEntry
+	if err := viper.UnmarshalKey("parentagent.parents", &parents); err != nil {
+		log.Printf("ParentAgent: Error from viper.UnmarshalKey(parentagent.parents): %v", err)
+		health.Inactive("parentagent")
+		return
+	}
+	for i := range parents {
+		parents[i].Zone = dns.Fqdn(strings.ToLower(parents[i].Zone))
+	}
+
+	interval := viper.GetInt("parentagent.interval")
+	if interval < 10 || interval > 3600 {
+		interval = 30
+	}
+	log.Printf("ParentAgent: managing %d parent zones, scanning every %d seconds", len(parents), interval)
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		health.Beat("parentagent", time.Duration(2*interval)*time.Second)
+		err := ParentAgentRun(mdb, parents, conf.Internal.EngineCheck)
+		health.Result("parentagent", err)
+
+		select {
+		case <-ticker.C:
+		case <-stopch:
+			log.Printf("ParentAgent: stop signal received. Terminating.")
+			return
+		}
+	}
+}
+
+// ParentAgentRun scans all zones in a process whose parent is managed and
+// updates the parent where needed.
+func ParentAgentRun(mdb *music.MusicDB, parents []ParentAgentEntry, enginecheck chan music.EngineCheck) error {
+	zones, err := mdb.ListZones()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for name, lz := range zones {
+		parent := managedParent(parents, name)
+		if lz.FSM == "" || parent == nil {
+			// only zones in a process publish CDS and CSYNC. Once the zone
+			// is no longer handled here the processes go back to discovery.
+			if mdb.ClearParentAddress(name) {
+				log.Printf("ParentAgent: zone %s: no longer handled, parent address cleared", name)
+			}
+			continue
+		}
+
+		updated, err := ParentAgentZone(mdb, name, parent)
+		if err != nil {
+			log.Printf("ParentAgent: zone %s: %v", name, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		if updated && enginecheck != nil {
+			enginecheck <- music.EngineCheck{ZoneName: name}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// managedParent returns the closest managed parent of the zone, or nil.
+func managedParent(parents []ParentAgentEntry, zone string) *ParentAgentEntry {
+	var parent *ParentAgentEntry
+	zone = strings.ToLower(zone)
+	for i, p := range parents {
+		if zone == p.Zone || !dns.IsSubDomain(p.Zone, zone) {
+			continue
+		}
+		if parent == nil || dns.CountLabel(p.Zone) > dns.CountLabel(parent.Zone) {
+			parent = &parents[i]
+		}
+	}
+	return parent
+}
+
+// ParentAgentZone syncs the DS and NS RRsets in the parent with the CDS and
+// CSYNC published by the signers of the zone. It returns true if the parent
+// was updated.
+func ParentAgentZone(mdb *music.MusicDB, name string, parent *ParentAgentEntry) (bool, error) {
+	z, exist, err := mdb.GetZone(nil, name)
+	if err != nil {
+		return false, err
+	}
+	if !exist || z.SGroup == nil || len(z.SGroup.SignerMap) == 0 {
+		return false, nil
+	}
+
+	psigner, err := mdb.GetSignerByName(nil, parent.Signer, false) // not apisafe
+	if err != nil {
+		return false, fmt.Errorf("parent signer: %v", err)
+	}
+
+	// the FSM should check the parent signer itself, which may be a hidden
+	// primary, rather than the discovered parent servers. This is not stored
+	// as "parentaddr" metadata, which would outlive the parent agent config.
+	addr := net.JoinHostPort(psigner.Address, psigner.Port)
+	if old, _ := mdb.ParentAddress(z.Name); old != addr {
+		mdb.SetParentAddress(z.Name, parent.Zone, addr)
+		log.Printf("ParentAgent: zone %s: parent address set to %s (parent signer %s)", name, addr, psigner.Name)
+	}
+
+	dsupdated, err := parentAgentSyncDS(z, parent.Zone, psigner)
+	if err != nil {
+		return false, err
+	}
+	nsupdated, err := parentAgentSyncNS(z, parent.Zone, psigner)
+	if err != nil {
+		return dsupdated, err
+	}
+	return dsupdated || nsupdated, nil
+}
+
+// signersRRset fetches the RRset from all signers of the zone. All signers
+// must have the same RRset.
+func signersRRset(z *music.Zone, rrtype uint16) ([]dns.RR, error) {
+	var rrset []dns.RR
+	var first, firstsigner string
+	for _, signer := range z.SGroup.SignerMap {
+		updater := music.GetUpdater(signer.Method)
+		err, rrs := updater.FetchRRset(signer, z.Name, z.Name, rrtype)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching %s from signer %s: %v",
+				dns.TypeToString[rrtype], signer.Name, err)
+		}
+		key := rrsetKey(rrs)
+		if firstsigner == "" {
+			first, firstsigner, rrset = key, signer.Name, rrs
+		} else if key != first {
+			return nil, fmt.Errorf("signers %s and %s have different %s RRsets",
+				firstsigner, signer.Name, dns.TypeToString[rrtype])
+		}
+	}
+	return rrset, nil
+}
+
+// rrdata returns the RR without owner, TTL and class, for comparisons.
+func rrdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+func rrsetKey(rrs []dns.RR) string {
+	var keys []string
+	for _, rr := range rrs {
+		keys = append(keys, strings.ToLower(rrdata(rr)))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "|")
+}
+
+// parentAgentSyncDS makes the DS RRset in the parent match the CDS (or
+// CDNSKEY) RRset of the zone, as interpreted by the CDS policy of the zone
+// (see music.CdsPolicy.PublishedDS), just as a parent updater would.
+func parentAgentSyncDS(z *music.Zone, pzone string, psigner *music.Signer) (bool, error) {
+	policy, err := z.CdsPolicy()
+	if err != nil {
+		return false, err
+	}
+	var published map[string]*dns.DS
+	var first, firstsigner string
+	for _, signer := range z.SGroup.SignerMap {
+		dses, err := policy.PublishedDS(z, signer)
+		if err != nil {
+			return false, err
+		}
+		key := "none" // nothing published is not the same as a delete
+		if dses != nil {
+			var rrs []dns.RR
+			for _, ds := range dses {
+				rrs = append(rrs, ds)
+			}
+			key = "ds:" + rrsetKey(rrs)
+		}
+		if firstsigner == "" {
+			first, firstsigner, published = key, signer.Name, dses
+		} else if key != first {
+			return false, fmt.Errorf("signers %s and %s publish different CDS/CDNSKEY RRsets",
+				firstsigner, signer.Name)
+		}
+	}
+	if published == nil {
+		return false, nil // nothing published, nothing to do
+	}
+
+	// an empty map is an RFC 8078 delete record: the zone goes insecure
+	want := map[string]dns.RR{}
+	for _, ds := range published {
+		want[strings.ToLower(rrdata(ds))] = ds
+	}
+
+	pupdater := music.GetUpdater(psigner.Method)
+	err, dses := pupdater.FetchRRset(psigner, pzone, z.Name, dns.TypeDS)
+	if err != nil {
+		return false, fmt.Errorf("Error fetching DS from parent signer %s: %v", psigner.Name, err)
+	}
+	return parentAgentUpdate(z, pzone, psigner, "DS", want, dses)
+}
+
+// parentAgentSyncNS makes the NS RRset in the parent match the NS RRset of
+// the zone, if the signers publish a CSYNC record that lists NS.
+func parentAgentSyncNS(z *music.Zone, pzone string, psigner *music.Signer) (bool, error) {
+	csyncs, err := signersRRset(z, dns.TypeCSYNC)
+	if err != nil || len(csyncs) == 0 {
+		return false, err
+	}
+	csync, ok := csyncs[0].(*dns.CSYNC)
+	if !ok {
+		return false, nil
+	}
+	listsns := false
+	for _, t := range csync.TypeBitMap {
+		if t == dns.TypeNS {
+			listsns = true
+		}
+	}
+	if !listsns {
+		return false, nil
+	}
+
+	nses, err := signersRRset(z, dns.TypeNS)
+	if err != nil || len(nses) == 0 {
+		return false, err
+	}
+	want := map[string]dns.RR{}
+	for _, rr := range nses {
+		want[strings.ToLower(rrdata(rr))] = rr
+	}
+
+	pupdater := music.GetUpdater(psigner.Method)
+	err, pnses := pupdater.FetchRRset(psigner, pzone, z.Name, dns.TypeNS)
+	if err != nil {
+		return false, fmt.Errorf("Error fetching NS from parent signer %s: %v", psigner.Name, err)
+	}
+	return parentAgentUpdate(z, pzone, psigner, "NS", want, pnses)
+}
+
+// parentAgentUpdate adds the wanted RRs that the parent does not have and
+// removes the ones that are not wanted.
+func parentAgentUpdate(z *music.Zone, pzone string, psigner *music.Signer, rrtype string,
+	want map[string]dns.RR, have []dns.RR) (bool, error) {
+	var adds, removes []dns.RR
+	haveset := map[string]bool{}
+	for _, rr := range have {
+		key := strings.ToLower(rrdata(rr))
+		haveset[key] = true
+		if _, exist := want[key]; !exist {
+			removes = append(removes, rr)
+		}
+	}
+	for key, rr := range want {
+		if !haveset[key] {
+			rr.Header().Name = z.Name
+			adds = append(adds, rr)
+		}
+	}
+	if len(adds) == 0 && len(removes) == 0 {
+		return false, nil
+	}
+
+	log.Printf("ParentAgent: zone %s: updating %s in %s via %s: adds: %v removes: %v",
+		z.Name, rrtype, pzone, psigner.Name, adds, removes)
+	pupdater := music.GetUpdater(psigner.Method)
+	if err := pupdater.Update(psigner, pzone, z.Name, &[][]dns.RR{adds}, &[][]dns.RR{removes}); err != nil {
+		return false, fmt.Errorf("Error updating %s in %s via %s: %v", rrtype, pzone, psigner.Name, err)
+	}
+	z.MusicDB.FlushParent(z.Name)
+	z.MusicDB.PublishEvent(music.MusicEvent{
+		Type:   music.EventParentUpdate,
+		Zone:   z.Name,
+		Signer: psigner.Name,
+		Reason: fmt.Sprintf("%s in %s: %d added, %d removed", rrtype, pzone, len(adds), len(removes)),
+	})
+	return true, nil
+}
@@ -0,0 +1,93 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+)
+
+// Parent updaters push DS and NS changes to parents that do not scan for
+// CDS and CSYNC. Each configured parent updater gets a name, and a zone uses
+// it by setting the "parentupdater" metadata to that name. Two types exist:
+//
+//	epp:    EPP (domain:update with secDNS and host objects) to a registry
+//	        or registrar
+//	signer: DNS UPDATE of a parent zone that we operate, via a MUSIC signer
+
+type ParentUpdaterConf struct {
+	Name         string `validate:"required"`
+	Type         string `validate:"required,oneof=epp signer"`
+	Address      string `validate:"omitempty,hostname_port"` // epp: host:port of the EPP server
+	Username     string // epp: client id
+	Password     string // not allowed, only here to reject passwords in the config file
+	PasswordFile string `validate:"omitempty,file"` // epp: file with the password
+	TLS          bool   // epp: connect with TLS (default true)
+	Insecure     bool   // epp: do not verify the server certificate
+	Signer       string // signer: the MUSIC signer that serves the parent zone
+	Zone         string // signer: the parent zone
+}
+
+// SetupParentUpdaters registers the configured parent updaters with music.
+func SetupParentUpdaters(conf *Config) {
+	var pucs []ParentUpdaterConf
+	if err := viper.UnmarshalKey("parentupdaters", &pucs); err != nil {
+		log.Printf("SetupParentUpdaters: Error from viper.UnmarshalKey(parentupdaters): %v", err)
+		return
+	}
+	for i, puc := range pucs {
+		if !viper.IsSet(fmt.Sprintf("parentupdaters.%d.tls", i)) {
+			puc.TLS = true
+		}
+		pu, err := NewParentUpdater(conf.Internal.MusicDB, puc)
+		if err != nil {
+			log.Printf("SetupParentUpdaters: %v. Parent updater ignored.", err)
+			continue
+		}
+		music.RegisterParentUpdater(puc.Name, pu)
+		log.Printf("SetupParentUpdaters: parent updater %s (%s) registered", puc.Name, puc.Type)
+	}
+}
+
+func NewParentUpdater(mdb *music.MusicDB, puc ParentUpdaterConf) (music.ParentUpdater, error) {
+	switch puc.Type {
+	case "epp":
+		if puc.Password != "" {
+			return nil, fmt.Errorf("parent updater %s: password must not be in the config, use passwordfile", puc.Name)
+		}
+		if puc.Address == "" || puc.Username == "" || puc.PasswordFile == "" {
+			return nil, fmt.Errorf("parent updater %s: address, username and passwordfile are required", puc.Name)
+		}
+		buf, err := ioutil.ReadFile(puc.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("parent updater %s: error reading password file %s: %v",
+				puc.Name, puc.PasswordFile, err)
+		}
+		return &music.EPPParentUpdater{Conf: music.EPPConf{
+			Address:  puc.Address,
+			Username: puc.Username,
+			Password: string(bytes.TrimSpace(buf)),
+			TLS:      puc.TLS,
+			Insecure: puc.Insecure,
+		}}, nil
+
+	case "signer":
+		if puc.Signer == "" || puc.Zone == "" {
+			return nil, fmt.Errorf("parent updater %s: signer and zone are required", puc.Name)
+		}
+		// the signer is looked up on every use, like the parent agent does,
+		// so it need not exist yet
+		return &music.SignerParentUpdater{MusicDB: mdb, Signer: puc.Signer,
+			ParentZone: dns.Fqdn(puc.Zone)}, nil
+	}
+	return nil, fmt.Errorf("parent updater %s: unknown type '%s'", puc.Name, puc.Type)
+}
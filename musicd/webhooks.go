@@ -0,0 +1,268 @@
+/*
+ * Johan Stenstam, johan.stenstam@internetstiftelsen.se
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/DNSSEC-Provisioning/music/music"
+)
+
+// Event types that make sense for webhooks if the config doesn't say otherwise.
+var DefaultWebhookEvents = []string{
+	music.EventStopReason,
+	music.EventZoneUnblocked,
+	music.EventProcessComplete,
+	music.EventSignerOpFailure,
+}
+
+type WebhookConf struct {
+	Name       string   `validate:"required"`
+	Url        string   `validate:"required,url"`
+	Events     []string // event types to send (default: DefaultWebhookEvents)
+	Secret     string   // not allowed, only here to reject secrets in the config file
+	SecretFile string   `validate:"omitempty,file"` // HMAC-SHA256 key used to sign the payload
+	Retries    int      // max number of retries (default 5)
+	Timeout    int      // seconds per attempt (default 10)
+}
+
+// WebhookPayload is what is POSTed to the webhook URL (as JSON). The body is
+// signed with HMAC-SHA256 and the signature is sent in the header
+// "X-Music-Signature: sha256=<hex>".
+type WebhookPayload struct {
+	Webhook     string
+	Event       string
+	Seq         uint64
+	Time        time.Time
+	Zone        string `json:",omitempty"`
+	SignerGroup string `json:",omitempty"`
+	Signer      string `json:",omitempty"`
+	Process     string `json:",omitempty"`
+	State       string `json:",omitempty"`
+	Reason      string `json:",omitempty"`
+}
+
+func NewWebhookPayload(name string, ev music.MusicEvent) WebhookPayload {
+	state := ev.To
+	if state == "" {
+		state = ev.From
+	}
+	return WebhookPayload{
+		Webhook:     name,
+		Event:       ev.Type,
+		Seq:         ev.Seq,
+		Time:        ev.Time,
+		Zone:        ev.Zone,
+		SignerGroup: ev.SignerGroup,
+		Signer:      ev.Signer,
+		Process:     ev.Process,
+		State:       state,
+		Reason:      ev.Reason,
+	}
+}
+
+func WebhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// A signer that is down will cause lots of failed ops. Only tell the webhook
+// about it once per SignerAlertHoldoff.
+const SignerAlertHoldoff = 10 * time.Minute
+
+type Webhook struct {
+	Conf        WebhookConf
+	secret      []byte
+	client      *http.Client
+	queue       chan music.MusicEvent
+	signeralert map[string]time.Time // signer --> time of last signer-op-failure sent
+}
+
+func NewWebhook(wc WebhookConf) (*Webhook, error) {
+	if wc.Secret != "" {
+		return nil, fmt.Errorf("webhook %s: secret must not be in the config, use secretfile", wc.Name)
+	}
+	if len(wc.Events) == 0 {
+		wc.Events = DefaultWebhookEvents
+	}
+	if wc.Retries == 0 {
+		wc.Retries = 5
+	}
+	if wc.Timeout == 0 {
+		wc.Timeout = 10
+	}
+
+	wh := Webhook{
+		Conf:   wc,
+		client: &http.Client{Timeout: time.Duration(wc.Timeout) * time.Second},
+		queue:  make(chan music.MusicEvent, 1000),
+
+		signeralert: map[string]time.Time{},
+	}
+
+	if wc.SecretFile != "" {
+		buf, err := ioutil.ReadFile(wc.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: error reading secret file %s: %v",
+				wc.Name, wc.SecretFile, err)
+		}
+		wh.secret = bytes.TrimSpace(buf)
+	}
+	return &wh, nil
+}
+
+// Deliver POSTs the event to the webhook URL. Failures (including non-2xx
+// responses) are retried with exponential backoff, starting at one second.
+func (wh *Webhook) Deliver(ev music.MusicEvent) error {
+	body, err := json.Marshal(NewWebhookPayload(wh.Conf.Name, ev))
+	if err != nil {
+		return err
+	}
+
+	backoff := 1 * time.Second
+	for attempt := 0; ; attempt++ {
+		err = wh.post(body)
+		if err == nil {
+			return nil
+		}
+		if attempt >= wh.Conf.Retries {
+			return fmt.Errorf("giving up after %d attempts: %v", attempt+1, err)
+		}
+		log.Printf("Webhook %s: delivery of event %d (%s) failed: %v. Retrying in %v.",
+			wh.Conf.Name, ev.Seq, ev.Type, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > 5*time.Minute {
+			backoff = 5 * time.Minute
+		}
+	}
+}
+
+func (wh *Webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.Conf.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "musicd")
+	if len(wh.secret) > 0 {
+		req.Header.Set("X-Music-Signature", WebhookSignature(wh.secret, body))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// WebhookManager subscribes each configured webhook to the event broker and
+// delivers the events, one webhook at a time in order, so that a slow or dead
+// receiver does not hold up the others.
+func WebhookManager(conf *Config, done <-chan struct{}) {
+	var webhooks []WebhookConf
+	err := viper.UnmarshalKey("webhooks", &webhooks)
+	if err != nil {
+		log.Printf("WebhookManager: Error from viper.UnmarshalKey(webhooks): %v", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		log.Printf("WebhookManager: no webhooks configured.")
+		return
+	}
+
+	eb := conf.Internal.EventBroker
+
+	for _, wc := range webhooks {
+		wh, err := NewWebhook(wc)
+		if err != nil {
+			log.Printf("WebhookManager: %v. Webhook ignored.", err)
+			continue
+		}
+
+		sub := &EventSubscriber{
+			Types:  map[string]bool{},
+			Remote: "webhook " + wh.Conf.Name,
+		}
+		for _, t := range wh.Conf.Events {
+			sub.Types[strings.TrimSpace(t)] = true
+		}
+		eb.Subscribe(sub, 0)
+
+		log.Printf("WebhookManager: webhook %s will receive %v events at %s",
+			wh.Conf.Name, wh.Conf.Events, wh.Conf.Url)
+
+		// Move events from the broker to the webhook queue quickly, the broker
+		// drops subscribers that don't keep up.
+		go func(wh *Webhook, sub *EventSubscriber) {
+			var last uint64
+			queue := func(ev music.MusicEvent) {
+				last = ev.Seq
+				select {
+				case wh.queue <- ev:
+				default:
+					log.Printf("Webhook %s: queue full. Dropped event %d (%s).",
+						wh.Conf.Name, ev.Seq, ev.Type)
+				}
+			}
+			for {
+				select {
+				case ev, ok := <-sub.C:
+					if !ok {
+						// dropped by the broker, catch up from its backlog
+						for _, ev := range eb.Subscribe(sub, last) {
+							queue(ev)
+						}
+						continue
+					}
+					queue(ev)
+				case <-done:
+					eb.Unsubscribe(sub)
+					return
+				}
+			}
+		}(wh, sub)
+
+		go func(wh *Webhook) {
+			for {
+				select {
+				case ev := <-wh.queue:
+					if ev.Type == music.EventSignerOpFailure {
+						if time.Since(wh.signeralert[ev.Signer]) < SignerAlertHoldoff {
+							continue
+						}
+						wh.signeralert[ev.Signer] = time.Now()
+					}
+					err := wh.Deliver(ev)
+					if err != nil {
+						log.Printf("Webhook %s: event %d (%s) for zone '%s' not delivered: %v",
+							wh.Conf.Name, ev.Seq, ev.Type, ev.Zone, err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}(wh)
+	}
+}
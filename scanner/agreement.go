@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The parent must only act on CDS, CDNSKEY and CSYNC that the child's
+// nameservers agree on, otherwise one stale or rogue nameserver could add a
+// DS. With the "all" policy every delegation NS must serve identical RRsets,
+// with "quorum" a strict majority of them is enough. In a multi-signer setup
+// the nameservers legitimately disagree for a while (e.g. during add-signer),
+// so disagreement is not an error but a condition on the zone that is kept
+// until the nameservers agree again.
+
+const (
+	AgreementAll    = "all"
+	AgreementQuorum = "quorum"
+)
+
+type ZoneCondition struct {
+	Zone     string
+	Reason   string
+	Since    time.Time
+	LastSeen time.Time
+}
+
+// zoneConditions holds the unresolved conditions, indexed by zone name.
+var zoneConditions = map[string]*ZoneCondition{}
+
+// SetZoneCondition records that the zone could not be updated because of reason.
+func SetZoneCondition(zone, reason string) {
+	now := time.Now()
+	if zc, exist := zoneConditions[zone]; exist && zc.Reason == reason {
+		zc.LastSeen = now
+		log.Printf("Zone %s: condition unresolved since %s: %s", zone,
+			zc.Since.Format(time.RFC3339), reason)
+		return
+	}
+	zoneConditions[zone] = &ZoneCondition{
+		Zone:     zone,
+		Reason:   reason,
+		Since:    now,
+		LastSeen: now,
+	}
+	log.Printf("Zone %s: new condition: %s", zone, reason)
+}
+
+// ClearZoneCondition removes the condition for the zone, if any.
+func ClearZoneCondition(zone string) {
+	if zc, exist := zoneConditions[zone]; exist {
+		log.Printf("Zone %s: condition resolved after %v: %s", zone,
+			time.Since(zc.Since).Round(time.Second), zc.Reason)
+		delete(zoneConditions, zone)
+	}
+}
+
+// nsRRsets returns a canonical representation of the CDS, CDNSKEY and CSYNC
+// RRsets served by a nameserver, so that they can be compared between
+// nameservers regardless of TTL and order.
+func nsRRsets(zns *ZoneNS) string {
+	cdses := []string{}
+	for _, cds := range zns.CDS {
+		cdses = append(cdses, fmt.Sprintf("%d %d %d %s", cds.KeyTag, cds.Algorithm,
+			cds.DigestType, strings.ToUpper(cds.Digest)))
+	}
+	sort.Strings(cdses)
+
+	cdnskeys := []string{}
+	for _, cdnskey := range zns.CDNSKEY {
+		cdnskeys = append(cdnskeys, fmt.Sprintf("%d %d %d %s", cdnskey.Flags,
+			cdnskey.Protocol, cdnskey.Algorithm, cdnskey.PublicKey))
+	}
+	sort.Strings(cdnskeys)
+
+	csync := ""
+	if zns.CSYNC != nil {
+		csync = fmt.Sprintf("%d %d %v", zns.CSYNC.Serial, zns.CSYNC.Flags, csyncTypes(zns.CSYNC))
+	}
+
+	return fmt.Sprintf("CDS: [%s] CDNSKEY: [%s] CSYNC: [%s]", strings.Join(cdses, ", "),
+		strings.Join(cdnskeys, ", "), csync)
+}
+
+// ZoneAgreement compares the CDS, CDNSKEY and CSYNC RRsets of all delegation
+// nameservers of the zone. If the nameservers agree according to the policy
+// it returns the agreeing nameservers, indexed by name. Otherwise it returns
+// an error describing the disagreement.
+func ZoneAgreement(z ZoneNG, policy string) (map[string]*ZoneNS, error) {
+	if len(z.DelegationNS) == 0 {
+		return nil, fmt.Errorf("no delegation NSes")
+	}
+
+	groups := map[string]map[string]*ZoneNS{}
+	for nsname, zns := range z.DelegationNS {
+		key := nsRRsets(zns)
+		if groups[key] == nil {
+			groups[key] = map[string]*ZoneNS{}
+		}
+		groups[key][nsname] = zns
+	}
+
+	var agreeing map[string]*ZoneNS
+	for _, group := range groups {
+		if len(group) > len(agreeing) {
+			agreeing = group
+		}
+	}
+
+	if len(groups) == 1 {
+		return agreeing, nil
+	}
+
+	var views []string
+	for key, group := range groups {
+		var nses []string
+		for nsname := range group {
+			nses = append(nses, nsname)
+		}
+		sort.Strings(nses)
+		views = append(views, fmt.Sprintf("%s: %s", strings.Join(nses, ", "), key))
+	}
+	sort.Strings(views)
+	disagreement := strings.Join(views, "; ")
+
+	switch policy {
+	case AgreementQuorum:
+		if 2*len(agreeing) > len(z.DelegationNS) {
+			log.Printf("Zone %s: quorum of %d of %d NSes agree, ignoring the others: %s",
+				z.Name, len(agreeing), len(z.DelegationNS), disagreement)
+			return agreeing, nil
+		}
+		return nil, fmt.Errorf("no quorum among %d NSes: %s", len(z.DelegationNS), disagreement)
+	default:
+		return nil, fmt.Errorf("NSes disagree: %s", disagreement)
+	}
+}
+
+// agreedRRsets returns one of the agreeing nameservers; they all serve the
+// same CDS, CDNSKEY and CSYNC RRsets.
+func agreedRRsets(agreeing map[string]*ZoneNS) *ZoneNS {
+	var nses []string
+	for nsname := range agreeing {
+		nses = append(nses, nsname)
+	}
+	sort.Strings(nses)
+	return agreeing[nses[0]]
+}
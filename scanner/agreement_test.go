@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneAgreement(t *testing.T) {
+	const zone = "child.example."
+	ksk1 := newTestKey(t, zone, 257)
+	ksk2 := newTestKey(t, zone, 257)
+	cds1 := testCDS(t, ksk1.key, dns.SHA256)
+	cds2 := testCDS(t, ksk2.key, dns.SHA256)
+	// the same record with another TTL and upper case digest
+	cds1upper := testCDS(t, ksk1.key, dns.SHA256)
+	cds1upper.Hdr.Ttl = 60
+	cds1upper.Digest = strings.ToUpper(cds1upper.Digest)
+	csync := newTestRR(t, zone+" 0 IN CSYNC 2022061501 3 NS").(*dns.CSYNC)
+
+	same := &ZoneNS{CDS: []*dns.CDS{cds1, cds2}}
+	reordered := &ZoneNS{CDS: []*dns.CDS{cds2, cds1upper}}
+	other := &ZoneNS{CDS: []*dns.CDS{cds1}}
+	withcsync := &ZoneNS{CDS: []*dns.CDS{cds1, cds2}, CSYNC: csync}
+
+	nses := func(zns ...*ZoneNS) map[string]*ZoneNS {
+		m := map[string]*ZoneNS{}
+		for i, z := range zns {
+			c := *z
+			c.NSName = string(rune('a'+i)) + ".ns." + zone
+			m[c.NSName] = &c
+		}
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		nses     map[string]*ZoneNS
+		policy   string
+		agreeing int // 0: error
+	}{
+		{"no NSes", nses(), AgreementAll, 0},
+		{"all agree", nses(same, same, same), AgreementAll, 3},
+		{"order and TTL do not matter", nses(same, reordered), AgreementAll, 2},
+		{"one differs, all", nses(same, same, other), AgreementAll, 0},
+		{"one differs, quorum", nses(same, same, other), AgreementQuorum, 2},
+		{"CSYNC differs, all", nses(same, withcsync), AgreementAll, 0},
+		{"half, quorum", nses(same, same, other, other), AgreementQuorum, 0},
+		{"no majority, quorum", nses(same, other, withcsync), AgreementQuorum, 0},
+		{"unknown policy", nses(same, other, other), "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := ZoneNG{Name: zone, DelegationNS: tt.nses}
+			agreeing, err := ZoneAgreement(z, tt.policy)
+			if tt.agreeing == 0 {
+				if err == nil {
+					t.Errorf("got %d agreeing NSes wanted an error", len(agreeing))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if len(agreeing) != tt.agreeing {
+				t.Errorf("got %d agreeing NSes wanted %d", len(agreeing), tt.agreeing)
+			}
+			for nsname, zns := range agreeing {
+				if tt.nses[nsname] != zns {
+					t.Errorf("agreeing NS %s is not one of the delegation NSes", nsname)
+				}
+			}
+		})
+	}
+}
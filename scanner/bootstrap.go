@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// RFC 8078 section 4 defines special CDS and CDNSKEY records that ask the
+// parent to remove all DS records for the zone, i.e. to make it insecure:
+//
+//	CDS     0 0 0 00
+//	CDNSKEY 0 3 0 AA==
+//
+// RFC 8078 section 3 also lists the ways a parent may accept the first DS
+// for a zone that has none (bootstrap). The scanner supports:
+//
+//	none:          never bootstrap, DS must be added by other means (default)
+//	hold-time:     accept the CDS once all NSes have served the same,
+//	               self-consistent CDS RRset for scanner.bootstrap-hold-time
+//	authenticated: accept the CDS if each NS also publishes it, DNSSEC
+//	               signed, at the signaling name _dsboot.<zone>._signal.<ns>
+//	               (RFC 9615)
+
+const (
+	BootstrapNone          = "none"
+	BootstrapHoldTime      = "hold-time"
+	BootstrapAuthenticated = "authenticated"
+)
+
+// IsDeleteCDS returns true for the CDS record that asks for DS deletion.
+func IsDeleteCDS(cds *dns.CDS) bool {
+	return cds.KeyTag == 0 && cds.Algorithm == 0 && cds.DigestType == 0 &&
+		strings.Trim(cds.Digest, "0") == ""
+}
+
+// IsDeleteCDNSKEY returns true for the CDNSKEY record that asks for DS deletion.
+func IsDeleteCDNSKEY(cdnskey *dns.CDNSKEY) bool {
+	return cdnskey.Flags == 0 && cdnskey.Protocol == 3 && cdnskey.Algorithm == 0 &&
+		(cdnskey.PublicKey == "AA==" || cdnskey.PublicKey == "")
+}
+
+// DeleteSignal returns true if the nameserver asks for DS deletion. A delete
+// record must be the only record in its RRset and, if both CDS and CDNSKEY are
+// published, both must be delete records.
+func DeleteSignal(zns *ZoneNS) (bool, error) {
+	cdsdel, cdnskeydel := 0, 0
+	for _, cds := range zns.CDS {
+		if IsDeleteCDS(cds) {
+			cdsdel++
+		}
+	}
+	for _, cdnskey := range zns.CDNSKEY {
+		if IsDeleteCDNSKEY(cdnskey) {
+			cdnskeydel++
+		}
+	}
+	if cdsdel == 0 && cdnskeydel == 0 {
+		return false, nil
+	}
+	if (cdsdel > 0 && len(zns.CDS) != cdsdel) || (cdnskeydel > 0 && len(zns.CDNSKEY) != cdnskeydel) {
+		return false, fmt.Errorf("delete CDS/CDNSKEY at %s is not the only record in its RRset", zns.NSName)
+	}
+	if (len(zns.CDS) > 0 && cdsdel == 0) || (len(zns.CDNSKEY) > 0 && cdnskeydel == 0) {
+		return false, fmt.Errorf("CDS and CDNSKEY at %s differ: only one of them asks for DS deletion", zns.NSName)
+	}
+	return true, nil
+}
+
+// bootstrapDS returns the DS records that the CDS and CDNSKEY RRsets of a
+// zone without DS point to. They are the trust anchor when bootstrapping.
+func bootstrapDS(zns *ZoneNS) []*dns.DS {
+	var dses []*dns.DS
+	for _, cds := range zns.CDS {
+		ds := cds.DS
+		dses = append(dses, &ds)
+	}
+	for _, cdnskey := range zns.CDNSKEY {
+		if ds := cdnskey.DNSKEY.ToDS(dns.SHA256); ds != nil {
+			dses = append(dses, ds)
+		}
+	}
+	return dses
+}
+
+// ValidateBootstrapCDS validates the CDS/CDNSKEY of a zone without DS in the
+// parent. There is no trust anchor yet, so the DNSKEY RRset must be signed by
+// a key that the CDS/CDNSKEY itself points to (RFC 9615, section 4.1).
+func ValidateBootstrapCDS(zone string, zns *ZoneNS) error {
+	if len(zns.CDS) == 0 && len(zns.CDNSKEY) == 0 {
+		return nil
+	}
+	if del, _ := DeleteSignal(zns); del {
+		return nil // already insecure, nothing to do
+	}
+	if err := ValidateCDS(zone, bootstrapDS(zns), zns); err != nil {
+		return fmt.Errorf("bootstrap: %v", err)
+	}
+	zns.Keys = nil // not anchored in the parent, so not good enough for CSYNC
+	return nil
+}
+
+type bootstrapState struct {
+	rrsets string
+	since  time.Time
+}
+
+// bootstrapSeen holds, per zone, the agreed CDS/CDNSKEY RRsets of a zone
+// without DS and when they were first seen.
+var bootstrapSeen = map[string]*bootstrapState{}
+
+// ForgetBootstrap restarts the hold time for the zone.
+func ForgetBootstrap(zone string) {
+	delete(bootstrapSeen, zone)
+}
+
+// BootstrapAllowed checks whether the agreed CDS/CDNSKEY of a zone without DS
+// in the parent may be used to create the DS RRset, according to the policy
+// in scanner.bootstrap.
+func BootstrapAllowed(zone string, agreed *ZoneNS, agreeing map[string]*ZoneNS) error {
+	policy := viper.GetString("scanner.bootstrap")
+	switch policy {
+	case BootstrapHoldTime:
+		holdtime := viper.GetDuration("scanner.bootstrap-hold-time")
+		rrsets := nsRRsets(&ZoneNS{CDS: agreed.CDS, CDNSKEY: agreed.CDNSKEY})
+		bs, exist := bootstrapSeen[zone]
+		if !exist || bs.rrsets != rrsets {
+			bs = &bootstrapState{rrsets: rrsets, since: time.Now()}
+			bootstrapSeen[zone] = bs
+		}
+		if time.Since(bs.since) < holdtime {
+			return fmt.Errorf("bootstrap: waiting for CDS to be unchanged for %v (since %s)",
+				holdtime, bs.since.Format(time.RFC3339))
+		}
+		log.Printf("Zone %s: bootstrap: CDS unchanged for %v, accepted", zone, holdtime)
+		return nil
+
+	case BootstrapAuthenticated:
+		want := nsRRsets(&ZoneNS{CDS: agreed.CDS, CDNSKEY: agreed.CDNSKEY})
+		var nses []string
+		for nsname := range agreeing {
+			nses = append(nses, nsname)
+		}
+		sort.Strings(nses)
+		for _, nsname := range nses {
+			sig, err := getSignalingRRsets(zone, nsname)
+			if err != nil {
+				return fmt.Errorf("bootstrap: %v", err)
+			}
+			if got := nsRRsets(sig); got != want {
+				return fmt.Errorf("bootstrap: signaling name for %s has %s, zone has %s",
+					nsname, got, want)
+			}
+		}
+		log.Printf("Zone %s: bootstrap: CDS authenticated via signaling names of %d NSes",
+			zone, len(nses))
+		return nil
+
+	default:
+		return fmt.Errorf("no DS in parent and bootstrap policy is '%s'", policy)
+	}
+}
+
+// SignalingName returns the name where the operator of nameserver nsname
+// publishes the CDS/CDNSKEY of zone (RFC 9615).
+func SignalingName(zone, nsname string) string {
+	return "_dsboot." + dns.Fqdn(zone) + "_signal." + dns.Fqdn(nsname)
+}
+
+// getSignalingRRsets looks up the CDS and CDNSKEY RRsets at the signaling
+// name via the validating resolver in scanner.resolver. Only answers that the
+// resolver has validated (AD bit) are accepted.
+func getSignalingRRsets(zone, nsname string) (*ZoneNS, error) {
+	qname := SignalingName(zone, nsname)
+	resolver := viper.GetString("scanner.resolver")
+	sig := &ZoneNS{NSName: nsname}
+	for _, rrtype := range []uint16{dns.TypeCDS, dns.TypeCDNSKEY} {
+		m := new(dns.Msg)
+		m.SetQuestion(qname, rrtype)
+		m.SetEdns0(4096, true)
+		m.AuthenticatedData = true
+		c := new(dns.Client)
+		r, _, err := c.Exchange(m, resolver)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up %s %s via %s: %v", qname,
+				dns.TypeToString[rrtype], resolver, err)
+		}
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("%s %s via %s: rcode %s", qname,
+				dns.TypeToString[rrtype], resolver, dns.RcodeToString[r.Rcode])
+		}
+		if !r.AuthenticatedData {
+			return nil, fmt.Errorf("%s %s via %s is not DNSSEC validated", qname,
+				dns.TypeToString[rrtype], resolver)
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.CDS:
+				sig.CDS = append(sig.CDS, rr)
+			case *dns.CDNSKEY:
+				sig.CDNSKEY = append(sig.CDNSKEY, rr)
+			}
+		}
+	}
+	return sig, nil
+}
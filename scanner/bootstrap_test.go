@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDeleteSignal(t *testing.T) {
+	const zone = "child.example."
+	ksk := newTestKey(t, zone, 257)
+	delcds := newTestRR(t, zone+" 0 IN CDS 0 0 0 00").(*dns.CDS)
+	delcdnskey := newTestRR(t, zone+" 0 IN CDNSKEY 0 3 0 AA==").(*dns.CDNSKEY)
+	cds := testCDS(t, ksk.key, dns.SHA256)
+	cdnskey := testCDNSKEY(ksk.key)
+
+	tests := []struct {
+		name    string
+		cds     []*dns.CDS
+		cdnskey []*dns.CDNSKEY
+		del     bool
+		ok      bool
+	}{
+		{"nothing published", nil, nil, false, true},
+		{"CDS and CDNSKEY", []*dns.CDS{cds}, []*dns.CDNSKEY{cdnskey}, false, true},
+		{"delete CDS", []*dns.CDS{delcds}, nil, true, true},
+		{"delete CDNSKEY", nil, []*dns.CDNSKEY{delcdnskey}, true, true},
+		{"delete CDS and CDNSKEY", []*dns.CDS{delcds}, []*dns.CDNSKEY{delcdnskey}, true, true},
+		{"delete CDS with other CDS", []*dns.CDS{delcds, cds}, nil, false, false},
+		{"delete CDNSKEY with other CDNSKEY", nil, []*dns.CDNSKEY{delcdnskey, cdnskey}, false, false},
+		{"delete CDS but not CDNSKEY", []*dns.CDS{delcds}, []*dns.CDNSKEY{cdnskey}, false, false},
+		{"delete CDNSKEY but not CDS", []*dns.CDS{cds}, []*dns.CDNSKEY{delcdnskey}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zns := &ZoneNS{NSName: "ns1." + zone, CDS: tt.cds, CDNSKEY: tt.cdnskey}
+			del, err := DeleteSignal(zns)
+			if del != tt.del {
+				t.Errorf("got delete %v wanted %v", del, tt.del)
+			}
+			if tt.ok && err != nil {
+				t.Errorf("got error %v wanted none", err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
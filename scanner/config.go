@@ -28,8 +28,9 @@ type Config struct {
 }
 
 type ScannerConf struct {
-	Zones    string `validate:"required", "file"`
-	Interval int
+	Zones     string `validate:"required"`
+	Interval  int
+	Agreement string `validate:"omitempty,oneof=all quorum"`
 }
 
 type LogConf struct {
@@ -114,6 +115,15 @@ func ReadConfNG(conf *Config) error {
 		// if p.TsigKey, ok = km[p.TsigName]; !ok {
 		// 	log.Fatalf("TSIG key '%s' is unknown.", p.TsigName)
 		// }
+		if p.DsFrom == "" {
+			p.DsFrom = "cds"
+		}
+		// same digest type names as the cdspolicy in musicd
+		policy, err := music.ParseCdsPolicy(p.DigestTypes, "")
+		if err != nil {
+			log.Fatalf("Error: parent %s: %v", p.Name, err)
+		}
+		p.digests = policy.Digests
 		pm[p.Name] = p
 		fmt.Printf("%s (%d children): %v\n", dns.Fqdn(p.Name), len(p.Children), p.Children)
 		for _, c := range p.Children {
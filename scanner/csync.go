@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// RFC 7477: the CSYNC record asks the parent to copy the RRsets listed in
+// its type bitmap (NS, A and AAAA) from the child. The flags modify that:
+//
+//	immediate:  process now. Without it the parent must wait for the change
+//	            to be approved out of band (scanner.csync-approved).
+//	soaminimum: only process if the SOA serial of the zone is at least the
+//	            CSYNC serial, i.e. the data listed is at least that recent.
+//
+// A and AAAA are only synced for nameservers below the zone (glue).
+
+const (
+	CsyncFlagImmediate  = 1 << 0
+	CsyncFlagSoaMinimum = 1 << 1
+)
+
+// csyncTypes returns the sorted names of the types in the CSYNC type bitmap.
+func csyncTypes(csync *dns.CSYNC) []string {
+	var types []string
+	for _, t := range csync.TypeBitMap {
+		types = append(types, dns.TypeToString[t])
+	}
+	sort.Strings(types)
+	return types
+}
+
+// csyncHasType returns true if rrtype is in the CSYNC type bitmap.
+func csyncHasType(csync *dns.CSYNC, rrtype uint16) bool {
+	for _, t := range csync.TypeBitMap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSOASerial returns the SOA serial of the zone at the nameserver.
+func GetSOASerial(zone, nsname, serverport string) (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeSOA)
+	c := new(dns.Client)
+	r, _, err := c.Exchange(m, serverport)
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch %s SOA from %s: %v", zone, nsname, err)
+	}
+	for _, a := range r.Answer {
+		if soa, ok := a.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("no %s SOA from %s (rcode %s)", zone, nsname,
+		dns.RcodeToString[r.Rcode])
+}
+
+// serialAtLeast compares SOA serials using serial number arithmetic (RFC 1982).
+func serialAtLeast(serial, min uint32) bool {
+	return serial == min || int32(serial-min) > 0
+}
+
+// CheckCsync checks the flags of the agreed CSYNC record against the SOA
+// serials of the agreeing nameservers. It returns an error if the CSYNC
+// must not be processed (yet).
+func CheckCsync(zone string, csync *dns.CSYNC, agreeing map[string]*ZoneNS) error {
+	if csync.Flags&CsyncFlagImmediate == 0 && !csyncApproved(zone, csync.Serial) {
+		return fmt.Errorf("CSYNC serial %d is not immediate, waiting for approval", csync.Serial)
+	}
+	if csync.Flags&CsyncFlagSoaMinimum != 0 {
+		for nsname, zns := range agreeing {
+			if !serialAtLeast(zns.Serial, csync.Serial) {
+				return fmt.Errorf("CSYNC soaminimum: SOA serial %d at %s is lower than CSYNC serial %d",
+					zns.Serial, nsname, csync.Serial)
+			}
+		}
+	}
+	return nil
+}
+
+// csyncApproved returns true if the operator has approved the non-immediate
+// CSYNC record with the serial for the zone. Approvals are configured as
+// "zone" (any serial) or "zone serial" in scanner.csync-approved.
+func csyncApproved(zone string, serial uint32) bool {
+	for _, approval := range viper.GetStringSlice("scanner.csync-approved") {
+		fields := strings.Fields(approval)
+		if len(fields) == 0 || !strings.EqualFold(dns.Fqdn(fields[0]), zone) {
+			continue
+		}
+		if len(fields) == 1 || fields[1] == fmt.Sprintf("%d", serial) {
+			return true
+		}
+	}
+	return false
+}
+
+// getAddrs returns the A or AAAA RRset of name from the nameserver.
+func getAddrs(name string, rrtype uint16, serverport string) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, rrtype)
+	c := new(dns.Client)
+	r, _, err := c.Exchange(m, serverport)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s %s from %s: %v", name,
+			dns.TypeToString[rrtype], serverport, err)
+	}
+	var rrs []dns.RR
+	for _, a := range r.Answer {
+		if a.Header().Rrtype == rrtype && strings.EqualFold(a.Header().Name, name) {
+			rrs = append(rrs, a)
+		}
+	}
+	return rrs, nil
+}
+
+// GetParentGlue returns the glue for the zone's nameservers in the referral
+// from the parent, indexed by nameserver name.
+func GetParentGlue(zone, serverport string) (map[string][]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeNS)
+	c := new(dns.Client)
+	r, _, err := c.Exchange(m, serverport)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s NS from %s: %v", zone, serverport, err)
+	}
+	glue := map[string][]dns.RR{}
+	for _, a := range r.Extra {
+		switch a.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			name := strings.ToLower(a.Header().Name)
+			glue[name] = append(glue[name], a)
+		}
+	}
+	return glue, nil
+}
+
+// CreateGlueUpdateNG computes the A/AAAA glue to add to and remove from the
+// parent for the in-bailiwick nameservers in nsnames. The addresses are
+// taken from the agreed nameserver for the types listed in the CSYNC
+// record and, with scanner.validate-cds, must validate against its DNSKEY
+// RRset. Glue for nameservers that are no longer in nsnames is removed.
+func CreateGlueUpdateNG(zone string, parent ParentNG, agreed *ZoneNS,
+	nsnames []string) ([]dns.RR, []dns.RR, error) {
+	var glueadd, glueremove []dns.RR
+
+	parentglue, err := GetParentGlue(zone, parent.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wanted := map[string]bool{}
+	for _, nsname := range nsnames {
+		nsname = strings.ToLower(nsname)
+		if !dns.IsSubDomain(zone, nsname) {
+			continue
+		}
+		wanted[nsname] = true
+		for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if !csyncHasType(agreed.CSYNC, rrtype) {
+				continue
+			}
+			var addrs []dns.RR
+			if viper.GetBool("scanner.validate-cds") {
+				addrs, err = GetValidatedRRset(nsname, rrtype, agreed)
+			} else {
+				addrs, err = getAddrs(nsname, rrtype, agreed.Address)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			have := map[string]dns.RR{}
+			for _, rr := range parentglue[nsname] {
+				if rr.Header().Rrtype == rrtype {
+					have[glueRdata(rr)] = rr
+				}
+			}
+			want := map[string]bool{}
+			for _, rr := range addrs {
+				want[glueRdata(rr)] = true
+				if _, exist := have[glueRdata(rr)]; !exist {
+					glueadd = append(glueadd, rr)
+				}
+			}
+			for rdata, rr := range have {
+				if !want[rdata] {
+					glueremove = append(glueremove, rr)
+				}
+			}
+		}
+	}
+
+	// glue for nameservers that are no longer used
+	for nsname, rrs := range parentglue {
+		if !dns.IsSubDomain(zone, nsname) || wanted[nsname] {
+			continue
+		}
+		for _, rr := range rrs {
+			if csyncHasType(agreed.CSYNC, rr.Header().Rrtype) {
+				glueremove = append(glueremove, rr)
+			}
+		}
+	}
+
+	log.Printf("Zone %s: glue adds -> %v", zone, glueadd)
+	log.Printf("Zone %s: glue removes -> %v", zone, glueremove)
+	return glueadd, glueremove, nil
+}
+
+func glueRdata(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.String()
+	case *dns.AAAA:
+		return rr.AAAA.String()
+	}
+	return rr.String()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// startTestServer starts a nameserver on localhost that answers with the
+// records in answer and extra, indexed by "<lower case qname> <qtype>". It
+// returns the address of the server.
+func startTestServer(t *testing.T, answer, extra map[string][]dns.RR) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		key := strings.ToLower(r.Question[0].Name) + " " + dns.TypeToString[r.Question[0].Qtype]
+		m.Answer = answer[key]
+		m.Extra = extra[key]
+		w.WriteMsg(m)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(handler),
+		NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// signedAnswer returns the RRset followed by an RRSIG over it by k, or
+// only the RRset if k is nil.
+func signedAnswer(t *testing.T, k *testKey, rrset ...dns.RR) []dns.RR {
+	if k == nil {
+		return rrset
+	}
+	return append(rrset, k.signNow(t, rrset))
+}
+
+func TestSerialAtLeast(t *testing.T) {
+	tests := []struct {
+		serial, min uint32
+		want        bool
+	}{
+		{2022061501, 2022061501, true},
+		{2022061502, 2022061501, true},
+		{2022061500, 2022061501, false},
+		{5, 0xfffffff0, true}, // wrapped around
+		{0xfffffff0, 5, false},
+		{0, 0, true},
+	}
+	for _, tt := range tests {
+		if got := serialAtLeast(tt.serial, tt.min); got != tt.want {
+			t.Errorf("serialAtLeast(%d, %d) = %v wanted %v", tt.serial, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCsync(t *testing.T) {
+	viper.Set("scanner.csync-approved", []string{"approved.example 2022061501", "any.example."})
+	defer viper.Set("scanner.csync-approved", nil)
+
+	tests := []struct {
+		name    string
+		zone    string
+		flags   uint16
+		serials []uint32 // SOA serials of the agreeing NSes
+		ok      bool
+	}{
+		{"immediate", "child.example.", CsyncFlagImmediate, []uint32{1}, true},
+		{"not immediate", "child.example.", 0, []uint32{1}, false},
+		{"approved serial", "approved.example.", 0, []uint32{1}, true},
+		{"any serial approved", "any.example.", 0, []uint32{1}, true},
+		{"soaminimum reached", "child.example.", CsyncFlagImmediate | CsyncFlagSoaMinimum,
+			[]uint32{2022061501, 2022061502}, true},
+		{"soaminimum not reached at one NS", "child.example.", CsyncFlagImmediate | CsyncFlagSoaMinimum,
+			[]uint32{2022061501, 2022061500}, false},
+		{"soaminimum ignored without flag", "child.example.", CsyncFlagImmediate,
+			[]uint32{2022061500}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csync := &dns.CSYNC{Serial: 2022061501, Flags: tt.flags, TypeBitMap: []uint16{dns.TypeNS}}
+			agreeing := map[string]*ZoneNS{}
+			for i, serial := range tt.serials {
+				nsname := string(rune('a'+i)) + ".ns." + tt.zone
+				agreeing[nsname] = &ZoneNS{NSName: nsname, Serial: serial}
+			}
+			err := CheckCsync(tt.zone, csync, agreeing)
+			if tt.ok && err != nil {
+				t.Errorf("got error %v wanted none", err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestValidateCsync(t *testing.T) {
+	const zone = "child.example."
+	zsk := newTestKey(t, zone, 256)
+	other := newTestKey(t, zone, 256)
+	csync := newTestRR(t, zone+" 300 IN CSYNC 2022061501 3 NS")
+	ns := newTestRR(t, zone+" 300 IN NS ns1.child.example.")
+	soa := newTestRR(t, zone+" 300 IN SOA ns1.child.example. hostmaster.child.example. 2022061502 3600 600 86400 300")
+
+	server := func(csyncsigner, nssigner *testKey) string {
+		return startTestServer(t, map[string][]dns.RR{
+			zone + " CSYNC": signedAnswer(t, csyncsigner, csync),
+			zone + " NS":    signedAnswer(t, nssigner, ns),
+			zone + " SOA":   signedAnswer(t, &zsk, soa),
+		}, nil)
+	}
+
+	tests := []struct {
+		name    string
+		address string
+		keys    []*dns.DNSKEY
+		ok      bool
+	}{
+		{"validates", server(&zsk, &zsk), []*dns.DNSKEY{zsk.key}, true},
+		{"no validated DNSKEYs", server(&zsk, &zsk), nil, false},
+		{"CSYNC by other key", server(&other, &zsk), []*dns.DNSKEY{zsk.key}, false},
+		{"unsigned CSYNC", server(nil, &zsk), []*dns.DNSKEY{zsk.key}, false},
+		{"NS by other key", server(&zsk, &other), []*dns.DNSKEY{zsk.key}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zns := &ZoneNS{NSName: "ns1." + zone, Address: tt.address, Keys: tt.keys}
+			err := ValidateCsync(zone, zns)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if zns.CSYNC == nil || zns.CSYNC.Serial != 2022061501 {
+				t.Errorf("got CSYNC %v", zns.CSYNC)
+			}
+			if _, exist := zns.NSes["ns1.child.example."]; !exist || len(zns.NSes) != 1 {
+				t.Errorf("got NSes %v", zns.NSes)
+			}
+			if zns.Serial != 2022061502 {
+				t.Errorf("got serial %d wanted 2022061502", zns.Serial)
+			}
+		})
+	}
+}
+
+func TestCreateGlueUpdateNG(t *testing.T) {
+	const zone = "child.example."
+	zsk := newTestKey(t, zone, 256)
+	other := newTestKey(t, zone, 256)
+
+	parentaddr := startTestServer(t, nil, map[string][]dns.RR{
+		zone + " NS": {
+			newTestRR(t, "ns1.child.example. 300 IN A 192.0.2.1"),
+			newTestRR(t, "ns2.child.example. 300 IN A 192.0.2.2"),
+			newTestRR(t, "ns2.child.example. 300 IN AAAA 2001:db8::2"),
+		},
+	})
+	child := func(k *testKey) string {
+		return startTestServer(t, map[string][]dns.RR{
+			"ns1.child.example. A": signedAnswer(t, k, newTestRR(t, "ns1.child.example. 300 IN A 192.0.2.1")),
+			"ns3.child.example. A": signedAnswer(t, k, newTestRR(t, "ns3.child.example. 300 IN A 192.0.2.3")),
+		}, nil)
+	}
+	nsnames := []string{"ns1.child.example.", "ns3.child.example.", "ns.other.example."}
+	wantadd := "ns3.child.example. A 192.0.2.3"
+	wantremove := "ns2.child.example. A 192.0.2.2"
+
+	tests := []struct {
+		name     string
+		validate bool
+		address  string
+		keys     []*dns.DNSKEY
+		ok       bool
+	}{
+		{"not validated", false, child(nil), nil, true},
+		{"validated", true, child(&zsk), []*dns.DNSKEY{zsk.key}, true},
+		{"signed by other key", true, child(&other), []*dns.DNSKEY{zsk.key}, false},
+		{"unsigned", true, child(nil), []*dns.DNSKEY{zsk.key}, false},
+		{"no validated DNSKEYs", true, child(&zsk), nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("scanner.validate-cds", tt.validate)
+			defer viper.Set("scanner.validate-cds", nil)
+
+			agreed := &ZoneNS{NSName: "ns1." + zone, Address: tt.address, Keys: tt.keys,
+				CSYNC: &dns.CSYNC{Serial: 1, Flags: CsyncFlagImmediate,
+					TypeBitMap: []uint16{dns.TypeNS, dns.TypeA}}}
+			adds, removes, err := CreateGlueUpdateNG(zone, ParentNG{Address: parentaddr}, agreed, nsnames)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if got := glueStrings(adds); got != wantadd {
+				t.Errorf("got adds %q wanted %q", got, wantadd)
+			}
+			// AAAA is not in the CSYNC type bitmap, so that glue stays
+			if got := glueStrings(removes); got != wantremove {
+				t.Errorf("got removes %q wanted %q", got, wantremove)
+			}
+		})
+	}
+}
+
+// glueStrings returns the sorted "name type address" of the glue records.
+func glueStrings(rrs []dns.RR) string {
+	var s []string
+	for _, rr := range rrs {
+		s = append(s, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype]+" "+glueRdata(rr))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
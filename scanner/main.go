@@ -14,6 +14,10 @@ import (
 
 func main() {
 	var conf Config
+	viper.SetDefault("scanner.validate-cds", true)
+	viper.SetDefault("scanner.agreement", AgreementAll)
+	viper.SetDefault("scanner.bootstrap", BootstrapNone)
+	viper.SetDefault("scanner.bootstrap-hold-time", "72h")
 	viper.SetConfigFile(DefaultCfgFile)
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -43,6 +47,9 @@ func main() {
 	log.Printf("Scanner: will run once every %d seconds\n", interval)
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 
+	scanch := make(chan string, 100)
+	NotifyReceiver(&conf, scanch)
+
 	runcount := 1
 	RunScanner(zones)
 	RunScannerNG(&conf, conf.ZoneMap)
@@ -57,6 +64,10 @@ func main() {
 			RunScannerNG(&conf, conf.ZoneMap)
 			log.Printf("***** Run %d complete ****", runcount)
 
+		case zone := <-scanch:
+			log.Printf("***** Scanning %s (NOTIFY) ****", zone)
+			RunScannerNG(&conf, map[string]ZoneNG{zone: conf.ZoneMap[zone]})
+
 			// no default case
 		}
 	}
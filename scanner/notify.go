@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// The scanner accepts generalized NOTIFY(CDS), NOTIFY(CDNSKEY) and
+// NOTIFY(CSYNC) (draft-ietf-dnsop-generalized-notify) for the zones it
+// scans, on scanner.notify-address. Each NOTIFY triggers a scan of that
+// zone right away. Publish the address as the target of a DSYNC record in
+// the parent (_dsync.<parent>) so that the children find it.
+
+// NotifyReceiver answers NOTIFY messages and passes the names of known zones
+// on to scanch.
+func NotifyReceiver(conf *Config, scanch chan string) {
+	address := viper.GetString("scanner.notify-address")
+	if address == "" {
+		log.Printf("NotifyReceiver: scanner.notify-address not set, not listening for NOTIFY")
+		return
+	}
+
+	// RunScannerNG writes to conf.ZoneMap while the servers are running, so
+	// the handler only looks at this copy of the zone names (lower case to
+	// name as configured), which is never written to after this.
+	zones := map[string]string{}
+	for name := range conf.ZoneMap {
+		zones[strings.ToLower(name)] = name
+	}
+
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		if r.Opcode != dns.OpcodeNotify || len(r.Question) != 1 {
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+		q := r.Question[0]
+		zone := dns.Fqdn(q.Name)
+		name, known := zones[strings.ToLower(zone)]
+		if known {
+			zone = name
+		}
+		switch q.Qtype {
+		case dns.TypeCDS, dns.TypeCDNSKEY, dns.TypeCSYNC:
+		default:
+			log.Printf("NotifyReceiver: ignoring NOTIFY(%s) for %s from %s",
+				dns.TypeToString[q.Qtype], zone, w.RemoteAddr())
+			m.SetRcode(r, dns.RcodeNotImplemented)
+			w.WriteMsg(m)
+			return
+		}
+		if !known {
+			log.Printf("NotifyReceiver: NOTIFY(%s) for unknown zone %s from %s",
+				dns.TypeToString[q.Qtype], zone, w.RemoteAddr())
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+
+		log.Printf("NotifyReceiver: NOTIFY(%s) for %s from %s", dns.TypeToString[q.Qtype],
+			zone, w.RemoteAddr())
+		m.Authoritative = true
+		w.WriteMsg(m)
+
+		select {
+		case scanch <- zone:
+		default:
+			log.Printf("NotifyReceiver: scan queue full, %s will be scanned at the next run", zone)
+		}
+	}
+
+	for _, proto := range []string{"udp", "tcp"} {
+		go func(proto string) {
+			server := &dns.Server{Addr: address, Net: proto, Handler: dns.HandlerFunc(handler)}
+			log.Printf("NotifyReceiver: listening for NOTIFY on %s/%s", address, proto)
+			if err := server.ListenAndServe(); err != nil {
+				log.Printf("NotifyReceiver: Error from ListenAndServe(%s/%s): %v", address, proto, err)
+			}
+		}(proto)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+func TestNotifyReceiver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	address := l.Addr().String()
+	l.Close()
+	viper.Set("scanner.notify-address", address)
+	defer viper.Set("scanner.notify-address", nil)
+
+	conf := &Config{ZoneMap: map[string]ZoneNG{"Child.Example.": {Name: "Child.Example."}}}
+	scanch := make(chan string, 10)
+	NotifyReceiver(conf, scanch)
+
+	// a periodic scan writes to the zone map while NOTIFYs arrive
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				conf.ZoneMap["Child.Example."] = ZoneNG{Name: "Child.Example."}
+			}
+		}
+	}()
+
+	notify := func(zone string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetNotify(zone)
+		m.Question[0].Qtype = qtype
+		c := &dns.Client{Net: "tcp", Timeout: time.Second}
+		var r *dns.Msg
+		for i := 0; i < 20; i++ { // until the server listens
+			if r, _, err = c.Exchange(m, address); err == nil {
+				return r
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("Exchange: %v", err)
+		return nil
+	}
+
+	tests := []struct {
+		name  string
+		zone  string
+		qtype uint16
+		rcode int
+		scan  string
+	}{
+		{"CDS", "child.example.", dns.TypeCDS, dns.RcodeSuccess, "Child.Example."},
+		{"CSYNC", "CHILD.EXAMPLE.", dns.TypeCSYNC, dns.RcodeSuccess, "Child.Example."},
+		{"unknown zone", "other.example.", dns.TypeCDS, dns.RcodeRefused, ""},
+		{"SOA", "child.example.", dns.TypeSOA, dns.RcodeNotImplemented, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := notify(tt.zone, tt.qtype)
+			if r.Rcode != tt.rcode {
+				t.Errorf("got rcode %s wanted %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			select {
+			case zone := <-scanch:
+				if zone != tt.scan {
+					t.Errorf("got scan of %s wanted %q", zone, tt.scan)
+				}
+			default:
+				if tt.scan != "" {
+					t.Errorf("got no scan wanted %s", tt.scan)
+				}
+			}
+		})
+	}
+}
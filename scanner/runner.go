@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/miekg/dns"
 	"github.com/spf13/viper"
@@ -98,6 +100,8 @@ func RunScannerNG(conf *Config, zonesng map[string]ZoneNG) {
 		//	for zone, z := range zonesng {
 		log.Printf("Working with zone %s (checking data from %d NSes)",
 			zone, len(z.DelegationNS))
+		cdserrors := map[string]string{}   // map[nameserver name]error
+		csyncerrors := map[string]string{} // map[nameserver name]error
 		for _, zns := range z.DelegationNS {
 			log.Printf("Working with zone %s NS: %s (fetch CDS+CSYNC)",
 				zone, zns.NSName)
@@ -108,9 +112,32 @@ func RunScannerNG(conf *Config, zonesng map[string]ZoneNG) {
 			for _, cds := range zns.CDS {
 				log.Printf("%s", cds)
 			}
+			// Get CDNSKEY From zone nameserver
+			zns.CDNSKEY = GetCDNSKEY(zone, zns.NSName, zns.Address)
+			if viper.GetBool("scanner.validate-cds") {
+				var err error
+				if len(z.CurrentDS) == 0 {
+					err = ValidateBootstrapCDS(zone, zns)
+				} else {
+					err = ValidateCDS(zone, z.CurrentDS, zns)
+				}
+				if err != nil {
+					log.Printf("Zone %s: CDS from %s not validated: %v", zone, zns.NSName, err)
+					cdserrors[zns.NSName] = err.Error()
+				}
+			}
+			if err := CheckCdsCdnskey(zns); err != nil {
+				log.Printf("Zone %s: CDS and CDNSKEY from %s differ: %v", zone, zns.NSName, err)
+				cdserrors[zns.NSName] = err.Error()
+			}
 			// Get CSYNC From Child nameserver
 			zns.CSYNC = GetCsyncNG(zone, zns.NSName, zns.Address)
-			log.Printf("CSYNC from zone NS: %s", zns.CSYNC)
+			log.Printf("CSYNC from zone NS: %v", zns.CSYNC)
+			if zns.CSYNC != nil {
+				if zns.Serial, err = GetSOASerial(zone, zns.NSName, zns.Address); err != nil {
+					log.Printf("Zone %s: %v", zone, err)
+				}
+			}
 
 			// Get NSes from Child nameserver
 			nses := GetNS(zone, zns.NSName, zns.Address)
@@ -120,23 +147,53 @@ func RunScannerNG(conf *Config, zonesng map[string]ZoneNG) {
 				zns.NSes[ns] = ""
 			}
 			log.Printf("NS from child: %v", nses)
+
+			if viper.GetBool("scanner.validate-cds") && zns.CSYNC != nil {
+				if err := ValidateCsync(zone, zns); err != nil {
+					log.Printf("Zone %s: CSYNC from %s not validated: %v", zone, zns.NSName, err)
+					csyncerrors[zns.NSName] = err.Error()
+				}
+			}
 		}
 		log.Printf("*** Scanner: GetCDS+GetCSYNC done ***")
 
+		// Only act on what the nameservers agree on
+		agreeing, err := ZoneAgreement(z, viper.GetString("scanner.agreement"))
+		if err != nil {
+			SetZoneCondition(zone, err.Error())
+			ForgetBootstrap(zone)
+			log.Printf("Zone %s: not updating parent %s: %v", zone, z.PName, err)
+			continue
+		}
+		agreed := agreedRRsets(agreeing)
+		var errs []string
+		for nsname := range agreeing {
+			if e, exist := cdserrors[nsname]; exist {
+				errs = append(errs, e)
+			}
+		}
+
+		// A zone without DS is only bootstrapped according to policy
+		del, _ := DeleteSignal(agreed)
+		if len(z.CurrentDS) == 0 && !del && (len(agreed.CDS) > 0 || len(agreed.CDNSKEY) > 0) {
+			if err := BootstrapAllowed(zone, agreed, agreeing); err != nil {
+				errs = append(errs, err.Error())
+			}
+		} else {
+			ForgetBootstrap(zone)
+		}
+
 		//	}
 
 		// Update DS information
 		// for zone, parent := range zonesng {
 		//	for zone, z := range zonesng {
 		log.Printf("Zone %s: \n", zone)
-		dsadd, dsremove := CreateDsUpdateNG(z)
-		for _, rr := range dsadd {
-			rr.Hdr.Rrtype = 43
-		}
+		dsadd, dsremove := CreateDsUpdateNG(z, agreed, parent)
 
 		adds := []dns.RR{}
 		for _, value := range dsadd {
-			adds = append(adds, &value.DS)
+			adds = append(adds, value)
 		}
 
 		removes := []dns.RR{}
@@ -148,7 +205,11 @@ func RunScannerNG(conf *Config, zonesng map[string]ZoneNG) {
 		// trying to get ddns to work with nsupdater_updater.go
 
 		output := []string{}
-		if len(adds) != 0 || len(removes) != -0 {
+		if len(errs) > 0 && (len(adds) != 0 || len(removes) != 0) {
+			log.Printf("Zone %s: Refusing to update parent DS RRset (%d adds, %d removes), CDS/CDNSKEY not accepted: %s",
+				zone, len(adds), len(removes), strings.Join(errs, "; "))
+			SetZoneCondition(zone, "CDS/CDNSKEY not accepted: "+strings.Join(errs, "; "))
+		} else if len(adds) != 0 || len(removes) != -0 {
 			//			err = updater_old.Update(z.PName, parent, &[][]dns.RR{adds}, &[][]dns.RR{removes}, &output)
 			//			if err != nil {
 			//				fmt.Printf("bob Got an err %v\n", err)
@@ -165,30 +226,73 @@ func RunScannerNG(conf *Config, zonesng map[string]ZoneNG) {
 		} else {
 			log.Printf("Zone %s: Updating parent DS RRset: no change", zone)
 		}
+		if len(errs) == 0 {
+			ClearZoneCondition(zone)
+		}
 		log.Printf("*** Scanner: UpdateDS done ***")
 
 		//	}
 
 		// Update NS in parent
-		updateNsFlag := 0
-
 		//	for zone, z := range zonesng {
 		output = []string{}
 		log.Printf("Zone: %s", zone)
-		flagCount := len(z.DelegationNS)
-		for _, zns := range z.DelegationNS {
-			if zns.CSYNC == "" {
-				log.Printf("Zone %s: No CSYNC at %s, not updating %s NS in %s",
-					zone, zone, z.PName)
-			} else {
-				updateNsFlag++
+		if agreed.CSYNC != nil {
+			log.Printf("CSYNC %v published by %d agreeing NSes", csyncTypes(agreed.CSYNC), len(agreeing))
+
+			// The NS RRset is only as trustworthy as the keys that signed
+			// the CDS, so nothing is synced if those did not validate.
+			var csyncerrs []string
+			for nsname := range agreeing {
+				if e, exist := cdserrors[nsname]; exist {
+					csyncerrs = append(csyncerrs, "CDS/CDNSKEY not accepted: "+e)
+				}
+				if e, exist := csyncerrors[nsname]; exist {
+					csyncerrs = append(csyncerrs, e)
+				}
 			}
-		}
-		if updateNsFlag == flagCount {
-			log.Printf("CSYNC count even, updating parent with NSes")
-			adds, removes, err := CreateNsUpdateNG(zone, z)
-			if err != nil {
-				fmt.Printf("CSYNC Update got err %v\n", err)
+			if len(csyncerrs) > 0 {
+				sort.Strings(csyncerrs)
+				SetZoneCondition(zone, "CSYNC not accepted: "+strings.Join(csyncerrs, "; "))
+				log.Printf("Zone %s: not processing CSYNC: %s", zone, strings.Join(csyncerrs, "; "))
+				continue
+			}
+			if err := CheckCsync(zone, agreed.CSYNC, agreeing); err != nil {
+				SetZoneCondition(zone, err.Error())
+				log.Printf("Zone %s: not processing CSYNC: %v", zone, err)
+				continue
+			}
+
+			// NS names after the update, for the glue
+			var nsnames []string
+			for nsname := range z.DelegationNS {
+				nsnames = append(nsnames, nsname)
+			}
+
+			adds, removes := []dns.RR{}, []dns.RR{}
+			if csyncHasType(agreed.CSYNC, dns.TypeNS) {
+				nsadds, nsremoves, err := CreateNsUpdateNG(zone, z, agreeing)
+				if err != nil {
+					SetZoneCondition(zone, err.Error())
+					log.Printf("Zone %s: not updating NS in %s: %v", zone, z.PName, err)
+					continue
+				}
+				adds = append(adds, nsadds...)
+				removes = append(removes, nsremoves...)
+				nsnames = []string{}
+				for nsname := range agreed.NSes {
+					nsnames = append(nsnames, nsname)
+				}
+			}
+			if csyncHasType(agreed.CSYNC, dns.TypeA) || csyncHasType(agreed.CSYNC, dns.TypeAAAA) {
+				glueadds, glueremoves, err := CreateGlueUpdateNG(zone, parent, agreed, nsnames)
+				if err != nil {
+					SetZoneCondition(zone, err.Error())
+					log.Printf("Zone %s: not updating glue in %s: %v", zone, z.PName, err)
+					continue
+				}
+				adds = append(adds, glueadds...)
+				removes = append(removes, glueremoves...)
 			}
 			//			parent := conf.ParentMap[z.PName]
 			//			err = updater_old.Update(z.PName, parent, &[][]dns.RR{adds},
@@ -198,15 +302,18 @@ func RunScannerNG(conf *Config, zonesng map[string]ZoneNG) {
 			//			}
 			//			fmt.Println(output)
 
-			err = updater.Update(&signer, z.PName, zone, &[][]dns.RR{adds},
-				&[][]dns.RR{removes})
-			if err != nil {
-				log.Printf("Error: updater.Update(zone %s, RR: %s NS): %v",
-					z.PName, zone, err)
+			if len(adds) == 0 && len(removes) == 0 {
+				log.Printf("Zone %s: Updating parent NS and glue: no change", zone)
+			} else {
+				err = updater.Update(&signer, z.PName, zone, &[][]dns.RR{adds},
+					&[][]dns.RR{removes})
+				if err != nil {
+					log.Printf("Error: updater.Update(zone %s, RR: %s NS): %v",
+						z.PName, zone, err)
+				}
 			}
-
 		} else {
-			log.Printf("CSYNC count uneven, no updating Parent with NSes")
+			log.Printf("Zone %s: No CSYNC, not updating %s NS in %s", zone, zone, z.PName)
 
 		}
 		log.Printf("*** Scanner: UpdateNS done ***")
@@ -6,6 +6,8 @@ import (
 	"strings"
 
 	"github.com/miekg/dns"
+
+	"github.com/DNSSEC-Provisioning/music/music"
 )
 
 func GetIP(hostname string, serverport string) string {
@@ -146,7 +148,7 @@ func GetCsync(zone string, hostname string, server string, port string) string {
 	}
 }
 
-func GetCsyncNG(zone, nsname, serverport string) string {
+func GetCsyncNG(zone, nsname, serverport string) *dns.CSYNC {
 	log.Printf("Getting %s CSYNC from %s @ %s\n", zone, nsname, serverport)
 	m := new(dns.Msg)
 	m.SetQuestion(zone, dns.TypeCSYNC)
@@ -154,23 +156,21 @@ func GetCsyncNG(zone, nsname, serverport string) string {
 	r, _, err := c.Exchange(m, serverport)
 	if err != nil {
 		log.Printf("Error: Unable to fetch %s CSYNC from %s: %s", zone, serverport, err)
+		return nil
 	}
 
 	if r.Rcode != dns.RcodeSuccess {
 		log.Printf("No CSYNC Received: %v\n", dns.RcodeToString[r.Rcode])
-		csync := ""
-		return csync
-	} else if len(r.Answer) == 0 {
-		log.Printf("No CSYNC RR\n")
-		csync := ""
-		return csync
-	} else {
-		// Only grabbing the first RR
-		answer := r.Answer[0].String()
-		csync := answer[strings.LastIndex(answer, "\t")+1:]
-		// debug	fmt.Println(ip)
-		return csync
+		return nil
 	}
+	for _, a := range r.Answer {
+		if csync, ok := a.(*dns.CSYNC); ok {
+			// there should only be one CSYNC RR
+			return csync
+		}
+	}
+	log.Printf("No CSYNC RR\n")
+	return nil
 }
 
 //func CreateNsUpdate(zone string, parent *Parent) ([]*dns.NS, []*dns.NS) {
@@ -229,7 +229,9 @@ func CreateNsUpdate(zone string, parent *Parent) ([]dns.RR, []dns.RR, error) {
 	return nsAdd, nsRemove, nil
 }
 
-func CreateNsUpdateNG(zone string, zng ZoneNG) ([]dns.RR, []dns.RR, error) {
+// CreateNsUpdateNG computes the NS records to add to and remove from the
+// parent from the NS RRsets served by the agreeing nameservers.
+func CreateNsUpdateNG(zone string, zng ZoneNG, agreeing map[string]*ZoneNS) ([]dns.RR, []dns.RR, error) {
 	// This logic needs discussion, I am shooting from the hip here
 	cNsesmap := make(map[string]string)
 	pNsesmap := make(map[string]string)
@@ -239,8 +241,10 @@ func CreateNsUpdateNG(zone string, zng ZoneNG) ([]dns.RR, []dns.RR, error) {
 	var nsRemove []dns.RR
 
 	// Get a full map of "all" nses the children know about for comparison
-	for nsname, zns := range zng.DelegationNS {
+	for nsname := range zng.DelegationNS {
 		pNsesmap[nsname] = nsname
+	}
+	for _, zns := range agreeing {
 		for ckey, cvalue := range zns.NSes {
 			cNsesmap[ckey] = cvalue
 		}
@@ -248,12 +252,12 @@ func CreateNsUpdateNG(zone string, zng ZoneNG) ([]dns.RR, []dns.RR, error) {
 
 	// Compare NS for all children
 	// If not match at children report
-	for _, zns := range zng.DelegationNS {
+	for _, zns := range agreeing {
 		for ckey, _ := range cNsesmap {
 			if _, ok := zns.NSes[ckey]; !ok {
 			        // WTF? children?
 				// return nil, nil, fmt.Errorf("children are not in sync send error, ns:%s is not in child:%s", ckey, child.hostname)
-				return nil, nil, fmt.Errorf("Zone %s: nameservers are not in sync send error, ns:%s is not in NS:%s", ckey, zns.NSName)
+				return nil, nil, fmt.Errorf("Zone %s: nameservers are not in sync send error, ns:%s is not in NS:%s", zone, ckey, zns.NSName)
 			}
 		}
 	}
@@ -328,43 +332,67 @@ func CreateDsUpdate(zone string, parent *Parent) ([]*dns.CDS, []*dns.DS) {
 	return dsadd, dsremove
 }
 
-func CreateDsUpdateNG(z ZoneNG) ([]*dns.CDS, []*dns.DS) {
-	dsmap := make(map[uint16]*dns.DS)
-	cdsmap := make(map[uint16]*dns.CDS)
+// CreateDsUpdateNG computes the DS records to add to and remove from the
+// parent, given the CDS and CDNSKEY RRsets that the zone's nameservers agree
+// on (see ZoneAgreement). The wanted DS RRset is the CDS RRset or, for parents
+// that only accept CDNSKEY, the digests of the CDNSKEYs using the parent's
+// digest types. A delete CDS/CDNSKEY (RFC 8078) empties the DS RRset. If
+// there is no CDS (or CDNSKEY) to build the DS RRset from, the child has
+// nothing to say and there is no change.
+func CreateDsUpdateNG(z ZoneNG, zns *ZoneNS, parent ParentNG) ([]*dns.DS, []*dns.DS) {
+	dsmap := make(map[string]*dns.DS)
+	wantmap := make(map[string]*dns.DS)
 	var dsremove []*dns.DS
-	var dsadd []*dns.CDS // Gets converte to DS in main.go
-	log.Printf("Zone %s: Creating DS Update", z.Name)
+	var dsadd []*dns.DS
+	log.Printf("Zone %s: Creating DS Update (from %s)", z.Name, parent.DsFrom)
 
 	// DSes
 	for _, ds := range z.CurrentDS {
-		// dsmap[fmt.Sprintf("%d %d %d %s", ds.KeyTag, ds.Algorithm,
-		// 	ds.DigestType, ds.Digest)] = ds
-		dsmap[ds.KeyTag] = ds
+		dsmap[music.DSKey(ds)] = ds
 	}
 	log.Printf("%s -> DS = %v", z.PName, dsmap)
 
-	// CDSes TODO: Possible bug that the childrens CDS records are not compared to each other.
-	for _, zns := range z.DelegationNS {
+	del, err := DeleteSignal(zns)
+	if err != nil {
+		log.Printf("%s -> %v, no change", zns.NSName, err)
+		return nil, nil
+	}
+	if del {
+		// RFC 8078: remove all DS, the zone goes insecure
+		log.Printf("%s -> delete CDS/CDNSKEY, removing all DS", zns.NSName)
+	} else if parent.DsFrom == "cdnskey" {
+		policy := music.CdsPolicy{Digests: parent.digests}
+		for _, cdnskey := range zns.CDNSKEY {
+			for _, ds := range policy.DS(&cdnskey.DNSKEY) {
+				ds.Hdr.Name = z.Name
+				wantmap[music.DSKey(ds)] = ds
+			}
+		}
+		log.Printf("%s -> DS from CDNSKEY = %v", zns.NSName, wantmap)
+	} else {
 		for _, cds := range zns.CDS {
-			// cdsmap[fmt.Sprintf("%d %d %d %s", cds.KeyTag,
-			// 			  cds.Algorithm,
-			//	cds.DigestType, cds.Digest)] = cds
-			cdsmap[cds.KeyTag] = cds
+			ds := cds.DS
+			ds.Hdr.Rrtype = dns.TypeDS
+			wantmap[music.DSKey(&ds)] = &ds
 		}
-		log.Printf("%s -> CDS = %v", zns.NSName, cdsmap)
+		log.Printf("%s -> CDS = %v", zns.NSName, wantmap)
+	}
+	if !del && len(wantmap) == 0 {
+		log.Printf("%s -> no %s published, no change", zns.NSName, strings.ToUpper(parent.DsFrom))
+		return nil, nil
 	}
 
-	// if in CDSmap but not in DSmap = add to DS-SET
-	for key, _ := range cdsmap {
+	// if wanted but not in DSmap = add to DS-SET
+	for key, ds := range wantmap {
 		if _, ok := dsmap[key]; !ok {
-			dsadd = append(dsadd, cdsmap[key])
+			dsadd = append(dsadd, ds)
 		}
 	}
 
-	// if in DSmap but not in CDSmap = Remove from DS-SET
-	for key, _ := range dsmap {
-		if _, ok := cdsmap[key]; !ok {
-			dsremove = append(dsremove, dsmap[key])
+	// if in DSmap but not wanted = Remove from DS-SET
+	for key, ds := range dsmap {
+		if _, ok := wantmap[key]; !ok {
+			dsremove = append(dsremove, ds)
 		}
 	}
 
@@ -373,7 +401,63 @@ func CreateDsUpdateNG(z ZoneNG) ([]*dns.CDS, []*dns.DS) {
 	return dsadd, dsremove
 }
 
-/*
-Not Implemented:
-func GetCdnskey()
-*/
+func GetCDNSKEY(zone string, nsname string, serverport string) []*dns.CDNSKEY {
+	log.Printf("Getting %s CDNSKEYs from %s @ %s\n", zone, nsname, serverport)
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeCDNSKEY)
+	c := new(dns.Client)
+	r, _, err := c.Exchange(m, serverport)
+	if err != nil {
+		log.Printf("Error: Unable to fetch %s CDNSKEY from %s: %s", zone, serverport, err)
+		return nil
+	}
+
+	var cdnskeys []*dns.CDNSKEY
+	for _, a := range r.Answer {
+		cdnskey, ok := a.(*dns.CDNSKEY)
+		if !ok {
+			continue
+		}
+		cdnskeys = append(cdnskeys, cdnskey)
+	}
+	log.Printf("CDNSKEY Slice: %v", cdnskeys)
+	return cdnskeys
+}
+
+// CheckCdsCdnskey verifies that the CDS and CDNSKEY RRsets from a
+// nameserver describe the same keys: every CDS must be the digest of a
+// CDNSKEY and every CDNSKEY must have a CDS. Both RRsets are optional, but if
+// both are published they must agree.
+func CheckCdsCdnskey(zns *ZoneNS) error {
+	if del, err := DeleteSignal(zns); err != nil || del {
+		return err
+	}
+	if len(zns.CDS) == 0 || len(zns.CDNSKEY) == 0 {
+		return nil
+	}
+
+	hascds := map[*dns.CDNSKEY]bool{}
+	for _, cds := range zns.CDS {
+		found := false
+		for _, cdnskey := range zns.CDNSKEY {
+			if cds.KeyTag != cdnskey.KeyTag() || cds.Algorithm != cdnskey.Algorithm {
+				continue
+			}
+			ds := cdnskey.DNSKEY.ToDS(cds.DigestType)
+			if ds != nil && strings.EqualFold(ds.Digest, cds.Digest) {
+				found = true
+				hascds[cdnskey] = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("CDS %d %d %d at %s matches no CDNSKEY", cds.KeyTag,
+				cds.Algorithm, cds.DigestType, zns.NSName)
+		}
+	}
+	for _, cdnskey := range zns.CDNSKEY {
+		if !hascds[cdnskey] {
+			return fmt.Errorf("CDNSKEY %d at %s has no CDS", cdnskey.KeyTag(), zns.NSName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func testCDS(t *testing.T, key *dns.DNSKEY, digesttype uint8) *dns.CDS {
+	t.Helper()
+	ds := key.ToDS(digesttype)
+	if ds == nil {
+		t.Fatalf("ToDS(%d) failed", digesttype)
+	}
+	cds := &dns.CDS{DS: *ds}
+	cds.Hdr.Rrtype = dns.TypeCDS
+	return cds
+}
+
+func testCDNSKEY(key *dns.DNSKEY) *dns.CDNSKEY {
+	cdnskey := &dns.CDNSKEY{DNSKEY: *key}
+	cdnskey.Hdr.Rrtype = dns.TypeCDNSKEY
+	return cdnskey
+}
+
+func TestCheckCdsCdnskey(t *testing.T) {
+	const zone = "child.example."
+	ksk1 := newTestKey(t, zone, 257)
+	ksk2 := newTestKey(t, zone, 257)
+	delcds := newTestRR(t, zone+" 0 IN CDS 0 0 0 00").(*dns.CDS)
+	delcdnskey := newTestRR(t, zone+" 0 IN CDNSKEY 0 3 0 AA==").(*dns.CDNSKEY)
+
+	tests := []struct {
+		name    string
+		cds     []*dns.CDS
+		cdnskey []*dns.CDNSKEY
+		ok      bool
+	}{
+		{"nothing published", nil, nil, true},
+		{"only CDS", []*dns.CDS{testCDS(t, ksk1.key, dns.SHA256)}, nil, true},
+		{"only CDNSKEY", nil, []*dns.CDNSKEY{testCDNSKEY(ksk1.key)}, true},
+		{"CDS and CDNSKEY agree",
+			[]*dns.CDS{testCDS(t, ksk1.key, dns.SHA256), testCDS(t, ksk2.key, dns.SHA256)},
+			[]*dns.CDNSKEY{testCDNSKEY(ksk1.key), testCDNSKEY(ksk2.key)}, true},
+		{"two digest types for one key",
+			[]*dns.CDS{testCDS(t, ksk1.key, dns.SHA256), testCDS(t, ksk1.key, dns.SHA384)},
+			[]*dns.CDNSKEY{testCDNSKEY(ksk1.key)}, true},
+		{"CDS without CDNSKEY",
+			[]*dns.CDS{testCDS(t, ksk1.key, dns.SHA256), testCDS(t, ksk2.key, dns.SHA256)},
+			[]*dns.CDNSKEY{testCDNSKEY(ksk1.key)}, false},
+		{"CDNSKEY without CDS",
+			[]*dns.CDS{testCDS(t, ksk1.key, dns.SHA256)},
+			[]*dns.CDNSKEY{testCDNSKEY(ksk1.key), testCDNSKEY(ksk2.key)}, false},
+		{"delete records", []*dns.CDS{delcds}, []*dns.CDNSKEY{delcdnskey}, true},
+		{"delete CDS and a CDNSKEY", []*dns.CDS{delcds}, []*dns.CDNSKEY{testCDNSKEY(ksk1.key)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zns := &ZoneNS{NSName: "ns1." + zone, CDS: tt.cds, CDNSKEY: tt.cdnskey}
+			err := CheckCdsCdnskey(zns)
+			if tt.ok && err != nil {
+				t.Errorf("got error %v wanted none", err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestCreateDsUpdateNG(t *testing.T) {
+	const zone = "child.example."
+	ksk1 := newTestKey(t, zone, 257)
+	ksk2 := newTestKey(t, zone, 257)
+	ds1 := ksk1.key.ToDS(dns.SHA256)
+	ds2 := ksk2.key.ToDS(dns.SHA256)
+	cds1 := testCDS(t, ksk1.key, dns.SHA256)
+	cds2 := testCDS(t, ksk2.key, dns.SHA256)
+	delcds := newTestRR(t, zone+" 0 IN CDS 0 0 0 00").(*dns.CDS)
+	delcdnskey := newTestRR(t, zone+" 0 IN CDNSKEY 0 3 0 AA==").(*dns.CDNSKEY)
+
+	fromcds := ParentNG{Name: "example.", DsFrom: "cds"}
+	fromcdnskey := ParentNG{Name: "example.", DsFrom: "cdnskey", digests: []uint8{dns.SHA256}}
+
+	tests := []struct {
+		name    string
+		current []*dns.DS
+		cds     []*dns.CDS
+		cdnskey []*dns.CDNSKEY
+		parent  ParentNG
+		add     []*dns.DS
+		remove  []*dns.DS
+	}{
+		{"no CDS", []*dns.DS{ds1}, nil, nil, fromcds, nil, nil},
+		{"no CDNSKEY", []*dns.DS{ds1}, []*dns.CDS{cds2}, nil, fromcdnskey, nil, nil},
+		{"unchanged", []*dns.DS{ds1}, []*dns.CDS{cds1}, nil, fromcds, nil, nil},
+		{"rollover: new key", []*dns.DS{ds1}, []*dns.CDS{cds1, cds2}, nil, fromcds, []*dns.DS{ds2}, nil},
+		{"rollover: old key gone", []*dns.DS{ds1, ds2}, []*dns.CDS{cds2}, nil, fromcds, nil, []*dns.DS{ds1}},
+		{"rollover from CDNSKEY", []*dns.DS{ds1}, nil,
+			[]*dns.CDNSKEY{testCDNSKEY(ksk1.key), testCDNSKEY(ksk2.key)}, fromcdnskey, []*dns.DS{ds2}, nil},
+		{"delete CDS", []*dns.DS{ds1, ds2}, []*dns.CDS{delcds}, nil, fromcds, nil, []*dns.DS{ds1, ds2}},
+		{"delete CDS and CDNSKEY", []*dns.DS{ds1}, []*dns.CDS{delcds},
+			[]*dns.CDNSKEY{delcdnskey}, fromcdnskey, nil, []*dns.DS{ds1}},
+		{"delete CDS with other CDS", []*dns.DS{ds1}, []*dns.CDS{delcds, cds2}, nil, fromcds, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := ZoneNG{Name: zone, PName: "example.", CurrentDS: tt.current}
+			zns := &ZoneNS{NSName: "ns1." + zone, CDS: tt.cds, CDNSKEY: tt.cdnskey}
+			add, remove := CreateDsUpdateNG(z, zns, tt.parent)
+			if got, want := dsKeyTags(add), dsKeyTags(tt.add); got != want {
+				t.Errorf("got adds %s wanted %s", got, want)
+			}
+			if got, want := dsKeyTags(remove), dsKeyTags(tt.remove); got != want {
+				t.Errorf("got removes %s wanted %s", got, want)
+			}
+		})
+	}
+}
+
+// dsKeyTags returns the sorted key tags and digest types of dses, for comparison.
+func dsKeyTags(dses []*dns.DS) string {
+	var tags []string
+	for _, ds := range dses {
+		tags = append(tags, fmt.Sprintf("%d/%d", ds.KeyTag, ds.DigestType))
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, " ")
+}
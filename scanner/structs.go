@@ -24,6 +24,9 @@ type ParentNG struct {
 	TsigName string // `validate:"required"`
 	TsigKey  TsigKey
 	Children []string
+	DsFrom      string   `validate:"omitempty,oneof=cds cdnskey"` // DS RRset is built from "cds" (default) or "cdnskey"
+	DigestTypes []string // digest types used for DS computed from CDNSKEY, default [ SHA256 ]
+	digests     []uint8
 }
 
 type TsigKey struct {
@@ -48,8 +51,10 @@ type ZoneNS struct {
 	Address	string	`validate:"host_port"`
 	NSes    map[string]string
 	CDS     []*dns.CDS
-	//CDNSKEY  []string //not implemented
-	CSYNC	string
+	CDNSKEY []*dns.CDNSKEY
+	CSYNC	*dns.CSYNC
+	Serial	uint32	// SOA serial of the zone at this nameserver
+	Keys	[]*dns.DNSKEY	// DNSKEY RRset validated by ValidateCDS, nil if not validated
 }
 
 type ZoneNG struct {
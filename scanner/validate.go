@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 7344 requires the CDS and CDNSKEY RRsets to be signed by a key in the
+// child's DNSKEY RRset, which in turn must chain to the DS RRset currently in
+// the parent. Without that check anyone who can answer for one of the child
+// nameservers can replace the DS.
+
+// GetSignedRRset fetches an RRset with its RRSIGs (DO bit set).
+func GetSignedRRset(zone string, rrtype uint16, serverport string) ([]dns.RR, []*dns.RRSIG, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, rrtype)
+	m.SetEdns0(4096, true)
+	c := new(dns.Client)
+	r, _, err := c.Exchange(m, serverport)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to fetch %s %s from %s: %v",
+			zone, dns.TypeToString[rrtype], serverport, err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, nil, fmt.Errorf("%s %s from %s: rcode %s", zone,
+			dns.TypeToString[rrtype], serverport, dns.RcodeToString[r.Rcode])
+	}
+
+	var rrs []dns.RR
+	var sigs []*dns.RRSIG
+	for _, a := range r.Answer {
+		if sig, ok := a.(*dns.RRSIG); ok {
+			if sig.TypeCovered == rrtype {
+				sigs = append(sigs, sig)
+			}
+			continue
+		}
+		if a.Header().Rrtype == rrtype {
+			rrs = append(rrs, a)
+		}
+	}
+	return rrs, sigs, nil
+}
+
+// verifyRRset returns nil if one of the RRSIGs over rrset is valid now and
+// made by one of the keys.
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	if len(sigs) == 0 {
+		return fmt.Errorf("no RRSIG")
+	}
+	now := time.Now()
+	var errs []string
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm ||
+				!strings.EqualFold(sig.SignerName, key.Header().Name) {
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				errs = append(errs, fmt.Sprintf("RRSIG by key %d has expired or is not yet valid", sig.KeyTag))
+				continue
+			}
+			if err := sig.Verify(key, rrset); err != nil {
+				errs = append(errs, fmt.Sprintf("RRSIG by key %d: %v", sig.KeyTag, err))
+				continue
+			}
+			return nil
+		}
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("no RRSIG made by a trusted key")
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// trustedDnskeys returns the keys in the DNSKEY RRset that the parent DS RRset
+// points to.
+func trustedDnskeys(dnskeys []dns.RR, dses []*dns.DS) []*dns.DNSKEY {
+	var trusted []*dns.DNSKEY
+	for _, rr := range dnskeys {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			continue
+		}
+		for _, ds := range dses {
+			if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+				continue
+			}
+			if kds := key.ToDS(ds.DigestType); kds != nil && strings.EqualFold(kds.Digest, ds.Digest) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	return trusted
+}
+
+// ValidateCDS validates the CDS (and, if published, CDNSKEY) RRset served by
+// the nameserver against the child DNSKEY RRset and the current parent DS.
+// On success the validated CDS and CDNSKEY RRsets replace zns.CDS and
+// zns.CDNSKEY, so that the records used for the DS update are the ones that
+// were validated, and the DNSKEY RRset is kept in zns.Keys to validate the
+// other RRsets from the nameserver with (see ValidateCsync).
+func ValidateCDS(zone string, currentds []*dns.DS, zns *ZoneNS) error {
+	if len(currentds) == 0 {
+		return fmt.Errorf("%s is not signed (no DS in parent), CDS can not be validated", zone)
+	}
+
+	dnskeys, keysigs, err := GetSignedRRset(zone, dns.TypeDNSKEY, zns.Address)
+	if err != nil {
+		return err
+	}
+	trusted := trustedDnskeys(dnskeys, currentds)
+	if len(trusted) == 0 {
+		return fmt.Errorf("no DNSKEY at %s matches the DS in the parent", zns.NSName)
+	}
+	if err := verifyRRset(dnskeys, keysigs, trusted); err != nil {
+		return fmt.Errorf("DNSKEY RRset at %s does not validate: %v", zns.NSName, err)
+	}
+
+	var keys []*dns.DNSKEY
+	for _, rr := range dnskeys {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	cdses, cdssigs, err := GetSignedRRset(zone, dns.TypeCDS, zns.Address)
+	if err != nil {
+		return err
+	}
+	if len(cdses) > 0 {
+		if err := verifyRRset(cdses, cdssigs, keys); err != nil {
+			return fmt.Errorf("CDS RRset at %s does not validate: %v", zns.NSName, err)
+		}
+	}
+
+	cdnskeys, cdnskeysigs, err := GetSignedRRset(zone, dns.TypeCDNSKEY, zns.Address)
+	if err != nil {
+		return err
+	}
+	if len(cdnskeys) > 0 {
+		if err := verifyRRset(cdnskeys, cdnskeysigs, keys); err != nil {
+			return fmt.Errorf("CDNSKEY RRset at %s does not validate: %v", zns.NSName, err)
+		}
+	}
+
+	zns.CDS = []*dns.CDS{}
+	for _, rr := range cdses {
+		zns.CDS = append(zns.CDS, rr.(*dns.CDS))
+	}
+	zns.CDNSKEY = []*dns.CDNSKEY{}
+	for _, rr := range cdnskeys {
+		zns.CDNSKEY = append(zns.CDNSKEY, rr.(*dns.CDNSKEY))
+	}
+	zns.Keys = keys
+	log.Printf("Zone %s: CDS/CDNSKEY RRsets at %s validated (%d CDS, %d CDNSKEY, DNSKEY RRset signed by %d trusted keys)",
+		zone, zns.NSName, len(zns.CDS), len(zns.CDNSKEY), len(trusted))
+	return nil
+}
+
+// GetValidatedRRset fetches the name/rrtype RRset from the nameserver and
+// validates it against the DNSKEY RRset that ValidateCDS validated for the
+// same nameserver. An empty RRset needs no signature.
+func GetValidatedRRset(name string, rrtype uint16, zns *ZoneNS) ([]dns.RR, error) {
+	if len(zns.Keys) == 0 {
+		return nil, fmt.Errorf("no validated DNSKEY RRset from %s", zns.NSName)
+	}
+	rrs, sigs, err := GetSignedRRset(name, rrtype, zns.Address)
+	if err != nil {
+		return nil, err
+	}
+	if len(rrs) == 0 {
+		return nil, nil
+	}
+	if err := verifyRRset(rrs, sigs, zns.Keys); err != nil {
+		return nil, fmt.Errorf("%s %s RRset at %s does not validate: %v", name,
+			dns.TypeToString[rrtype], zns.NSName, err)
+	}
+	return rrs, nil
+}
+
+// ValidateCsync validates the CSYNC RRset served by the nameserver, and the
+// NS and SOA RRsets that processing it depends on, against the DNSKEY RRset
+// in zns.Keys. On success the validated RRsets replace zns.CSYNC, zns.NSes
+// and zns.Serial, just as ValidateCDS does for the CDS.
+func ValidateCsync(zone string, zns *ZoneNS) error {
+	csyncs, err := GetValidatedRRset(zone, dns.TypeCSYNC, zns)
+	if err != nil {
+		return err
+	}
+	nses, err := GetValidatedRRset(zone, dns.TypeNS, zns)
+	if err != nil {
+		return err
+	}
+	soas, err := GetValidatedRRset(zone, dns.TypeSOA, zns)
+	if err != nil {
+		return err
+	}
+
+	zns.CSYNC = nil
+	if len(csyncs) > 0 {
+		zns.CSYNC = csyncs[0].(*dns.CSYNC) // there should only be one CSYNC RR
+	}
+	zns.NSes = map[string]string{}
+	for _, rr := range nses {
+		zns.NSes[rr.(*dns.NS).Ns] = ""
+	}
+	if len(soas) > 0 {
+		zns.Serial = soas[0].(*dns.SOA).Serial
+	}
+	log.Printf("Zone %s: CSYNC, NS and SOA RRsets at %s validated", zone, zns.NSName)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+// newTestKey generates an ECDSA P-256 DNSKEY for zone with the given flags
+// (257 for a KSK, 256 for a ZSK).
+func newTestKey(t *testing.T, zone string, flags uint16) testKey {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	return testKey{key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns an RRSIG over rrset by k, valid from inception to expiration.
+func (k testKey) sign(t *testing.T, rrset []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		Algorithm:  k.key.Algorithm,
+		SignerName: k.key.Hdr.Name,
+		KeyTag:     k.key.KeyTag(),
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(k.priv, rrset); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return sig
+}
+
+// signNow returns an RRSIG over rrset by k that is valid for an hour either side of now.
+func (k testKey) signNow(t *testing.T, rrset []dns.RR) *dns.RRSIG {
+	return k.sign(t, rrset, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+func newTestRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("NewRR(%s): %v", s, err)
+	}
+	return rr
+}
+
+func TestVerifyRRset(t *testing.T) {
+	const zone = "child.example."
+	ksk := newTestKey(t, zone, 257)
+	zsk := newTestKey(t, zone, 256)
+	other := newTestKey(t, "other.example.", 257)
+
+	rrset := []dns.RR{newTestRR(t, zone+" 3600 IN CDS 12345 13 2 "+
+		"0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF")}
+	tampered := []dns.RR{newTestRR(t, zone+" 3600 IN CDS 12345 13 2 "+
+		"FEDCBA9876543210FEDCBA9876543210FEDCBA9876543210FEDCBA9876543210")}
+	now := time.Now()
+	keys := []*dns.DNSKEY{ksk.key, zsk.key}
+
+	tests := []struct {
+		name  string
+		rrset []dns.RR
+		sigs  []*dns.RRSIG
+		keys  []*dns.DNSKEY
+		ok    bool
+	}{
+		{"signed by ZSK", rrset, []*dns.RRSIG{zsk.signNow(t, rrset)}, keys, true},
+		{"signed by KSK", rrset, []*dns.RRSIG{ksk.signNow(t, rrset)}, keys, true},
+		{"one good of two", rrset, []*dns.RRSIG{other.signNow(t, rrset), zsk.signNow(t, rrset)}, keys, true},
+		{"no RRSIG", rrset, nil, keys, false},
+		{"signer not in keys", rrset, []*dns.RRSIG{zsk.signNow(t, rrset)}, []*dns.DNSKEY{ksk.key}, false},
+		{"key of other zone", rrset, []*dns.RRSIG{other.signNow(t, rrset)}, keys, false},
+		{"expired", rrset, []*dns.RRSIG{zsk.sign(t, rrset, now.Add(-2*time.Hour), now.Add(-time.Hour))}, keys, false},
+		{"not yet valid", rrset, []*dns.RRSIG{zsk.sign(t, rrset, now.Add(time.Hour), now.Add(2*time.Hour))}, keys, false},
+		{"tampered RRset", tampered, []*dns.RRSIG{zsk.signNow(t, rrset)}, keys, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyRRset(tt.rrset, tt.sigs, tt.keys)
+			if tt.ok && err != nil {
+				t.Errorf("got error %v wanted none", err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestTrustedDnskeys(t *testing.T) {
+	const zone = "child.example."
+	ksk := newTestKey(t, zone, 257)
+	zsk := newTestKey(t, zone, 256)
+	dnskeys := []dns.RR{ksk.key, zsk.key}
+
+	sha256 := ksk.key.ToDS(dns.SHA256)
+	sha384 := ksk.key.ToDS(dns.SHA384)
+	upper := ksk.key.ToDS(dns.SHA256)
+	upper.Digest = strings.ToUpper(upper.Digest)
+	wrongdigest := ksk.key.ToDS(dns.SHA256)
+	wrongdigest.Digest = "00" + wrongdigest.Digest[2:]
+	if wrongdigest.Digest == sha256.Digest {
+		wrongdigest.Digest = "11" + wrongdigest.Digest[2:]
+	}
+	wrongalg := ksk.key.ToDS(dns.SHA256)
+	wrongalg.Algorithm = dns.RSASHA256
+
+	tests := []struct {
+		name string
+		dses []*dns.DS
+		want []*dns.DNSKEY
+	}{
+		{"SHA256 DS", []*dns.DS{sha256}, []*dns.DNSKEY{ksk.key}},
+		{"SHA384 DS", []*dns.DS{sha384}, []*dns.DNSKEY{ksk.key}},
+		{"upper case digest", []*dns.DS{upper}, []*dns.DNSKEY{ksk.key}},
+		{"two DS for one key", []*dns.DS{sha256, sha384}, []*dns.DNSKEY{ksk.key}},
+		{"DS for the ZSK", []*dns.DS{zsk.key.ToDS(dns.SHA256)}, []*dns.DNSKEY{zsk.key}},
+		{"wrong digest", []*dns.DS{wrongdigest}, nil},
+		{"wrong algorithm", []*dns.DS{wrongalg}, nil},
+		{"no DS", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := trustedDnskeys(dnskeys, tt.dses)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d keys wanted %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got key %d wanted %d", got[i].KeyTag(), tt.want[i].KeyTag())
+				}
+			}
+		})
+	}
+}